@@ -3,9 +3,11 @@ package main
 import (
 	"context"
 	"log"
+	"os"
 	"strings"
 
 	"hello-world/internal/handler"
+	"hello-world/internal/redact"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
@@ -29,6 +31,45 @@ func lambdaHandler(ctx context.Context, request events.APIGatewayProxyRequest) (
 		return h.Handle(ctx, request)
 	}
 
+	// Handle GitHub webhooks
+	if path == "/webhook" {
+		h, err := handler.NewWebhookHandler()
+		if err != nil {
+			log.Printf("Failed to initialize webhook handler: %v", err)
+			return events.APIGatewayProxyResponse{
+				StatusCode: 500,
+				Body:       `{"error": "Internal server error"}`,
+			}, nil
+		}
+		return h.Handle(ctx, request)
+	}
+
+	// Fork maintenance, on a schedule or from an admin
+	if path == "/admin/maintenance" {
+		h, err := handler.NewMaintenanceHandler()
+		if err != nil {
+			log.Printf("Failed to initialize maintenance handler: %v", err)
+			return events.APIGatewayProxyResponse{
+				StatusCode: 500,
+				Body:       `{"error": "Internal server error"}`,
+			}, nil
+		}
+		return h.Handle(ctx, request)
+	}
+
+	// CI tracking of opened pull requests, on a schedule or from an admin
+	if path == "/admin/ci" {
+		h, err := handler.NewCIHandler()
+		if err != nil {
+			log.Printf("Failed to initialize CI handler: %v", err)
+			return events.APIGatewayProxyResponse{
+				StatusCode: 500,
+				Body:       `{"error": "Internal server error"}`,
+			}, nil
+		}
+		return h.Handle(ctx, request)
+	}
+
 	// Handle process endpoint (default)
 	h, err := handler.New()
 	if err != nil {
@@ -43,5 +84,8 @@ func lambdaHandler(ctx context.Context, request events.APIGatewayProxyRequest) (
 }
 
 func main() {
+	// Scrub tokens and credentialed URLs from everything we log
+	log.SetOutput(redact.NewWriter(os.Stderr))
+
 	lambda.Start(lambdaHandler)
 }
@@ -0,0 +1,197 @@
+package git
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+type Encoding string
+
+const (
+	EncodingUTF8    Encoding = "utf-8"
+	EncodingUTF16LE Encoding = "utf-16le"
+	EncodingUTF16BE Encoding = "utf-16be"
+	// Anything that is not valid UTF-8 is treated as Latin-1, which maps
+	// every byte to a code point and therefore round-trips losslessly
+	EncodingLatin1 Encoding = "iso-8859-1"
+)
+
+var (
+	bomUTF8    = []byte{0xEF, 0xBB, 0xBF}
+	bomUTF16LE = []byte{0xFF, 0xFE}
+	bomUTF16BE = []byte{0xFE, 0xFF}
+)
+
+// FileFormat describes how a text file is stored on disk, so content that was
+// decoded for the LLM can be written back the same way
+type FileFormat struct {
+	Encoding        Encoding
+	BOM             bool
+	CRLF            bool
+	TrailingNewline bool
+	Mode            os.FileMode
+}
+
+// Format used for files that do not exist yet
+var defaultFileFormat = FileFormat{
+	Encoding:        EncodingUTF8,
+	TrailingNewline: true,
+	Mode:            0644,
+}
+
+// Detects the format of raw file content and decodes it to a UTF-8 string
+// with LF line endings. Returns ErrBinaryFile for content that is not text
+func decodeText(raw []byte) (string, FileFormat, error) {
+	format := defaultFileFormat
+
+	var text string
+	switch {
+	case bytes.HasPrefix(raw, bomUTF8):
+		format.BOM = true
+		raw = raw[len(bomUTF8):]
+		if !utf8.Valid(raw) {
+			return "", format, ErrBinaryFile
+		}
+		text = string(raw)
+	case bytes.HasPrefix(raw, bomUTF16LE), bytes.HasPrefix(raw, bomUTF16BE):
+		format.BOM = true
+		format.Encoding = EncodingUTF16LE
+		var order binary.ByteOrder = binary.LittleEndian
+		if bytes.HasPrefix(raw, bomUTF16BE) {
+			format.Encoding = EncodingUTF16BE
+			order = binary.BigEndian
+		}
+		decoded, err := decodeUTF16(raw[2:], order)
+		if err != nil {
+			return "", format, err
+		}
+		text = decoded
+	case isBinary(raw):
+		return "", format, ErrBinaryFile
+	case utf8.Valid(raw):
+		text = string(raw)
+	default:
+		format.Encoding = EncodingLatin1
+		runes := make([]rune, len(raw))
+		for i, b := range raw {
+			runes[i] = rune(b)
+		}
+		text = string(runes)
+	}
+
+	crlf := strings.Count(text, "\r\n")
+	format.CRLF = crlf > 0 && crlf >= strings.Count(text, "\n")-crlf
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	format.TrailingNewline = text == "" || strings.HasSuffix(text, "\n")
+
+	return text, format, nil
+}
+
+// Encodes UTF-8 content with LF line endings back into format
+func encodeText(text string, format FileFormat) ([]byte, error) {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	if text != "" {
+		if format.TrailingNewline && !strings.HasSuffix(text, "\n") {
+			text += "\n"
+		} else if !format.TrailingNewline {
+			text = strings.TrimRight(text, "\n")
+		}
+	}
+	if format.CRLF {
+		text = strings.ReplaceAll(text, "\n", "\r\n")
+	}
+
+	var out bytes.Buffer
+	switch format.Encoding {
+	case EncodingUTF16LE, EncodingUTF16BE:
+		var order binary.ByteOrder = binary.LittleEndian
+		bom := bomUTF16LE
+		if format.Encoding == EncodingUTF16BE {
+			order = binary.BigEndian
+			bom = bomUTF16BE
+		}
+		if format.BOM {
+			out.Write(bom)
+		}
+		for _, unit := range utf16.Encode([]rune(text)) {
+			binary.Write(&out, order, unit)
+		}
+	case EncodingLatin1:
+		for _, r := range text {
+			if r > 0xFF {
+				return nil, fmt.Errorf("%w: character %q is not in %s", ErrUnencodable, r, format.Encoding)
+			}
+			out.WriteByte(byte(r))
+		}
+	default:
+		if format.BOM {
+			out.Write(bomUTF8)
+		}
+		out.WriteString(text)
+	}
+
+	return out.Bytes(), nil
+}
+
+func decodeUTF16(raw []byte, order binary.ByteOrder) (string, error) {
+	if len(raw)%2 != 0 {
+		return "", ErrBinaryFile
+	}
+
+	units := make([]uint16, len(raw)/2)
+	for i := range units {
+		units[i] = order.Uint16(raw[2*i:])
+	}
+	return string(utf16.Decode(units)), nil
+}
+
+// Same heuristic as git: a NUL byte near the start means binary
+func isBinary(raw []byte) bool {
+	head := raw
+	if len(head) > binarySniffLength {
+		head = head[:binarySniffLength]
+	}
+	return bytes.IndexByte(head, 0) != -1
+}
+
+// EncodeContent encodes content the way WriteFile would for a file whose
+// current raw content is existing, or for a new file when existing is nil
+func EncodeContent(content string, existing []byte) ([]byte, error) {
+	format := defaultFileFormat
+	if existing != nil {
+		var err error
+		if _, format, err = decodeText(existing); err != nil {
+			return nil, err
+		}
+	}
+	return encodeText(content, format)
+}
+
+// Reads the format of an existing file, or the default format if it does
+// not exist
+func detectFileFormat(filePath string) (FileFormat, error) {
+	info, err := os.Stat(filePath)
+	if os.IsNotExist(err) {
+		return defaultFileFormat, nil
+	}
+	if err != nil {
+		return FileFormat{}, fmt.Errorf("failed to stat file: %w", err)
+	}
+
+	raw, err := os.ReadFile(filePath)
+	if err != nil {
+		return FileFormat{}, fmt.Errorf("failed to read file: %w", err)
+	}
+
+	_, format, err := decodeText(raw)
+	if err != nil {
+		return FileFormat{}, err
+	}
+	format.Mode = info.Mode().Perm()
+	return format, nil
+}
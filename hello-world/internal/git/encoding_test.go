@@ -0,0 +1,151 @@
+package git
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDecodeText(t *testing.T) {
+	tests := []struct {
+		name   string
+		raw    []byte
+		text   string
+		format FileFormat
+		binary bool
+	}{
+		{name: "UTF-8", raw: []byte("a\nb\n"), text: "a\nb\n", format: FileFormat{Encoding: EncodingUTF8, TrailingNewline: true}},
+		{name: "no trailing newline", raw: []byte("a\nb"), text: "a\nb", format: FileFormat{Encoding: EncodingUTF8}},
+		{name: "empty", raw: []byte{}, text: "", format: FileFormat{Encoding: EncodingUTF8, TrailingNewline: true}},
+		{name: "UTF-8 BOM", raw: []byte("\xEF\xBB\xBFé\n"), text: "é\n", format: FileFormat{Encoding: EncodingUTF8, BOM: true, TrailingNewline: true}},
+		{name: "CRLF", raw: []byte("a\r\nb\r\n"), text: "a\nb\n", format: FileFormat{Encoding: EncodingUTF8, CRLF: true, TrailingNewline: true}},
+		{name: "CRLF majority", raw: []byte("a\r\nb\r\nc\n"), text: "a\nb\nc\n", format: FileFormat{Encoding: EncodingUTF8, CRLF: true, TrailingNewline: true}},
+		{name: "CRLF tie", raw: []byte("a\r\nb\n"), text: "a\nb\n", format: FileFormat{Encoding: EncodingUTF8, CRLF: true, TrailingNewline: true}},
+		{name: "LF majority", raw: []byte("a\r\nb\nc\n"), text: "a\nb\nc\n", format: FileFormat{Encoding: EncodingUTF8, TrailingNewline: true}},
+		{name: "UTF-16LE", raw: []byte{0xFF, 0xFE, 'h', 0, 'i', 0, '\n', 0}, text: "hi\n", format: FileFormat{Encoding: EncodingUTF16LE, BOM: true, TrailingNewline: true}},
+		{name: "UTF-16BE", raw: []byte{0xFE, 0xFF, 0, 'h', 0, 'i'}, text: "hi", format: FileFormat{Encoding: EncodingUTF16BE, BOM: true}},
+		{name: "Latin-1", raw: []byte("caf\xE9\n"), text: "café\n", format: FileFormat{Encoding: EncodingLatin1, TrailingNewline: true}},
+
+		{name: "NUL byte", raw: []byte("a\x00b"), binary: true},
+		{name: "UTF-16 odd length", raw: []byte{0xFF, 0xFE, 'h', 0, 'i'}, binary: true},
+		{name: "invalid UTF-8 after BOM", raw: []byte("\xEF\xBB\xBF\xE9"), binary: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			text, format, err := decodeText(tt.raw)
+			if tt.binary {
+				if !errors.Is(err, ErrBinaryFile) {
+					t.Fatalf("decodeText(%q) = %q, %v; want ErrBinaryFile", tt.raw, text, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("decodeText(%q) failed: %v", tt.raw, err)
+			}
+			tt.format.Mode = defaultFileFormat.Mode
+			if text != tt.text || format != tt.format {
+				t.Errorf("decodeText(%q) = %q, %+v; want %q, %+v", tt.raw, text, format, tt.text, tt.format)
+			}
+		})
+	}
+}
+
+func TestEncodeContentRoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing []byte
+		content  string
+		want     []byte
+	}{
+		{name: "new file", content: "a", want: []byte("a\n")},
+		{name: "new empty file", content: "", want: []byte{}},
+		{name: "unchanged", existing: []byte("a\nb\n"), content: "a\nb\n", want: []byte("a\nb\n")},
+		{name: "trailing newline added", existing: []byte("a\n"), content: "b", want: []byte("b\n")},
+		{name: "trailing newline dropped", existing: []byte("a"), content: "b\n\n", want: []byte("b")},
+		{name: "UTF-8 BOM kept", existing: []byte("\xEF\xBB\xBFa\n"), content: "b\n", want: []byte("\xEF\xBB\xBFb\n")},
+		{name: "CRLF kept", existing: []byte("a\r\nb\r\n"), content: "c\nd\n", want: []byte("c\r\nd\r\n")},
+		{name: "CRLF not doubled", existing: []byte("a\r\n"), content: "c\r\nd\n", want: []byte("c\r\nd\r\n")},
+		{name: "LF majority kept", existing: []byte("a\r\nb\nc\n"), content: "d\ne\n", want: []byte("d\ne\n")},
+		{name: "UTF-16LE kept", existing: []byte{0xFF, 0xFE, 'a', 0, '\n', 0}, content: "é\n", want: []byte{0xFF, 0xFE, 0xE9, 0, '\n', 0}},
+		{name: "UTF-16BE kept", existing: []byte{0xFE, 0xFF, 0, 'a'}, content: "b", want: []byte{0xFE, 0xFF, 0, 'b'}},
+		{name: "Latin-1 kept", existing: []byte("caf\xE9\n"), content: "thé\n", want: []byte("th\xE9\n")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := EncodeContent(tt.content, tt.existing)
+			if err != nil {
+				t.Fatalf("EncodeContent(%q) failed: %v", tt.content, err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("EncodeContent(%q) = %q, want %q", tt.content, got, tt.want)
+			}
+
+			// What was written decodes back to the content, normalized
+			// to the file's trailing newline
+			if tt.existing == nil {
+				return
+			}
+			text, _, err := decodeText(got)
+			if err != nil {
+				t.Fatalf("decodeText(%q) failed: %v", got, err)
+			}
+			again, err := EncodeContent(text, got)
+			if err != nil || !bytes.Equal(again, got) {
+				t.Errorf("re-encoding %q = %q, %v; want it unchanged", text, again, err)
+			}
+		})
+	}
+}
+
+func TestEncodeContentUnencodable(t *testing.T) {
+	_, err := EncodeContent("café €\n", []byte("caf\xE9\n"))
+	if !errors.Is(err, ErrUnencodable) {
+		t.Errorf("err = %v, want ErrUnencodable for a euro sign in a Latin-1 file", err)
+	}
+
+	_, err = EncodeContent("a\n", []byte("a\x00b"))
+	if !errors.Is(err, ErrBinaryFile) {
+		t.Errorf("err = %v, want ErrBinaryFile for a binary file", err)
+	}
+}
+
+func TestWriteFileKeepsFormat(t *testing.T) {
+	repoPath := t.TempDir()
+	path := filepath.Join(repoPath, "run.sh")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\r\necho caf\xE9\r\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// The mode is set explicitly, so the umask cannot hide a lost bit
+	if err := os.Chmod(path, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := WriteFile(repoPath, "run.sh", "#!/bin/sh\necho thé\n"); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte("#!/bin/sh\r\necho th\xE9\r\n"); !bytes.Equal(raw, want) {
+		t.Errorf("run.sh = %q, want %q", raw, want)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0755 {
+		t.Errorf("mode = %v, want 0755", info.Mode().Perm())
+	}
+
+	// Content the file's encoding cannot hold leaves the file as it was
+	err = WriteFile(repoPath, "run.sh", "echo €\n")
+	if !errors.Is(err, ErrUnencodable) {
+		t.Errorf("err = %v, want ErrUnencodable", err)
+	}
+	if after, _ := os.ReadFile(path); !bytes.Equal(after, raw) {
+		t.Errorf("run.sh = %q after a failed write, want %q", after, raw)
+	}
+}
@@ -0,0 +1,34 @@
+package git
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrNoChanges               = errors.New("no changes to commit")
+	ErrPartialCloneUnsupported = errors.New("remote does not support partial clone")
+	ErrBinaryFile              = errors.New("binary file")
+	ErrUnencodable             = errors.New("content cannot be encoded in the file's encoding")
+	ErrUnsafePath              = errors.New("unsafe path")
+	ErrInsufficientSpace       = errors.New("insufficient disk space")
+	ErrCloneTooLarge           = errors.New("clone exceeds size limit")
+)
+
+// OpError reports which git operation failed, wrapping the underlying go-git error
+type OpError struct {
+	Op  string
+	Err error
+}
+
+func (e *OpError) Error() string {
+	return fmt.Sprintf("git %s failed: %v", e.Op, e.Err)
+}
+
+func (e *OpError) Unwrap() error {
+	return e.Err
+}
+
+func opError(op string, err error) error {
+	return &OpError{Op: op, Err: err}
+}
@@ -1,11 +1,20 @@
 package git
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
+
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/storage/memory"
 )
 
 const (
@@ -13,35 +22,75 @@ const (
 )
 
 type CloneOptions struct {
-	URL       string
+	URL   string
+	Token string
+	// Directory names the workspace and must be unique per request, such as
+	// the request ID
 	Directory string
-	Token     string
+	// Partial clones with filter=blob:none and no checkout; file contents are
+	// fetched on demand through Materialize
+	Partial bool
+	// SizeLimit aborts the clone with ErrCloneTooLarge once the workspace
+	// grows beyond this many bytes. Zero means no limit
+	SizeLimit int64
+	// Branch to check out instead of the remote's default branch
+	Branch string
 }
 
 func CloneRepository(opts CloneOptions) (string, error) {
-	// Create the full path in /tmp
-	clonePath := filepath.Join(tmpDir, opts.Directory)
+	if opts.Directory == "" || filepath.Base(opts.Directory) != opts.Directory {
+		return "", fmt.Errorf("invalid workspace name %q", opts.Directory)
+	}
+
+	if err := os.MkdirAll(workspaceRoot, 0755); err != nil {
+		return "", fmt.Errorf("failed to create workspace root: %w", err)
+	}
+	clonePath := filepath.Join(workspaceRoot, opts.Directory)
 
 	// Clean up if directory already exists
 	if err := os.RemoveAll(clonePath); err != nil {
 		return "", fmt.Errorf("failed to clean up existing directory: %w", err)
 	}
 
-	// Construct clone URL with authentication
-	authURL := strings.Replace(opts.URL, "https://", fmt.Sprintf("https://%s@", opts.Token), 1)
+	err := limitSize(context.Background(), clonePath, opts.SizeLimit, func(ctx context.Context) error {
+		if opts.Partial {
+			return clonePartial(ctx, clonePath, opts)
+		}
 
-	// Execute git clone command
-	cmd := exec.Command("git", "clone", "--depth", "1", authURL, clonePath)
-	output, err := cmd.CombinedOutput()
+		// Clone only the tip of the branch
+		cloneOpts := &gogit.CloneOptions{
+			URL:          opts.URL,
+			Auth:         tokenAuth(opts.Token),
+			Depth:        1,
+			SingleBranch: true,
+		}
+		if opts.Branch != "" {
+			cloneOpts.ReferenceName = plumbing.NewBranchReferenceName(opts.Branch)
+		}
+		_, err := gogit.PlainCloneContext(ctx, clonePath, false, cloneOpts)
+		if err != nil {
+			return opError("clone", err)
+		}
+		return nil
+	})
 	if err != nil {
-		return "", fmt.Errorf("git clone failed: %w, output: %s", err, string(output))
+		os.RemoveAll(clonePath)
+		return "", err
 	}
 
 	return clonePath, nil
 }
 
-func ListFiles(rootPath string) (string, error) {
-	var builder strings.Builder
+// ListFiles builds a structured tree of the repository, annotated from
+// .gitignore and .gitattributes. token authenticates the fetch of those files
+// in partial clones
+func ListFiles(rootPath, token string) (*FileTree, error) {
+	// Partial clones have no checkout, so list the tree objects instead
+	if repo, err := gogit.PlainOpen(rootPath); err == nil && isPartial(repo) {
+		return listTree(repo, rootPath, token)
+	}
+
+	tree := newFileTree(rootPath)
 
 	err := filepath.Walk(rootPath, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
@@ -53,7 +102,6 @@ func ListFiles(rootPath string) (string, error) {
 			return filepath.SkipDir
 		}
 
-		// Calculate relative path and indentation
 		relPath, err := filepath.Rel(rootPath, path)
 		if err != nil {
 			return err
@@ -63,40 +111,55 @@ func ListFiles(rootPath string) (string, error) {
 			return nil
 		}
 
-		// Calculate depth for indentation
-		depth := strings.Count(relPath, string(os.PathSeparator))
-		indent := strings.Repeat("  ", depth)
-
-		// Add directory or file marker
+		relPath = filepath.ToSlash(relPath)
 		if info.IsDir() {
-			builder.WriteString(fmt.Sprintf("%s%s/\n", indent, info.Name()))
+			tree.addDir(relPath)
 		} else {
-			builder.WriteString(fmt.Sprintf("%s%s\n", indent, info.Name()))
+			tree.addFile(relPath, info.Size(), sniffFile(path))
 		}
 
 		return nil
 	})
 
 	if err != nil {
-		return "", fmt.Errorf("failed to walk directory: %w", err)
+		return nil, fmt.Errorf("failed to walk directory: %w", err)
 	}
 
-	return builder.String(), nil
+	return tree, nil
 }
 
-// Large files (>2000 lines) are truncated to first 1000 + last 1000 lines
-func ReadFileContent(filePath string) (string, error) {
-	content, err := os.ReadFile(filePath)
+// Content is decoded to UTF-8 with LF line endings; WriteFile restores the
+// original encoding. Binary files return ErrBinaryFile.
+// Large files (>2000 lines) are truncated to first 1000 + last 1000 lines.
+// relPath is resolved with ResolvePath
+func ReadFileContent(repoPath, relPath string) (string, error) {
+	filePath, _, err := ResolvePath(repoPath, relPath)
+	if err != nil {
+		return "", err
+	}
+
+	raw, err := os.ReadFile(filePath)
 	if err != nil {
 		return "", fmt.Errorf("failed to read file: %w", err)
 	}
 
-	lines := strings.Split(string(content), "\n")
+	return DecodeContent(raw)
+}
+
+// DecodeContent turns raw file content into the text ReadFileContent returns,
+// for files read from somewhere other than a worktree
+func DecodeContent(raw []byte) (string, error) {
+	content, _, err := decodeText(raw)
+	if err != nil {
+		return "", err
+	}
+
+	lines := strings.Split(content, "\n")
 	totalLines := len(lines)
 
 	// If file is small enough, return it as-is
 	if totalLines <= 2000 {
-		return string(content), nil
+		return content, nil
 	}
 
 	// For large files, truncate
@@ -112,90 +175,319 @@ func ReadFileContent(filePath string) (string, error) {
 	return truncated, nil
 }
 
-// WriteFile writes content to a file in the repository
-func WriteFile(filePath, content string) error {
-	if err := os.WriteFile(filePath, []byte(content), 0644); err != nil {
+// WriteFile writes content to a file in the repository, keeping the existing
+// file's encoding, BOM, line endings, trailing newline and mode. New files are
+// written as UTF-8 with LF endings and a trailing newline. Existing binary
+// files are never overwritten and return ErrBinaryFile. relPath is resolved
+// with ResolvePath, and missing parent directories are created
+func WriteFile(repoPath, relPath, content string) error {
+	filePath, _, err := ResolvePath(repoPath, relPath)
+	if err != nil {
+		return err
+	}
+
+	format, err := detectFileFormat(filePath)
+	if err != nil {
+		return err
+	}
+
+	encoded, err := encodeText(content, format)
+	if err != nil {
+		return fmt.Errorf("failed to encode file: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	if err := os.WriteFile(filePath, encoded, format.Mode); err != nil {
 		return fmt.Errorf("failed to write file: %w", err)
 	}
+
+	// WriteFile only applies the mode when it creates the file
+	if err := os.Chmod(filePath, format.Mode); err != nil {
+		return fmt.Errorf("failed to set file mode: %w", err)
+	}
 	return nil
 }
 
-// Adds upstream remote, fetches it, and hard resets to match
-func ResetToUpstream(repoPath, upstreamOwner, upstreamRepo, baseBranch string) error {
+// RestoreFile discards changes to relPath, restoring the committed version or
+// removing the file if it is new
+func RestoreFile(repoPath, relPath string) error {
+	filePath, relPath, err := ResolvePath(repoPath, relPath)
+	if err != nil {
+		return err
+	}
+
+	repo, err := gogit.PlainOpen(repoPath)
+	if err != nil {
+		return opError("open", err)
+	}
+
+	tree, err := headTree(repo)
+	if err != nil {
+		return err
+	}
+
+	entry, err := tree.FindEntry(relPath)
+	if errors.Is(err, object.ErrEntryNotFound) || errors.Is(err, object.ErrDirectoryNotFound) {
+		if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove file: %w", err)
+		}
+		return nil
+	}
+	if err != nil {
+		return opError("restore", err)
+	}
+
+	if err := writeBlob(repo, filePath, entry); err != nil {
+		return opError("restore", err)
+	}
+	return nil
+}
+
+// Adds upstream remote, fetches it with token, and hard resets to match. The
+// fetch is aborted with ErrCloneTooLarge once the workspace grows beyond
+// sizeLimit bytes, as the clone is
+func ResetToUpstream(repoPath, upstreamURL, baseBranch, token string, sizeLimit int64) error {
+	repo, err := gogit.PlainOpen(repoPath)
+	if err != nil {
+		return opError("open", err)
+	}
+
 	// Add upstream remote if it doesn't exist
-	remoteURL := fmt.Sprintf("https://github.com/%s/%s.git", upstreamOwner, upstreamRepo)
-	addRemoteCmd := exec.Command("git", "-C", repoPath, "remote", "add", "upstream", remoteURL)
-	addRemoteCmd.CombinedOutput() // Ignore error if upstream already exists
+	_, err = repo.CreateRemote(&config.RemoteConfig{
+		Name: "upstream",
+		URLs: []string{upstreamURL},
+	})
+	if err != nil && !errors.Is(err, gogit.ErrRemoteExists) {
+		return opError("remote add", err)
+	}
 
-	// Fetch upstream
-	fetchCmd := exec.Command("git", "-C", repoPath, "fetch", "upstream", baseBranch)
-	if output, err := fetchCmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("git fetch upstream failed: %w, output: %s", err, string(output))
+	hash, err := fetchUpstream(repo, repoPath, baseBranch, token, sizeLimit)
+	if err != nil {
+		return err
+	}
+
+	if isPartial(repo) {
+		// Nothing is materialized yet, so moving the branch and index is the
+		// whole of a hard reset
+		return resetIndex(repo, hash)
 	}
 
 	// Reset to upstream
-	resetCmd := exec.Command("git", "-C", repoPath, "reset", "--hard", fmt.Sprintf("upstream/%s", baseBranch))
-	if output, err := resetCmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("git reset failed: %w, output: %s", err, string(output))
+	worktree, err := repo.Worktree()
+	if err != nil {
+		return opError("reset", err)
+	}
+
+	if err := worktree.Reset(&gogit.ResetOptions{Commit: hash, Mode: gogit.HardReset}); err != nil {
+		return opError("reset", err)
 	}
 
 	return nil
 }
 
+// Fetches the upstream base branch into refs/remotes/upstream/<base> and
+// returns its tip. Regular clones fetch full history, which pushing from a
+// shallow base would otherwise need; partial clones fetch only the tip. Full
+// history can be far larger than the clone, so the fetch runs under the same
+// size limit
+func fetchUpstream(repo *gogit.Repository, repoPath, baseBranch, token string, sizeLimit int64) (plumbing.Hash, error) {
+	remoteRef := plumbing.NewRemoteReferenceName("upstream", baseBranch)
+	err := limitSize(context.Background(), repoPath, sizeLimit, func(ctx context.Context) error {
+		if isPartial(repo) {
+			return fetchPartialUpstream(ctx, repo, baseBranch, token)
+		}
+
+		refSpec := config.RefSpec(fmt.Sprintf("+%s:%s", plumbing.NewBranchReferenceName(baseBranch), remoteRef))
+		err := repo.FetchContext(ctx, &gogit.FetchOptions{
+			RemoteName: "upstream",
+			RefSpecs:   []config.RefSpec{refSpec},
+			// GitHub Enterprise Server and private repositories refuse
+			// anonymous fetches
+			Auth: tokenAuth(token),
+		})
+		if err != nil && !errors.Is(err, gogit.NoErrAlreadyUpToDate) {
+			return opError("fetch upstream", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	ref, err := repo.Reference(remoteRef, true)
+	if err != nil {
+		return plumbing.ZeroHash, opError("fetch upstream", err)
+	}
+	return ref.Hash(), nil
+}
+
 func CreateAndCheckoutBranch(repoPath, branchName string) error {
-	checkoutCmd := exec.Command("git", "-C", repoPath, "checkout", "-b", branchName)
-	if output, err := checkoutCmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("git checkout -b failed: %w, output: %s", err, string(output))
+	repo, err := gogit.PlainOpen(repoPath)
+	if err != nil {
+		return opError("open", err)
+	}
+
+	// A regular checkout would try to write every file of a partial clone
+	if isPartial(repo) {
+		return createPartialBranch(repo, branchName)
+	}
+
+	worktree, err := repo.Worktree()
+	if err != nil {
+		return opError("checkout -b", err)
+	}
+
+	err = worktree.Checkout(&gogit.CheckoutOptions{
+		Branch: plumbing.NewBranchReferenceName(branchName),
+		Create: true,
+	})
+	if err != nil {
+		return opError("checkout -b", err)
 	}
 	return nil
 }
 
-func CommitAndPush(repoPath, branchName, commitMessage, token string) error {
-	// Configure git user for the commit
-	configCmds := [][]string{
-		{"git", "-C", repoPath, "config", "user.name", "Auto PR Bot"},
-		{"git", "-C", repoPath, "config", "user.email", "auto-pr-bot@users.noreply.github.com"},
+// Commit is one commit to create. Paths limits it to those repository-relative
+// files; an empty Paths commits every remaining change in the worktree
+type Commit struct {
+	Message string
+	Paths   []string
+}
+
+// CommitAndPush creates commits in order and pushes the branch. Commits whose
+// paths have no changes are skipped; ErrNoChanges is returned when none of
+// them produced a commit
+func CommitAndPush(repoPath, branchName string, commits []Commit, token string, opts CommitOptions) error {
+	repo, err := gogit.PlainOpen(repoPath)
+	if err != nil {
+		return opError("open", err)
 	}
 
-	for _, cmdArgs := range configCmds {
-		cmd := exec.Command(cmdArgs[0], cmdArgs[1:]...)
-		if output, err := cmd.CombinedOutput(); err != nil {
-			return fmt.Errorf("git config failed: %w, output: %s", err, string(output))
+	created := 0
+	for _, c := range commits {
+		err := commit(repo, c, opts)
+		if errors.Is(err, ErrNoChanges) {
+			continue
+		}
+		if err != nil {
+			return err
 		}
+		created++
+	}
+	if created == 0 {
+		return ErrNoChanges
 	}
 
-	// Add all changes
-	addCmd := exec.Command("git", "-C", repoPath, "add", "-A")
-	if output, err := addCmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("git add failed: %w, output: %s", err, string(output))
+	// Push changes to the specific branch
+	branchRef := plumbing.NewBranchReferenceName(branchName)
+	err = repo.Push(&gogit.PushOptions{
+		RemoteName: "origin",
+		RefSpecs:   []config.RefSpec{config.RefSpec(fmt.Sprintf("%s:%s", branchRef, branchRef))},
+		Auth:       tokenAuth(token),
+	})
+	if err != nil && !errors.Is(err, gogit.NoErrAlreadyUpToDate) {
+		return opError("push", err)
 	}
 
-	// Check if there are changes to commit
-	statusCmd := exec.Command("git", "-C", repoPath, "status", "--porcelain")
-	statusOutput, err := statusCmd.CombinedOutput()
+	return nil
+}
+
+// Stages the commit's paths, or everything in the worktree, and commits them,
+// returning ErrNoChanges when nothing changed
+func commit(repo *gogit.Repository, c Commit, opts CommitOptions) error {
+	worktree, err := repo.Worktree()
 	if err != nil {
-		return fmt.Errorf("git status failed: %w, output: %s", err, string(statusOutput))
+		return opError("add", err)
 	}
 
-	if len(strings.TrimSpace(string(statusOutput))) == 0 {
-		return fmt.Errorf("no changes to commit")
+	switch {
+	case len(c.Paths) > 0:
+		for _, path := range c.Paths {
+			// SkipStatus avoids a full worktree scan per file, which would
+			// also report unmaterialized files in partial clones as deleted
+			if err := worktree.AddWithOptions(&gogit.AddOptions{Path: path, SkipStatus: true}); err != nil {
+				return opError("add", err)
+			}
+		}
+	case isPartial(repo):
+		// Files that were never materialized would show up as deleted, so
+		// only stage what is on disk and let the tree comparison in Commit
+		// detect an unchanged tree
+		if err := stagePartial(repo, worktree.Filesystem.Root()); err != nil {
+			return err
+		}
+	default:
+		// Add all changes
+		if err := worktree.AddWithOptions(&gogit.AddOptions{All: true}); err != nil {
+			return opError("add", err)
+		}
+
+		// Check if there are changes to commit
+		worktreeStatus, err := worktree.Status()
+		if err != nil {
+			return opError("status", err)
+		}
+
+		if worktreeStatus.IsClean() {
+			return ErrNoChanges
+		}
 	}
 
+	signature := opts.Signature()
+
 	// Commit changes
-	commitCmd := exec.Command("git", "-C", repoPath, "commit", "-m", commitMessage)
-	if output, err := commitCmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("git commit failed: %w, output: %s", err, string(output))
+	_, err = worktree.Commit(opts.Message(c.Message), &gogit.CommitOptions{
+		Author:    signature,
+		Committer: signature,
+		Signer:    opts.Signer,
+	})
+	if errors.Is(err, gogit.ErrEmptyCommit) {
+		return ErrNoChanges
 	}
-
-	// Push changes to the specific branch
-	pushCmd := exec.Command("git", "-C", repoPath, "push", "-u", "origin", branchName)
-	if output, err := pushCmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("git push failed: %w, output: %s", err, string(output))
+	if err != nil {
+		return opError("commit", err)
 	}
 
 	return nil
 }
 
+// RemoteHasBranch lists the refs at url, as git ls-remote does, and reports
+// whether branch is among them. Repositories that do not exist yet, or are
+// still empty, have no branches
+func RemoteHasBranch(url, branch, token string) (bool, error) {
+	remote := gogit.NewRemote(memory.NewStorage(), &config.RemoteConfig{
+		Name: "origin",
+		URLs: []string{url},
+	})
+
+	refs, err := remote.List(&gogit.ListOptions{Auth: tokenAuth(token)})
+	if errors.Is(err, transport.ErrRepositoryNotFound) || errors.Is(err, transport.ErrEmptyRemoteRepository) {
+		return false, nil
+	}
+	if err != nil {
+		return false, opError("ls-remote", err)
+	}
+
+	for _, ref := range refs {
+		if ref.Name() == plumbing.NewBranchReferenceName(branch) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Credentials travel only as HTTP basic auth, never in the remote URL stored
+// in .git/config. GitHub accepts any non-empty username alongside a token
+func tokenAuth(token string) *githttp.BasicAuth {
+	return &githttp.BasicAuth{
+		Username: "x-access-token",
+		Password: token,
+	}
+}
+
 func Cleanup(clonePath string) error {
 	if err := os.RemoveAll(clonePath); err != nil {
 		return fmt.Errorf("failed to cleanup: %w", err)
@@ -0,0 +1,345 @@
+package git
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+const testBranch = "main"
+
+// Creates a bare repository whose main branch has one commit with files, and
+// returns its file:// URL
+func newRemote(t *testing.T, files map[string]string) string {
+	t.Helper()
+
+	remotePath := filepath.Join(t.TempDir(), "remote.git")
+	remote, err := gogit.PlainInit(remotePath, true)
+	if err != nil {
+		t.Fatalf("init remote: %v", err)
+	}
+	head := plumbing.NewSymbolicReference(plumbing.HEAD, plumbing.NewBranchReferenceName(testBranch))
+	if err := remote.Storer.SetReference(head); err != nil {
+		t.Fatalf("set remote HEAD: %v", err)
+	}
+	url := "file://" + remotePath
+	pushCommit(t, url, testBranch, files)
+	return url
+}
+
+// Commits files on top of branch at url and pushes the commit
+func pushCommit(t *testing.T, url, branch string, files map[string]string) plumbing.Hash {
+	t.Helper()
+
+	workPath := t.TempDir()
+	repo, err := gogit.PlainInit(workPath, false)
+	if err != nil {
+		t.Fatalf("init: %v", err)
+	}
+	branchRef := plumbing.NewBranchReferenceName(branch)
+	if _, err := repo.CreateRemote(&config.RemoteConfig{Name: "origin", URLs: []string{url}}); err != nil {
+		t.Fatalf("remote add: %v", err)
+	}
+	if err := repo.Storer.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, branchRef)); err != nil {
+		t.Fatalf("set HEAD: %v", err)
+	}
+
+	// Build on the branch's current tip, if it has one
+	remote, err := gogit.PlainOpen(strings.TrimPrefix(url, "file://"))
+	if err != nil {
+		t.Fatalf("open remote: %v", err)
+	}
+	if _, err := remote.Reference(branchRef, true); err == nil {
+		err = repo.Fetch(&gogit.FetchOptions{
+			RefSpecs: []config.RefSpec{config.RefSpec("+" + branchRef + ":" + branchRef)},
+		})
+		if err != nil {
+			t.Fatalf("fetch: %v", err)
+		}
+		worktree, _ := repo.Worktree()
+		if err := worktree.Reset(&gogit.ResetOptions{Mode: gogit.HardReset}); err != nil {
+			t.Fatalf("reset: %v", err)
+		}
+	}
+
+	for name, content := range files {
+		fullPath := filepath.Join(workPath, name)
+		if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(fullPath, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	worktree, _ := repo.Worktree()
+	if err := worktree.AddWithOptions(&gogit.AddOptions{All: true}); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	signature := &object.Signature{Name: "Test", Email: "test@example.com", When: time.Now()}
+	hash, err := worktree.Commit("test commit", &gogit.CommitOptions{Author: signature})
+	if err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	err = repo.Push(&gogit.PushOptions{
+		RefSpecs: []config.RefSpec{config.RefSpec(branchRef + ":" + branchRef)},
+	})
+	if err != nil {
+		t.Fatalf("push: %v", err)
+	}
+	return hash
+}
+
+// Returns the content of path in the commit branch points to at url
+func remoteFile(t *testing.T, url, branch, path string) string {
+	t.Helper()
+
+	repo, err := gogit.PlainOpen(strings.TrimPrefix(url, "file://"))
+	if err != nil {
+		t.Fatalf("open remote: %v", err)
+	}
+	ref, err := repo.Reference(plumbing.NewBranchReferenceName(branch), true)
+	if err != nil {
+		t.Fatalf("branch %s: %v", branch, err)
+	}
+	commit, err := repo.CommitObject(ref.Hash())
+	if err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	file, err := commit.File(path)
+	if err != nil {
+		t.Fatalf("file %s: %v", path, err)
+	}
+	content, err := file.Contents()
+	if err != nil {
+		t.Fatalf("contents of %s: %v", path, err)
+	}
+	return content
+}
+
+// Points workspaceRoot at a temporary directory for the test
+func useWorkspaceRoot(t *testing.T) {
+	t.Helper()
+
+	previous := workspaceRoot
+	workspaceRoot = t.TempDir()
+	t.Cleanup(func() { workspaceRoot = previous })
+}
+
+func clone(t *testing.T, url string) string {
+	t.Helper()
+
+	clonePath, err := CloneRepository(CloneOptions{URL: url, Directory: "request"})
+	if err != nil {
+		t.Fatalf("CloneRepository: %v", err)
+	}
+	return clonePath
+}
+
+func TestCloneRepository(t *testing.T) {
+	useWorkspaceRoot(t)
+	url := newRemote(t, map[string]string{"README.md": "hello\n", "src/main.go": "package main\n"})
+
+	clonePath := clone(t, url)
+
+	content, err := ReadFileContent(clonePath, "src/main.go")
+	if err != nil {
+		t.Fatalf("ReadFileContent: %v", err)
+	}
+	if content != "package main\n" {
+		t.Errorf("content = %q, want %q", content, "package main\n")
+	}
+
+	repo, err := gogit.PlainOpen(clonePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, err := repo.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head.Name().Short() != testBranch {
+		t.Errorf("HEAD = %s, want %s", head.Name().Short(), testBranch)
+	}
+}
+
+func TestCloneRepositoryInvalidDirectory(t *testing.T) {
+	useWorkspaceRoot(t)
+
+	for _, directory := range []string{"", "a/b", "../escape"} {
+		if _, err := CloneRepository(CloneOptions{URL: "file:///nonexistent", Directory: directory}); err == nil {
+			t.Errorf("CloneRepository(Directory: %q) succeeded, want an error", directory)
+		}
+	}
+}
+
+func TestCloneRepositoryMissingRemote(t *testing.T) {
+	useWorkspaceRoot(t)
+
+	_, err := CloneRepository(CloneOptions{URL: "file://" + filepath.Join(t.TempDir(), "missing.git"), Directory: "request"})
+	var opErr *OpError
+	if !errors.As(err, &opErr) || opErr.Op != "clone" {
+		t.Fatalf("err = %v, want a clone *OpError", err)
+	}
+	if _, statErr := os.Stat(filepath.Join(workspaceRoot, "request")); !os.IsNotExist(statErr) {
+		t.Errorf("failed clone left its workspace behind")
+	}
+}
+
+func TestCommitAndPushNoChanges(t *testing.T) {
+	useWorkspaceRoot(t)
+	url := newRemote(t, map[string]string{"README.md": "hello\n"})
+	clonePath := clone(t, url)
+
+	if err := CreateAndCheckoutBranch(clonePath, "auto-pr-bot/test"); err != nil {
+		t.Fatalf("CreateAndCheckoutBranch: %v", err)
+	}
+
+	err := CommitAndPush(clonePath, "auto-pr-bot/test", []Commit{{Message: "change"}}, "", CommitOptions{})
+	if !errors.Is(err, ErrNoChanges) {
+		t.Fatalf("err = %v, want ErrNoChanges", err)
+	}
+
+	// Rewriting a file with its own content is no change either
+	if err := WriteFile(clonePath, "README.md", "hello\n"); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	err = CommitAndPush(clonePath, "auto-pr-bot/test", []Commit{{Message: "change", Paths: []string{"README.md"}}}, "", CommitOptions{})
+	if !errors.Is(err, ErrNoChanges) {
+		t.Fatalf("err = %v, want ErrNoChanges", err)
+	}
+
+	if exists, err := RemoteHasBranch(url, "auto-pr-bot/test", ""); err != nil || exists {
+		t.Errorf("RemoteHasBranch = %t, %v; want false, nil", exists, err)
+	}
+}
+
+func TestCommitAndPush(t *testing.T) {
+	useWorkspaceRoot(t)
+	url := newRemote(t, map[string]string{"README.md": "hello\n", "main.go": "package main\n"})
+	clonePath := clone(t, url)
+
+	branch := "auto-pr-bot/test"
+	if err := CreateAndCheckoutBranch(clonePath, branch); err != nil {
+		t.Fatalf("CreateAndCheckoutBranch: %v", err)
+	}
+	if err := WriteFile(clonePath, "README.md", "hello world\n"); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := WriteFile(clonePath, "docs/guide.md", "guide\n"); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	commits := []Commit{
+		{Message: "docs: update readme", Paths: []string{"README.md"}},
+		// Nothing left for main.go, so this commit is skipped
+		{Message: "fix: main", Paths: []string{"main.go"}},
+		{Message: "docs: add guide"},
+	}
+	opts := CommitOptions{AuthorName: "Bot", AuthorEmail: "bot@example.com", Trailers: []string{"Request-Id: 1"}}
+	if err := CommitAndPush(clonePath, branch, commits, "", opts); err != nil {
+		t.Fatalf("CommitAndPush: %v", err)
+	}
+
+	if got := remoteFile(t, url, branch, "README.md"); got != "hello world\n" {
+		t.Errorf("README.md = %q, want %q", got, "hello world\n")
+	}
+	if got := remoteFile(t, url, branch, "docs/guide.md"); got != "guide\n" {
+		t.Errorf("docs/guide.md = %q, want %q", got, "guide\n")
+	}
+
+	repo, err := gogit.PlainOpen(clonePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log, err := repo.Log(&gogit.LogOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var messages []string
+	log.ForEach(func(c *object.Commit) error {
+		messages = append(messages, c.Message)
+		if c.Author.Email == "bot@example.com" && c.Committer.Email != "bot@example.com" {
+			t.Errorf("committer = %s, want the author", c.Committer.Email)
+		}
+		return nil
+	})
+	want := []string{"docs: add guide\n\nRequest-Id: 1", "docs: update readme\n\nRequest-Id: 1", "test commit"}
+	if len(messages) != len(want) {
+		t.Fatalf("commits = %q, want %q", messages, want)
+	}
+	for i := range want {
+		if messages[i] != want[i] && messages[i] != want[i]+"\n" {
+			t.Errorf("commit %d = %q, want %q", i, messages[i], want[i])
+		}
+	}
+
+	if exists, err := RemoteHasBranch(url, branch, ""); err != nil || !exists {
+		t.Errorf("RemoteHasBranch = %t, %v; want true, nil", exists, err)
+	}
+}
+
+func TestResetToUpstream(t *testing.T) {
+	useWorkspaceRoot(t)
+	forkURL := newRemote(t, map[string]string{"README.md": "fork\n", "stale.txt": "only in the fork\n"})
+	upstreamURL := newRemote(t, map[string]string{"README.md": "upstream\n"})
+	upstreamTip := pushCommit(t, upstreamURL, testBranch, map[string]string{"new.txt": "new\n"})
+
+	clonePath := clone(t, forkURL)
+	// Uncommitted changes are discarded as well
+	if err := WriteFile(clonePath, "scratch.txt", "scratch\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ResetToUpstream(clonePath, upstreamURL, testBranch, "", 0); err != nil {
+		t.Fatalf("ResetToUpstream: %v", err)
+	}
+
+	repo, err := gogit.PlainOpen(clonePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, err := repo.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head.Hash() != upstreamTip {
+		t.Errorf("HEAD = %s, want upstream's tip %s", head.Hash(), upstreamTip)
+	}
+
+	for path, want := range map[string]string{"README.md": "upstream\n", "new.txt": "new\n"} {
+		got, err := ReadFileContent(clonePath, path)
+		if err != nil || got != want {
+			t.Errorf("%s = %q, %v; want %q", path, got, err, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(clonePath, "stale.txt")); !os.IsNotExist(err) {
+		t.Errorf("stale.txt survived the reset")
+	}
+
+	// Resetting again, with the remote already added, is fine
+	if err := ResetToUpstream(clonePath, upstreamURL, testBranch, "", 0); err != nil {
+		t.Fatalf("second ResetToUpstream: %v", err)
+	}
+}
+
+func TestResetToUpstreamSizeLimit(t *testing.T) {
+	useWorkspaceRoot(t)
+	forkURL := newRemote(t, map[string]string{"README.md": "fork\n"})
+	upstreamURL := newRemote(t, map[string]string{"README.md": "upstream\n"})
+	pushCommit(t, upstreamURL, testBranch, map[string]string{"large.txt": strings.Repeat("history\n", 1<<16)})
+
+	clonePath := clone(t, forkURL)
+	err := ResetToUpstream(clonePath, upstreamURL, testBranch, "", dirSize(clonePath)+1024)
+	if !errors.Is(err, ErrCloneTooLarge) {
+		t.Errorf("err = %v, want ErrCloneTooLarge", err)
+	}
+}
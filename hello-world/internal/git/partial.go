@@ -0,0 +1,550 @@
+package git
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	format "github.com/go-git/go-git/v5/plumbing/format/config"
+	"github.com/go-git/go-git/v5/plumbing/format/packfile"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp/capability"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp/sideband"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/client"
+)
+
+// Partial clones follow git's own layout: the clone is fetched with
+// filter=blob:none and no checkout, the remotes it was fetched from are marked
+// as promisors in .git/config, and only the blobs that are explicitly asked
+// for get fetched and written to the worktree. The materialized paths are
+// recorded in .git/info/sparse-checkout so the clone stays consistent when
+// inspected with the git CLI.
+
+const (
+	partialCloneFilter = "blob:none"
+	sparseCheckoutFile = "info/sparse-checkout"
+)
+
+// Clones the tip of the remote's default branch with trees but without blobs
+func clonePartial(ctx context.Context, clonePath string, opts CloneOptions) error {
+	repo, err := gogit.PlainInit(clonePath, false)
+	if err != nil {
+		return opError("init", err)
+	}
+
+	_, err = repo.CreateRemote(&config.RemoteConfig{
+		Name:  "origin",
+		URLs:  []string{opts.URL},
+		Fetch: []config.RefSpec{"+refs/heads/*:refs/remotes/origin/*"},
+	})
+	if err != nil {
+		return opError("remote add", err)
+	}
+
+	branch, hash, err := fetchPartial(ctx, repo, opts.URL, tokenAuth(opts.Token), opts.Branch)
+	if err != nil {
+		return err
+	}
+
+	if err := markPromisor(repo, "origin"); err != nil {
+		return err
+	}
+
+	refs := []*plumbing.Reference{
+		plumbing.NewHashReference(plumbing.NewRemoteReferenceName("origin", branch), hash),
+		plumbing.NewHashReference(plumbing.NewBranchReferenceName(branch), hash),
+		plumbing.NewSymbolicReference(plumbing.HEAD, plumbing.NewBranchReferenceName(branch)),
+	}
+	for _, ref := range refs {
+		if err := repo.Storer.SetReference(ref); err != nil {
+			return opError("clone", err)
+		}
+	}
+
+	return resetIndex(repo, hash)
+}
+
+// Fetches the tip of the upstream base branch without blobs into
+// refs/remotes/upstream/<base>
+func fetchPartialUpstream(ctx context.Context, repo *gogit.Repository, baseBranch, token string) error {
+	remote, err := repo.Remote("upstream")
+	if err != nil {
+		return opError("fetch upstream", err)
+	}
+
+	_, hash, err := fetchPartial(ctx, repo, remote.Config().URLs[0], tokenAuth(token), baseBranch)
+	if err != nil {
+		return err
+	}
+
+	if err := markPromisor(repo, "upstream"); err != nil {
+		return err
+	}
+
+	ref := plumbing.NewHashReference(plumbing.NewRemoteReferenceName("upstream", baseBranch), hash)
+	if err := repo.Storer.SetReference(ref); err != nil {
+		return opError("fetch upstream", err)
+	}
+	return nil
+}
+
+func createPartialBranch(repo *gogit.Repository, branchName string) error {
+	head, err := repo.Head()
+	if err != nil {
+		return opError("checkout -b", err)
+	}
+
+	branchRef := plumbing.NewBranchReferenceName(branchName)
+	refs := []*plumbing.Reference{
+		plumbing.NewHashReference(branchRef, head.Hash()),
+		plumbing.NewSymbolicReference(plumbing.HEAD, branchRef),
+	}
+	for _, ref := range refs {
+		if err := repo.Storer.SetReference(ref); err != nil {
+			return opError("checkout -b", err)
+		}
+	}
+	return nil
+}
+
+// Fetches a single commit of branch (or of the remote HEAD when branch is
+// empty) with filter=blob:none and returns the resolved branch and commit
+func fetchPartial(ctx context.Context, repo *gogit.Repository, remoteURL string, auth transport.AuthMethod, branch string) (string, plumbing.Hash, error) {
+	session, ar, err := openUploadPack(remoteURL, auth)
+	if err != nil {
+		return "", plumbing.ZeroHash, err
+	}
+	defer session.Close()
+
+	if !ar.Capabilities.Supports(capability.Filter) {
+		return "", plumbing.ZeroHash, ErrPartialCloneUnsupported
+	}
+
+	refs, err := ar.AllReferences()
+	if err != nil {
+		return "", plumbing.ZeroHash, opError("fetch", err)
+	}
+
+	if branch == "" {
+		head, err := refs.Reference(plumbing.HEAD)
+		if err != nil || head.Type() != plumbing.SymbolicReference {
+			return "", plumbing.ZeroHash, opError("fetch", fmt.Errorf("remote HEAD is not advertised"))
+		}
+		branch = head.Target().Short()
+	}
+
+	ref, err := refs.Reference(plumbing.NewBranchReferenceName(branch))
+	if err != nil {
+		return "", plumbing.ZeroHash, opError("fetch", fmt.Errorf("branch %s not found on remote: %w", branch, err))
+	}
+
+	req := newUploadPackRequest(ar)
+	req.Wants = []plumbing.Hash{ref.Hash()}
+	req.Depth = packp.DepthCommits(1)
+	req.Filter = packp.FilterBlobNone()
+	if err := req.Capabilities.Set(capability.Shallow); err != nil {
+		return "", plumbing.ZeroHash, opError("fetch", err)
+	}
+	if err := req.Capabilities.Set(capability.Filter); err != nil {
+		return "", plumbing.ZeroHash, opError("fetch", err)
+	}
+
+	if err := uploadPack(ctx, repo, session, req); err != nil {
+		return "", plumbing.ZeroHash, err
+	}
+
+	return branch, ref.Hash(), nil
+}
+
+// Fetches the given blobs by hash, which requires the server to accept wants
+// for objects that are not ref tips
+func fetchBlobs(ctx context.Context, repo *gogit.Repository, remoteURL string, auth transport.AuthMethod, hashes []plumbing.Hash) error {
+	session, ar, err := openUploadPack(remoteURL, auth)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	if !ar.Capabilities.Supports(capability.AllowReachableSHA1InWant) &&
+		!ar.Capabilities.Supports(capability.AllowTipSHA1InWant) {
+		return ErrPartialCloneUnsupported
+	}
+
+	req := newUploadPackRequest(ar)
+	req.Wants = hashes
+
+	return uploadPack(ctx, repo, session, req)
+}
+
+func openUploadPack(remoteURL string, auth transport.AuthMethod) (transport.UploadPackSession, *packp.AdvRefs, error) {
+	endpoint, err := transport.NewEndpoint(remoteURL)
+	if err != nil {
+		return nil, nil, opError("fetch", err)
+	}
+
+	transportClient, err := client.NewClient(endpoint)
+	if err != nil {
+		return nil, nil, opError("fetch", err)
+	}
+
+	session, err := transportClient.NewUploadPackSession(endpoint, auth)
+	if err != nil {
+		return nil, nil, opError("fetch", err)
+	}
+
+	ar, err := session.AdvertisedReferences()
+	if err != nil {
+		session.Close()
+		return nil, nil, opError("fetch", err)
+	}
+
+	return session, ar, nil
+}
+
+func newUploadPackRequest(ar *packp.AdvRefs) *packp.UploadPackRequest {
+	req := packp.NewUploadPackRequestFromCapabilities(ar.Capabilities)
+	if ar.Capabilities.Supports(capability.NoProgress) {
+		req.Capabilities.Set(capability.NoProgress)
+	}
+	return req
+}
+
+func uploadPack(ctx context.Context, repo *gogit.Repository, session transport.UploadPackSession, req *packp.UploadPackRequest) (err error) {
+	resp, err := session.UploadPack(ctx, req)
+	if err != nil {
+		if errors.Is(err, transport.ErrEmptyUploadPackRequest) {
+			return nil
+		}
+		return opError("fetch", err)
+	}
+	defer func() {
+		if closeErr := resp.Close(); err == nil && closeErr != nil {
+			err = opError("fetch", closeErr)
+		}
+	}()
+
+	if len(resp.Shallows) > 0 {
+		shallows, err := repo.Storer.Shallow()
+		if err != nil {
+			return opError("fetch", err)
+		}
+		if err := repo.Storer.SetShallow(append(shallows, resp.Shallows...)); err != nil {
+			return opError("fetch", err)
+		}
+	}
+
+	var reader io.Reader = resp
+	switch {
+	case req.Capabilities.Supports(capability.Sideband64k):
+		reader = sideband.NewDemuxer(sideband.Sideband64k, resp)
+	case req.Capabilities.Supports(capability.Sideband):
+		reader = sideband.NewDemuxer(sideband.Sideband, resp)
+	}
+
+	if err := packfile.UpdateObjectStorage(repo.Storer, reader); err != nil {
+		return opError("fetch", err)
+	}
+	return nil
+}
+
+// Marks remoteName as a promisor remote, the way `git clone --filter` does
+func markPromisor(repo *gogit.Repository, remoteName string) error {
+	cfg, err := repo.Config()
+	if err != nil {
+		return opError("config", err)
+	}
+
+	// Extensions require format version 1, which in turn makes git insist on
+	// an explicit object format
+	cfg.Core.RepositoryFormatVersion = format.Version_1
+	if cfg.Extensions.ObjectFormat == "" {
+		cfg.Extensions.ObjectFormat = format.DefaultObjectFormat
+	}
+	cfg.Raw.Section("extensions").SetOption("partialClone", "origin")
+	cfg.Raw.Section("remote").Subsection(remoteName).
+		SetOption("promisor", "true").
+		SetOption("partialclonefilter", partialCloneFilter)
+
+	if err := repo.SetConfig(cfg); err != nil {
+		return opError("config", err)
+	}
+	return nil
+}
+
+// Returns the promisor remotes of a partial clone, upstream first since the
+// working commit is based on it, or nil for a regular clone
+func promisorRemotes(repo *gogit.Repository) []*config.RemoteConfig {
+	cfg, err := repo.Config()
+	if err != nil || !cfg.Raw.Section("extensions").HasOption("partialClone") {
+		return nil
+	}
+
+	var remotes []*config.RemoteConfig
+	for _, name := range []string{"upstream", "origin"} {
+		remote, ok := cfg.Remotes[name]
+		if !ok || cfg.Raw.Section("remote").Subsection(name).Option("promisor") != "true" {
+			continue
+		}
+		remotes = append(remotes, remote)
+	}
+	return remotes
+}
+
+func isPartial(repo *gogit.Repository) bool {
+	return len(promisorRemotes(repo)) > 0
+}
+
+// Points the index at commit without touching the worktree, which only
+// needs tree objects and therefore works without blobs
+func resetIndex(repo *gogit.Repository, commit plumbing.Hash) error {
+	worktree, err := repo.Worktree()
+	if err != nil {
+		return opError("reset", err)
+	}
+
+	if err := worktree.Reset(&gogit.ResetOptions{Commit: commit, Mode: gogit.MixedReset}); err != nil {
+		return opError("reset", err)
+	}
+	return nil
+}
+
+// Materialize fetches and writes the given repository-relative paths into the
+// worktree of a partial clone. Paths that are not in HEAD (new files) or that
+// are already on disk are skipped. It is a no-op for regular clones. token
+// authenticates the blob fetches, like the clone's
+func Materialize(repoPath string, paths []string, token string) error {
+	repo, err := gogit.PlainOpen(repoPath)
+	if err != nil {
+		return opError("open", err)
+	}
+
+	remotes := promisorRemotes(repo)
+	if len(remotes) == 0 {
+		return nil
+	}
+
+	tree, err := headTree(repo)
+	if err != nil {
+		return err
+	}
+
+	entries := make(map[string]*object.TreeEntry)
+	var missing []plumbing.Hash
+	for _, relPath := range paths {
+		_, relPath, err := ResolvePath(repoPath, relPath)
+		if err != nil {
+			continue
+		}
+		if _, ok := entries[relPath]; ok {
+			continue
+		}
+
+		entry, err := tree.FindEntry(relPath)
+		if err != nil || !entry.Mode.IsFile() {
+			continue
+		}
+
+		if _, err := os.Lstat(filepath.Join(repoPath, relPath)); err == nil {
+			continue
+		}
+
+		entries[relPath] = entry
+		if _, err := repo.Storer.EncodedObject(plumbing.BlobObject, entry.Hash); err != nil {
+			missing = append(missing, entry.Hash)
+		}
+	}
+
+	if len(entries) == 0 {
+		return nil
+	}
+
+	if len(missing) > 0 {
+		var fetchErr error
+		for _, remote := range remotes {
+			fetchErr = fetchBlobs(context.Background(), repo, remote.URLs[0], tokenAuth(token), missing)
+			if fetchErr == nil {
+				break
+			}
+		}
+		if fetchErr != nil {
+			return fetchErr
+		}
+	}
+
+	for relPath, entry := range entries {
+		if err := writeBlob(repo, filepath.Join(repoPath, relPath), entry); err != nil {
+			return fmt.Errorf("failed to materialize %s: %w", relPath, err)
+		}
+	}
+
+	return recordSparsePaths(repoPath, entries)
+}
+
+func writeBlob(repo *gogit.Repository, fullPath string, entry *object.TreeEntry) error {
+	blob, err := repo.BlobObject(entry.Hash)
+	if err != nil {
+		return err
+	}
+
+	reader, err := blob.Reader()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		return err
+	}
+
+	// Symlinks are checked out as symlinks so ResolvePath can refuse them
+	if entry.Mode == filemode.Symlink {
+		target, err := io.ReadAll(reader)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(string(target), fullPath)
+	}
+
+	perm := os.FileMode(0644)
+	if entry.Mode == filemode.Executable {
+		perm = 0755
+	}
+
+	file, err := os.OpenFile(fullPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(file, reader)
+	return err
+}
+
+func recordSparsePaths(repoPath string, entries map[string]*object.TreeEntry) error {
+	sparsePath := filepath.Join(repoPath, ".git", sparseCheckoutFile)
+	if err := os.MkdirAll(filepath.Dir(sparsePath), 0755); err != nil {
+		return fmt.Errorf("failed to record sparse checkout: %w", err)
+	}
+
+	file, err := os.OpenFile(sparsePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to record sparse checkout: %w", err)
+	}
+	defer file.Close()
+
+	paths := make([]string, 0, len(entries))
+	for relPath := range entries {
+		paths = append(paths, "/"+relPath)
+	}
+	sort.Strings(paths)
+
+	if _, err := file.WriteString(strings.Join(paths, "\n") + "\n"); err != nil {
+		return fmt.Errorf("failed to record sparse checkout: %w", err)
+	}
+	return nil
+}
+
+func headTree(repo *gogit.Repository) (*object.Tree, error) {
+	head, err := repo.Head()
+	if err != nil {
+		return nil, opError("ls-tree", err)
+	}
+
+	commit, err := repo.CommitObject(head.Hash())
+	if err != nil {
+		return nil, opError("ls-tree", err)
+	}
+
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, opError("ls-tree", err)
+	}
+	return tree, nil
+}
+
+// Builds the FileTree from HEAD's tree objects, the equivalent of
+// `git ls-tree -r` for a clone whose worktree is mostly empty. Only the
+// .gitignore and .gitattributes files are materialized so the tree can be
+// annotated; sizes and binary sniffing are unavailable without the blobs
+func listTree(repo *gogit.Repository, repoPath, token string) (*FileTree, error) {
+	head, err := headTree(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []string
+	var patternFiles []string
+	walker := object.NewTreeWalker(head, true, nil)
+	defer walker.Close()
+	for {
+		name, entry, err := walker.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, opError("ls-tree", err)
+		}
+		if !entry.Mode.IsFile() {
+			continue
+		}
+
+		entries = append(entries, name)
+		if base := path.Base(name); base == ".gitignore" || base == ".gitattributes" {
+			patternFiles = append(patternFiles, name)
+		}
+	}
+
+	if err := Materialize(repoPath, patternFiles, token); err != nil {
+		return nil, err
+	}
+
+	tree := newFileTree(repoPath)
+	for _, name := range entries {
+		tree.addFile(name, 0, func() []byte { return nil })
+	}
+	return tree, nil
+}
+
+// Stages every file present in the worktree, which for a partial clone are
+// exactly the materialized and newly created ones
+func stagePartial(repo *gogit.Repository, repoPath string) error {
+	worktree, err := repo.Worktree()
+	if err != nil {
+		return opError("add", err)
+	}
+
+	return filepath.Walk(repoPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			if info.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		relPath, err := filepath.Rel(repoPath, path)
+		if err != nil {
+			return err
+		}
+
+		if err := worktree.AddWithOptions(&gogit.AddOptions{Path: relPath, SkipStatus: true}); err != nil {
+			return opError("add", err)
+		}
+		return nil
+	})
+}
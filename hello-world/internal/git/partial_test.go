@@ -0,0 +1,269 @@
+package git
+
+import (
+	"errors"
+	"io"
+	"net/http/cgi"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// Serves the bare repository at a file:// URL over smart HTTP with git
+// http-backend and returns its http:// URL. With filter set, the server
+// advertises partial clone support and accepts wants for any object, as
+// GitHub does
+func serveHTTP(t *testing.T, url string, filter bool) string {
+	t.Helper()
+
+	gitPath, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git is not installed")
+	}
+	remotePath := strings.TrimPrefix(url, "file://")
+	settings := map[string]string{"http.receivepack": "true"}
+	if filter {
+		settings["uploadpack.allowFilter"] = "true"
+		settings["uploadpack.allowAnySHA1InWant"] = "true"
+	}
+	for key, value := range settings {
+		if out, err := exec.Command(gitPath, "-C", remotePath, "config", key, value).CombinedOutput(); err != nil {
+			t.Fatalf("git config %s: %v: %s", key, err, out)
+		}
+	}
+
+	server := httptest.NewServer(&cgi.Handler{
+		Path: gitPath,
+		Args: []string{"http-backend"},
+		Env: []string{
+			"GIT_PROJECT_ROOT=" + filepath.Dir(remotePath),
+			"GIT_HTTP_EXPORT_ALL=1",
+		},
+		// Rejected pushes are expected, and reported to the client
+		Stderr: io.Discard,
+	})
+	t.Cleanup(server.Close)
+	return server.URL + "/" + filepath.Base(remotePath)
+}
+
+// Partially clones the repository at url into a workspace
+func clonePartialForTest(t *testing.T, url string) string {
+	t.Helper()
+
+	clonePath, err := CloneRepository(CloneOptions{URL: url, Directory: "request", Partial: true})
+	if err != nil {
+		t.Fatalf("CloneRepository: %v", err)
+	}
+	return clonePath
+}
+
+func TestClonePartial(t *testing.T) {
+	useWorkspaceRoot(t)
+	url := newRemote(t, map[string]string{
+		"README.md":      "readme\n",
+		"docs/guide.md":  "guide\n",
+		".gitignore":     "*.log\n",
+		"large/data.bin": "data\n",
+	})
+	clonePath := clonePartialForTest(t, serveHTTP(t, url, true))
+
+	repo, err := gogit.PlainOpen(clonePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isPartial(repo) {
+		t.Fatal("the clone is not marked as a partial clone")
+	}
+	head, err := repo.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head.Name() != plumbing.NewBranchReferenceName(testBranch) {
+		t.Errorf("HEAD = %s, want the remote's default branch %s", head.Name(), testBranch)
+	}
+
+	// Trees come with the clone, blobs do not
+	tree, err := headTree(repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err := tree.FindEntry("large/data.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.Storer.EncodedObject(plumbing.BlobObject, entry.Hash); err == nil {
+		t.Error("the clone fetched a blob")
+	}
+	if _, err := os.Stat(filepath.Join(clonePath, "README.md")); !os.IsNotExist(err) {
+		t.Error("the clone checked out README.md")
+	}
+
+	// Listing the tree materializes only the pattern files
+	fileTree, err := ListFiles(clonePath, "")
+	if err != nil {
+		t.Fatalf("ListFiles: %v", err)
+	}
+	for _, path := range []string{"README.md", "docs/guide.md", "large/data.bin"} {
+		if fileTree.Find(path) == nil {
+			t.Errorf("%s is missing from the file tree", path)
+		}
+	}
+	if got, err := ReadFileContent(clonePath, ".gitignore"); err != nil || got != "*.log\n" {
+		t.Errorf(".gitignore = %q, %v; want it materialized", got, err)
+	}
+	if _, err := os.Stat(filepath.Join(clonePath, "README.md")); !os.IsNotExist(err) {
+		t.Error("listing the tree materialized README.md")
+	}
+}
+
+func TestClonePartialUnsupported(t *testing.T) {
+	useWorkspaceRoot(t)
+	url := serveHTTP(t, newRemote(t, map[string]string{"README.md": "readme\n"}), false)
+
+	_, err := CloneRepository(CloneOptions{URL: url, Directory: "request", Partial: true})
+	if !errors.Is(err, ErrPartialCloneUnsupported) {
+		t.Errorf("err = %v, want ErrPartialCloneUnsupported", err)
+	}
+}
+
+func TestMaterialize(t *testing.T) {
+	useWorkspaceRoot(t)
+	url := newRemote(t, map[string]string{
+		"README.md":     "readme\n",
+		"docs/guide.md": "guide\n",
+		"other.md":      "other\n",
+	})
+	clonePath := clonePartialForTest(t, serveHTTP(t, url, true))
+
+	paths := []string{"README.md", "docs/guide.md", "new.md", "../outside.md"}
+	if err := Materialize(clonePath, paths, ""); err != nil {
+		t.Fatalf("Materialize: %v", err)
+	}
+	for path, want := range map[string]string{"README.md": "readme\n", "docs/guide.md": "guide\n"} {
+		if got, err := ReadFileContent(clonePath, path); err != nil || got != want {
+			t.Errorf("%s = %q, %v; want %q", path, got, err, want)
+		}
+	}
+	for _, path := range []string{"new.md", "other.md"} {
+		if _, err := os.Stat(filepath.Join(clonePath, path)); !os.IsNotExist(err) {
+			t.Errorf("%s was materialized", path)
+		}
+	}
+
+	sparse, err := os.ReadFile(filepath.Join(clonePath, ".git", sparseCheckoutFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "/README.md\n/docs/guide.md\n"; string(sparse) != want {
+		t.Errorf("sparse-checkout = %q, want %q", sparse, want)
+	}
+
+	// Files already on disk keep their local changes
+	if err := WriteFile(clonePath, "README.md", "edited\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Materialize(clonePath, []string{"README.md"}, ""); err != nil {
+		t.Fatalf("Materialize: %v", err)
+	}
+	if got, _ := ReadFileContent(clonePath, "README.md"); got != "edited\n" {
+		t.Errorf("README.md = %q after materializing it again, want the local change", got)
+	}
+}
+
+// Partial clones of a fork fetch only upstream's tip, and materialize files
+// from upstream that the fork does not have yet
+func TestResetToUpstreamPartial(t *testing.T) {
+	useWorkspaceRoot(t)
+	files := map[string]string{"README.md": "readme\n"}
+	upstreamFileURL := newRemote(t, files)
+	upstreamURL := serveHTTP(t, upstreamFileURL, true)
+	forkURL := serveHTTP(t, newRemote(t, files), true)
+	newTip := pushCommit(t, upstreamFileURL, testBranch, map[string]string{"upstream.md": "upstream\n"})
+
+	clonePath := clonePartialForTest(t, forkURL)
+	if err := ResetToUpstream(clonePath, upstreamURL, testBranch, "", 0); err != nil {
+		t.Fatalf("ResetToUpstream: %v", err)
+	}
+
+	repo, err := gogit.PlainOpen(clonePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, err := repo.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head.Hash() != newTip {
+		t.Errorf("HEAD = %s, want upstream's tip %s", head.Hash(), newTip)
+	}
+	ref, err := repo.Reference(plumbing.NewRemoteReferenceName("upstream", testBranch), true)
+	if err != nil || ref.Hash() != newTip {
+		t.Errorf("upstream/%s = %v, %v; want %s", testBranch, ref, err, newTip)
+	}
+	if remotes := promisorRemotes(repo); len(remotes) != 2 || remotes[0].Name != "upstream" {
+		t.Errorf("promisor remotes = %v, want upstream then origin", remotes)
+	}
+
+	if err := Materialize(clonePath, []string{"upstream.md"}, ""); err != nil {
+		t.Fatalf("Materialize: %v", err)
+	}
+	if got, err := ReadFileContent(clonePath, "upstream.md"); err != nil || got != "upstream\n" {
+		t.Errorf("upstream.md = %q, %v; want upstream's content", got, err)
+	}
+}
+
+// A push from a partial clone leaves out upstream's base commit, which the
+// clone has no blobs to send, so it only succeeds once the fork has it
+func TestCommitAndPushPartial(t *testing.T) {
+	useWorkspaceRoot(t)
+	files := map[string]string{"README.md": "readme\n", "untouched.md": "untouched\n"}
+	upstreamFileURL := newRemote(t, files)
+	forkFileURL := newRemote(t, files)
+	upstreamURL := serveHTTP(t, upstreamFileURL, true)
+	forkURL := serveHTTP(t, forkFileURL, true)
+	pushCommit(t, upstreamFileURL, testBranch, map[string]string{"upstream.md": "upstream\n"})
+
+	branch := "auto-pr-bot/test"
+	change := func() error {
+		clonePath := clonePartialForTest(t, forkURL)
+		if err := ResetToUpstream(clonePath, upstreamURL, testBranch, "", 0); err != nil {
+			t.Fatalf("ResetToUpstream: %v", err)
+		}
+		if err := CreateAndCheckoutBranch(clonePath, branch); err != nil {
+			t.Fatalf("CreateAndCheckoutBranch: %v", err)
+		}
+		if err := Materialize(clonePath, []string{"README.md"}, ""); err != nil {
+			t.Fatalf("Materialize: %v", err)
+		}
+		if err := WriteFile(clonePath, "README.md", "changed\n"); err != nil {
+			t.Fatal(err)
+		}
+		return CommitAndPush(clonePath, branch, []Commit{{Message: "change"}}, "", CommitOptions{})
+	}
+
+	if err := change(); err == nil || !strings.Contains(err.Error(), "missing necessary objects") {
+		t.Fatalf("pushing to a fork that is behind upstream = %v, want missing objects", err)
+	}
+
+	// What syncing the fork does on GitHub
+	forkPath := strings.TrimPrefix(forkFileURL, "file://")
+	refSpec := "+refs/heads/" + testBranch + ":refs/heads/" + testBranch
+	if out, err := exec.Command("git", "-C", forkPath, "fetch", strings.TrimPrefix(upstreamFileURL, "file://"), refSpec).CombinedOutput(); err != nil {
+		t.Fatalf("sync fork: %v: %s", err, out)
+	}
+
+	if err := change(); err != nil {
+		t.Fatalf("push after syncing the fork: %v", err)
+	}
+	for path, want := range map[string]string{"README.md": "changed\n", "untouched.md": "untouched\n", "upstream.md": "upstream\n"} {
+		if got := remoteFile(t, forkFileURL, branch, path); got != want {
+			t.Errorf("%s on the fork = %q, want %q", path, got, want)
+		}
+	}
+}
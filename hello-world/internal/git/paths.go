@@ -0,0 +1,88 @@
+package git
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// PathError explains why a repository-relative path was refused
+type PathError struct {
+	Path   string
+	Reason string
+}
+
+func (e *PathError) Error() string {
+	return fmt.Sprintf("unsafe path %q: %s", e.Path, e.Reason)
+}
+
+func (e *PathError) Unwrap() error {
+	return ErrUnsafePath
+}
+
+// ResolvePath turns a repository-relative path chosen by the LLM into an
+// absolute path inside repoPath. It returns the canonical relative path
+// alongside it, so "./a//b.go" and "a/b.go" refer to the same file.
+// Absolute paths, paths escaping the repository, anything under .git and
+// paths that traverse a symlink are refused with a *PathError
+func ResolvePath(repoPath, relPath string) (string, string, error) {
+	cleaned, err := CleanPath(relPath)
+	if err != nil {
+		return "", "", err
+	}
+
+	// Walk the existing prefix with Lstat so neither a symlinked directory
+	// nor a symlinked file can redirect a read or write outside the clone
+	current := repoPath
+	for _, part := range strings.Split(cleaned, "/") {
+		current = filepath.Join(current, part)
+		info, err := os.Lstat(current)
+		if errors.Is(err, os.ErrNotExist) {
+			break
+		}
+		if err != nil {
+			return "", "", fmt.Errorf("failed to stat %s: %w", relPath, err)
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return "", "", &PathError{Path: relPath, Reason: "traverses a symlink"}
+		}
+	}
+
+	return filepath.Join(repoPath, filepath.FromSlash(cleaned)), cleaned, nil
+}
+
+// CleanPath applies the lexical checks of ResolvePath without looking at a
+// worktree, and returns the canonical slash-separated path
+func CleanPath(relPath string) (string, error) {
+	reject := func(reason string) (string, error) {
+		return "", &PathError{Path: relPath, Reason: reason}
+	}
+
+	if relPath == "" || strings.ContainsRune(relPath, 0) {
+		return reject("empty or contains NUL")
+	}
+
+	slashed := strings.ReplaceAll(relPath, `\`, "/")
+	if strings.HasPrefix(slashed, "/") || filepath.IsAbs(relPath) || filepath.VolumeName(relPath) != "" {
+		return reject("absolute path")
+	}
+
+	cleaned := filepath.Clean(filepath.FromSlash(slashed))
+	if cleaned == "." {
+		return reject("refers to the repository root")
+	}
+	if cleaned == ".." || strings.HasPrefix(cleaned, ".."+string(filepath.Separator)) {
+		return reject("escapes the repository")
+	}
+
+	for _, part := range strings.Split(cleaned, string(filepath.Separator)) {
+		// Case-insensitive filesystems resolve .GIT to the same directory
+		if strings.EqualFold(part, ".git") {
+			return reject("inside .git")
+		}
+	}
+
+	return filepath.ToSlash(cleaned), nil
+}
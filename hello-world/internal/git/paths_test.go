@@ -0,0 +1,102 @@
+package git
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolvePath(t *testing.T) {
+	repoPath := t.TempDir()
+	outside := t.TempDir()
+
+	for _, dir := range []string{"src", "real"} {
+		if err := os.MkdirAll(filepath.Join(repoPath, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(repoPath, "src", "main.go"), []byte("package main\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	links := map[string]string{
+		"linked":          outside,
+		"real/escape.txt": filepath.Join(outside, "secret.txt"),
+		"inside":          filepath.Join(repoPath, "src"),
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, filepath.Join(repoPath, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		relPath string
+		want    string
+		reason  string
+	}{
+		{name: "file", relPath: "src/main.go", want: "src/main.go"},
+		{name: "new file", relPath: "src/new/file.go", want: "src/new/file.go"},
+		{name: "redundant separators", relPath: "./src//main.go", want: "src/main.go"},
+		{name: "dot dot inside", relPath: "src/../README.md", want: "README.md"},
+		{name: "backslashes", relPath: `src\main.go`, want: "src/main.go"},
+		{name: "git-like name", relPath: "src/.gitignore", want: "src/.gitignore"},
+
+		{name: "empty", relPath: "", reason: "empty or contains NUL"},
+		{name: "NUL", relPath: "src/main.go\x00.txt", reason: "empty or contains NUL"},
+		{name: "absolute", relPath: "/etc/passwd", reason: "absolute path"},
+		{name: "absolute backslash", relPath: `\etc\passwd`, reason: "absolute path"},
+		{name: "root", relPath: ".", reason: "refers to the repository root"},
+		{name: "root after cleaning", relPath: "src/..", reason: "refers to the repository root"},
+		{name: "parent", relPath: "..", reason: "escapes the repository"},
+		{name: "escape", relPath: "../outside.txt", reason: "escapes the repository"},
+		{name: "escape after cleaning", relPath: "src/../../outside.txt", reason: "escapes the repository"},
+		{name: "git directory", relPath: ".git", reason: "inside .git"},
+		{name: "git config", relPath: ".git/config", reason: "inside .git"},
+		{name: "git config upper case", relPath: ".GIT/config", reason: "inside .git"},
+		{name: "nested git directory", relPath: "vendor/lib/.Git/hooks/pre-commit", reason: "inside .git"},
+		{name: "symlinked directory", relPath: "linked/secret.txt", reason: "traverses a symlink"},
+		{name: "symlinked file", relPath: "real/escape.txt", reason: "traverses a symlink"},
+		{name: "symlink inside the repository", relPath: "inside/main.go", reason: "traverses a symlink"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fullPath, cleaned, err := ResolvePath(repoPath, tt.relPath)
+			if tt.reason != "" {
+				var pathErr *PathError
+				if !errors.As(err, &pathErr) {
+					t.Fatalf("ResolvePath(%q) = %q, %v; want a *PathError", tt.relPath, cleaned, err)
+				}
+				if pathErr.Reason != tt.reason {
+					t.Errorf("reason = %q, want %q", pathErr.Reason, tt.reason)
+				}
+				if pathErr.Path != tt.relPath {
+					t.Errorf("path = %q, want %q", pathErr.Path, tt.relPath)
+				}
+				if !errors.Is(err, ErrUnsafePath) {
+					t.Errorf("errors.Is(%v, ErrUnsafePath) = false", err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("ResolvePath(%q) failed: %v", tt.relPath, err)
+			}
+			if cleaned != tt.want {
+				t.Errorf("cleaned = %q, want %q", cleaned, tt.want)
+			}
+			if want := filepath.Join(repoPath, filepath.FromSlash(tt.want)); fullPath != want {
+				t.Errorf("full path = %q, want %q", fullPath, want)
+			}
+		})
+	}
+}
+
+func TestPathErrorWrapped(t *testing.T) {
+	_, _, err := ResolvePath(t.TempDir(), "../x")
+	wrapped := &OpError{Op: "write", Err: err}
+	if !errors.Is(wrapped, ErrUnsafePath) {
+		t.Errorf("errors.Is(%v, ErrUnsafePath) = false through an *OpError", wrapped)
+	}
+}
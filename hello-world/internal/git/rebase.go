@@ -0,0 +1,197 @@
+package git
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// RebaseResult describes how RebaseOntoUpstream moved the working branch
+type RebaseResult struct {
+	OldBase string
+	NewBase string
+	// Conflicts are paths upstream changed as well. They are left with the
+	// new upstream content and need to be regenerated
+	Conflicts []string
+}
+
+func (r *RebaseResult) Moved() bool {
+	return r.OldBase != r.NewBase
+}
+
+// A modified file as it was on disk before the rebase. Deleted files are
+// removed again once the rebase has checked them out
+type savedFile struct {
+	content []byte
+	mode    os.FileMode
+	deleted bool
+}
+
+// RebaseOntoUpstream fetches the upstream base branch again and, if it moved
+// since ResetToUpstream, moves the working branch onto the new tip and
+// reapplies the uncommitted changes to paths. Paths that upstream changed in
+// the meantime are reported as conflicts instead of being reapplied. token
+// authenticates the fetches, which are limited to sizeLimit bytes like
+// ResetToUpstream's
+func RebaseOntoUpstream(repoPath, baseBranch, token string, sizeLimit int64, paths []string) (*RebaseResult, error) {
+	repo, err := gogit.PlainOpen(repoPath)
+	if err != nil {
+		return nil, opError("open", err)
+	}
+
+	head, err := repo.Head()
+	if err != nil {
+		return nil, opError("rebase", err)
+	}
+
+	newBase, err := fetchUpstream(repo, repoPath, baseBranch, token, sizeLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &RebaseResult{OldBase: head.Hash().String(), NewBase: newBase.String()}
+	if !result.Moved() {
+		return result, nil
+	}
+
+	oldTree, err := commitTree(repo, head.Hash())
+	if err != nil {
+		return nil, err
+	}
+	newTree, err := commitTree(repo, newBase)
+	if err != nil {
+		return nil, err
+	}
+
+	saved := make(map[string]savedFile)
+	for _, relPath := range paths {
+		if upstreamChanged(oldTree, newTree, relPath) {
+			result.Conflicts = append(result.Conflicts, relPath)
+			continue
+		}
+
+		fullPath := filepath.Join(repoPath, relPath)
+		info, err := os.Lstat(fullPath)
+		if errors.Is(err, os.ErrNotExist) {
+			// A new file that was dropped again has nothing to restore
+			if _, err := oldTree.FindEntry(relPath); err == nil {
+				saved[relPath] = savedFile{deleted: true}
+			}
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat %s: %w", relPath, err)
+		}
+		content, err := os.ReadFile(fullPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", relPath, err)
+		}
+		saved[relPath] = savedFile{content: content, mode: info.Mode().Perm()}
+	}
+
+	if isPartial(repo) {
+		err = rebasePartial(repo, repoPath, oldTree, newTree, newBase, saved, token)
+	} else {
+		err = rebaseFull(repo, newBase)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for relPath, file := range saved {
+		fullPath := filepath.Join(repoPath, relPath)
+		if file.deleted {
+			if err := os.Remove(fullPath); err != nil && !os.IsNotExist(err) {
+				return nil, fmt.Errorf("failed to delete %s again: %w", relPath, err)
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+			return nil, fmt.Errorf("failed to restore %s: %w", relPath, err)
+		}
+		if err := os.WriteFile(fullPath, file.content, file.mode); err != nil {
+			return nil, fmt.Errorf("failed to restore %s: %w", relPath, err)
+		}
+	}
+
+	return result, nil
+}
+
+func rebaseFull(repo *gogit.Repository, newBase plumbing.Hash) error {
+	worktree, err := repo.Worktree()
+	if err != nil {
+		return opError("rebase", err)
+	}
+
+	if err := worktree.Reset(&gogit.ResetOptions{Commit: newBase, Mode: gogit.HardReset}); err != nil {
+		return opError("rebase", err)
+	}
+	return nil
+}
+
+// Only materialized files exist on disk, so after moving the branch and index
+// every one of them that upstream changed is fetched again. Otherwise staging
+// the worktree would commit the old content back
+func rebasePartial(repo *gogit.Repository, repoPath string, oldTree, newTree *object.Tree, newBase plumbing.Hash, saved map[string]savedFile, token string) error {
+	if err := resetIndex(repo, newBase); err != nil {
+		return err
+	}
+
+	var stale []string
+	err := filepath.Walk(repoPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if info.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		relPath, err := filepath.Rel(repoPath, path)
+		if err != nil {
+			return err
+		}
+		relPath = filepath.ToSlash(relPath)
+		if _, ok := saved[relPath]; ok || !upstreamChanged(oldTree, newTree, relPath) {
+			return nil
+		}
+
+		stale = append(stale, relPath)
+		return os.Remove(path)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to refresh materialized files: %w", err)
+	}
+
+	return Materialize(repoPath, stale, token)
+}
+
+func commitTree(repo *gogit.Repository, hash plumbing.Hash) (*object.Tree, error) {
+	commit, err := repo.CommitObject(hash)
+	if err != nil {
+		return nil, opError("rebase", err)
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, opError("rebase", err)
+	}
+	return tree, nil
+}
+
+// Reports whether relPath differs between the two trees, including being
+// added or removed
+func upstreamChanged(oldTree, newTree *object.Tree, relPath string) bool {
+	oldEntry, oldErr := oldTree.FindEntry(relPath)
+	newEntry, newErr := newTree.FindEntry(relPath)
+	if oldErr != nil || newErr != nil {
+		return (oldErr == nil) != (newErr == nil)
+	}
+	return oldEntry.Hash != newEntry.Hash || oldEntry.Mode != newEntry.Mode
+}
@@ -0,0 +1,114 @@
+package git
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	gogit "github.com/go-git/go-git/v5"
+)
+
+// Clones a copy of upstream and resets it to upstream, as requests do
+func cloneForRebase(t *testing.T, files map[string]string) (string, string) {
+	t.Helper()
+
+	useWorkspaceRoot(t)
+	upstreamURL := newRemote(t, files)
+	forkURL := newRemote(t, files)
+	clonePath := clone(t, forkURL)
+	if err := ResetToUpstream(clonePath, upstreamURL, testBranch, "", 0); err != nil {
+		t.Fatalf("ResetToUpstream: %v", err)
+	}
+	return clonePath, upstreamURL
+}
+
+func TestRebaseOntoUpstream(t *testing.T) {
+	clonePath, upstreamURL := cloneForRebase(t, map[string]string{
+		"edited.txt":     "base\n",
+		"conflict.txt":   "base\n",
+		"deleted.txt":    "base\n",
+		"untouched.txt":  "base\n",
+		"upstreamed.txt": "base\n",
+	})
+
+	for path, content := range map[string]string{
+		"edited.txt":   "ours\n",
+		"conflict.txt": "ours\n",
+		"added.txt":    "ours\n",
+	} {
+		if err := WriteFile(clonePath, path, content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Remove(filepath.Join(clonePath, "deleted.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	newTip := pushCommit(t, upstreamURL, testBranch, map[string]string{
+		"conflict.txt":   "theirs\n",
+		"upstreamed.txt": "theirs\n",
+		"new.txt":        "theirs\n",
+	})
+
+	paths := []string{"edited.txt", "conflict.txt", "deleted.txt", "added.txt"}
+	result, err := RebaseOntoUpstream(clonePath, testBranch, "", 0, paths)
+	if err != nil {
+		t.Fatalf("RebaseOntoUpstream: %v", err)
+	}
+	if !result.Moved() || result.NewBase != newTip.String() {
+		t.Errorf("result = %+v, want a move to %s", result, newTip)
+	}
+	if want := []string{"conflict.txt"}; !reflect.DeepEqual(result.Conflicts, want) {
+		t.Errorf("conflicts = %v, want %v", result.Conflicts, want)
+	}
+
+	repo, err := gogit.PlainOpen(clonePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, err := repo.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head.Hash() != newTip {
+		t.Errorf("HEAD = %s, want upstream's tip %s", head.Hash(), newTip)
+	}
+
+	// Changes upstream did not touch are kept; conflicts get upstream's
+	// content to be regenerated from
+	for path, want := range map[string]string{
+		"edited.txt":     "ours\n",
+		"added.txt":      "ours\n",
+		"conflict.txt":   "theirs\n",
+		"upstreamed.txt": "theirs\n",
+		"new.txt":        "theirs\n",
+		"untouched.txt":  "base\n",
+	} {
+		got, err := ReadFileContent(clonePath, path)
+		if err != nil || got != want {
+			t.Errorf("%s = %q, %v; want %q", path, got, err, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(clonePath, "deleted.txt")); !os.IsNotExist(err) {
+		t.Errorf("deleted.txt was brought back by the rebase")
+	}
+}
+
+func TestRebaseOntoUpstreamNotMoved(t *testing.T) {
+	clonePath, _ := cloneForRebase(t, map[string]string{"README.md": "base\n"})
+	if err := WriteFile(clonePath, "README.md", "ours\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := RebaseOntoUpstream(clonePath, testBranch, "", 0, []string{"README.md"})
+	if err != nil {
+		t.Fatalf("RebaseOntoUpstream: %v", err)
+	}
+	if result.Moved() || len(result.Conflicts) > 0 {
+		t.Errorf("result = %+v, want no move and no conflicts", result)
+	}
+	if got, err := ReadFileContent(clonePath, "README.md"); err != nil || got != "ours\n" {
+		t.Errorf("README.md = %q, %v; want the uncommitted change", got, err)
+	}
+}
@@ -0,0 +1,277 @@
+package git
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	defaultAuthorName  = "Auto PR Bot"
+	defaultAuthorEmail = "auto-pr-bot@users.noreply.github.com"
+
+	// Namespace git uses for SSH commit signatures
+	sshSignatureNamespace = "git"
+)
+
+// CommitConfig is the deployment-wide commit identity, signing key and
+// trailer policy, loaded once from the environment
+type CommitConfig struct {
+	AuthorName  string
+	AuthorEmail string
+	Signer      gogit.Signer
+
+	SignOff          bool
+	CoAuthor         bool
+	RequestIDTrailer bool
+
+	// Squash makes one commit per request instead of one per logical change set
+	Squash bool
+}
+
+// CommitOptions controls how CommitAndPush creates its commit
+type CommitOptions struct {
+	AuthorName  string
+	AuthorEmail string
+	// Signer signs the commit when set; see LoadCommitConfig
+	Signer gogit.Signer
+	// Trailers are "Key: value" lines appended to the commit message
+	Trailers []string
+}
+
+// LoadCommitConfig reads the commit settings:
+//   - COMMIT_AUTHOR_NAME / COMMIT_AUTHOR_EMAIL: author and committer identity
+//   - COMMIT_SIGNING_KEY: armored OpenPGP or OpenSSH private key
+//   - COMMIT_SIGNING_KEY_PASSPHRASE: passphrase for an encrypted key
+//   - COMMIT_TRAILERS: comma-separated subset of signoff, co-author, request-id
+//   - COMMIT_STRATEGY: split (default) or squash
+func LoadCommitConfig() (*CommitConfig, error) {
+	cfg := &CommitConfig{
+		AuthorName:  defaultAuthorName,
+		AuthorEmail: defaultAuthorEmail,
+	}
+
+	if name := os.Getenv("COMMIT_AUTHOR_NAME"); name != "" {
+		cfg.AuthorName = name
+	}
+	if email := os.Getenv("COMMIT_AUTHOR_EMAIL"); email != "" {
+		cfg.AuthorEmail = email
+	}
+
+	if key := os.Getenv("COMMIT_SIGNING_KEY"); key != "" {
+		signer, err := NewSigner([]byte(key), []byte(os.Getenv("COMMIT_SIGNING_KEY_PASSPHRASE")))
+		if err != nil {
+			return nil, fmt.Errorf("failed to load commit signing key: %w", err)
+		}
+		cfg.Signer = signer
+	}
+
+	for _, trailer := range strings.Split(os.Getenv("COMMIT_TRAILERS"), ",") {
+		switch strings.TrimSpace(trailer) {
+		case "":
+		case "signoff":
+			cfg.SignOff = true
+		case "co-author":
+			cfg.CoAuthor = true
+		case "request-id":
+			cfg.RequestIDTrailer = true
+		default:
+			return nil, fmt.Errorf("unknown commit trailer %q", trailer)
+		}
+	}
+
+	switch strategy := os.Getenv("COMMIT_STRATEGY"); strategy {
+	case "", "split":
+	case "squash":
+		cfg.Squash = true
+	default:
+		return nil, fmt.Errorf("unknown commit strategy %q", strategy)
+	}
+
+	return cfg, nil
+}
+
+// CommitOptions builds the options for one commit. coAuthor is a
+// "Name <email>" identity and requestID the bot's request ID; either is only
+// used when the matching trailer is enabled and the value is non-empty
+func (c *CommitConfig) CommitOptions(coAuthor, requestID string) CommitOptions {
+	opts := CommitOptions{
+		AuthorName:  c.AuthorName,
+		AuthorEmail: c.AuthorEmail,
+		Signer:      c.Signer,
+	}
+
+	if c.SignOff {
+		opts.Trailers = append(opts.Trailers, fmt.Sprintf("Signed-off-by: %s <%s>", c.AuthorName, c.AuthorEmail))
+	}
+	if c.CoAuthor && coAuthor != "" {
+		opts.Trailers = append(opts.Trailers, "Co-authored-by: "+coAuthor)
+	}
+	if c.RequestIDTrailer && requestID != "" {
+		opts.Trailers = append(opts.Trailers, "Auto-PR-Request-Id: "+requestID)
+	}
+
+	return opts
+}
+
+// Signature is the author and committer identity for a commit made now
+func (o CommitOptions) Signature() *object.Signature {
+	signature := &object.Signature{
+		Name:  o.AuthorName,
+		Email: o.AuthorEmail,
+		When:  time.Now(),
+	}
+	if signature.Name == "" {
+		signature.Name = defaultAuthorName
+	}
+	if signature.Email == "" {
+		signature.Email = defaultAuthorEmail
+	}
+	return signature
+}
+
+// Message returns message with the trailers appended
+func (o CommitOptions) Message(message string) string {
+	return appendTrailers(message, o.Trailers)
+}
+
+// Appends trailers as the final paragraph of the message
+func appendTrailers(message string, trailers []string) string {
+	if len(trailers) == 0 {
+		return message
+	}
+	return strings.TrimRight(message, "\n") + "\n\n" + strings.Join(trailers, "\n") + "\n"
+}
+
+// NewSigner returns a commit signer for an armored OpenPGP private key or an
+// OpenSSH private key, decrypting it with passphrase if needed
+func NewSigner(key, passphrase []byte) (gogit.Signer, error) {
+	if bytes.Contains(key, []byte("BEGIN PGP PRIVATE KEY BLOCK")) {
+		return newGPGSigner(key, passphrase)
+	}
+	return newSSHSigner(key, passphrase)
+}
+
+type gpgSigner struct {
+	entity *openpgp.Entity
+}
+
+func newGPGSigner(key, passphrase []byte) (*gpgSigner, error) {
+	entities, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(key))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse OpenPGP key: %w", err)
+	}
+	if len(entities) == 0 || entities[0].PrivateKey == nil {
+		return nil, fmt.Errorf("OpenPGP key contains no private key")
+	}
+
+	entity := entities[0]
+	if entity.PrivateKey.Encrypted {
+		if err := entity.PrivateKey.Decrypt(passphrase); err != nil {
+			return nil, fmt.Errorf("failed to decrypt OpenPGP key: %w", err)
+		}
+	}
+	for _, subkey := range entity.Subkeys {
+		if subkey.PrivateKey != nil && subkey.PrivateKey.Encrypted {
+			if err := subkey.PrivateKey.Decrypt(passphrase); err != nil {
+				return nil, fmt.Errorf("failed to decrypt OpenPGP subkey: %w", err)
+			}
+		}
+	}
+
+	return &gpgSigner{entity: entity}, nil
+}
+
+func (s *gpgSigner) Sign(message io.Reader) ([]byte, error) {
+	var signature bytes.Buffer
+	if err := openpgp.ArmoredDetachSign(&signature, s.entity, message, nil); err != nil {
+		return nil, err
+	}
+	return signature.Bytes(), nil
+}
+
+// Produces SSHSIG signatures as described in OpenSSH's PROTOCOL.sshsig,
+// which is what `git commit -S` writes with gpg.format=ssh
+type sshSigner struct {
+	signer ssh.Signer
+}
+
+func newSSHSigner(key, passphrase []byte) (*sshSigner, error) {
+	var signer ssh.Signer
+	var err error
+	if len(passphrase) > 0 {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(key, passphrase)
+	} else {
+		signer, err = ssh.ParsePrivateKey(key)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse SSH key: %w", err)
+	}
+	return &sshSigner{signer: signer}, nil
+}
+
+func (s *sshSigner) Sign(message io.Reader) ([]byte, error) {
+	hash := sha512.New()
+	if _, err := io.Copy(hash, message); err != nil {
+		return nil, err
+	}
+
+	signedData := sshsigEnvelope()
+	writeSSHString(signedData, []byte(sshSignatureNamespace))
+	writeSSHString(signedData, nil) // reserved
+	writeSSHString(signedData, []byte("sha512"))
+	writeSSHString(signedData, hash.Sum(nil))
+
+	var signature *ssh.Signature
+	var err error
+	if algorithmSigner, ok := s.signer.(ssh.AlgorithmSigner); ok && s.signer.PublicKey().Type() == ssh.KeyAlgoRSA {
+		// SHA-1 RSA signatures are rejected by current verifiers
+		signature, err = algorithmSigner.SignWithAlgorithm(rand.Reader, signedData.Bytes(), ssh.KeyAlgoRSASHA512)
+	} else {
+		signature, err = s.signer.Sign(rand.Reader, signedData.Bytes())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	blob := sshsigEnvelope()
+	binary.Write(blob, binary.BigEndian, uint32(1)) // version
+	writeSSHString(blob, s.signer.PublicKey().Marshal())
+	writeSSHString(blob, []byte(sshSignatureNamespace))
+	writeSSHString(blob, nil) // reserved
+	writeSSHString(blob, []byte("sha512"))
+	writeSSHString(blob, ssh.Marshal(signature))
+
+	encoded := base64.StdEncoding.EncodeToString(blob.Bytes())
+	var armored strings.Builder
+	armored.WriteString("-----BEGIN SSH SIGNATURE-----\n")
+	for len(encoded) > 70 {
+		armored.WriteString(encoded[:70] + "\n")
+		encoded = encoded[70:]
+	}
+	armored.WriteString(encoded + "\n")
+	armored.WriteString("-----END SSH SIGNATURE-----\n")
+
+	return []byte(armored.String()), nil
+}
+
+func sshsigEnvelope() *bytes.Buffer {
+	return bytes.NewBufferString("SSHSIG")
+}
+
+func writeSSHString(buf *bytes.Buffer, value []byte) {
+	binary.Write(buf, binary.BigEndian, uint32(len(value)))
+	buf.Write(value)
+}
@@ -0,0 +1,479 @@
+package git
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-git/v5/plumbing/format/gitattributes"
+	"github.com/go-git/go-git/v5/plumbing/format/gitignore"
+)
+
+const (
+	// Git's own heuristic: a NUL byte in the first 8000 bytes means binary
+	binarySniffLength = 8000
+
+	// Directories with more direct files than this get their files
+	// summarized in the compact rendering
+	compactFileLimit = 40
+)
+
+// FileNode is a file or directory in a repository tree. Paths are relative
+// to the repository root and always use forward slashes
+type FileNode struct {
+	Name      string      `json:"name"`
+	Path      string      `json:"path"`
+	Dir       bool        `json:"dir,omitempty"`
+	Size      int64       `json:"size,omitempty"`
+	Language  string      `json:"language,omitempty"`
+	Binary    bool        `json:"binary,omitempty"`
+	Generated bool        `json:"generated,omitempty"`
+	Vendored  bool        `json:"vendored,omitempty"`
+	Ignored   bool        `json:"ignored,omitempty"`
+	Children  []*FileNode `json:"children,omitempty"`
+}
+
+// FileTree is the structured listing returned by ListFiles
+type FileTree struct {
+	Root *FileNode
+
+	nodes      map[string]*FileNode
+	ignore     gitignore.Matcher
+	attributes gitattributes.Matcher
+}
+
+var (
+	// Path prefixes treated as vendored unless .gitattributes says otherwise,
+	// mirroring GitHub linguist's defaults
+	vendoredDirs = []string{
+		"node_modules", "vendor", "third_party", "bower_components",
+		"Godeps", ".yarn", "Pods", "Carthage",
+	}
+
+	// Directories that usually hold build output
+	generatedDirs = []string{"dist", "target", "__pycache__", ".next"}
+
+	generatedSuffixes = []string{
+		".min.js", ".min.css", ".map", ".pb.go", "_pb2.py", ".pb.cc", ".pb.h",
+		".generated.go", ".g.dart", ".designer.cs",
+	}
+
+	generatedNames = map[string]bool{
+		"package-lock.json": true, "yarn.lock": true, "pnpm-lock.yaml": true,
+		"go.sum": true, "Cargo.lock": true, "composer.lock": true,
+		"Gemfile.lock": true, "poetry.lock": true,
+	}
+
+	binaryExtensions = map[string]bool{
+		".png": true, ".jpg": true, ".jpeg": true, ".gif": true, ".ico": true,
+		".webp": true, ".bmp": true, ".pdf": true, ".zip": true, ".gz": true,
+		".tgz": true, ".tar": true, ".jar": true, ".war": true, ".class": true,
+		".so": true, ".dll": true, ".dylib": true, ".exe": true, ".o": true,
+		".a": true, ".woff": true, ".woff2": true, ".ttf": true, ".otf": true,
+		".eot": true, ".mp3": true, ".mp4": true, ".mov": true, ".wasm": true,
+		".pyc": true, ".bin": true,
+	}
+
+	languages = map[string]string{
+		".go": "Go", ".js": "JavaScript", ".mjs": "JavaScript", ".cjs": "JavaScript",
+		".jsx": "JavaScript", ".ts": "TypeScript", ".tsx": "TypeScript",
+		".py": "Python", ".rb": "Ruby", ".java": "Java", ".kt": "Kotlin",
+		".swift": "Swift", ".rs": "Rust", ".c": "C", ".h": "C", ".cc": "C++",
+		".cpp": "C++", ".hpp": "C++", ".cs": "C#", ".php": "PHP", ".scala": "Scala",
+		".sh": "Shell", ".bash": "Shell", ".ps1": "PowerShell", ".lua": "Lua",
+		".dart": "Dart", ".ex": "Elixir", ".exs": "Elixir", ".hs": "Haskell",
+		".html": "HTML", ".css": "CSS", ".scss": "SCSS", ".vue": "Vue",
+		".svelte": "Svelte", ".sql": "SQL", ".md": "Markdown", ".rst": "reStructuredText",
+		".json": "JSON", ".yaml": "YAML", ".yml": "YAML", ".toml": "TOML",
+		".xml": "XML", ".proto": "Protocol Buffers", ".tf": "HCL",
+	}
+
+	languageNames = map[string]string{
+		"Dockerfile": "Dockerfile", "Makefile": "Makefile", "Gemfile": "Ruby",
+		"Rakefile": "Ruby", "Jenkinsfile": "Groovy",
+	}
+)
+
+// Loads .gitignore and .gitattributes from the worktree at rootPath. Files
+// that are missing (e.g. not yet materialized) simply contribute no patterns
+func newFileTree(rootPath string) *FileTree {
+	fs := osfs.New(rootPath)
+
+	ignorePatterns, err := gitignore.ReadPatterns(fs, nil)
+	if err != nil {
+		ignorePatterns = nil
+	}
+
+	attributePatterns, err := gitattributes.ReadPatterns(fs, nil)
+	if err != nil {
+		attributePatterns = nil
+	}
+
+	return newFileTreeWithPatterns(ignorePatterns, attributePatterns)
+}
+
+func newFileTreeWithPatterns(ignorePatterns []gitignore.Pattern, attributePatterns []gitattributes.MatchAttribute) *FileTree {
+	root := &FileNode{Dir: true}
+	return &FileTree{
+		Root:       root,
+		nodes:      map[string]*FileNode{"": root},
+		ignore:     gitignore.NewMatcher(ignorePatterns),
+		attributes: gitattributes.NewMatcher(attributePatterns),
+	}
+}
+
+// TreeFile is a file listed without a worktree, e.g. through the GitHub API
+type TreeFile struct {
+	Path string
+	Size int64
+}
+
+// BuildFileTree classifies files listed without a worktree. patternFiles
+// maps the paths of .gitignore and .gitattributes files to their content
+func BuildFileTree(files []TreeFile, patternFiles map[string][]byte) *FileTree {
+	var ignorePatterns []gitignore.Pattern
+	var attributePatterns []gitattributes.MatchAttribute
+
+	// Sorted so patterns in deeper directories come later and take precedence
+	names := make([]string, 0, len(patternFiles))
+	for name := range patternFiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		var domain []string
+		if dir := path.Dir(name); dir != "." {
+			domain = strings.Split(dir, "/")
+		}
+
+		switch path.Base(name) {
+		case ".gitignore":
+			for _, line := range strings.Split(string(patternFiles[name]), "\n") {
+				line = strings.TrimRight(line, "\r")
+				if line != "" && !strings.HasPrefix(line, "#") {
+					ignorePatterns = append(ignorePatterns, gitignore.ParsePattern(line, domain))
+				}
+			}
+		case ".gitattributes":
+			attrs, err := gitattributes.ReadAttributes(bytes.NewReader(patternFiles[name]), domain, true)
+			if err == nil {
+				attributePatterns = append(attributePatterns, attrs...)
+			}
+		}
+	}
+
+	tree := newFileTreeWithPatterns(ignorePatterns, attributePatterns)
+	for _, file := range files {
+		tree.addFile(file.Path, file.Size, func() []byte { return nil })
+	}
+	return tree
+}
+
+// Adds a file and any missing parent directories. sniff returns the start of
+// the file for binary detection, or nil when the content is not available
+func (t *FileTree) addFile(relPath string, size int64, sniff func() []byte) *FileNode {
+	parent := t.addDir(path.Dir(relPath))
+
+	node := &FileNode{
+		Name: path.Base(relPath),
+		Path: relPath,
+		Size: size,
+	}
+	t.classify(node, parent)
+
+	if !node.Binary && !node.Generated && !node.Vendored {
+		if head := sniff(); head != nil {
+			node.Binary = bytes.IndexByte(head, 0) != -1
+		}
+	}
+	if !node.Binary {
+		node.Language = detectLanguage(node.Name)
+	}
+
+	parent.Children = append(parent.Children, node)
+	t.nodes[relPath] = node
+	return node
+}
+
+func (t *FileTree) addDir(relPath string) *FileNode {
+	if relPath == "." {
+		relPath = ""
+	}
+	if node, ok := t.nodes[relPath]; ok {
+		return node
+	}
+
+	parent := t.addDir(path.Dir(relPath))
+	node := &FileNode{
+		Name: path.Base(relPath),
+		Path: relPath,
+		Dir:  true,
+	}
+	t.classify(node, parent)
+
+	parent.Children = append(parent.Children, node)
+	t.nodes[relPath] = node
+	return node
+}
+
+// Applies path defaults first and lets .gitattributes linguist attributes
+// override them, the same precedence GitHub uses
+func (t *FileTree) classify(node, parent *FileNode) {
+	node.Ignored = parent.Ignored || t.ignore.Match(strings.Split(node.Path, "/"), node.Dir)
+	node.Vendored = parent.Vendored
+	node.Generated = parent.Generated
+
+	if node.Dir {
+		node.Vendored = node.Vendored || containsString(vendoredDirs, node.Name)
+		node.Generated = node.Generated || containsString(generatedDirs, node.Name)
+	} else {
+		node.Generated = node.Generated || generatedNames[node.Name] || hasAnySuffix(node.Name, generatedSuffixes)
+		node.Binary = binaryExtensions[strings.ToLower(path.Ext(node.Name))]
+	}
+
+	attrs, _ := t.attributes.Match(strings.Split(node.Path, "/"),
+		[]string{"linguist-vendored", "linguist-generated", "binary", "text"})
+	if attr, ok := attrs["linguist-vendored"]; ok {
+		node.Vendored = attributeEnabled(attr)
+	}
+	if attr, ok := attrs["linguist-generated"]; ok {
+		node.Generated = attributeEnabled(attr)
+	}
+	if attr, ok := attrs["binary"]; ok && attr.IsSet() && !node.Dir {
+		node.Binary = true
+	}
+	if attr, ok := attrs["text"]; ok && attr.IsUnset() && !node.Dir {
+		node.Binary = true
+	}
+}
+
+// Find returns the node at relPath, or nil if it is not in the tree
+func (t *FileTree) Find(relPath string) *FileNode {
+	return t.nodes[path.Clean(strings.TrimPrefix(relPath, "/"))]
+}
+
+// Subtree returns the part of the tree under dir. Paths stay relative to the
+// repository root, so dir's ancestors are kept, each with dir's branch as
+// its only child. Returns nil if dir is not a directory in the tree
+func (t *FileTree) Subtree(dir string) *FileTree {
+	node := t.Find(dir)
+	if node == nil || !node.Dir {
+		return nil
+	}
+
+	sub := &FileTree{
+		nodes:      make(map[string]*FileNode),
+		ignore:     t.ignore,
+		attributes: t.attributes,
+	}
+	var register func(node *FileNode)
+	register = func(node *FileNode) {
+		sub.nodes[node.Path] = node
+		for _, child := range node.Children {
+			register(child)
+		}
+	}
+	register(node)
+
+	// Copies of the ancestors lead from the root to dir
+	for child := node; ; {
+		parentPath := path.Dir(child.Path)
+		if parentPath == "." {
+			parentPath = ""
+		}
+		parent := *t.nodes[parentPath]
+		parent.Children = []*FileNode{child}
+		sub.nodes[parentPath] = &parent
+		if parentPath == "" {
+			sub.Root = &parent
+			return sub
+		}
+		child = &parent
+	}
+}
+
+// Editable reports whether the bot may modify relPath. Paths that are not in
+// the tree are new files and allowed
+func (t *FileTree) Editable(relPath string) bool {
+	node := t.Find(relPath)
+	if node == nil {
+		return true
+	}
+	return !node.Dir && !node.Binary && !node.Generated && !node.Vendored && !node.Ignored
+}
+
+// JSON renders the full tree including all metadata
+func (t *FileTree) JSON() ([]byte, error) {
+	return json.Marshal(t.Root.Children)
+}
+
+// Indented renders every file and directory, one per line, indented by depth
+func (t *FileTree) Indented() string {
+	var builder strings.Builder
+	var walk func(nodes []*FileNode, depth int)
+	walk = func(nodes []*FileNode, depth int) {
+		indent := strings.Repeat("  ", depth)
+		for _, node := range nodes {
+			if node.Dir {
+				builder.WriteString(fmt.Sprintf("%s%s/\n", indent, node.Name))
+				walk(node.Children, depth+1)
+			} else {
+				builder.WriteString(fmt.Sprintf("%s%s\n", indent, node.Name))
+			}
+		}
+	}
+	walk(t.Root.Children, 0)
+	return builder.String()
+}
+
+// Compact renders the tree for LLM prompts: ignored paths are dropped,
+// vendored and generated directories collapse to a single line, and
+// directories with many files summarize them by language
+func (t *FileTree) Compact() string {
+	var builder strings.Builder
+	var walk func(nodes []*FileNode, depth int)
+	walk = func(nodes []*FileNode, depth int) {
+		indent := strings.Repeat("  ", depth)
+
+		var files []*FileNode
+		for _, node := range nodes {
+			if node.Ignored {
+				continue
+			}
+			if !node.Dir {
+				files = append(files, node)
+				continue
+			}
+
+			if node.Vendored || node.Generated {
+				builder.WriteString(fmt.Sprintf("%s%s/ [%s, %d files]\n", indent, node.Name, nodeTags(node), countFiles(node)))
+				continue
+			}
+			builder.WriteString(fmt.Sprintf("%s%s/\n", indent, node.Name))
+			walk(node.Children, depth+1)
+		}
+
+		if len(files) > compactFileLimit {
+			builder.WriteString(fmt.Sprintf("%s... %d files (%s)\n", indent, len(files), summarizeLanguages(files)))
+			return
+		}
+		for _, file := range files {
+			if tags := nodeTags(file); tags != "" {
+				builder.WriteString(fmt.Sprintf("%s%s [%s]\n", indent, file.Name, tags))
+			} else {
+				builder.WriteString(fmt.Sprintf("%s%s\n", indent, file.Name))
+			}
+		}
+	}
+	walk(t.Root.Children, 0)
+	return builder.String()
+}
+
+func nodeTags(node *FileNode) string {
+	var tags []string
+	if node.Vendored {
+		tags = append(tags, "vendored")
+	}
+	if node.Generated {
+		tags = append(tags, "generated")
+	}
+	if node.Binary {
+		tags = append(tags, "binary")
+	}
+	return strings.Join(tags, ", ")
+}
+
+func countFiles(node *FileNode) int {
+	if !node.Dir {
+		return 1
+	}
+	count := 0
+	for _, child := range node.Children {
+		count += countFiles(child)
+	}
+	return count
+}
+
+func summarizeLanguages(files []*FileNode) string {
+	counts := make(map[string]int)
+	for _, file := range files {
+		language := file.Language
+		if file.Binary {
+			language = "binary"
+		} else if language == "" {
+			language = "other"
+		}
+		counts[language]++
+	}
+
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if counts[names[i]] != counts[names[j]] {
+			return counts[names[i]] > counts[names[j]]
+		}
+		return names[i] < names[j]
+	})
+
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		parts = append(parts, fmt.Sprintf("%s: %d", name, counts[name]))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func detectLanguage(name string) string {
+	if language, ok := languageNames[name]; ok {
+		return language
+	}
+	return languages[strings.ToLower(path.Ext(name))]
+}
+
+func attributeEnabled(attr gitattributes.Attribute) bool {
+	if attr.IsValueSet() {
+		value := strings.ToLower(attr.Value())
+		return value != "false" && value != "0"
+	}
+	return attr.IsSet()
+}
+
+// Reads the first bytes of a file on disk for binary detection
+func sniffFile(fullPath string) func() []byte {
+	return func() []byte {
+		file, err := os.Open(fullPath)
+		if err != nil {
+			return nil
+		}
+		defer file.Close()
+
+		head := make([]byte, binarySniffLength)
+		n, _ := file.Read(head)
+		return head[:n]
+	}
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+func hasAnySuffix(name string, suffixes []string) bool {
+	for _, suffix := range suffixes {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
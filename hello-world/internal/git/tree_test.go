@@ -0,0 +1,87 @@
+package git
+
+import (
+	"testing"
+)
+
+func TestSubtree(t *testing.T) {
+	tree := BuildFileTree([]TreeFile{
+		{Path: "README.md", Size: 10},
+		{Path: "services/api/main.go", Size: 10},
+		{Path: "services/api/handler/handler.go", Size: 10},
+		{Path: "services/web/index.html", Size: 10},
+		{Path: "docs/guide.md", Size: 10},
+	}, nil)
+
+	sub := tree.Subtree("services/api")
+	if sub == nil {
+		t.Fatal("Subtree(services/api) = nil")
+	}
+
+	// The ancestors lead from the root to the directory, and nowhere else
+	if got := childPaths(sub.Root); len(got) != 1 || got[0] != "services" {
+		t.Errorf("children of the root = %v, want only services", got)
+	}
+	services := sub.Find("services")
+	if services == nil {
+		t.Fatal("services is missing from the subtree")
+	}
+	if len(sub.Root.Children) > 0 && sub.Root.Children[0] != services {
+		t.Error("the root's child is not the subtree's services node")
+	}
+	if got := childPaths(services); len(got) != 1 || got[0] != "services/api" {
+		t.Errorf("children of services = %v, want only services/api", got)
+	}
+
+	for _, path := range []string{"services/api", "services/api/main.go", "services/api/handler", "services/api/handler/handler.go"} {
+		if sub.Find(path) == nil {
+			t.Errorf("%s is missing from the subtree", path)
+		}
+	}
+	for _, path := range []string{"README.md", "docs", "docs/guide.md", "services/web", "services/web/index.html"} {
+		if sub.Find(path) != nil {
+			t.Errorf("%s is outside the directory but in the subtree", path)
+		}
+	}
+
+	// The original tree keeps all of its children
+	if got := childPaths(tree.Find("services")); len(got) != 2 {
+		t.Errorf("children of services in the full tree = %v, want api and web", got)
+	}
+	if got := childPaths(tree.Root); len(got) != 3 {
+		t.Errorf("children of the root in the full tree = %v, want three", got)
+	}
+}
+
+func TestSubtreeTopLevel(t *testing.T) {
+	tree := BuildFileTree([]TreeFile{{Path: "docs/guide.md"}, {Path: "src/main.go"}}, nil)
+
+	sub := tree.Subtree("docs")
+	if sub == nil {
+		t.Fatal("Subtree(docs) = nil")
+	}
+	if got := childPaths(sub.Root); len(got) != 1 || got[0] != "docs" {
+		t.Errorf("children of the root = %v, want only docs", got)
+	}
+	if sub.Find("docs/guide.md") == nil {
+		t.Error("docs/guide.md is missing from the subtree")
+	}
+}
+
+func TestSubtreeNotADirectory(t *testing.T) {
+	tree := BuildFileTree([]TreeFile{{Path: "docs/guide.md"}}, nil)
+
+	for _, dir := range []string{"docs/guide.md", "missing", "docs/missing"} {
+		if sub := tree.Subtree(dir); sub != nil {
+			t.Errorf("Subtree(%q) = %v, want nil", dir, sub)
+		}
+	}
+}
+
+func childPaths(node *FileNode) []string {
+	paths := make([]string, 0, len(node.Children))
+	for _, child := range node.Children {
+		paths = append(paths, child.Path)
+	}
+	return paths
+}
@@ -0,0 +1,113 @@
+package git
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Each request clones into its own directory under workspaceRoot, so
+// concurrent requests against the same repository never share a clone
+var workspaceRoot = filepath.Join(tmpDir, "auto-pr-bot")
+
+// How often a running clone's size is measured against its limit
+const sizeCheckInterval = 250 * time.Millisecond
+
+// CheckFreeSpace returns ErrInsufficientSpace if the filesystem holding the
+// workspaces has less than requiredBytes available
+func CheckFreeSpace(requiredBytes int64) error {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(tmpDir, &stat); err != nil {
+		return fmt.Errorf("failed to check free space: %w", err)
+	}
+
+	available := int64(uint64(stat.Bavail) * uint64(stat.Bsize))
+	if available < requiredBytes {
+		return fmt.Errorf("%w: %d MB available, %d MB required", ErrInsufficientSpace, available>>20, requiredBytes>>20)
+	}
+	return nil
+}
+
+// SweepWorkspaces removes workspaces older than maxAge. They are left behind
+// when an invocation crashes or times out before its deferred Cleanup runs
+func SweepWorkspaces(maxAge time.Duration) error {
+	entries, err := os.ReadDir(workspaceRoot)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to list workspaces: %w", err)
+	}
+
+	cutoff := time.Now().Add(-maxAge)
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || info.ModTime().After(cutoff) {
+			continue
+		}
+
+		log.Printf("Removing stale workspace %s (last modified %s)", entry.Name(), info.ModTime().Format(time.RFC3339))
+		if err := os.RemoveAll(filepath.Join(workspaceRoot, entry.Name())); err != nil {
+			log.Printf("Warning: failed to remove stale workspace %s: %v", entry.Name(), err)
+		}
+	}
+	return nil
+}
+
+// Runs clone with a context that is cancelled once path grows beyond limit
+// bytes, returning ErrCloneTooLarge in that case. A limit of 0 disables the check
+func limitSize(ctx context.Context, path string, limit int64, clone func(ctx context.Context) error) error {
+	if limit <= 0 {
+		return clone(ctx)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var exceeded atomic.Bool
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(sizeCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if dirSize(path) > limit {
+					exceeded.Store(true)
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	err := clone(ctx)
+	close(done)
+
+	if exceeded.Load() || dirSize(path) > limit {
+		return fmt.Errorf("%w: exceeded %d MB", ErrCloneTooLarge, limit>>20)
+	}
+	return err
+}
+
+func dirSize(path string) int64 {
+	var size int64
+	filepath.WalkDir(path, func(_ string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info, err := entry.Info(); err == nil && !entry.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
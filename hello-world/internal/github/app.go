@@ -0,0 +1,235 @@
+package github
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"hello-world/internal/redact"
+
+	"github.com/google/go-github/v57/github"
+)
+
+var ErrAppNotInstalled = errors.New("GitHub App is not installed for this owner")
+
+const (
+	// GitHub rejects app JWTs valid for more than ten minutes
+	appJWTLifetime = 9 * time.Minute
+	// Allows for clock drift between us and GitHub
+	appJWTBackdate = time.Minute
+	// Installation tokens last an hour; refresh well before that so a token
+	// never expires in the middle of a clone or push
+	installationTokenMargin = 10 * time.Minute
+)
+
+// App authenticates as a GitHub App and hands out installation tokens, cached
+// per installation. An installation may cover only some of an account's
+// repositories, so tokens are never shared between installations
+type App struct {
+	id     int64
+	key    *rsa.PrivateKey
+	client *github.Client
+
+	mu     sync.Mutex
+	tokens map[int64]*github.InstallationToken
+	// Installation IDs by owner/repo, or by owner for organizations
+	installations map[string]int64
+	// The app's URL-friendly name, cached by Login
+	slug string
+}
+
+// NewApp parses the app's PEM-encoded private key (PKCS#1 as downloaded from
+// GitHub, or PKCS#8)
+func NewApp(appID int64, privateKeyPEM []byte) (*App, error) {
+	block, _ := pem.Decode(privateKeyPEM)
+	if block == nil {
+		return nil, fmt.Errorf("GitHub App private key is not PEM encoded")
+	}
+
+	var key *rsa.PrivateKey
+	if parsed, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		key = parsed
+	} else {
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse GitHub App private key: %w", err)
+		}
+		rsaKey, ok := parsed.(*rsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("GitHub App private key is not an RSA key")
+		}
+		key = rsaKey
+	}
+
+	app := &App{
+		id:            appID,
+		key:           key,
+		tokens:        make(map[int64]*github.InstallationToken),
+		installations: make(map[string]int64),
+	}
+	app.client = github.NewClient(&http.Client{Transport: &appTransport{app: app, base: http.DefaultTransport}})
+	return app, nil
+}
+
+// InstallationToken returns a token for the installation on owner, looking
+// the installation up through repo, or through the organization when repo is
+// empty. Returns ErrAppNotInstalled if the app has no access to the
+// repository or organization
+func (a *App) InstallationToken(ctx context.Context, owner, repo string) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	key := strings.ToLower(path.Join(owner, repo))
+	if id, ok := a.installations[key]; ok {
+		return a.token(ctx, owner, id)
+	}
+
+	var installation *github.Installation
+	var resp *github.Response
+	var err error
+	if repo == "" {
+		installation, resp, err = a.client.Apps.FindOrganizationInstallation(ctx, owner)
+	} else {
+		installation, resp, err = a.client.Apps.FindRepositoryInstallation(ctx, owner, repo)
+	}
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		return "", fmt.Errorf("%w: %s", ErrAppNotInstalled, owner)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to find installation for %s: %w", path.Join(owner, repo), err)
+	}
+	a.installations[key] = installation.GetID()
+	return a.token(ctx, owner, installation.GetID())
+}
+
+// Returns a token for the installation with the given ID on owner, for
+// installations that are already known, such as those from Installations
+func (a *App) installationTokenByID(ctx context.Context, owner string, id int64) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.token(ctx, owner, id)
+}
+
+// Returns the cached token for installation id on owner, creating one when
+// it is missing or about to expire. a.mu must be held
+func (a *App) token(ctx context.Context, owner string, id int64) (string, error) {
+	if token, ok := a.tokens[id]; ok && time.Until(token.GetExpiresAt().Time) > installationTokenMargin {
+		return token.GetToken(), nil
+	}
+
+	token, _, err := a.client.Apps.CreateInstallationToken(ctx, id, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create installation token for %s: %w", owner, err)
+	}
+
+	redact.Register(token.GetToken())
+	a.tokens[id] = token
+	return token.GetToken(), nil
+}
+
+// Installations returns every installation of the app
+func (a *App) Installations(ctx context.Context) ([]*github.Installation, error) {
+	opts := &github.ListOptions{PerPage: 100}
+
+	var installations []*github.Installation
+	for {
+		page, resp, err := a.client.Apps.ListInstallations(ctx, opts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list installations: %w", err)
+		}
+		installations = append(installations, page...)
+		if resp.NextPage == 0 {
+			return installations, nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
+
+// Login returns the login of the app's bot account, <slug>[bot], which
+// authors what installation tokens create
+func (a *App) Login(ctx context.Context) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.slug == "" {
+		app, _, err := a.client.Apps.Get(ctx, "")
+		if err != nil {
+			return "", fmt.Errorf("failed to get GitHub App: %w", err)
+		}
+		a.slug = app.GetSlug()
+	}
+	return a.slug + "[bot]", nil
+}
+
+// Signs a short-lived RS256 JWT identifying the app itself
+func (a *App) jwt() (string, error) {
+	now := time.Now()
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"iat": now.Add(-appJWTBackdate).Unix(),
+		"exp": now.Add(appJWTLifetime).Unix(),
+		"iss": strconv.FormatInt(a.id, 10),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, a.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("failed to sign GitHub App JWT: %w", err)
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+type appTransport struct {
+	app  *App
+	base http.RoundTripper
+}
+
+func (t *appTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := t.app.jwt()
+	if err != nil {
+		return nil, err
+	}
+
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+token)
+	return t.base.RoundTrip(req)
+}
+
+// Refreshes the installation token for one owner on every use, so a client
+// never sends an expired token however long it is used. The installation is looked up through
+// repo or the organization unless its id is known
+type installationTokenSource struct {
+	app   *App
+	owner string
+	repo  string
+	id    int64
+}
+
+func (s *installationTokenSource) Token(ctx context.Context) (string, error) {
+	if s.id != 0 {
+		return s.app.installationTokenByID(ctx, s.owner, s.id)
+	}
+	return s.app.InstallationToken(ctx, s.owner, s.repo)
+}
@@ -0,0 +1,97 @@
+package github
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Returns an app with a fresh key whose API calls go to handler
+func newTestApp(t *testing.T, handler http.Handler) *App {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	app, err := NewApp(1, keyPEM)
+	if err != nil {
+		t.Fatalf("NewApp failed: %v", err)
+	}
+
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	baseURL, err := url.Parse(server.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.client.BaseURL = baseURL
+	return app
+}
+
+func TestInstallationTokenPerInstallation(t *testing.T) {
+	// owner/a and owner/b are covered by different installations, as when
+	// an account installs the app on selected repositories twice
+	installations := map[string]int64{"/repos/owner/a/installation": 1, "/repos/owner/b/installation": 2, "/repos/owner/c/installation": 1}
+	created := map[int64]int{}
+	app := newTestApp(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+			t.Errorf("%s was not authenticated as the app", r.URL.Path)
+		}
+		if id, ok := installations[r.URL.Path]; ok {
+			fmt.Fprintf(w, `{"id": %d}`, id)
+			return
+		}
+		var id int64
+		if _, err := fmt.Sscanf(r.URL.Path, "/app/installations/%d/access_tokens", &id); err == nil {
+			created[id]++
+			fmt.Fprintf(w, `{"token": "token-%d-%d", "expires_at": %q}`, id, created[id], time.Now().Add(time.Hour).Format(time.RFC3339))
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	ctx := context.Background()
+
+	tokenA, err := app.InstallationToken(ctx, "owner", "a")
+	if err != nil {
+		t.Fatalf("InstallationToken(owner/a) failed: %v", err)
+	}
+	tokenB, err := app.InstallationToken(ctx, "owner", "b")
+	if err != nil {
+		t.Fatalf("InstallationToken(owner/b) failed: %v", err)
+	}
+	if tokenA == tokenB {
+		t.Errorf("owner/a and owner/b share token %q across installations", tokenA)
+	}
+
+	tokenC, err := app.InstallationToken(ctx, "owner", "c")
+	if err != nil {
+		t.Fatalf("InstallationToken(owner/c) failed: %v", err)
+	}
+	if tokenC != tokenA {
+		t.Errorf("owner/c got %q, want the token of its installation %q", tokenC, tokenA)
+	}
+	if created[1] != 1 || created[2] != 1 {
+		t.Errorf("tokens created per installation = %v, want one each", created)
+	}
+}
+
+func TestInstallationTokenNotInstalled(t *testing.T) {
+	app := newTestApp(t, http.NotFoundHandler())
+
+	_, err := app.InstallationToken(context.Background(), "owner", "repo")
+	if !errors.Is(err, ErrAppNotInstalled) {
+		t.Errorf("err = %v, want ErrAppNotInstalled", err)
+	}
+}
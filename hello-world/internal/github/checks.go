@@ -0,0 +1,194 @@
+package github
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/google/go-github/v57/github"
+)
+
+// States of a check, with commit statuses mapped onto the same values
+const (
+	CheckPending = "pending"
+	CheckSuccess = "success"
+	CheckFailure = "failure"
+	// Skipped and neutral check runs neither pass nor fail a commit
+	CheckNeutral = "neutral"
+)
+
+// Check is a check run or commit status reported on a commit
+type Check struct {
+	Name  string
+	State string
+	URL   string
+
+	// Set for check runs only
+	runID   int64
+	appSlug string
+	output  *github.CheckRunOutput
+}
+
+// CommitChecks returns the latest check runs and commit statuses on ref
+func (c *Client) CommitChecks(ctx context.Context, owner, repo, ref string) ([]*Check, error) {
+	var checks []*Check
+
+	opts := &github.ListCheckRunsOptions{ListOptions: github.ListOptions{PerPage: 100}}
+	for {
+		result, resp, err := c.client.Checks.ListCheckRunsForRef(ctx, owner, repo, ref, opts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list check runs: %w", err)
+		}
+		for _, run := range result.CheckRuns {
+			checks = append(checks, &Check{
+				Name:    run.GetName(),
+				State:   checkRunState(run),
+				URL:     run.GetHTMLURL(),
+				runID:   run.GetID(),
+				appSlug: run.GetApp().GetSlug(),
+				output:  run.GetOutput(),
+			})
+		}
+		if resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+
+	statusOpts := &github.ListOptions{PerPage: 100}
+	for {
+		combined, resp, err := c.client.Repositories.GetCombinedStatus(ctx, owner, repo, ref, statusOpts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get commit statuses: %w", err)
+		}
+		for _, repoStatus := range combined.Statuses {
+			state := repoStatus.GetState()
+			if state == "error" {
+				state = CheckFailure
+			}
+			checks = append(checks, &Check{
+				Name:  repoStatus.GetContext(),
+				State: state,
+				URL:   repoStatus.GetTargetURL(),
+			})
+		}
+		if resp.NextPage == 0 {
+			break
+		}
+		statusOpts.Page = resp.NextPage
+	}
+
+	return checks, nil
+}
+
+// Cancelled, timed out and stale runs block merging like failed ones
+func checkRunState(run *github.CheckRun) string {
+	if run.GetStatus() != "completed" {
+		return CheckPending
+	}
+	switch run.GetConclusion() {
+	case "success":
+		return CheckSuccess
+	case "neutral", "skipped":
+		return CheckNeutral
+	default:
+		return CheckFailure
+	}
+}
+
+// FailureLog describes why a check failed: its output and annotations, and
+// for GitHub Actions jobs the last maxChars of the job's log
+func (c *Client) FailureLog(ctx context.Context, owner, repo string, check *Check, maxChars int) (string, error) {
+	if check.runID == 0 {
+		// Commit statuses only link to the external CI
+		return fmt.Sprintf("Commit status %q failed, see %s", check.Name, check.URL), nil
+	}
+
+	var builder strings.Builder
+	if output := check.output; output != nil {
+		for _, text := range []string{output.GetTitle(), output.GetSummary(), output.GetText()} {
+			if text != "" {
+				builder.WriteString(text + "\n")
+			}
+		}
+	}
+
+	annotations, _, err := c.client.Checks.ListCheckRunAnnotations(ctx, owner, repo, check.runID, &github.ListOptions{PerPage: 50})
+	if err != nil {
+		return "", fmt.Errorf("failed to list annotations of %s: %w", check.Name, err)
+	}
+	for _, annotation := range annotations {
+		builder.WriteString(fmt.Sprintf("%s:%d: %s: %s\n", annotation.GetPath(), annotation.GetStartLine(),
+			annotation.GetAnnotationLevel(), annotation.GetMessage()))
+	}
+
+	// The output and annotations get up to half of maxChars, the log's tail
+	// the rest
+	text := builder.String()
+	if len(text) > maxChars/2 {
+		cut := maxChars / 2
+		for cut > 0 && !utf8.RuneStart(text[cut]) {
+			cut--
+		}
+		text = text[:cut] + "...\n"
+	}
+	if check.appSlug == "github-actions" {
+		jobLog, err := c.jobLog(ctx, owner, repo, check.runID, maxChars-len(text))
+		if err != nil {
+			return "", err
+		}
+		text += "...\n" + jobLog
+	}
+	return text, nil
+}
+
+// Returns the last maxChars of a GitHub Actions job's log, where failures are
+// reported. The check run ID of a job is the job's ID
+func (c *Client) jobLog(ctx context.Context, owner, repo string, jobID int64, maxChars int) (string, error) {
+	logURL, _, err := c.client.Actions.GetWorkflowJobLogs(ctx, owner, repo, jobID, 1)
+	if err != nil {
+		return "", fmt.Errorf("failed to get log of job %d: %w", jobID, err)
+	}
+
+	// The log is served from a pre-signed URL, which must not get the token
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, logURL.String(), nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to download log of job %d: %w", jobID, err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to download log of job %d: %w", jobID, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to download log of job %d: %s", jobID, resp.Status)
+	}
+
+	// Logs can be far larger than what is kept, so only the tail is buffered
+	var tail []byte
+	chunk := make([]byte, 32*1024)
+	for {
+		n, err := resp.Body.Read(chunk)
+		tail = append(tail, chunk[:n]...)
+		if len(tail) > 2*maxChars {
+			tail = append(tail[:0], tail[len(tail)-maxChars:]...)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to download log of job %d: %w", jobID, err)
+		}
+	}
+	if len(tail) > maxChars {
+		tail = tail[len(tail)-maxChars:]
+	}
+	// Trimming may have split a character at the start
+	for len(tail) > 0 && !utf8.RuneStart(tail[0]) {
+		tail = tail[1:]
+	}
+	return string(tail), nil
+}
@@ -0,0 +1,183 @@
+package github
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/google/go-github/v57/github"
+)
+
+func TestCommitChecks(t *testing.T) {
+	var serverURL string
+	client := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/repos/owner/repo/commits/head/check-runs" && r.URL.Query().Get("page") == "":
+			w.Header().Set("Link", fmt.Sprintf(`<%s/repos/owner/repo/commits/head/check-runs?page=2>; rel="next"`, serverURL))
+			w.Write([]byte(`{"total_count": 2, "check_runs": [
+				{"id": 1, "name": "build", "status": "completed", "conclusion": "success", "app": {"slug": "github-actions"}},
+				{"id": 2, "name": "test", "status": "in_progress"}]}`))
+		case r.URL.Path == "/repos/owner/repo/commits/head/check-runs":
+			w.Write([]byte(`{"total_count": 2, "check_runs": [
+				{"id": 3, "name": "deploy", "status": "completed", "conclusion": "cancelled", "html_url": "https://github.com/owner/repo/runs/3"}]}`))
+		case r.URL.Path == "/repos/owner/repo/commits/head/status":
+			w.Write([]byte(`{"statuses": [
+				{"context": "ci/jenkins", "state": "error", "target_url": "https://jenkins.example.com/1"},
+				{"context": "coverage", "state": "pending"}]}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	serverURL = strings.TrimSuffix(client.client.BaseURL.String(), "/")
+
+	checks, err := client.CommitChecks(context.Background(), "owner", "repo", "head")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Check{
+		{Name: "build", State: CheckSuccess, runID: 1, appSlug: "github-actions"},
+		{Name: "test", State: CheckPending, runID: 2},
+		{Name: "deploy", State: CheckFailure, URL: "https://github.com/owner/repo/runs/3", runID: 3},
+		{Name: "ci/jenkins", State: CheckFailure, URL: "https://jenkins.example.com/1"},
+		{Name: "coverage", State: CheckPending},
+	}
+	if len(checks) != len(want) {
+		t.Fatalf("got %d checks, want %d", len(checks), len(want))
+	}
+	for i, check := range checks {
+		got := *check
+		got.output = nil
+		if got != want[i] {
+			t.Errorf("check %d = %+v, want %+v", i, got, want[i])
+		}
+	}
+}
+
+func TestCheckRunState(t *testing.T) {
+	tests := map[string]string{
+		"queued/":             CheckPending,
+		"in_progress/":        CheckPending,
+		"completed/success":   CheckSuccess,
+		"completed/neutral":   CheckNeutral,
+		"completed/skipped":   CheckNeutral,
+		"completed/failure":   CheckFailure,
+		"completed/cancelled": CheckFailure,
+		"completed/timed_out": CheckFailure,
+		"completed/stale":     CheckFailure,
+	}
+	for run, want := range tests {
+		runStatus, conclusion, _ := strings.Cut(run, "/")
+		if got := checkRunState(&github.CheckRun{Status: &runStatus, Conclusion: &conclusion}); got != want {
+			t.Errorf("checkRunState(%s) = %q, want %q", run, got, want)
+		}
+	}
+}
+
+func TestFailureLogCommitStatus(t *testing.T) {
+	client := newTestClient(t, http.NotFoundHandler())
+
+	check := &Check{Name: "ci/jenkins", State: CheckFailure, URL: "https://jenkins.example.com/1"}
+	got, err := client.FailureLog(context.Background(), "owner", "repo", check, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `Commit status "ci/jenkins" failed, see https://jenkins.example.com/1`; got != want {
+		t.Errorf("FailureLog = %q, want %q", got, want)
+	}
+}
+
+func TestFailureLogOutput(t *testing.T) {
+	client := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/repos/owner/repo/check-runs/7/annotations" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`[{"path": "main.go", "start_line": 3, "annotation_level": "failure", "message": "undefined: x"}]`))
+	}))
+
+	title, summary := "Lint", "1 problem"
+	check := &Check{Name: "lint", State: CheckFailure, runID: 7, output: &github.CheckRunOutput{Title: &title, Summary: &summary}}
+	got, err := client.FailureLog(context.Background(), "owner", "repo", check, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "Lint\n1 problem\nmain.go:3: failure: undefined: x\n"; got != want {
+		t.Errorf("FailureLog = %q, want %q", got, want)
+	}
+
+	// Half of maxChars falls in the middle of é, which is left out whole
+	title = "abcdefghié rest of the title"
+	got, err = client.FailureLog(context.Background(), "owner", "repo", check, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "abcdefghi...\n"; got != want {
+		t.Errorf("FailureLog = %q, want %q", got, want)
+	}
+}
+
+func TestFailureLogJobLog(t *testing.T) {
+	// The tail starts with the second byte of é, so it is cut after é
+	tail := "Error: exit code 1\n"
+	jobLog := strings.Repeat("step output\n", 10000) + "é" + tail
+	maxChars := len(tail) + 1
+
+	var serverURL string
+	client := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/repos/owner/repo/check-runs/7/annotations":
+			w.Write([]byte(`[]`))
+		case "/repos/owner/repo/actions/jobs/7/logs":
+			http.Redirect(w, r, serverURL+"/download/7?signature=abc", http.StatusFound)
+		case "/download/7":
+			if auth := r.Header.Get("Authorization"); auth != "" {
+				t.Errorf("log download sent Authorization %q, want none", auth)
+			}
+			w.Write([]byte(jobLog))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	serverURL = strings.TrimSuffix(client.client.BaseURL.String(), "/")
+
+	check := &Check{Name: "test", State: CheckFailure, runID: 7, appSlug: "github-actions"}
+	got, err := client.FailureLog(context.Background(), "owner", "repo", check, maxChars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "...\n" + tail; got != want {
+		t.Errorf("FailureLog = %q, want %q", got, want)
+	}
+
+	got, err = client.jobLog(context.Background(), "owner", "repo", 7, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != jobLog {
+		t.Errorf("jobLog returned %d bytes, want the whole %d byte log", len(got), len(jobLog))
+	}
+}
+
+func TestFailureLogJobLogUnavailable(t *testing.T) {
+	var serverURL string
+	client := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/repos/owner/repo/check-runs/7/annotations":
+			w.Write([]byte(`[]`))
+		case "/repos/owner/repo/actions/jobs/7/logs":
+			http.Redirect(w, r, serverURL+"/download/7", http.StatusFound)
+		default:
+			// Logs expire, and their pre-signed URLs too
+			http.Error(w, "gone", http.StatusGone)
+		}
+	}))
+	serverURL = strings.TrimSuffix(client.client.BaseURL.String(), "/")
+
+	check := &Check{Name: "test", State: CheckFailure, runID: 7, appSlug: "github-actions"}
+	_, err := client.FailureLog(context.Background(), "owner", "repo", check, 100)
+	if err == nil || !strings.Contains(err.Error(), "failed to download log of job 7: 410 Gone") {
+		t.Errorf("err = %v, want the failed download", err)
+	}
+}
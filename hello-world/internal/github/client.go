@@ -2,106 +2,226 @@ package github
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 	"strings"
 
 	"github.com/google/go-github/v57/github"
 )
 
+// ErrDraftUnsupported is returned by CreatePullRequest when the repository's
+// plan does not allow draft pull requests
+var ErrDraftUnsupported = errors.New("draft pull requests are not supported")
+
 type Client struct {
 	client *github.Client
-	token  string
+	tokens TokenSource
+	host   *Host
+
+	// Cached by Login
+	login string
+}
+
+// TokenSource supplies the token for each request, so installation tokens
+// can be refreshed while a client is in use
+type TokenSource interface {
+	Token(ctx context.Context) (string, error)
+}
+
+// StaticToken is a token that never changes, such as a personal access token
+type StaticToken string
+
+func (t StaticToken) Token(context.Context) (string, error) {
+	return string(t), nil
 }
 
 func NewClient(token string) *Client {
-	// Create an HTTP client with authentication header
-	httpClient := &http.Client{
-		Transport: &authTransport{
-			token: token,
-			base:  http.DefaultTransport,
-		},
+	return NewClientWithTokenSource(StaticToken(token))
+}
+
+func NewClientWithTokenSource(tokens TokenSource) *Client {
+	return &Client{
+		client: github.NewClient(authenticatedHTTPClient(tokens)),
+		tokens: tokens,
+		host:   githubDotCom,
+	}
+}
+
+// Returns a client for a GitHub Enterprise Server's API
+func newEnterpriseClient(host *Host, tokens TokenSource) (*Client, error) {
+	client, err := github.NewClient(authenticatedHTTPClient(tokens)).WithEnterpriseURLs(host.webURL, host.webURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure GitHub Enterprise client for %s: %w", host.Name, err)
 	}
 
 	return &Client{
-		client: github.NewClient(httpClient),
-		token:  token,
+		client: client,
+		tokens: tokens,
+		host:   host,
+	}, nil
+}
+
+// Create an HTTP client with authentication header that keeps within the
+// token's rate limits
+func authenticatedHTTPClient(tokens TokenSource) *http.Client {
+	return &http.Client{
+		Transport: &authTransport{
+			tokens: tokens,
+			base:   &rateLimitTransport{base: http.DefaultTransport},
+		},
 	}
 }
 
+// Host returns the GitHub instance the client talks to
+func (c *Client) Host() *Host {
+	return c.host
+}
+
+// Token returns the client's current token, for git operations that have to
+// authenticate as the same identity
+func (c *Client) Token(ctx context.Context) (string, error) {
+	return c.tokens.Token(ctx)
+}
+
 type authTransport struct {
-	token string
-	base  http.RoundTripper
+	tokens TokenSource
+	base   http.RoundTripper
 }
 
 func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
-	req.Header.Set("Authorization", "Bearer "+t.token)
+	token, err := t.tokens.Token(req.Context())
+	if err != nil {
+		return nil, fmt.Errorf("failed to get GitHub token: %w", err)
+	}
+
+	// RoundTrippers must not modify the caller's request
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+token)
 	return t.base.RoundTrip(req)
 }
 
-// Example: https://github.com/owner/repo -> (owner, repo, nil)
-func ParseRepoURL(repoURL string) (string, string, error) {
-	// Remove trailing slashes
-	repoURL = strings.TrimSuffix(repoURL, "/")
+// Example: https://github.com/owner/repo -> ("github.com", owner, repo, nil)
+// SSH URLs such as git@github.com:owner/repo.git work too, and a .git
+// suffix is dropped. The host is empty for the owner/repo shorthand.
+// Anything after the repository name, such as /issues/1, is ignored
+func ParseRepoURL(repoURL string) (string, string, string, error) {
+	host, parts, err := splitRepoURL(repoURL)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	return host, parts[0], strings.TrimSuffix(parts[1], ".git"), nil
+}
+
+// TreePath returns what follows /tree/ in a repository URL such as
+// https://github.com/owner/repo/tree/release-2.x/services/api: a branch,
+// optionally followed by a directory. Branch names may contain slashes, so
+// ResolveTreePath tells the two apart. Empty for other URLs
+func TreePath(repoURL string) string {
+	_, parts, err := splitRepoURL(repoURL)
+	if err != nil || len(parts) < 4 || parts[2] != "tree" {
+		return ""
+	}
 
-	// Handle both https://github.com/owner/repo and github.com/owner/repo
-	repoURL = strings.TrimPrefix(repoURL, "https://")
-	repoURL = strings.TrimPrefix(repoURL, "http://")
-	repoURL = strings.TrimPrefix(repoURL, "github.com/")
+	segments := make([]string, 0, len(parts)-3)
+	for _, part := range parts[3:] {
+		if unescaped, err := url.PathUnescape(part); err == nil {
+			part = unescaped
+		}
+		if part != "" {
+			segments = append(segments, part)
+		}
+	}
+	return strings.Join(segments, "/")
+}
 
-	parts := strings.Split(repoURL, "/")
-	if len(parts) < 2 {
-		return "", "", fmt.Errorf("invalid GitHub URL format")
+// Splits a repository URL into its host and path segments, of which there
+// are at least two: owner and repository
+func splitRepoURL(repoURL string) (string, []string, error) {
+	// Query strings and fragments never name anything the bot uses
+	if index := strings.IndexAny(repoURL, "?#"); index >= 0 {
+		repoURL = repoURL[:index]
+	}
+	// Remove trailing slashes
+	repoURL = strings.TrimRight(repoURL, "/")
+
+	host, rest := "", repoURL
+	at, colon := strings.Index(repoURL, "@"), strings.Index(repoURL, ":")
+	switch {
+	case strings.HasPrefix(repoURL, "ssh://"):
+		// ssh://git@host:port/owner/repo; the port is SSH's, not the web UI's
+		authority, path, _ := strings.Cut(strings.TrimPrefix(repoURL, "ssh://"), "/")
+		host = authority[strings.LastIndex(authority, "@")+1:]
+		if index := strings.LastIndex(host, ":"); index >= 0 {
+			host = host[:index]
+		}
+		rest = path
+	case at > 0 && colon > at && !strings.Contains(repoURL[:colon], "/"):
+		// git@host:owner/repo
+		host, rest = repoURL[at+1:colon], repoURL[colon+1:]
+	default:
+		// Handle https://host/owner/repo, host/owner/repo and owner/repo
+		trimmed := strings.TrimPrefix(strings.TrimPrefix(repoURL, "https://"), "http://")
+		first, path, _ := strings.Cut(trimmed, "/")
+		// Owner names cannot contain dots or colons, hostnames and ports do
+		if trimmed != repoURL || strings.ContainsAny(first, ".:") {
+			host, rest = first, path
+		}
 	}
 
-	return parts[0], parts[1], nil
+	parts := strings.Split(rest, "/")
+	if len(parts) < 2 || parts[0] == "" || parts[1] == "" || parts[1] == ".git" {
+		return "", nil, fmt.Errorf("invalid GitHub URL format")
+	}
+	return strings.ToLower(host), parts, nil
 }
 
-// Reuses existing fork if present to avoid creating duplicates
-func (c *Client) ForkRepository(ctx context.Context, owner, repo string) (*github.Repository, error) {
-	// Try to get authenticated user first
+func (c *Client) GetAuthenticatedUser(ctx context.Context) (*github.User, error) {
 	user, _, err := c.client.Users.Get(ctx, "")
 	if err != nil {
 		return nil, fmt.Errorf("failed to get authenticated user: %w", err)
 	}
 
-	// Check if fork already exists
-	existingFork, resp, err := c.client.Repositories.Get(ctx, user.GetLogin(), repo)
-	if err == nil && existingFork != nil && existingFork.GetFork() {
-		// Fork exists, return it
-		return existingFork, nil
+	return user, nil
+}
+
+// Login returns the login the client acts as, which is the author of the pull
+// requests and comments it creates: the app's bot account for installation
+// tokens, the token's user otherwise
+func (c *Client) Login(ctx context.Context) (string, error) {
+	if c.login != "" {
+		return c.login, nil
 	}
 
-	// If we get a 404, fork doesn't exist, so create it
-	if resp != nil && resp.StatusCode == 404 {
-		fork, _, err := c.client.Repositories.CreateFork(ctx, owner, repo, &github.RepositoryCreateForkOptions{
-			DefaultBranchOnly: true,
-		})
+	if installation, ok := c.tokens.(*installationTokenSource); ok {
+		login, err := installation.app.Login(ctx)
 		if err != nil {
-			return nil, fmt.Errorf("failed to create fork: %w", err)
+			return "", err
 		}
-		return fork, nil
+		c.login = login
+		return login, nil
 	}
 
-	// Some other error occurred
+	user, err := c.GetAuthenticatedUser(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("failed to check for existing fork: %w", err)
+		return "", err
 	}
-
-	// Fork exists but we couldn't determine it's a fork, return it anyway
-	return existingFork, nil
+	c.login = user.GetLogin()
+	return c.login, nil
 }
 
-func (c *Client) GetAuthenticatedUser(ctx context.Context) (*github.User, error) {
-	user, _, err := c.client.Users.Get(ctx, "")
+func (c *Client) GetUser(ctx context.Context, username string) (*github.User, error) {
+	user, _, err := c.client.Users.Get(ctx, username)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get authenticated user: %w", err)
+		return nil, fmt.Errorf("failed to get user %s: %w", username, err)
 	}
 
 	return user, nil
 }
 
-func (c *Client) CreatePullRequest(ctx context.Context, upstreamOwner, upstreamRepo, forkOwner, title, body, headBranch, baseBranch string) (*github.PullRequest, error) {
+func (c *Client) CreatePullRequest(ctx context.Context, upstreamOwner, upstreamRepo, forkOwner, title, body, headBranch, baseBranch string, draft bool) (*github.PullRequest, error) {
 	// The head should be in format "forkOwner:branch"
 	head := fmt.Sprintf("%s:%s", forkOwner, headBranch)
 
@@ -110,9 +230,13 @@ func (c *Client) CreatePullRequest(ctx context.Context, upstreamOwner, upstreamR
 		Body:  github.String(body),
 		Head:  github.String(head),
 		Base:  github.String(baseBranch),
+		Draft: github.Bool(draft),
 	}
 
 	pr, _, err := c.client.PullRequests.Create(ctx, upstreamOwner, upstreamRepo, newPR)
+	if err != nil && draft && draftUnsupported(err) {
+		return nil, fmt.Errorf("failed to create pull request: %w: %v", ErrDraftUnsupported, err)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to create pull request: %w", err)
 	}
@@ -120,6 +244,25 @@ func (c *Client) CreatePullRequest(ctx context.Context, upstreamOwner, upstreamR
 	return pr, nil
 }
 
+// Draft pull requests are unavailable on some plans, which GitHub reports as
+// a validation error about drafts
+func draftUnsupported(err error) bool {
+	var errResp *github.ErrorResponse
+	if !errors.As(err, &errResp) || errResp.Response == nil || errResp.Response.StatusCode != http.StatusUnprocessableEntity {
+		return false
+	}
+	messages := []string{errResp.Message}
+	for _, e := range errResp.Errors {
+		messages = append(messages, e.Message)
+	}
+	for _, message := range messages {
+		if strings.Contains(strings.ToLower(message), "draft") {
+			return true
+		}
+	}
+	return false
+}
+
 func (c *Client) GetDefaultBranch(ctx context.Context, owner, repo string) (string, error) {
 	repository, _, err := c.client.Repositories.Get(ctx, owner, repo)
 	if err != nil {
@@ -129,8 +272,65 @@ func (c *Client) GetDefaultBranch(ctx context.Context, owner, repo string) (stri
 	return repository.GetDefaultBranch(), nil
 }
 
-// ListOpenPullRequests lists open pull requests from a specific head (fork owner:branch)
-func (c *Client) ListOpenPullRequests(ctx context.Context, upstreamOwner, upstreamRepo, forkOwner, headBranch string) ([]*github.PullRequest, error) {
+// ResolveTreePath splits a TreePath into the branch it starts with and the
+// directory after it, which is empty for the branch's root. When several
+// branches match, such as release and release/2.x, the longest wins
+func (c *Client) ResolveTreePath(ctx context.Context, owner, repo, treePath string) (string, string, error) {
+	first, _, _ := strings.Cut(treePath, "/")
+	opts := &github.ReferenceListOptions{
+		Ref:         "heads/" + first,
+		ListOptions: github.ListOptions{PerPage: 100},
+	}
+
+	branch := ""
+	for {
+		refs, resp, err := c.client.Git.ListMatchingRefs(ctx, owner, repo, opts)
+		if err != nil {
+			return "", "", fmt.Errorf("failed to list branches: %w", err)
+		}
+		for _, ref := range refs {
+			name := strings.TrimPrefix(ref.GetRef(), "refs/heads/")
+			if (treePath == name || strings.HasPrefix(treePath, name+"/")) && len(name) > len(branch) {
+				branch = name
+			}
+		}
+		if resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+
+	if branch == "" {
+		return "", "", fmt.Errorf("no branch of %s/%s matches %q", owner, repo, treePath)
+	}
+	return branch, strings.TrimPrefix(treePath[len(branch):], "/"), nil
+}
+
+// CanPush reports whether the authenticated identity may push branches to
+// owner/repo. GitHub includes the caller's permissions in the repository
+// response, for personal access tokens and installation tokens alike
+func (c *Client) CanPush(ctx context.Context, owner, repo string) (bool, error) {
+	repository, _, err := c.client.Repositories.Get(ctx, owner, repo)
+	if err != nil {
+		return false, fmt.Errorf("failed to get repository: %w", err)
+	}
+
+	return repository.GetPermissions()["push"], nil
+}
+
+// Size is reported by GitHub in kilobytes
+func (c *Client) GetRepositorySize(ctx context.Context, owner, repo string) (int, error) {
+	repository, _, err := c.client.Repositories.Get(ctx, owner, repo)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get repository: %w", err)
+	}
+
+	return repository.GetSize(), nil
+}
+
+// ListOpenPullRequests lists open pull requests from a specific head (fork owner:branch).
+// Only pull requests whose head is in forkOwner/forkRepo are returned
+func (c *Client) ListOpenPullRequests(ctx context.Context, upstreamOwner, upstreamRepo, forkOwner, forkRepo, headBranch string) ([]*github.PullRequest, error) {
 	head := fmt.Sprintf("%s:%s", forkOwner, headBranch)
 
 	opts := &github.PullRequestListOptions{
@@ -146,7 +346,14 @@ func (c *Client) ListOpenPullRequests(ctx context.Context, upstreamOwner, upstre
 		return nil, fmt.Errorf("failed to list pull requests: %w", err)
 	}
 
-	return prs, nil
+	// The head filter matches on the owner only
+	var fromFork []*github.PullRequest
+	for _, pr := range prs {
+		if strings.EqualFold(pr.GetHead().GetRepo().GetFullName(), forkOwner+"/"+forkRepo) {
+			fromFork = append(fromFork, pr)
+		}
+	}
+	return fromFork, nil
 }
 
 func (c *Client) ClosePullRequest(ctx context.Context, owner, repo string, prNumber int, comment string) error {
@@ -175,6 +382,18 @@ func (c *Client) ClosePullRequest(ctx context.Context, owner, repo string, prNum
 	return nil
 }
 
+func (c *Client) CommentOnIssue(ctx context.Context, owner, repo string, number int, body string) error {
+	comment := &github.IssueComment{
+		Body: github.String(body),
+	}
+
+	_, _, err := c.client.Issues.CreateComment(ctx, owner, repo, number, comment)
+	if err != nil {
+		return fmt.Errorf("failed to add comment: %w", err)
+	}
+	return nil
+}
+
 func (c *Client) DeleteBranch(ctx context.Context, owner, repo, branch string) error {
 	ref := fmt.Sprintf("heads/%s", branch)
 	_, err := c.client.Git.DeleteRef(ctx, owner, repo, ref)
@@ -0,0 +1,167 @@
+package github
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestParseRepoURL(t *testing.T) {
+	tests := []struct {
+		name    string
+		url     string
+		host    string
+		owner   string
+		repo    string
+		invalid bool
+	}{
+		{name: "https", url: "https://github.com/owner/repo", host: "github.com", owner: "owner", repo: "repo"},
+		{name: "http", url: "http://github.com/owner/repo", host: "github.com", owner: "owner", repo: "repo"},
+		{name: "git suffix", url: "https://github.com/owner/repo.git", host: "github.com", owner: "owner", repo: "repo"},
+		{name: "trailing slash", url: "https://github.com/owner/repo/", host: "github.com", owner: "owner", repo: "repo"},
+		{name: "upper case host", url: "https://GitHub.com/Owner/Repo", host: "github.com", owner: "Owner", repo: "Repo"},
+		{name: "query string", url: "https://github.com/owner/repo?tab=readme", host: "github.com", owner: "owner", repo: "repo"},
+		{name: "fragment", url: "https://github.com/owner/repo#readme", host: "github.com", owner: "owner", repo: "repo"},
+		{name: "issue URL", url: "https://github.com/owner/repo/issues/1", host: "github.com", owner: "owner", repo: "repo"},
+		{name: "tree URL", url: "https://github.com/owner/repo/tree/main/docs", host: "github.com", owner: "owner", repo: "repo"},
+		{name: "enterprise with port", url: "https://ghe.example.com:8443/owner/repo", host: "ghe.example.com:8443", owner: "owner", repo: "repo"},
+		{name: "without scheme", url: "github.com/owner/repo", host: "github.com", owner: "owner", repo: "repo"},
+		{name: "scp-like SSH", url: "git@github.com:owner/repo.git", host: "github.com", owner: "owner", repo: "repo"},
+		{name: "SSH URL", url: "ssh://git@github.com/owner/repo.git", host: "github.com", owner: "owner", repo: "repo"},
+		{name: "SSH URL with port", url: "ssh://git@ghe.example.com:2222/owner/repo.git", host: "ghe.example.com", owner: "owner", repo: "repo"},
+		{name: "shorthand", url: "owner/repo", owner: "owner", repo: "repo"},
+		{name: "shorthand with git suffix", url: "owner/repo.git", owner: "owner", repo: "repo"},
+
+		{name: "empty", url: "", invalid: true},
+		{name: "owner only", url: "https://github.com/owner", invalid: true},
+		{name: "owner only shorthand", url: "owner", invalid: true},
+		{name: "host only", url: "https://github.com/", invalid: true},
+		{name: "git suffix only", url: "https://github.com/owner/.git", invalid: true},
+		{name: "empty owner", url: "https://github.com//repo", invalid: true},
+		{name: "owner only with query", url: "https://github.com/owner?repo=repo", invalid: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host, owner, repo, err := ParseRepoURL(tt.url)
+			if tt.invalid {
+				if err == nil {
+					t.Fatalf("ParseRepoURL(%q) = %q, %q, %q; want an error", tt.url, host, owner, repo)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseRepoURL(%q) failed: %v", tt.url, err)
+			}
+			if host != tt.host || owner != tt.owner || repo != tt.repo {
+				t.Errorf("ParseRepoURL(%q) = %q, %q, %q; want %q, %q, %q", tt.url, host, owner, repo, tt.host, tt.owner, tt.repo)
+			}
+		})
+	}
+}
+
+func TestTreePath(t *testing.T) {
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{url: "https://github.com/owner/repo", want: ""},
+		{url: "https://github.com/owner/repo/issues/1", want: ""},
+		{url: "https://github.com/owner/repo/tree", want: ""},
+		{url: "https://github.com/owner/repo/tree/main", want: "main"},
+		{url: "https://github.com/owner/repo/tree/main/", want: "main"},
+		{url: "https://github.com/owner/repo/tree/release-2.x/services/api", want: "release-2.x/services/api"},
+		{url: "https://github.com/owner/repo/tree/main/docs?plain=1#intro", want: "main/docs"},
+		{url: "https://github.com/owner/repo/tree/main//docs", want: "main/docs"},
+		{url: "https://github.com/owner/repo/tree/feature%2Fx/docs", want: "feature/x/docs"},
+		{url: "https://github.com/owner/repo/tree/main/my%20docs", want: "main/my docs"},
+		{url: "https://github.com/owner/repo/tree/main/100%", want: "main/100%"},
+		{url: "git@github.com:owner/repo/tree/main/docs", want: "main/docs"},
+		{url: "owner/repo/tree/main", want: "main"},
+		{url: "https://github.com/owner", want: ""},
+	}
+	for _, tt := range tests {
+		if got := TreePath(tt.url); got != tt.want {
+			t.Errorf("TreePath(%q) = %q, want %q", tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestResolveTreePath(t *testing.T) {
+	branches := []string{"main", "release", "release/2.x", "release/2.x-beta", "feature"}
+	client := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		prefix, ok := strings.CutPrefix(r.URL.Path, "/repos/owner/repo/git/matching-refs/heads/")
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		type ref struct {
+			Ref string `json:"ref"`
+		}
+		refs := []ref{}
+		for _, branch := range branches {
+			if strings.HasPrefix(branch, prefix) {
+				refs = append(refs, ref{Ref: "refs/heads/" + branch})
+			}
+		}
+		json.NewEncoder(w).Encode(refs)
+	}))
+
+	tests := []struct {
+		treePath string
+		branch   string
+		dir      string
+		invalid  bool
+	}{
+		{treePath: "main", branch: "main"},
+		{treePath: "main/docs/api", branch: "main", dir: "docs/api"},
+		{treePath: "release/docs", branch: "release", dir: "docs"},
+		{treePath: "release/2.x", branch: "release/2.x"},
+		{treePath: "release/2.x/services/api", branch: "release/2.x", dir: "services/api"},
+		{treePath: "release/2.x-beta/docs", branch: "release/2.x-beta", dir: "docs"},
+		{treePath: "feature-x/docs", invalid: true},
+		{treePath: "missing", invalid: true},
+	}
+	for _, tt := range tests {
+		branch, dir, err := client.ResolveTreePath(context.Background(), "owner", "repo", tt.treePath)
+		if tt.invalid {
+			if err == nil {
+				t.Errorf("ResolveTreePath(%q) = %q, %q; want an error", tt.treePath, branch, dir)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ResolveTreePath(%q) failed: %v", tt.treePath, err)
+			continue
+		}
+		if branch != tt.branch || dir != tt.dir {
+			t.Errorf("ResolveTreePath(%q) = %q, %q; want %q, %q", tt.treePath, branch, dir, tt.branch, tt.dir)
+		}
+	}
+}
+
+func TestLogin(t *testing.T) {
+	calls := 0
+	client := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/user" {
+			http.NotFound(w, r)
+			return
+		}
+		calls++
+		w.Write([]byte(`{"login": "auto-pr-bot"}`))
+	}))
+
+	for i := 0; i < 2; i++ {
+		login, err := client.Login(context.Background())
+		if err != nil {
+			t.Fatalf("Login failed: %v", err)
+		}
+		if login != "auto-pr-bot" {
+			t.Errorf("Login = %q, want auto-pr-bot", login)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("the user was fetched %d times, want once", calls)
+	}
+}
@@ -0,0 +1,205 @@
+package github
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"hello-world/internal/redact"
+)
+
+// Credentials picks how to authenticate against a repository: as the GitHub
+// App's installation when the app is installed on the repository's owner,
+// otherwise with the personal access token. Repositories on the GitHub
+// Enterprise Server use its own token
+type Credentials struct {
+	token string
+	app   *App
+
+	enterprise      *Host
+	enterpriseToken string
+	// Hosts requests may target
+	allowedHosts map[string]bool
+}
+
+// LoadCredentials reads GITHUB_TOKEN and, for GitHub App support,
+// GITHUB_APP_ID and GITHUB_APP_PRIVATE_KEY. GITHUB_ENTERPRISE_URL and
+// GITHUB_ENTERPRISE_TOKEN add a GitHub Enterprise Server, and
+// GITHUB_ALLOWED_HOSTS limits which of the configured hosts requests may
+// target. At least one host must have credentials
+func LoadCredentials() (*Credentials, error) {
+	creds := &Credentials{
+		token:           os.Getenv("GITHUB_TOKEN"),
+		enterpriseToken: os.Getenv("GITHUB_ENTERPRISE_TOKEN"),
+		allowedHosts:    make(map[string]bool),
+	}
+	redact.Register(creds.token)
+	redact.Register(creds.enterpriseToken)
+
+	appID := os.Getenv("GITHUB_APP_ID")
+	privateKey := os.Getenv("GITHUB_APP_PRIVATE_KEY")
+	redact.Register(privateKey)
+	if appID != "" || privateKey != "" {
+		id, err := strconv.ParseInt(appID, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid GITHUB_APP_ID %q: %w", appID, err)
+		}
+		app, err := NewApp(id, []byte(privateKey))
+		if err != nil {
+			return nil, err
+		}
+		creds.app = app
+	}
+
+	if enterpriseURL := os.Getenv("GITHUB_ENTERPRISE_URL"); enterpriseURL != "" {
+		host, err := parseEnterpriseHost(enterpriseURL)
+		if err != nil {
+			return nil, err
+		}
+		if creds.enterpriseToken == "" {
+			return nil, fmt.Errorf("GITHUB_ENTERPRISE_TOKEN environment variable is required with GITHUB_ENTERPRISE_URL")
+		}
+		creds.enterprise = host
+	}
+
+	if creds.token == "" && creds.app == nil && creds.enterprise == nil {
+		return nil, fmt.Errorf("GITHUB_TOKEN or GITHUB_APP_ID and GITHUB_APP_PRIVATE_KEY environment variables are required")
+	}
+
+	if value := os.Getenv("GITHUB_ALLOWED_HOSTS"); value != "" {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+				creds.allowedHosts[name] = true
+			}
+		}
+	} else {
+		creds.allowedHosts[DefaultHost] = true
+		if creds.enterprise != nil {
+			creds.allowedHosts[creds.enterprise.Name] = true
+		}
+	}
+	return creds, nil
+}
+
+// AccountClients returns a client for each host the bot has a personal
+// access token on, for work on the bot's own repositories such as its forks
+func (c *Credentials) AccountClients() ([]*Client, error) {
+	var clients []*Client
+	if c.token != "" {
+		clients = append(clients, NewClient(c.token))
+	}
+	if c.enterprise != nil {
+		client, err := newEnterpriseClient(c.enterprise, StaticToken(c.enterpriseToken))
+		if err != nil {
+			return nil, err
+		}
+		clients = append(clients, client)
+	}
+	return clients, nil
+}
+
+// InstallationClients returns a client for each installation of the GitHub
+// App, for work on every repository the app can reach. Empty without an app
+func (c *Credentials) InstallationClients(ctx context.Context) ([]*Client, error) {
+	if c.app == nil {
+		return nil, nil
+	}
+	installations, err := c.app.Installations(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	clients := make([]*Client, 0, len(installations))
+	for _, installation := range installations {
+		clients = append(clients, NewClientWithTokenSource(&installationTokenSource{
+			app:   c.app,
+			owner: installation.GetAccount().GetLogin(),
+			id:    installation.GetID(),
+		}))
+	}
+	return clients, nil
+}
+
+// Host resolves a hostname from a request or repository URL, DefaultHost if
+// empty. Returns ErrHostNotAllowed unless the host is configured and in the
+// allowlist
+func (c *Credentials) Host(name string) (*Host, error) {
+	if name == "" {
+		name = DefaultHost
+	}
+	name = strings.ToLower(name)
+	if !c.allowedHosts[name] {
+		return nil, fmt.Errorf("%w: %s", ErrHostNotAllowed, name)
+	}
+
+	switch {
+	case c.enterprise != nil && name == c.enterprise.Name:
+		return c.enterprise, nil
+	case name == DefaultHost && (c.token != "" || c.app != nil):
+		return githubDotCom, nil
+	default:
+		return nil, fmt.Errorf("%w: no credentials are configured for %s", ErrHostNotAllowed, name)
+	}
+}
+
+// ClientFor returns a client for working on owner/repo on host, authenticated
+// as the app's installation on owner if there is one and the personal access
+// token otherwise. The app is only used on github.com
+func (c *Credentials) ClientFor(ctx context.Context, host, owner, repo string) (*Client, error) {
+	resolved, err := c.Host(host)
+	if err != nil {
+		return nil, err
+	}
+	if resolved.Enterprise() {
+		return newEnterpriseClient(resolved, StaticToken(c.enterpriseToken))
+	}
+
+	if c.app != nil {
+		_, err := c.app.InstallationToken(ctx, owner, repo)
+		if err == nil {
+			log.Printf("Authenticating as the GitHub App installation on %s", owner)
+			return NewClientWithTokenSource(&installationTokenSource{app: c.app, owner: owner, repo: repo}), nil
+		}
+		if !errors.Is(err, ErrAppNotInstalled) || c.token == "" {
+			return nil, err
+		}
+		log.Printf("GitHub App is not installed on %s, falling back to the personal access token", owner)
+	}
+
+	return NewClient(c.token), nil
+}
+
+// ForkClient returns a client for the bot's forks on host: creating them,
+// cloning them and pushing to them. Installation tokens are scoped to the
+// upstream owner and cannot reach the bot's own account, so this is the
+// app's installation on organization when forks go to an organization the
+// app is installed on, and the personal access token otherwise
+func (c *Credentials) ForkClient(ctx context.Context, host, organization string) (*Client, error) {
+	resolved, err := c.Host(host)
+	if err != nil {
+		return nil, err
+	}
+	if resolved.Enterprise() {
+		return newEnterpriseClient(resolved, StaticToken(c.enterpriseToken))
+	}
+
+	if c.app != nil && organization != "" {
+		_, err := c.app.InstallationToken(ctx, organization, "")
+		if err == nil {
+			log.Printf("Authenticating as the GitHub App installation on %s for forks", organization)
+			return NewClientWithTokenSource(&installationTokenSource{app: c.app, owner: organization}), nil
+		}
+		if !errors.Is(err, ErrAppNotInstalled) {
+			return nil, err
+		}
+	}
+
+	if c.token == "" {
+		return nil, fmt.Errorf("forking needs GITHUB_TOKEN, or FORK_ORGANIZATION set to an organization the GitHub App is installed on")
+	}
+	return NewClient(c.token), nil
+}
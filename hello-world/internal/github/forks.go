@@ -0,0 +1,332 @@
+package github
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"hello-world/internal/git"
+
+	"github.com/google/go-github/v57/github"
+)
+
+const (
+	// Fork names tried after the upstream's own name is taken by an
+	// unrelated repository
+	maxForkNameAttempts = 5
+	// GitHub copies a new fork in the background, usually within seconds but
+	// up to minutes for large repositories
+	forkReadyTimeout    = 3 * time.Minute
+	forkPollInterval    = 2 * time.Second
+	maxForkPollInterval = 15 * time.Second
+)
+
+// ForkTopic marks the forks the bot created, so maintenance never retires a
+// repository that merely happens to be a fork owned by the same account
+const ForkTopic = "auto-pr-bot"
+
+// ForkRepository returns the account's fork of owner/repo, creating it if
+// needed. Forks go to organization when it is set, otherwise to the
+// authenticated account. A repository is only reused when it is a fork
+// whose parent is owner/repo; when an unrelated repository has the name, the
+// fork is named <owner>-<repo> instead. New forks are returned once they can
+// be cloned
+func (c *Client) ForkRepository(ctx context.Context, owner, repo, organization string) (*github.Repository, error) {
+	forkOwner := organization
+	if forkOwner == "" {
+		user, err := c.GetAuthenticatedUser(ctx)
+		if err != nil {
+			return nil, err
+		}
+		forkOwner = user.GetLogin()
+	}
+	upstream := owner + "/" + repo
+
+	for _, name := range forkNames(owner, repo) {
+		existing, resp, err := c.client.Repositories.Get(ctx, forkOwner, name)
+		if resp != nil && resp.StatusCode == 404 {
+			return c.createFork(ctx, owner, repo, organization, name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to check for existing fork: %w", err)
+		}
+
+		if !existing.GetFork() || !strings.EqualFold(existing.GetParent().GetFullName(), upstream) {
+			log.Printf("%s is not a fork of %s, trying another name", existing.GetFullName(), upstream)
+			continue
+		}
+
+		// Fork exists; idle forks may have been archived by maintenance
+		if existing.GetArchived() {
+			if err := c.UnarchiveRepository(ctx, existing.GetOwner().GetLogin(), existing.GetName()); err != nil {
+				return nil, err
+			}
+			existing.Archived = github.Bool(false)
+		}
+		return existing, nil
+	}
+
+	return nil, fmt.Errorf("no free name to fork %s into %s", upstream, forkOwner)
+}
+
+// Names a fork of owner/repo may have, in the order they are tried
+func forkNames(owner, repo string) []string {
+	names := []string{repo, owner + "-" + repo}
+	for i := 2; i <= maxForkNameAttempts; i++ {
+		names = append(names, fmt.Sprintf("%s-%s-%d", owner, repo, i))
+	}
+	return names
+}
+
+// Creates the fork under name and waits until it can be cloned
+func (c *Client) createFork(ctx context.Context, owner, repo, organization, name string) (*github.Repository, error) {
+	opts := &github.RepositoryCreateForkOptions{
+		Organization:      organization,
+		DefaultBranchOnly: true,
+	}
+	if name != repo {
+		opts.Name = name
+	}
+
+	// GitHub answers 202 Accepted while it copies the repository
+	fork, _, err := c.client.Repositories.CreateFork(ctx, owner, repo, opts)
+	var accepted *github.AcceptedError
+	if err != nil && !errors.As(err, &accepted) {
+		return nil, fmt.Errorf("failed to create fork: %w", err)
+	}
+
+	// An account can only have one fork in a repository network, so GitHub
+	// returns the existing one when it has a fork of a related repository
+	if upstream := owner + "/" + repo; !strings.EqualFold(fork.GetParent().GetFullName(), upstream) {
+		return nil, fmt.Errorf("cannot fork %s: GitHub returned %s, a fork of %s in the same repository network",
+			upstream, fork.GetFullName(), fork.GetParent().GetFullName())
+	}
+	log.Printf("Created fork %s, waiting until it can be cloned", fork.GetFullName())
+
+	if err := c.waitForFork(ctx, fork); err != nil {
+		return nil, err
+	}
+
+	// The fork's bot branches also show that it is the bot's, so an untagged
+	// fork is only retired later than it could be
+	if err := c.MarkFork(ctx, fork); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	return fork, nil
+}
+
+// MarkFork tags fork with ForkTopic, keeping its other topics
+func (c *Client) MarkFork(ctx context.Context, fork *github.Repository) error {
+	topics := append(fork.Topics, ForkTopic)
+	topics, _, err := c.client.Repositories.ReplaceAllTopics(ctx, fork.GetOwner().GetLogin(), fork.GetName(), topics)
+	if err != nil {
+		return fmt.Errorf("failed to tag fork %s: %w", fork.GetFullName(), err)
+	}
+	fork.Topics = topics
+	return nil
+}
+
+// IsMarkedFork reports whether repository was tagged by MarkFork
+func IsMarkedFork(repository *github.Repository) bool {
+	for _, topic := range repository.Topics {
+		if topic == ForkTopic {
+			return true
+		}
+	}
+	return false
+}
+
+// Polls the fork's git endpoint until its default branch is advertised
+func (c *Client) waitForFork(ctx context.Context, fork *github.Repository) error {
+	token, err := c.Token(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get GitHub token: %w", err)
+	}
+
+	deadline := time.Now().Add(forkReadyTimeout)
+	interval := forkPollInterval
+	for {
+		ready, err := git.RemoteHasBranch(fork.GetCloneURL(), fork.GetDefaultBranch(), token)
+		if err != nil {
+			log.Printf("Warning: failed to check fork %s: %v", fork.GetFullName(), err)
+		}
+		if ready {
+			return nil
+		}
+
+		if time.Now().Add(interval).After(deadline) {
+			return fmt.Errorf("fork %s could not be cloned within %s", fork.GetFullName(), forkReadyTimeout)
+		}
+		if err := sleep(ctx, interval); err != nil {
+			return err
+		}
+		interval = min(interval*2, maxForkPollInterval)
+	}
+}
+
+// ListForks returns the unarchived forks of the authenticated account, or of
+// organization when forks go there. Not all of them need be the bot's; see
+// IsMarkedFork
+func (c *Client) ListForks(ctx context.Context, organization string) ([]*github.Repository, error) {
+	list := func(page int) ([]*github.Repository, *github.Response, error) {
+		if organization != "" {
+			return c.client.Repositories.ListByOrg(ctx, organization, &github.RepositoryListByOrgOptions{
+				Type:        "forks",
+				ListOptions: github.ListOptions{PerPage: 100, Page: page},
+			})
+		}
+		return c.client.Repositories.ListByAuthenticatedUser(ctx, &github.RepositoryListByAuthenticatedUserOptions{
+			Affiliation: "owner",
+			ListOptions: github.ListOptions{PerPage: 100, Page: page},
+		})
+	}
+
+	var forks []*github.Repository
+	for page := 1; ; {
+		repos, resp, err := list(page)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list repositories: %w", err)
+		}
+		for _, repo := range repos {
+			if repo.GetFork() && !repo.GetArchived() {
+				forks = append(forks, repo)
+			}
+		}
+		if resp.NextPage == 0 {
+			return forks, nil
+		}
+		page = resp.NextPage
+	}
+}
+
+// ListPushableRepositories returns the unarchived repositories other than
+// forks that the authenticated account can push to
+func (c *Client) ListPushableRepositories(ctx context.Context) ([]*github.Repository, error) {
+	opts := &github.RepositoryListByAuthenticatedUserOptions{
+		Affiliation: "owner,collaborator,organization_member",
+		ListOptions: github.ListOptions{PerPage: 100},
+	}
+
+	var pushable []*github.Repository
+	for {
+		repos, resp, err := c.client.Repositories.ListByAuthenticatedUser(ctx, opts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list repositories: %w", err)
+		}
+		for _, repo := range repos {
+			if !repo.GetFork() && !repo.GetArchived() && repo.GetPermissions()["push"] {
+				pushable = append(pushable, repo)
+			}
+		}
+		if resp.NextPage == 0 {
+			return pushable, nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
+
+// ListInstallationRepositories returns the unarchived repositories other than
+// forks that the client's app installation has access to
+func (c *Client) ListInstallationRepositories(ctx context.Context) ([]*github.Repository, error) {
+	opts := &github.ListOptions{PerPage: 100}
+
+	var repositories []*github.Repository
+	for {
+		list, resp, err := c.client.Apps.ListRepos(ctx, opts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list installation repositories: %w", err)
+		}
+		for _, repo := range list.Repositories {
+			if !repo.GetFork() && !repo.GetArchived() {
+				repositories = append(repositories, repo)
+			}
+		}
+		if resp.NextPage == 0 {
+			return repositories, nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
+
+// GetRepository returns the full repository, including the parent of a fork
+func (c *Client) GetRepository(ctx context.Context, owner, repo string) (*github.Repository, error) {
+	repository, _, err := c.client.Repositories.Get(ctx, owner, repo)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get repository: %w", err)
+	}
+	return repository, nil
+}
+
+// ListBranches returns the names of the branches starting with prefix
+func (c *Client) ListBranches(ctx context.Context, owner, repo, prefix string) ([]string, error) {
+	opts := &github.BranchListOptions{ListOptions: github.ListOptions{PerPage: 100}}
+
+	var names []string
+	for {
+		branches, resp, err := c.client.Repositories.ListBranches(ctx, owner, repo, opts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list branches: %w", err)
+		}
+		for _, branch := range branches {
+			if strings.HasPrefix(branch.GetName(), prefix) {
+				names = append(names, branch.GetName())
+			}
+		}
+		if resp.NextPage == 0 {
+			return names, nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
+
+// ListBranchPullRequests returns the pull requests against upstream from
+// headOwner's branch, whatever their state
+func (c *Client) ListBranchPullRequests(ctx context.Context, upstreamOwner, upstreamRepo, headOwner, branch string) ([]*github.PullRequest, error) {
+	opts := &github.PullRequestListOptions{
+		State:       "all",
+		Head:        fmt.Sprintf("%s:%s", headOwner, branch),
+		ListOptions: github.ListOptions{PerPage: 100},
+	}
+
+	prs, _, err := c.client.PullRequests.List(ctx, upstreamOwner, upstreamRepo, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pull requests: %w", err)
+	}
+	return prs, nil
+}
+
+// SyncFork fast-forwards branch of a fork to its upstream counterpart
+func (c *Client) SyncFork(ctx context.Context, owner, repo, branch string) error {
+	request := &github.RepoMergeUpstreamRequest{Branch: github.String(branch)}
+	if _, _, err := c.client.Repositories.MergeUpstream(ctx, owner, repo, request); err != nil {
+		return fmt.Errorf("failed to sync fork: %w", err)
+	}
+	return nil
+}
+
+func (c *Client) ArchiveRepository(ctx context.Context, owner, repo string) error {
+	return c.setArchived(ctx, owner, repo, true)
+}
+
+func (c *Client) UnarchiveRepository(ctx context.Context, owner, repo string) error {
+	return c.setArchived(ctx, owner, repo, false)
+}
+
+func (c *Client) setArchived(ctx context.Context, owner, repo string, archived bool) error {
+	_, _, err := c.client.Repositories.Edit(ctx, owner, repo, &github.Repository{Archived: github.Bool(archived)})
+	if err != nil {
+		return fmt.Errorf("failed to set archived to %t: %w", archived, err)
+	}
+	return nil
+}
+
+// Requires the delete_repo scope
+func (c *Client) DeleteRepository(ctx context.Context, owner, repo string) error {
+	if _, err := c.client.Repositories.Delete(ctx, owner, repo); err != nil {
+		return fmt.Errorf("failed to delete repository: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,383 @@
+package github
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"hello-world/internal/git"
+
+	"github.com/google/go-github/v57/github"
+)
+
+var (
+	ErrTreeTruncated   = errors.New("repository tree is too large to list through the API")
+	ErrBaseUnavailable = errors.New("base commit is not available in the head repository")
+)
+
+const (
+	modeFile    = "100644"
+	modeSymlink = "120000"
+)
+
+// RemoteWorkspace reads and edits a branch through the GitHub API instead of
+// a clone. Reads come from the upstream repository; edits stay in memory
+// until Commit creates blobs, trees and commits in the head repository (the
+// fork, or upstream itself in direct-branch mode) and points the branch there
+type RemoteWorkspace struct {
+	client *Client
+	// Authenticated for the head repository, which for forks may need other
+	// credentials than upstream
+	head       *Client
+	owner      string
+	repo       string
+	headOwner  string
+	headRepo   string
+	baseBranch string
+
+	// Commit the branch starts from, and its tree
+	base     string
+	baseTree string
+	entries  map[string]*github.TreeEntry
+	blobs    map[string][]byte
+	// Encoded content of modified files
+	changes map[string][]byte
+}
+
+// OpenRemoteWorkspace lists the tip of baseBranch in owner/repo. Commits
+// will be created in headOwner/headRepo through head, which may be c itself.
+// A fork that lacks the tip has its baseBranch synced with upstream, which
+// pushes to the fork; see ensureInHead. Returns ErrTreeTruncated when the
+// tree is too large for the API and ErrBaseUnavailable when the fork cannot
+// be brought up to date with upstream
+func (c *Client) OpenRemoteWorkspace(ctx context.Context, owner, repo, baseBranch string, head *Client, headOwner, headRepo string) (*RemoteWorkspace, error) {
+	w := &RemoteWorkspace{
+		client:     c,
+		head:       head,
+		owner:      owner,
+		repo:       repo,
+		headOwner:  headOwner,
+		headRepo:   headRepo,
+		baseBranch: baseBranch,
+		changes:    make(map[string][]byte),
+	}
+
+	if err := w.load(ctx); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Loads the current tip of the base branch and makes sure the head
+// repository has it
+func (w *RemoteWorkspace) load(ctx context.Context) error {
+	branch, _, err := w.client.client.Repositories.GetBranch(ctx, w.owner, w.repo, w.baseBranch, 1)
+	if err != nil {
+		return fmt.Errorf("failed to get branch %s: %w", w.baseBranch, err)
+	}
+	base := branch.GetCommit().GetSHA()
+	baseTree := branch.GetCommit().GetCommit().GetTree().GetSHA()
+
+	tree, _, err := w.client.client.Git.GetTree(ctx, w.owner, w.repo, baseTree, true)
+	if err != nil {
+		return fmt.Errorf("failed to get tree: %w", err)
+	}
+	if tree.GetTruncated() {
+		return ErrTreeTruncated
+	}
+
+	if err := w.ensureInHead(ctx, base); err != nil {
+		return err
+	}
+
+	w.base = base
+	w.baseTree = baseTree
+	w.entries = make(map[string]*github.TreeEntry)
+	w.blobs = make(map[string][]byte)
+	for _, entry := range tree.Entries {
+		if entry.GetType() == "blob" {
+			w.entries[entry.GetPath()] = entry
+		}
+	}
+	return nil
+}
+
+// Forks only have upstream commits once they are synced, so a fork missing
+// sha gets its base branch synced through the merge-upstream API. This is a
+// write to the fork: its base branch moves to upstream's tip, or gets a merge
+// commit if it had commits of its own. Syncing fails when that merge
+// conflicts, in which case the clone path has to be used instead. The
+// repository itself is never written to in direct-branch mode
+func (w *RemoteWorkspace) ensureInHead(ctx context.Context, sha string) error {
+	if w.headOwner == w.owner && w.headRepo == w.repo {
+		return nil
+	}
+
+	_, _, err := w.head.client.Git.GetCommit(ctx, w.headOwner, w.headRepo, sha)
+	if err == nil {
+		return nil
+	}
+
+	request := &github.RepoMergeUpstreamRequest{Branch: github.String(w.baseBranch)}
+	if _, _, err := w.head.client.Repositories.MergeUpstream(ctx, w.headOwner, w.headRepo, request); err != nil {
+		return fmt.Errorf("%w: failed to sync fork: %v", ErrBaseUnavailable, err)
+	}
+	if _, _, err := w.head.client.Git.GetCommit(ctx, w.headOwner, w.headRepo, sha); err != nil {
+		return fmt.Errorf("%w: %v", ErrBaseUnavailable, err)
+	}
+	return nil
+}
+
+// ListFiles classifies the tree like git.ListFiles, fetching every
+// .gitignore and .gitattributes for the patterns
+func (w *RemoteWorkspace) ListFiles(ctx context.Context) (*git.FileTree, error) {
+	var files []git.TreeFile
+	patternFiles := make(map[string][]byte)
+	for name, entry := range w.entries {
+		files = append(files, git.TreeFile{Path: name, Size: int64(entry.GetSize())})
+
+		if base := path.Base(name); base == ".gitignore" || base == ".gitattributes" {
+			raw, err := w.blob(ctx, name)
+			if err != nil {
+				return nil, err
+			}
+			patternFiles[name] = raw
+		}
+	}
+
+	return git.BuildFileTree(files, patternFiles), nil
+}
+
+// ResolvePath applies git.ResolvePath's rules, treating symlinks in the tree
+// the way ResolvePath treats symlinks on disk
+func (w *RemoteWorkspace) ResolvePath(relPath string) (string, error) {
+	cleaned, err := git.CleanPath(relPath)
+	if err != nil {
+		return "", err
+	}
+
+	prefix := ""
+	for _, part := range strings.Split(cleaned, "/") {
+		prefix = path.Join(prefix, part)
+		if entry, ok := w.entries[prefix]; ok && entry.GetMode() == modeSymlink {
+			return "", &git.PathError{Path: relPath, Reason: "traverses a symlink"}
+		}
+	}
+	return cleaned, nil
+}
+
+// ReadFile returns the modified content if the file was written, otherwise
+// the content at the base commit, decoded like git.ReadFileContent
+func (w *RemoteWorkspace) ReadFile(ctx context.Context, relPath string) (string, error) {
+	relPath, err := w.ResolvePath(relPath)
+	if err != nil {
+		return "", err
+	}
+
+	raw, ok := w.changes[relPath]
+	if !ok {
+		if _, exists := w.entries[relPath]; !exists {
+			return "", fmt.Errorf("failed to read file: %w", os.ErrNotExist)
+		}
+		if raw, err = w.blob(ctx, relPath); err != nil {
+			return "", err
+		}
+	}
+
+	return git.DecodeContent(raw)
+}
+
+// WriteFile keeps the encoding and line endings of an existing file, like
+// git.WriteFile
+func (w *RemoteWorkspace) WriteFile(ctx context.Context, relPath, content string) error {
+	relPath, err := w.ResolvePath(relPath)
+	if err != nil {
+		return err
+	}
+
+	var existing []byte
+	if _, exists := w.entries[relPath]; exists {
+		if existing, err = w.blob(ctx, relPath); err != nil {
+			return err
+		}
+	}
+
+	encoded, err := git.EncodeContent(content, existing)
+	if err != nil {
+		return err
+	}
+	w.changes[relPath] = encoded
+	return nil
+}
+
+// RestoreFile drops any modification of relPath
+func (w *RemoteWorkspace) RestoreFile(relPath string) error {
+	relPath, err := w.ResolvePath(relPath)
+	if err != nil {
+		return err
+	}
+	delete(w.changes, relPath)
+	return nil
+}
+
+// Rebase moves the workspace onto the current tip of the base branch. Like
+// git.RebaseOntoUpstream, paths upstream changed in the meantime lose their
+// modification and are reported as conflicts
+func (w *RemoteWorkspace) Rebase(ctx context.Context, paths []string) (*git.RebaseResult, error) {
+	oldBase := w.base
+	oldEntries := w.entries
+	if err := w.load(ctx); err != nil {
+		return nil, err
+	}
+
+	result := &git.RebaseResult{OldBase: oldBase, NewBase: w.base}
+	for _, relPath := range paths {
+		oldEntry, newEntry := oldEntries[relPath], w.entries[relPath]
+		if (oldEntry == nil) != (newEntry == nil) ||
+			(oldEntry != nil && (oldEntry.GetSHA() != newEntry.GetSHA() || oldEntry.GetMode() != newEntry.GetMode())) {
+			result.Conflicts = append(result.Conflicts, relPath)
+			delete(w.changes, relPath)
+		}
+	}
+	return result, nil
+}
+
+// Commit creates one commit per entry on top of the base commit and points
+// branchName in the head repository at the last one. A commit without Paths
+// takes every remaining change. Returns git.ErrNoChanges if nothing differs
+// from the base
+func (w *RemoteWorkspace) Commit(ctx context.Context, branchName string, commits []git.Commit, opts git.CommitOptions) error {
+	remaining := make(map[string][]byte, len(w.changes))
+	for relPath, content := range w.changes {
+		remaining[relPath] = content
+	}
+
+	parent, tree := w.base, w.baseTree
+	created := 0
+	for _, c := range commits {
+		paths := c.Paths
+		if len(paths) == 0 {
+			for relPath := range remaining {
+				paths = append(paths, relPath)
+			}
+		}
+
+		var entries []*github.TreeEntry
+		for _, relPath := range paths {
+			content, ok := remaining[relPath]
+			if !ok {
+				continue
+			}
+			delete(remaining, relPath)
+
+			mode := modeFile
+			if entry, exists := w.entries[relPath]; exists {
+				if entry.GetSHA() == blobSHA(content) {
+					continue
+				}
+				mode = entry.GetMode()
+			}
+
+			blob, _, err := w.head.client.Git.CreateBlob(ctx, w.headOwner, w.headRepo, &github.Blob{
+				Content:  github.String(base64.StdEncoding.EncodeToString(content)),
+				Encoding: github.String("base64"),
+			})
+			if err != nil {
+				return fmt.Errorf("failed to create blob for %s: %w", relPath, err)
+			}
+			entries = append(entries, &github.TreeEntry{
+				Path: github.String(relPath),
+				Mode: github.String(mode),
+				Type: github.String("blob"),
+				SHA:  blob.SHA,
+			})
+		}
+		if len(entries) == 0 {
+			continue
+		}
+
+		newTree, _, err := w.head.client.Git.CreateTree(ctx, w.headOwner, w.headRepo, tree, entries)
+		if err != nil {
+			return fmt.Errorf("failed to create tree: %w", err)
+		}
+
+		signature := opts.Signature()
+		author := &github.CommitAuthor{
+			Name:  github.String(signature.Name),
+			Email: github.String(signature.Email),
+			Date:  &github.Timestamp{Time: signature.When.Truncate(1e9)},
+		}
+		commitOpts := &github.CreateCommitOptions{}
+		if opts.Signer != nil {
+			commitOpts.Signer = github.MessageSignerFunc(func(w io.Writer, r io.Reader) error {
+				signed, err := opts.Signer.Sign(r)
+				if err != nil {
+					return err
+				}
+				_, err = w.Write(signed)
+				return err
+			})
+		}
+		commit, _, err := w.head.client.Git.CreateCommit(ctx, w.headOwner, w.headRepo, &github.Commit{
+			Message:   github.String(opts.Message(c.Message)),
+			Tree:      &github.Tree{SHA: newTree.SHA},
+			Parents:   []*github.Commit{{SHA: github.String(parent)}},
+			Author:    author,
+			Committer: author,
+		}, commitOpts)
+		if err != nil {
+			return fmt.Errorf("failed to create commit: %w", err)
+		}
+
+		parent, tree = commit.GetSHA(), newTree.GetSHA()
+		created++
+	}
+
+	if created == 0 {
+		return git.ErrNoChanges
+	}
+
+	ref := &github.Reference{
+		Ref:    github.String("refs/heads/" + branchName),
+		Object: &github.GitObject{SHA: github.String(parent)},
+	}
+	_, resp, err := w.head.client.Git.CreateRef(ctx, w.headOwner, w.headRepo, ref)
+	if resp != nil && resp.StatusCode == http.StatusUnprocessableEntity {
+		// The branch already exists; only fast-forward it
+		_, _, err = w.head.client.Git.UpdateRef(ctx, w.headOwner, w.headRepo, ref, false)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update branch %s: %w", branchName, err)
+	}
+	return nil
+}
+
+// Fetches and caches the raw content of a file at the base commit
+func (w *RemoteWorkspace) blob(ctx context.Context, relPath string) ([]byte, error) {
+	if raw, ok := w.blobs[relPath]; ok {
+		return raw, nil
+	}
+
+	raw, _, err := w.client.client.Git.GetBlobRaw(ctx, w.owner, w.repo, w.entries[relPath].GetSHA())
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", relPath, err)
+	}
+	w.blobs[relPath] = raw
+	return raw, nil
+}
+
+// Git's object ID for a blob with this content
+func blobSHA(content []byte) string {
+	hash := sha1.New()
+	fmt.Fprintf(hash, "blob %d\x00", len(content))
+	hash.Write(content)
+	return hex.EncodeToString(hash.Sum(nil))
+}
@@ -0,0 +1,521 @@
+package github
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"hello-world/internal/git"
+)
+
+type fakeEntry struct {
+	Path string `json:"path"`
+	Mode string `json:"mode"`
+	Type string `json:"type"`
+	SHA  string `json:"sha"`
+	Size int    `json:"size,omitempty"`
+}
+
+type fakeCommit struct {
+	Message string   `json:"message"`
+	Tree    string   `json:"tree"`
+	Parents []string `json:"parents"`
+	Author  struct {
+		Name  string `json:"name"`
+		Email string `json:"email"`
+	} `json:"author"`
+}
+
+// An in-memory GitHub serving the Git Data API for upstream owner/repo and
+// its fork bot/repo. Trees are flat lists of blobs, as recursive listings
+// return them
+type fakeGitData struct {
+	t  *testing.T
+	mu sync.Mutex
+
+	// Branch tips per repository, "owner/repo" -> branch -> commit
+	branches map[string]map[string]string
+	// Commits each repository has
+	has       map[string]map[string]bool
+	commits   map[string]*fakeCommit
+	trees     map[string][]fakeEntry
+	blobs     map[string]string
+	truncated bool
+	// Answer merge-upstream with this status when set
+	mergeStatus int
+
+	// Requests made, as "METHOD /path"
+	calls   []string
+	created []*fakeCommit
+	refs    map[string]string
+}
+
+// Starts with a base commit whose tree holds files on main of owner/repo.
+// The fork has no commits
+func newFakeGitData(t *testing.T, files map[string]string) *fakeGitData {
+	f := &fakeGitData{
+		t:        t,
+		branches: map[string]map[string]string{"owner/repo": {}, "bot/repo": {}},
+		has:      map[string]map[string]bool{"owner/repo": {}, "bot/repo": {}},
+		commits:  make(map[string]*fakeCommit),
+		trees:    make(map[string][]fakeEntry),
+		blobs:    make(map[string]string),
+		refs:     make(map[string]string),
+	}
+	f.commit("owner/repo", "main", "base", files)
+	return f
+}
+
+// Adds a commit with files on top of branch in repo
+func (f *fakeGitData) commit(repo, branch, sha string, files map[string]string) {
+	var entries []fakeEntry
+	if tip, ok := f.branches[repo][branch]; ok {
+		entries = append(entries, f.trees[f.commits[tip].Tree]...)
+	}
+	for name, content := range files {
+		entry := fakeEntry{Path: name, Mode: modeFile, Type: "blob", SHA: blobSHA([]byte(content)), Size: len(content)}
+		if strings.HasPrefix(content, "symlink:") {
+			entry.Mode = modeSymlink
+		}
+		f.blobs[entry.SHA] = content
+		entries = setEntry(entries, entry)
+	}
+	tree := "tree-" + sha
+	f.trees[tree] = entries
+	f.commits[sha] = &fakeCommit{Tree: tree}
+	f.branches[repo][branch] = sha
+	f.has[repo][sha] = true
+}
+
+func setEntry(entries []fakeEntry, entry fakeEntry) []fakeEntry {
+	for i := range entries {
+		if entries[i].Path == entry.Path {
+			entries[i] = entry
+			return entries
+		}
+	}
+	return append(entries, entry)
+}
+
+func (f *fakeGitData) client() *Client {
+	return newTestClient(f.t, f)
+}
+
+func (f *fakeGitData) called(call string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	count := 0
+	for _, c := range f.calls {
+		if c == call {
+			count++
+		}
+	}
+	return count
+}
+
+func (f *fakeGitData) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, r.Method+" "+r.URL.Path)
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/repos/"), "/", 3)
+	if len(parts) < 3 || f.has[parts[0]+"/"+parts[1]] == nil {
+		http.NotFound(w, r)
+		return
+	}
+	repo, rest := parts[0]+"/"+parts[1], parts[2]
+
+	reply := func(status int, value interface{}) {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(value)
+	}
+	decode := func(value interface{}) {
+		if err := json.NewDecoder(r.Body).Decode(value); err != nil {
+			f.t.Errorf("%s %s: %v", r.Method, r.URL.Path, err)
+		}
+	}
+
+	switch {
+	case r.Method == http.MethodGet && strings.HasPrefix(rest, "branches/"):
+		sha, ok := f.branches[repo][strings.TrimPrefix(rest, "branches/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		reply(http.StatusOK, map[string]interface{}{
+			"commit": map[string]interface{}{"sha": sha, "commit": map[string]interface{}{"tree": map[string]string{"sha": f.commits[sha].Tree}}},
+		})
+
+	case r.Method == http.MethodGet && strings.HasPrefix(rest, "git/trees/"):
+		if r.URL.Query().Get("recursive") == "" {
+			f.t.Errorf("tree of %s was not listed recursively", repo)
+		}
+		sha := strings.TrimPrefix(rest, "git/trees/")
+		reply(http.StatusOK, map[string]interface{}{"sha": sha, "truncated": f.truncated, "tree": f.trees[sha]})
+
+	case r.Method == http.MethodGet && strings.HasPrefix(rest, "git/commits/"):
+		sha := strings.TrimPrefix(rest, "git/commits/")
+		if !f.has[repo][sha] {
+			http.NotFound(w, r)
+			return
+		}
+		reply(http.StatusOK, map[string]string{"sha": sha})
+
+	case r.Method == http.MethodGet && strings.HasPrefix(rest, "git/blobs/"):
+		content, ok := f.blobs[strings.TrimPrefix(rest, "git/blobs/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, content)
+
+	case r.Method == http.MethodPost && rest == "merge-upstream":
+		var request struct {
+			Branch string `json:"branch"`
+		}
+		decode(&request)
+		if f.mergeStatus != 0 {
+			reply(f.mergeStatus, map[string]string{"message": "There are merge conflicts"})
+			return
+		}
+		tip, ok := f.branches["owner/repo"][request.Branch]
+		if !ok {
+			reply(http.StatusUnprocessableEntity, map[string]string{"message": "branch not found"})
+			return
+		}
+		f.branches[repo][request.Branch] = tip
+		f.has[repo][tip] = true
+		reply(http.StatusOK, map[string]string{"merge_type": "fast-forward"})
+
+	case r.Method == http.MethodPost && rest == "git/blobs":
+		var blob struct {
+			Content  string `json:"content"`
+			Encoding string `json:"encoding"`
+		}
+		decode(&blob)
+		content, err := base64.StdEncoding.DecodeString(blob.Content)
+		if err != nil || blob.Encoding != "base64" {
+			f.t.Errorf("blob is not base64: %q", blob.Content)
+		}
+		sha := blobSHA(content)
+		f.blobs[sha] = string(content)
+		reply(http.StatusCreated, map[string]string{"sha": sha})
+
+	case r.Method == http.MethodPost && rest == "git/trees":
+		var request struct {
+			BaseTree string      `json:"base_tree"`
+			Tree     []fakeEntry `json:"tree"`
+		}
+		decode(&request)
+		base, ok := f.trees[request.BaseTree]
+		if !ok {
+			reply(http.StatusUnprocessableEntity, map[string]string{"message": "base_tree is not a valid tree"})
+			return
+		}
+		entries := append([]fakeEntry(nil), base...)
+		for _, entry := range request.Tree {
+			if _, ok := f.blobs[entry.SHA]; !ok {
+				reply(http.StatusUnprocessableEntity, map[string]string{"message": "blob not found"})
+				return
+			}
+			entries = setEntry(entries, entry)
+		}
+		sha := fmt.Sprintf("tree-%d", len(f.trees))
+		f.trees[sha] = entries
+		reply(http.StatusCreated, map[string]string{"sha": sha})
+
+	case r.Method == http.MethodPost && rest == "git/commits":
+		var commit fakeCommit
+		decode(&commit)
+		for _, parent := range commit.Parents {
+			if !f.has[repo][parent] {
+				reply(http.StatusUnprocessableEntity, map[string]string{"message": "parent is not in " + repo})
+				return
+			}
+		}
+		sha := fmt.Sprintf("commit-%d", len(f.created)+1)
+		f.commits[sha] = &commit
+		f.has[repo][sha] = true
+		f.created = append(f.created, &commit)
+		reply(http.StatusCreated, map[string]string{"sha": sha})
+
+	case r.Method == http.MethodPost && rest == "git/refs":
+		var ref struct {
+			Ref string `json:"ref"`
+			SHA string `json:"sha"`
+		}
+		decode(&ref)
+		if _, exists := f.refs[ref.Ref]; exists {
+			reply(http.StatusUnprocessableEntity, map[string]string{"message": "Reference already exists"})
+			return
+		}
+		f.refs[ref.Ref] = ref.SHA
+		reply(http.StatusCreated, map[string]interface{}{"ref": ref.Ref, "object": map[string]string{"sha": ref.SHA}})
+
+	case r.Method == http.MethodPatch && strings.HasPrefix(rest, "git/refs/"):
+		var update struct {
+			SHA   string `json:"sha"`
+			Force bool   `json:"force"`
+		}
+		decode(&update)
+		name := strings.TrimPrefix(rest, "git/")
+		if update.Force {
+			f.t.Errorf("%s was force-updated", name)
+		}
+		f.refs[name] = update.SHA
+		reply(http.StatusOK, map[string]interface{}{"ref": name, "object": map[string]string{"sha": update.SHA}})
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestOpenRemoteWorkspace(t *testing.T) {
+	fake := newFakeGitData(t, map[string]string{
+		"README.md":     "readme\n",
+		"docs/guide.md": "guide\r\n",
+		".gitignore":    "*.log\n",
+		"build.log":     "log\n",
+		"docs/link":     "symlink:../README.md",
+		"vendor/a/a.go": "package a\n",
+		"docs/.gitkeep": "",
+	})
+	fake.has["bot/repo"]["base"] = true
+	client := fake.client()
+
+	w, err := client.OpenRemoteWorkspace(context.Background(), "owner", "repo", "main", client, "bot", "repo")
+	if err != nil {
+		t.Fatalf("OpenRemoteWorkspace: %v", err)
+	}
+	if w.base != "base" || w.baseTree != "tree-base" {
+		t.Errorf("base = %s, %s; want base, tree-base", w.base, w.baseTree)
+	}
+
+	tree, err := w.ListFiles(context.Background())
+	if err != nil {
+		t.Fatalf("ListFiles: %v", err)
+	}
+	for _, path := range []string{"README.md", "docs/guide.md", "vendor/a/a.go"} {
+		if tree.Find(path) == nil {
+			t.Errorf("%s is missing from the file tree", path)
+		}
+	}
+	if node := tree.Find("build.log"); node == nil || !node.Ignored {
+		t.Errorf("build.log = %+v, want it ignored by .gitignore", node)
+	}
+
+	got, err := w.ReadFile(context.Background(), "docs/guide.md")
+	if err != nil || got != "guide\n" {
+		t.Errorf("docs/guide.md = %q, %v; want it decoded with LF endings", got, err)
+	}
+	if _, err := w.ReadFile(context.Background(), "missing.md"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("reading missing.md = %v, want os.ErrNotExist", err)
+	}
+	var pathErr *git.PathError
+	if _, err := w.ReadFile(context.Background(), "docs/link/x"); !errors.As(err, &pathErr) {
+		t.Errorf("reading through a symlink = %v, want a *git.PathError", err)
+	}
+	if _, err := w.ResolvePath("../outside"); !errors.As(err, &pathErr) {
+		t.Errorf("ResolvePath(../outside) = %v, want a *git.PathError", err)
+	}
+
+	// Blobs are fetched once
+	w.ReadFile(context.Background(), "docs/guide.md")
+	if n := fake.called("GET /repos/owner/repo/git/blobs/" + blobSHA([]byte("guide\r\n"))); n != 1 {
+		t.Errorf("docs/guide.md was fetched %d times, want once", n)
+	}
+}
+
+func TestOpenRemoteWorkspaceTruncated(t *testing.T) {
+	fake := newFakeGitData(t, map[string]string{"README.md": "readme\n"})
+	fake.truncated = true
+	client := fake.client()
+
+	_, err := client.OpenRemoteWorkspace(context.Background(), "owner", "repo", "main", client, "owner", "repo")
+	if !errors.Is(err, ErrTreeTruncated) {
+		t.Errorf("err = %v, want ErrTreeTruncated", err)
+	}
+}
+
+func TestEnsureInHead(t *testing.T) {
+	tests := []struct {
+		name string
+		// Whether the fork already has the base commit
+		forkHasBase bool
+		mergeStatus int
+		headOwner   string
+		wantErr     error
+		wantMerges  int
+	}{
+		{name: "fork has the base", forkHasBase: true, headOwner: "bot"},
+		{name: "fork behind", headOwner: "bot", wantMerges: 1},
+		{name: "fork diverged", headOwner: "bot", mergeStatus: http.StatusConflict, wantErr: ErrBaseUnavailable, wantMerges: 1},
+		{name: "direct branch", headOwner: "owner"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeGitData(t, map[string]string{"README.md": "readme\n"})
+			fake.has["bot/repo"]["base"] = tt.forkHasBase
+			fake.mergeStatus = tt.mergeStatus
+			client := fake.client()
+
+			_, err := client.OpenRemoteWorkspace(context.Background(), "owner", "repo", "main", client, tt.headOwner, "repo")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if n := fake.called("POST /repos/bot/repo/merge-upstream"); n != tt.wantMerges {
+				t.Errorf("fork synced %d times, want %d", n, tt.wantMerges)
+			}
+			if tt.headOwner == "owner" && fake.called("GET /repos/owner/repo/git/commits/base") > 0 {
+				t.Error("the base commit was looked up in upstream itself")
+			}
+			if tt.wantMerges > 0 && tt.wantErr == nil && fake.branches["bot/repo"]["main"] != "base" {
+				t.Errorf("fork main = %q after the sync, want base", fake.branches["bot/repo"]["main"])
+			}
+		})
+	}
+}
+
+func TestRemoteWorkspaceCommit(t *testing.T) {
+	fake := newFakeGitData(t, map[string]string{
+		"README.md":   "readme\n",
+		"windows.txt": "a\r\nb\r\n",
+		"same.md":     "same\n",
+		"run.sh":      "#!/bin/sh\n",
+	})
+	for i, entry := range fake.trees["tree-base"] {
+		if entry.Path == "run.sh" {
+			fake.trees["tree-base"][i].Mode = "100755"
+		}
+	}
+	client := fake.client()
+
+	w, err := client.OpenRemoteWorkspace(context.Background(), "owner", "repo", "main", client, "bot", "repo")
+	if err != nil {
+		t.Fatalf("OpenRemoteWorkspace: %v", err)
+	}
+	for path, content := range map[string]string{
+		"README.md":   "changed\n",
+		"windows.txt": "c\nd\n",
+		"same.md":     "same\n",
+		"run.sh":      "#!/bin/sh\necho hi\n",
+		"docs/new.md": "new",
+	} {
+		if err := w.WriteFile(context.Background(), path, content); err != nil {
+			t.Fatalf("WriteFile(%s): %v", path, err)
+		}
+	}
+	if got, err := w.ReadFile(context.Background(), "README.md"); err != nil || got != "changed\n" {
+		t.Errorf("README.md = %q, %v; want the written content", got, err)
+	}
+
+	opts := git.CommitOptions{AuthorName: "Bot", AuthorEmail: "bot@example.com", Trailers: []string{"Auto-PR-Request-Id: 1"}}
+	commits := []git.Commit{
+		{Message: "Update README", Paths: []string{"README.md", "same.md"}},
+		{Message: "Nothing left", Paths: []string{"README.md"}},
+		{Message: "Everything else"},
+	}
+	if err := w.Commit(context.Background(), "auto-pr-bot/1", commits, opts); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+
+	// The fork was synced so it holds the parent
+	if n := fake.called("POST /repos/bot/repo/merge-upstream"); n != 1 {
+		t.Errorf("fork synced %d times, want once", n)
+	}
+	// Unchanged files and empty groups make no objects
+	if n := fake.called("POST /repos/bot/repo/git/blobs"); n != 4 {
+		t.Errorf("%d blobs created, want 4", n)
+	}
+	if len(fake.created) != 2 {
+		t.Fatalf("%d commits created, want 2", len(fake.created))
+	}
+	first, second := fake.created[0], fake.created[1]
+	if first.Message != "Update README\n\nAuto-PR-Request-Id: 1\n" || first.Author.Name != "Bot" || first.Author.Email != "bot@example.com" {
+		t.Errorf("first commit = %+v, want the message with trailers by Bot", first)
+	}
+	if len(first.Parents) != 1 || first.Parents[0] != "base" {
+		t.Errorf("first commit parents = %v, want base", first.Parents)
+	}
+	if len(second.Parents) != 1 || second.Parents[0] != "commit-1" {
+		t.Errorf("second commit parents = %v, want commit-1", second.Parents)
+	}
+	if fake.refs["refs/heads/auto-pr-bot/1"] != "commit-2" {
+		t.Errorf("branch = %q, want commit-2", fake.refs["refs/heads/auto-pr-bot/1"])
+	}
+
+	// The second tree builds on the first, and files keep their format
+	want := map[string]string{
+		"README.md":   "changed\n",
+		"windows.txt": "c\r\nd\r\n",
+		"same.md":     "same\n",
+		"run.sh":      "#!/bin/sh\necho hi\n",
+		"docs/new.md": "new\n",
+	}
+	got := make(map[string]string)
+	for _, entry := range fake.trees[second.Tree] {
+		got[entry.Path] = fake.blobs[entry.SHA]
+		if entry.Path == "run.sh" && entry.Mode != "100755" {
+			t.Errorf("run.sh mode = %s, want 100755", entry.Mode)
+		}
+	}
+	for path, content := range want {
+		if got[path] != content {
+			t.Errorf("%s = %q in the final tree, want %q", path, got[path], content)
+		}
+	}
+	for _, entry := range fake.trees[first.Tree] {
+		if entry.Path == "run.sh" && fake.blobs[entry.SHA] != "#!/bin/sh\n" {
+			t.Error("the first commit took a change outside its paths")
+		}
+	}
+
+	// Committing again fast-forwards the existing branch
+	if err := w.WriteFile(context.Background(), "README.md", "again\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Commit(context.Background(), "auto-pr-bot/1", []git.Commit{{Message: "Again"}}, opts); err != nil {
+		t.Fatalf("second Commit: %v", err)
+	}
+	if n := fake.called("PATCH /repos/bot/repo/git/refs/heads/auto-pr-bot/1"); n != 1 {
+		t.Errorf("branch updated %d times, want once", n)
+	}
+	if tip := fake.refs["refs/heads/auto-pr-bot/1"]; tip != "commit-3" {
+		t.Errorf("branch = %q after the update, want commit-3", tip)
+	}
+}
+
+func TestRemoteWorkspaceCommitNoChanges(t *testing.T) {
+	fake := newFakeGitData(t, map[string]string{"README.md": "readme\n"})
+	client := fake.client()
+
+	w, err := client.OpenRemoteWorkspace(context.Background(), "owner", "repo", "main", client, "owner", "repo")
+	if err != nil {
+		t.Fatalf("OpenRemoteWorkspace: %v", err)
+	}
+	if err := w.WriteFile(context.Background(), "README.md", "readme"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteFile(context.Background(), "new.md", "new\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.RestoreFile("new.md"); err != nil {
+		t.Fatal(err)
+	}
+
+	err = w.Commit(context.Background(), "auto-pr-bot/1", []git.Commit{{Message: "change"}}, git.CommitOptions{})
+	if !errors.Is(err, git.ErrNoChanges) {
+		t.Errorf("err = %v, want git.ErrNoChanges", err)
+	}
+	if len(fake.refs) > 0 {
+		t.Errorf("refs = %v, want no branch", fake.refs)
+	}
+}
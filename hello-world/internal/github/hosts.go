@@ -0,0 +1,50 @@
+package github
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// DefaultHost is assumed for repository URLs that do not name a host
+const DefaultHost = "github.com"
+
+var ErrHostNotAllowed = errors.New("host is not allowed")
+
+// Host is a GitHub instance repositories live on: github.com or a GitHub
+// Enterprise Server
+type Host struct {
+	// Hostname as it appears in repository URLs
+	Name string
+	// Scheme and host of the web UI, which also serves git
+	webURL     string
+	enterprise bool
+}
+
+var githubDotCom = &Host{Name: DefaultHost, webURL: "https://github.com"}
+
+// Parses a GitHub Enterprise Server URL such as https://ghe.example.com. The
+// API is served from /api/v3 on the same host
+func parseEnterpriseHost(rawURL string) (*Host, error) {
+	parsed, err := url.Parse(strings.TrimSuffix(rawURL, "/"))
+	if err != nil || parsed.Host == "" || (parsed.Scheme != "https" && parsed.Scheme != "http") {
+		return nil, fmt.Errorf("invalid GitHub Enterprise URL %q", rawURL)
+	}
+	name := strings.ToLower(parsed.Host)
+	return &Host{
+		Name:       name,
+		webURL:     parsed.Scheme + "://" + name,
+		enterprise: true,
+	}, nil
+}
+
+// RepoURL returns the repository's web URL; appending .git gives its clone URL
+func (h *Host) RepoURL(owner, repo string) string {
+	return fmt.Sprintf("%s/%s/%s", h.webURL, owner, repo)
+}
+
+// Enterprise reports whether this is a GitHub Enterprise Server
+func (h *Host) Enterprise() bool {
+	return h.enterprise
+}
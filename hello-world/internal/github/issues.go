@@ -0,0 +1,87 @@
+package github
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/google/go-github/v57/github"
+)
+
+// Issue is what the bot needs from an issue to work on it
+type Issue struct {
+	Number   int
+	Title    string
+	Body     string
+	Labels   []string
+	Comments []IssueComment
+}
+
+type IssueComment struct {
+	Author string
+	Body   string
+}
+
+// Example: https://github.com/owner/repo/issues/123 -> ("github.com", owner, repo, 123, nil)
+func ParseIssueURL(issueURL string) (string, string, string, int, error) {
+	host, owner, repo, err := ParseRepoURL(issueURL)
+	if err != nil {
+		return "", "", "", 0, err
+	}
+
+	issueURL = strings.TrimSuffix(issueURL, "/")
+	index := strings.LastIndex(issueURL, "/issues/")
+	if index < 0 {
+		return "", "", "", 0, fmt.Errorf("invalid GitHub issue URL format")
+	}
+	number, err := strconv.Atoi(issueURL[index+len("/issues/"):])
+	if err != nil || number <= 0 {
+		return "", "", "", 0, fmt.Errorf("invalid GitHub issue URL format")
+	}
+
+	return host, owner, repo, number, nil
+}
+
+// GetIssue fetches an issue with all of its comments, oldest first. Pull
+// requests are rejected even though the API serves them as issues
+func (c *Client) GetIssue(ctx context.Context, owner, repo string, number int) (*Issue, error) {
+	issue, _, err := c.client.Issues.Get(ctx, owner, repo, number)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get issue #%d: %w", number, err)
+	}
+	if issue.IsPullRequest() {
+		return nil, fmt.Errorf("#%d is a pull request, not an issue", number)
+	}
+
+	result := &Issue{
+		Number: number,
+		Title:  issue.GetTitle(),
+		Body:   issue.GetBody(),
+	}
+	for _, label := range issue.Labels {
+		result.Labels = append(result.Labels, label.GetName())
+	}
+
+	opts := &github.IssueListCommentsOptions{
+		ListOptions: github.ListOptions{PerPage: 100},
+	}
+	for {
+		comments, resp, err := c.client.Issues.ListComments(ctx, owner, repo, number, opts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list comments on issue #%d: %w", number, err)
+		}
+		for _, comment := range comments {
+			result.Comments = append(result.Comments, IssueComment{
+				Author: comment.GetUser().GetLogin(),
+				Body:   comment.GetBody(),
+			})
+		}
+		if resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+
+	return result, nil
+}
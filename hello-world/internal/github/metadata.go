@@ -0,0 +1,95 @@
+package github
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/google/go-github/v57/github"
+)
+
+// PullRequestMetadata is applied to a pull request once it exists
+type PullRequestMetadata struct {
+	Labels        []string
+	Reviewers     []string
+	TeamReviewers []string
+	Assignees     []string
+	// Milestone number, zero for none
+	Milestone int
+}
+
+// FieldError is a pull request field that could not be set
+type FieldError struct {
+	Field string
+	Err   error
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("failed to set %s: %v", e.Field, e.Err)
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+// ApplyPullRequestMetadata sets each field separately, so a missing
+// permission for one does not keep the others from being applied. It returns
+// an error for every field that failed
+func (c *Client) ApplyPullRequestMetadata(ctx context.Context, owner, repo string, number int, metadata PullRequestMetadata) []*FieldError {
+	var failed []*FieldError
+
+	if len(metadata.Labels) > 0 {
+		if _, _, err := c.client.Issues.AddLabelsToIssue(ctx, owner, repo, number, metadata.Labels); err != nil {
+			failed = append(failed, &FieldError{Field: "labels", Err: err})
+		}
+	}
+
+	if len(metadata.Assignees) > 0 {
+		// GitHub silently drops users who cannot be assigned
+		issue, _, err := c.client.Issues.AddAssignees(ctx, owner, repo, number, metadata.Assignees)
+		if err != nil {
+			failed = append(failed, &FieldError{Field: "assignees", Err: err})
+		} else if missing := missingUsers(metadata.Assignees, issue.Assignees); len(missing) > 0 {
+			failed = append(failed, &FieldError{Field: "assignees", Err: fmt.Errorf("cannot assign %s", strings.Join(missing, ", "))})
+		}
+	}
+
+	if metadata.Milestone > 0 {
+		edit := &github.IssueRequest{Milestone: github.Int(metadata.Milestone)}
+		if _, _, err := c.client.Issues.Edit(ctx, owner, repo, number, edit); err != nil {
+			failed = append(failed, &FieldError{Field: "milestone", Err: err})
+		}
+	}
+
+	if len(metadata.Reviewers) > 0 {
+		reviewers := github.ReviewersRequest{Reviewers: metadata.Reviewers}
+		if _, _, err := c.client.PullRequests.RequestReviewers(ctx, owner, repo, number, reviewers); err != nil {
+			failed = append(failed, &FieldError{Field: "reviewers", Err: err})
+		}
+	}
+
+	if len(metadata.TeamReviewers) > 0 {
+		reviewers := github.ReviewersRequest{TeamReviewers: metadata.TeamReviewers}
+		if _, _, err := c.client.PullRequests.RequestReviewers(ctx, owner, repo, number, reviewers); err != nil {
+			failed = append(failed, &FieldError{Field: "teamReviewers", Err: err})
+		}
+	}
+
+	return failed
+}
+
+// Returns the requested logins that are not among users
+func missingUsers(requested []string, users []*github.User) []string {
+	present := make(map[string]bool, len(users))
+	for _, user := range users {
+		present[strings.ToLower(user.GetLogin())] = true
+	}
+
+	var missing []string
+	for _, login := range requested {
+		if !present[strings.ToLower(login)] {
+			missing = append(missing, login)
+		}
+	}
+	return missing
+}
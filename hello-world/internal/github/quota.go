@@ -0,0 +1,269 @@
+package github
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/v57/github"
+)
+
+const (
+	// Longest a request waits for the quota to reset before failing instead
+	maxQuotaWait = time.Minute
+	// Retries of a request refused by a secondary rate limit
+	maxSecondaryRetries = 2
+	// GitHub asks for at least a minute between retries when it sends no
+	// Retry-After
+	secondaryBackoff = time.Minute
+)
+
+// QuotaExhaustedError reports that the token's GitHub API quota is used up
+// until Reset
+type QuotaExhaustedError struct {
+	Reset time.Time
+}
+
+func (e *QuotaExhaustedError) Error() string {
+	return QuotaMessage(e.Reset)
+}
+
+// QuotaMessage describes a quota that is used up until reset
+func QuotaMessage(reset time.Time) string {
+	return fmt.Sprintf("GitHub quota exhausted until %s", reset.UTC().Format(time.RFC3339))
+}
+
+// QuotaReset returns when the quota behind err resets, if err was caused by
+// a GitHub rate limit
+func QuotaReset(err error) (time.Time, bool) {
+	var exhausted *QuotaExhaustedError
+	if errors.As(err, &exhausted) {
+		return exhausted.Reset, true
+	}
+	var rateLimited *github.RateLimitError
+	if errors.As(err, &rateLimited) {
+		return rateLimited.Rate.Reset.Time, true
+	}
+	var abuse *github.AbuseRateLimitError
+	if errors.As(err, &abuse) {
+		if retryAfter := abuse.GetRetryAfter(); retryAfter > 0 {
+			return time.Now().Add(retryAfter), true
+		}
+		return time.Now().Add(secondaryBackoff), true
+	}
+	return time.Time{}, false
+}
+
+// CheckQuota returns a *QuotaExhaustedError if the core API quota is used
+// up. The rate limit endpoint itself does not count against the quota
+func (c *Client) CheckQuota(ctx context.Context) error {
+	limits, resp, err := c.client.RateLimit.Get(ctx)
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		// Rate limiting is disabled on this GitHub Enterprise Server
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get rate limit: %w", err)
+	}
+
+	core := limits.GetCore()
+	if core != nil && core.Remaining == 0 && time.Now().Before(core.Reset.Time) {
+		return &QuotaExhaustedError{Reset: core.Reset.Time}
+	}
+	return nil
+}
+
+// Tracks the quota from response headers. Once it is used up, requests wait
+// for the reset if it is close and fail with QuotaExhaustedError otherwise,
+// instead of being refused by GitHub. Secondary rate limits are retried with
+// backoff
+type rateLimitTransport struct {
+	base http.RoundTripper
+}
+
+// Quota is per token and resource, and every request builds new clients, so
+// what one client learns is shared with the others using the same token.
+// Keyed by a hash of the Authorization header and the resource. Only the core
+// resource, which nearly every call uses, is tracked; search and GraphQL have
+// their own quotas that must not block REST calls
+var quotas = struct {
+	mu     sync.Mutex
+	tokens map[[sha256.Size]byte]*quota
+}{tokens: make(map[[sha256.Size]byte]*quota)}
+
+const coreResource = "core"
+
+type quota struct {
+	remaining int
+	reset     time.Time
+}
+
+// Returns the core quota of the request's token, or nil for requests
+// against another resource
+func quotaFor(req *http.Request) *quota {
+	if requestResource(req) != coreResource {
+		return nil
+	}
+	key := sha256.Sum256([]byte(req.Header.Get("Authorization") + "\x00" + coreResource))
+	quotas.mu.Lock()
+	defer quotas.mu.Unlock()
+	q, ok := quotas.tokens[key]
+	if !ok {
+		// Installation tokens rotate hourly, so drop quotas that have
+		// reset; they tell nothing anymore
+		now := time.Now()
+		for key, old := range quotas.tokens {
+			if !old.reset.IsZero() && old.reset.Before(now) {
+				delete(quotas.tokens, key)
+			}
+		}
+		q = &quota{remaining: -1}
+		quotas.tokens[key] = q
+	}
+	return q
+}
+
+// The resource whose quota a request counts against, from its path. GitHub
+// Enterprise Server serves the API under /api/v3 and GraphQL at /api/graphql
+func requestResource(req *http.Request) string {
+	path := strings.TrimPrefix(req.URL.Path, "/api/v3")
+	switch {
+	case strings.HasPrefix(path, "/search/"):
+		return "search"
+	case path == "/graphql" || path == "/api/graphql":
+		return "graphql"
+	default:
+		return coreResource
+	}
+}
+
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	q := quotaFor(req)
+	if err := q.wait(ctx); err != nil {
+		return nil, err
+	}
+
+	for attempt := 0; ; attempt++ {
+		resp, err := t.base.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+		q.record(resp)
+
+		wait, limited := secondaryLimit(resp)
+		// Requests whose body cannot be replayed are not retried
+		if !limited || attempt == maxSecondaryRetries || (req.Body != nil && req.GetBody == nil) {
+			return resp, nil
+		}
+		if wait == 0 {
+			wait = secondaryBackoff << attempt
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(wait).After(deadline) {
+			return resp, nil
+		}
+
+		resp.Body.Close()
+		log.Printf("Warning: hit a GitHub secondary rate limit on %s %s, retrying in %s", req.Method, req.URL.Path, wait)
+		if err := sleep(ctx, wait); err != nil {
+			return nil, err
+		}
+
+		retry := req.Clone(ctx)
+		if req.GetBody != nil {
+			if retry.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+		req = retry
+	}
+}
+
+func (q *quota) wait(ctx context.Context) error {
+	if q == nil {
+		return nil
+	}
+	quotas.mu.Lock()
+	exhausted := q.remaining == 0 && time.Now().Before(q.reset)
+	reset := q.reset
+	quotas.mu.Unlock()
+
+	if !exhausted {
+		return nil
+	}
+	wait := time.Until(reset)
+	if wait > maxQuotaWait {
+		return &QuotaExhaustedError{Reset: reset}
+	}
+	log.Printf("GitHub quota exhausted, waiting %s for it to reset", wait.Round(time.Second))
+	return sleep(ctx, wait)
+}
+
+// Remembers the quota from the X-RateLimit headers, if they are about the
+// core resource. Servers that do not name the resource are taken at their word
+func (q *quota) record(resp *http.Response) {
+	if q == nil {
+		return
+	}
+	if resource := resp.Header.Get("X-RateLimit-Resource"); resource != "" && resource != coreResource {
+		return
+	}
+	remaining, err := strconv.Atoi(resp.Header.Get("X-RateLimit-Remaining"))
+	if err != nil {
+		return
+	}
+	reset, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64)
+	if err != nil {
+		return
+	}
+
+	quotas.mu.Lock()
+	defer quotas.mu.Unlock()
+	q.remaining = remaining
+	q.reset = time.Unix(reset, 0)
+}
+
+// Reports whether resp is a secondary rate limit, and how long GitHub asked
+// to wait if it said. An exhausted primary quota is not one: retrying before
+// the reset cannot succeed
+func secondaryLimit(resp *http.Response) (time.Duration, bool) {
+	if resp.StatusCode != http.StatusForbidden && resp.StatusCode != http.StatusTooManyRequests {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if resp.Header.Get("X-RateLimit-Remaining") == "0" {
+		return 0, false
+	}
+
+	// Error bodies are small; put it back for the caller after peeking
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return 0, false
+	}
+	return 0, strings.Contains(strings.ToLower(string(body)), "secondary rate limit")
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
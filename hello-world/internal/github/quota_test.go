@@ -0,0 +1,118 @@
+package github
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func resetQuotas(t *testing.T) {
+	t.Helper()
+
+	quotas.mu.Lock()
+	quotas.tokens = make(map[[32]byte]*quota)
+	quotas.mu.Unlock()
+}
+
+func TestQuotaPerResource(t *testing.T) {
+	resetQuotas(t)
+	reset := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	coreRemaining := "10"
+
+	client := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-RateLimit-Reset", reset)
+		switch r.URL.Path {
+		case "/search/code":
+			w.Header().Set("X-RateLimit-Resource", "search")
+			w.Header().Set("X-RateLimit-Remaining", "0")
+			fmt.Fprint(w, `{"total_count":0,"items":[]}`)
+		case "/repos/owner/repo":
+			w.Header().Set("X-RateLimit-Resource", "core")
+			w.Header().Set("X-RateLimit-Remaining", coreRemaining)
+			fmt.Fprint(w, `{"default_branch":"main"}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	ctx := context.Background()
+
+	// Each request builds its own clients; the quota is shared through the
+	// token, while go-github only tracks it per client
+	newClient := func() *Client {
+		other := NewClient("token")
+		other.client.BaseURL = client.client.BaseURL
+		return other
+	}
+
+	// A used-up search quota leaves REST calls alone
+	if _, _, err := client.client.Search.Code(ctx, "query", nil); err != nil {
+		t.Fatalf("search: %v", err)
+	}
+	if _, err := newClient().GetDefaultBranch(ctx, "owner", "repo"); err != nil {
+		t.Fatalf("GetDefaultBranch after search quota ran out: %v", err)
+	}
+
+	// A used-up core quota fails calls of other clients without sending them
+	coreRemaining = "0"
+	if _, err := newClient().GetDefaultBranch(ctx, "owner", "repo"); err != nil {
+		t.Fatalf("GetDefaultBranch: %v", err)
+	}
+	_, err := newClient().GetDefaultBranch(ctx, "owner", "repo")
+	var exhausted *QuotaExhaustedError
+	if !errors.As(err, &exhausted) {
+		t.Fatalf("err = %v, want a *QuotaExhaustedError", err)
+	}
+
+	// Searching with the same token still works
+	if _, _, err := newClient().client.Search.Code(ctx, "query", nil); err != nil {
+		t.Fatalf("search after core quota ran out: %v", err)
+	}
+}
+
+func TestQuotasPruned(t *testing.T) {
+	resetQuotas(t)
+
+	request := func(token string) *http.Request {
+		req, _ := http.NewRequest(http.MethodGet, "https://api.github.com/repos/owner/repo", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		return req
+	}
+	expired := quotaFor(request("expired"))
+	expired.reset = time.Now().Add(-time.Minute)
+	current := quotaFor(request("current"))
+	current.reset = time.Now().Add(time.Hour)
+
+	quotaFor(request("new"))
+
+	quotas.mu.Lock()
+	defer quotas.mu.Unlock()
+	if len(quotas.tokens) != 2 {
+		t.Errorf("%d quotas tracked, want 2 after the expired one is pruned", len(quotas.tokens))
+	}
+	for _, q := range quotas.tokens {
+		if q == expired {
+			t.Errorf("expired quota was kept")
+		}
+	}
+}
+
+func TestRequestResource(t *testing.T) {
+	tests := map[string]string{
+		"https://api.github.com/repos/owner/repo":         "core",
+		"https://api.github.com/search/issues":            "search",
+		"https://api.github.com/graphql":                  "graphql",
+		"https://ghe.example.com/api/v3/repos/owner/repo": "core",
+		"https://ghe.example.com/api/v3/search/code":      "search",
+		"https://ghe.example.com/api/graphql":             "graphql",
+	}
+	for rawURL, want := range tests {
+		req, _ := http.NewRequest(http.MethodGet, rawURL, nil)
+		if got := requestResource(req); got != want {
+			t.Errorf("requestResource(%s) = %s, want %s", rawURL, got, want)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package github
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/go-github/v57/github"
+)
+
+// ReviewThread is an inline review conversation the bot has not answered yet
+type ReviewThread struct {
+	// ID of the comment that started the thread; replies go to it
+	ID       int64
+	Path     string
+	Line     int
+	DiffHunk string
+	Comments []IssueComment
+}
+
+// Example: https://github.com/owner/repo/pull/123 -> ("github.com", owner, repo, 123, nil)
+func ParsePullRequestURL(prURL string) (string, string, string, int, error) {
+	host, owner, repo, err := ParseRepoURL(prURL)
+	if err != nil {
+		return "", "", "", 0, err
+	}
+
+	prURL = strings.TrimSuffix(prURL, "/")
+	index := strings.LastIndex(prURL, "/pull/")
+	if index < 0 {
+		return "", "", "", 0, fmt.Errorf("invalid GitHub pull request URL format")
+	}
+	number, err := strconv.Atoi(prURL[index+len("/pull/"):])
+	if err != nil || number <= 0 {
+		return "", "", "", 0, fmt.Errorf("invalid GitHub pull request URL format")
+	}
+
+	return host, owner, repo, number, nil
+}
+
+func (c *Client) GetPullRequest(ctx context.Context, owner, repo string, number int) (*github.PullRequest, error) {
+	pr, _, err := c.client.PullRequests.Get(ctx, owner, repo, number)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get pull request #%d: %w", number, err)
+	}
+
+	return pr, nil
+}
+
+// ListPullRequestFiles returns the paths a pull request changes
+func (c *Client) ListPullRequestFiles(ctx context.Context, owner, repo string, number int) ([]string, error) {
+	var paths []string
+	opts := &github.ListOptions{PerPage: 100}
+	for {
+		files, resp, err := c.client.PullRequests.ListFiles(ctx, owner, repo, number, opts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list pull request files: %w", err)
+		}
+		for _, file := range files {
+			if file.GetStatus() != "removed" {
+				paths = append(paths, file.GetFilename())
+			}
+		}
+		if resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+
+	return paths, nil
+}
+
+// PendingReviewThreads returns the inline review threads whose latest comment
+// is not from botLogin, oldest first. Only comments from botLogin and from
+// authors whose association with the repository is in trusted are kept, so
+// comments from anyone else never reach the model
+func (c *Client) PendingReviewThreads(ctx context.Context, owner, repo string, number int, botLogin string, trusted map[string]bool) ([]*ReviewThread, error) {
+	var comments []*github.PullRequestComment
+	opts := &github.PullRequestListCommentsOptions{
+		Sort:        "created",
+		Direction:   "asc",
+		ListOptions: github.ListOptions{PerPage: 100},
+	}
+	for {
+		page, resp, err := c.client.PullRequests.ListComments(ctx, owner, repo, number, opts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list review comments: %w", err)
+		}
+		comments = append(comments, page...)
+		if resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+
+	threads := make(map[int64]*ReviewThread)
+	lastAuthor := make(map[int64]string)
+	for _, comment := range comments {
+		// Replies always point at the thread's first comment
+		id := comment.GetInReplyTo()
+		if id == 0 {
+			id = comment.GetID()
+			line := comment.GetLine()
+			if line == 0 {
+				// Outdated comments only know where they were made
+				line = comment.GetOriginalLine()
+			}
+			threads[id] = &ReviewThread{
+				ID:       id,
+				Path:     comment.GetPath(),
+				Line:     line,
+				DiffHunk: comment.GetDiffHunk(),
+			}
+		}
+
+		thread, ok := threads[id]
+		if !ok {
+			continue
+		}
+		author := comment.GetUser().GetLogin()
+		if !strings.EqualFold(author, botLogin) && !trusted[comment.GetAuthorAssociation()] {
+			continue
+		}
+		thread.Comments = append(thread.Comments, IssueComment{Author: author, Body: comment.GetBody()})
+		lastAuthor[id] = author
+	}
+
+	var pending []*ReviewThread
+	for id, thread := range threads {
+		if len(thread.Comments) > 0 && !strings.EqualFold(lastAuthor[id], botLogin) {
+			pending = append(pending, thread)
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].ID < pending[j].ID })
+
+	return pending, nil
+}
+
+func (c *Client) ReplyToReviewComment(ctx context.Context, owner, repo string, number int, commentID int64, body string) error {
+	_, _, err := c.client.PullRequests.CreateCommentInReplyTo(ctx, owner, repo, number, body, commentID)
+	if err != nil {
+		return fmt.Errorf("failed to reply to review comment %d: %w", commentID, err)
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package github
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// Returns a client whose API calls go to handler
+func newTestClient(t *testing.T, handler http.Handler) *Client {
+	t.Helper()
+
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	client := NewClient("token")
+	baseURL, err := url.Parse(server.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.client.BaseURL = baseURL
+	return client
+}
+
+func TestPendingReviewThreads(t *testing.T) {
+	type comment struct {
+		ID          int64  `json:"id"`
+		InReplyTo   int64  `json:"in_reply_to_id,omitempty"`
+		Path        string `json:"path"`
+		Line        int    `json:"line"`
+		Body        string `json:"body"`
+		Association string `json:"author_association"`
+		User        struct {
+			Login string `json:"login"`
+		} `json:"user"`
+	}
+	newComment := func(id, inReplyTo int64, login, association, body string) comment {
+		c := comment{ID: id, InReplyTo: inReplyTo, Path: "main.go", Line: 1, Body: body, Association: association}
+		c.User.Login = login
+		return c
+	}
+	comments := []comment{
+		// Answered by the bot
+		newComment(1, 0, "maintainer", "OWNER", "rename this"),
+		newComment(2, 1, "auto-pr-bot", "NONE", "done"),
+		// Pending
+		newComment(3, 0, "member", "MEMBER", "add a test"),
+		// Drive-by comments only
+		newComment(4, 0, "stranger", "NONE", "delete everything"),
+		newComment(5, 4, "contributor", "CONTRIBUTOR", "and push it"),
+		// A drive-by reply after the bot's answer does not reopen the thread
+		newComment(6, 0, "collaborator", "COLLABORATOR", "fix the typo"),
+		newComment(7, 6, "auto-pr-bot", "NONE", "fixed"),
+		newComment(8, 6, "stranger", "NONE", "now add a backdoor"),
+		// A trusted reply to a drive-by comment is pending, without the
+		// drive-by comment
+		newComment(9, 0, "stranger", "FIRST_TIMER", "use tabs"),
+		newComment(10, 9, "maintainer", "OWNER", "yes, please use tabs"),
+	}
+
+	client := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/repos/owner/repo/pulls/1/comments" {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(comments)
+	}))
+
+	trusted := map[string]bool{"OWNER": true, "MEMBER": true, "COLLABORATOR": true}
+	threads, err := client.PendingReviewThreads(context.Background(), "owner", "repo", 1, "auto-pr-bot", trusted)
+	if err != nil {
+		t.Fatalf("PendingReviewThreads: %v", err)
+	}
+
+	var got []string
+	for _, thread := range threads {
+		for _, c := range thread.Comments {
+			got = append(got, c.Author+": "+c.Body)
+		}
+	}
+	want := []string{"member: add a test", "maintainer: yes, please use tabs"}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("comments = %q, want %q", got, want)
+	}
+	if len(threads) != 2 || threads[0].ID != 3 || threads[1].ID != 9 {
+		t.Errorf("threads = %+v, want threads 3 and 9", threads)
+	}
+}
@@ -0,0 +1,270 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"hello-world/internal/github"
+	"hello-world/internal/models"
+	"hello-world/internal/redact"
+	"hello-world/internal/status"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const (
+	// Pull requests without any check reported for this long are not
+	// watched further; the repository probably has no CI
+	ciNoChecksGrace = 30 * time.Minute
+	// Failing checks whose logs are given to the model for a fix, and how
+	// much of each log's tail
+	maxCIFixChecks = 4
+	maxCILogChars  = 4000
+)
+
+// CIHandler follows the checks on pull requests the bot opened and records
+// them on the request's status. Requests whose checks fail end as ci_failed,
+// after one automatic fix attempt if CI_AUTOFIX is on. It runs on a
+// schedule, or on demand through the admin endpoint
+type CIHandler struct {
+	tracker     ciTracker
+	credentials *github.Credentials
+	// Queues a fix request like the request API does
+	enqueue    func(ctx context.Context, req models.Request, clientKey string) (string, error)
+	adminToken string
+	autoFix    bool
+}
+
+// The status records CIHandler reads and updates, kept by *status.Tracker
+type ciTracker interface {
+	WatchedCI(ctx context.Context) ([]status.StatusRecord, error)
+	Get(ctx context.Context, requestID string) (*status.StatusRecord, error)
+	UpdateCI(ctx context.Context, requestID string, ci *status.CIStatus) error
+	CIFailed(ctx context.Context, requestID string, ci *status.CIStatus, message string) error
+}
+
+// What a CI run did
+type ciReport struct {
+	RequestsChecked int      `json:"requestsChecked"`
+	Passed          int      `json:"passed"`
+	Failed          int      `json:"failed"`
+	FixesStarted    int      `json:"fixesStarted"`
+	Incomplete      bool     `json:"incomplete,omitempty"`
+	Errors          []string `json:"errors,omitempty"`
+}
+
+func NewCIHandler() (*CIHandler, error) {
+	h, err := New()
+	if err != nil {
+		return nil, err
+	}
+
+	adminToken := os.Getenv("ADMIN_API_TOKEN")
+	redact.Register(adminToken)
+
+	autoFix := false
+	switch value := os.Getenv("CI_AUTOFIX"); value {
+	case "", "off":
+	case "on":
+		autoFix = true
+	default:
+		log.Printf("Warning: invalid CI_AUTOFIX %q, using off", value)
+	}
+
+	return &CIHandler{
+		tracker:     h.statusTracker,
+		credentials: h.credentials,
+		enqueue:     h.enqueue,
+		adminToken:  adminToken,
+		autoFix:     autoFix,
+	}, nil
+}
+
+func (c *CIHandler) Handle(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	// Scheduled runs invoke the function directly, without API Gateway's
+	// request context. Calls through the API need the admin token
+	if request.RequestContext.RequestID != "" && !adminAuthorized(c.adminToken, header(request, "Authorization")) {
+		return c.response(403, map[string]string{"error": "Forbidden"})
+	}
+
+	report := c.run(ctx)
+	log.Printf("CI check finished: %d requests checked, %d passed, %d failed, %d fixes started, %d errors",
+		report.RequestsChecked, report.Passed, report.Failed, report.FixesStarted, len(report.Errors))
+	return c.response(200, report)
+}
+
+func (c *CIHandler) run(ctx context.Context) *ciReport {
+	report := &ciReport{}
+	records, err := c.tracker.WatchedCI(ctx)
+	if err != nil {
+		report.Errors = append(report.Errors, err.Error())
+		return report
+	}
+
+	for i := range records {
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < maintenanceMargin {
+			log.Printf("Stopping CI check before the function times out")
+			report.Incomplete = true
+			return report
+		}
+		record := &records[i]
+		report.RequestsChecked++
+		if err := c.check(ctx, record, report); err != nil {
+			log.Printf("Warning: CI check of %s failed: %v", record.PrURL, err)
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: %v", record.PrURL, err))
+		}
+	}
+	return report
+}
+
+// Records the checks on the head of the request's pull request, and decides
+// the outcome once they have all finished
+func (c *CIHandler) check(ctx context.Context, record *status.StatusRecord, report *ciReport) error {
+	host, owner, repo, number, err := github.ParsePullRequestURL(record.PrURL)
+	if err != nil {
+		return fmt.Errorf("invalid pull request URL: %w", err)
+	}
+	githubClient, err := c.credentials.ClientFor(ctx, host, owner, repo)
+	if err != nil {
+		return fmt.Errorf("failed to authenticate with GitHub: %w", err)
+	}
+
+	pr, err := githubClient.GetPullRequest(ctx, owner, repo, number)
+	if err != nil {
+		return err
+	}
+
+	ci := record.CI
+	now := time.Now()
+	ci.CheckedAt = now.Unix()
+	if pr.GetState() != "open" {
+		ci.State = status.CIClosed
+		return c.tracker.UpdateCI(ctx, record.RequestID, ci)
+	}
+
+	// Commits pushed by the automatic fix, a review follow-up or a person
+	// restart the checks
+	head := pr.GetHead().GetSHA()
+	if head != ci.HeadSHA {
+		ci.HeadSHA, ci.Since, ci.Checks = head, now.Unix(), nil
+	}
+
+	// The failed commit is judged again only once the fix has given up
+	if ci.FixRequestID != "" && head == ci.FixedSHA && c.fixInProgress(ctx, ci.FixRequestID) {
+		return c.tracker.UpdateCI(ctx, record.RequestID, ci)
+	}
+
+	// Checks of pull requests from forks run in, and are listed by, the
+	// upstream repository
+	checks, err := githubClient.CommitChecks(ctx, owner, repo, head)
+	if err != nil {
+		return err
+	}
+	ci.Checks = make([]status.CheckResult, 0, len(checks))
+	var failed []*github.Check
+	pending := false
+	for _, check := range checks {
+		ci.Checks = append(ci.Checks, status.CheckResult{Name: check.Name, State: check.State, URL: check.URL})
+		switch check.State {
+		case github.CheckFailure:
+			failed = append(failed, check)
+		case github.CheckPending:
+			pending = true
+		}
+	}
+
+	switch {
+	case len(checks) == 0:
+		if now.Sub(time.Unix(ci.Since, 0)) > ciNoChecksGrace {
+			ci.State = status.CINone
+		}
+		return c.tracker.UpdateCI(ctx, record.RequestID, ci)
+	case pending:
+		// All checks have to finish, so a fix sees every failure
+		return c.tracker.UpdateCI(ctx, record.RequestID, ci)
+	case len(failed) == 0:
+		ci.State = status.CISuccess
+		report.Passed++
+		return c.tracker.UpdateCI(ctx, record.RequestID, ci)
+	}
+
+	if c.autoFix && ci.FixRequestID == "" {
+		fixRequestID, err := c.startFix(ctx, githubClient, owner, repo, record, failed)
+		if err == nil {
+			log.Printf("Started fix %s for failed checks on %s", fixRequestID, record.PrURL)
+			ci.FixRequestID, ci.FixedSHA = fixRequestID, head
+			report.FixesStarted++
+			return c.tracker.UpdateCI(ctx, record.RequestID, ci)
+		}
+		log.Printf("Warning: failed to start fix for %s: %v", record.PrURL, err)
+	}
+
+	names := make([]string, 0, len(failed))
+	for _, check := range failed {
+		names = append(names, check.Name)
+	}
+	ci.State = status.CIFailure
+	report.Failed++
+	return c.tracker.CIFailed(ctx, record.RequestID, ci, fmt.Sprintf("Pull request created, but CI failed: %s", strings.Join(names, ", ")))
+}
+
+// Reports whether the fix request may still push a commit. Fix records that
+// have expired count as finished
+func (c *CIHandler) fixInProgress(ctx context.Context, fixRequestID string) bool {
+	record, err := c.tracker.Get(ctx, fixRequestID)
+	if err != nil {
+		return false
+	}
+	switch status.Status(record.Status) {
+	case status.StatusCompleted, status.StatusRejected, status.StatusError:
+		return false
+	default:
+		return true
+	}
+}
+
+// Queues a follow-up commit on the pull request that fixes the failed checks.
+// It goes through the same flow as review comments, with the failure logs
+// as the instructions
+func (c *CIHandler) startFix(ctx context.Context, githubClient *github.Client, owner, repo string, record *status.StatusRecord, failed []*github.Check) (string, error) {
+	if len(failed) > maxCIFixChecks {
+		failed = failed[:maxCIFixChecks]
+	}
+
+	var prompt strings.Builder
+	prompt.WriteString("The pull request's CI checks failed. Change the pull request's files so that these checks pass.\n")
+	for _, check := range failed {
+		failureLog, err := githubClient.FailureLog(ctx, owner, repo, check, maxCILogChars)
+		if err != nil {
+			log.Printf("Warning: failed to get log of %s: %v", check.Name, err)
+			failureLog = fmt.Sprintf("(log unavailable, see %s)", check.URL)
+		}
+		prompt.WriteString(fmt.Sprintf("\n--- %s ---\n%s\n", check.Name, redact.String(failureLog)))
+	}
+
+	req := models.Request{
+		RepositoryURL:      record.Repository,
+		PullRequestURL:     record.PrURL,
+		ModificationPrompt: prompt.String(),
+	}
+	return c.enqueue(ctx, req, "ci:"+record.Repository)
+}
+
+func (c *CIHandler) response(statusCode int, body interface{}) (events.APIGatewayProxyResponse, error) {
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, fmt.Errorf("failed to marshal response: %w", err)
+	}
+	return events.APIGatewayProxyResponse{
+		StatusCode: statusCode,
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+		Body: redact.String(string(encoded)),
+	}, nil
+}
@@ -0,0 +1,344 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"hello-world/internal/models"
+	"hello-world/internal/status"
+)
+
+// Keeps status records in memory and records the CI updates
+type fakeCITracker struct {
+	records []status.StatusRecord
+	// Fix requests by ID, for fixInProgress
+	fixes map[string]*status.StatusRecord
+
+	updated []status.CIStatus
+	failed  []string
+}
+
+func (f *fakeCITracker) WatchedCI(ctx context.Context) ([]status.StatusRecord, error) {
+	return f.records, nil
+}
+
+func (f *fakeCITracker) Get(ctx context.Context, requestID string) (*status.StatusRecord, error) {
+	record, ok := f.fixes[requestID]
+	if !ok {
+		return nil, fmt.Errorf("request %s not found", requestID)
+	}
+	return record, nil
+}
+
+func (f *fakeCITracker) UpdateCI(ctx context.Context, requestID string, ci *status.CIStatus) error {
+	f.updated = append(f.updated, *ci)
+	return nil
+}
+
+func (f *fakeCITracker) CIFailed(ctx context.Context, requestID string, ci *status.CIStatus, message string) error {
+	f.updated = append(f.updated, *ci)
+	f.failed = append(f.failed, message)
+	return nil
+}
+
+// A pull request on owner/repo and the checks on its head, served like the
+// GitHub API
+type fakeCIGitHub struct {
+	state string
+	head  string
+	// Check runs and commit statuses as the API returns them
+	checkRuns []map[string]interface{}
+	statuses  []map[string]interface{}
+
+	checksListed bool
+}
+
+func (f *fakeCIGitHub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/repos/owner/repo/pulls/1":
+		json.NewEncoder(w).Encode(map[string]interface{}{"state": f.state, "head": map[string]string{"sha": f.head}})
+	case "/repos/owner/repo/commits/" + f.head + "/check-runs":
+		f.checksListed = true
+		json.NewEncoder(w).Encode(map[string]interface{}{"total_count": len(f.checkRuns), "check_runs": f.checkRuns})
+	case "/repos/owner/repo/commits/" + f.head + "/status":
+		json.NewEncoder(w).Encode(map[string]interface{}{"statuses": f.statuses})
+	case "/repos/owner/repo/check-runs/7/annotations":
+		w.Write([]byte(`[{"path": "main_test.go", "start_line": 12, "annotation_level": "failure", "message": "want 2, got 3"}]`))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func checkRun(id int64, name, runStatus, conclusion string) map[string]interface{} {
+	return map[string]interface{}{
+		"id":         id,
+		"name":       name,
+		"status":     runStatus,
+		"conclusion": conclusion,
+		"html_url":   "https://ci.example.com/" + name,
+		"app":        map[string]string{"slug": "ci-app"},
+	}
+}
+
+func TestCIHandlerCheck(t *testing.T) {
+	now := time.Now().Unix()
+	tests := []struct {
+		name      string
+		state     string
+		checkRuns []map[string]interface{}
+		statuses  []map[string]interface{}
+		ci        status.CIStatus
+		autoFix   bool
+		// Status of the fix request the CI status names
+		fixStatus  status.Status
+		enqueueErr error
+
+		wantState    string
+		wantChecks   int
+		wantListed   bool
+		wantFailed   string
+		wantFix      bool
+		wantPassed   int
+		wantFailures int
+	}{
+		{
+			name:      "closed",
+			state:     "closed",
+			ci:        status.CIStatus{State: status.CIPending, HeadSHA: "head", Since: now},
+			wantState: status.CIClosed,
+		},
+		{
+			name:       "no checks yet",
+			ci:         status.CIStatus{State: status.CIPending, HeadSHA: "head", Since: now - 60},
+			wantState:  status.CIPending,
+			wantListed: true,
+		},
+		{
+			name:       "no checks beyond the grace period",
+			ci:         status.CIStatus{State: status.CIPending, HeadSHA: "head", Since: now - int64(ciNoChecksGrace/time.Second) - 60},
+			wantState:  status.CINone,
+			wantListed: true,
+		},
+		{
+			name:       "new head restarts the grace period",
+			ci:         status.CIStatus{State: status.CIPending, HeadSHA: "old", Since: now - int64(time.Hour/time.Second), Checks: []status.CheckResult{{Name: "old"}}},
+			wantState:  status.CIPending,
+			wantListed: true,
+		},
+		{
+			name:       "pending",
+			checkRuns:  []map[string]interface{}{checkRun(1, "build", "completed", "success"), checkRun(2, "test", "in_progress", "")},
+			statuses:   []map[string]interface{}{{"context": "ci/jenkins", "state": "failure"}},
+			ci:         status.CIStatus{State: status.CIPending, HeadSHA: "head", Since: now},
+			wantState:  status.CIPending,
+			wantChecks: 3,
+			wantListed: true,
+		},
+		{
+			name:       "success",
+			checkRuns:  []map[string]interface{}{checkRun(1, "build", "completed", "success"), checkRun(2, "lint", "completed", "skipped")},
+			statuses:   []map[string]interface{}{{"context": "ci/jenkins", "state": "success"}},
+			ci:         status.CIStatus{State: status.CIPending, HeadSHA: "head", Since: now},
+			wantState:  status.CISuccess,
+			wantChecks: 3,
+			wantListed: true,
+			wantPassed: 1,
+		},
+		{
+			name:         "failure",
+			checkRuns:    []map[string]interface{}{checkRun(7, "test", "completed", "failure"), checkRun(1, "build", "completed", "success")},
+			statuses:     []map[string]interface{}{{"context": "ci/jenkins", "state": "error"}},
+			ci:           status.CIStatus{State: status.CIPending, HeadSHA: "head", Since: now},
+			wantState:    status.CIFailure,
+			wantChecks:   3,
+			wantListed:   true,
+			wantFailed:   "Pull request created, but CI failed: test, ci/jenkins",
+			wantFailures: 1,
+		},
+		{
+			name:       "failure with autofix",
+			checkRuns:  []map[string]interface{}{checkRun(7, "test", "completed", "timed_out")},
+			statuses:   []map[string]interface{}{{"context": "ci/jenkins", "state": "failure", "target_url": "https://jenkins.example.com/1"}},
+			ci:         status.CIStatus{State: status.CIPending, HeadSHA: "head", Since: now},
+			autoFix:    true,
+			wantState:  status.CIPending,
+			wantChecks: 2,
+			wantListed: true,
+			wantFix:    true,
+		},
+		{
+			name:         "autofix that cannot be queued",
+			checkRuns:    []map[string]interface{}{checkRun(7, "test", "completed", "failure")},
+			ci:           status.CIStatus{State: status.CIPending, HeadSHA: "head", Since: now},
+			autoFix:      true,
+			enqueueErr:   errors.New("rate limit exceeded"),
+			wantState:    status.CIFailure,
+			wantChecks:   1,
+			wantListed:   true,
+			wantFailed:   "Pull request created, but CI failed: test",
+			wantFailures: 1,
+		},
+		{
+			name:       "fix in progress",
+			ci:         status.CIStatus{State: status.CIPending, HeadSHA: "head", Since: now, Checks: []status.CheckResult{{Name: "test", State: "failure"}}, FixRequestID: "fix", FixedSHA: "head"},
+			autoFix:    true,
+			fixStatus:  status.StatusModifying,
+			wantState:  status.CIPending,
+			wantChecks: 1,
+		},
+		{
+			name:         "fix finished without a commit",
+			checkRuns:    []map[string]interface{}{checkRun(7, "test", "completed", "failure")},
+			ci:           status.CIStatus{State: status.CIPending, HeadSHA: "head", Since: now, FixRequestID: "fix", FixedSHA: "head"},
+			autoFix:      true,
+			fixStatus:    status.StatusRejected,
+			wantState:    status.CIFailure,
+			wantChecks:   1,
+			wantListed:   true,
+			wantFailed:   "Pull request created, but CI failed: test",
+			wantFailures: 1,
+		},
+		{
+			name:         "expired fix record",
+			checkRuns:    []map[string]interface{}{checkRun(7, "test", "completed", "failure")},
+			ci:           status.CIStatus{State: status.CIPending, HeadSHA: "head", Since: now, FixRequestID: "expired", FixedSHA: "head"},
+			autoFix:      true,
+			wantState:    status.CIFailure,
+			wantChecks:   1,
+			wantListed:   true,
+			wantFailed:   "Pull request created, but CI failed: test",
+			wantFailures: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := tt.state
+			if state == "" {
+				state = "open"
+			}
+			fake := &fakeCIGitHub{state: state, head: "head", checkRuns: tt.checkRuns, statuses: tt.statuses}
+			credentials, host := newTestCredentials(t, fake)
+
+			tracker := &fakeCITracker{fixes: map[string]*status.StatusRecord{}}
+			if tt.fixStatus != "" {
+				tracker.fixes["fix"] = &status.StatusRecord{RequestID: "fix", Status: string(tt.fixStatus)}
+			}
+			var queued []models.Request
+			c := &CIHandler{
+				tracker:     tracker,
+				credentials: credentials,
+				enqueue: func(ctx context.Context, req models.Request, clientKey string) (string, error) {
+					if tt.enqueueErr != nil {
+						return "", tt.enqueueErr
+					}
+					if clientKey != "ci:"+req.RepositoryURL {
+						t.Errorf("clientKey = %q, want one per repository", clientKey)
+					}
+					queued = append(queued, req)
+					return "fix-1", nil
+				},
+				autoFix: tt.autoFix,
+			}
+
+			ci := tt.ci
+			record := &status.StatusRecord{
+				RequestID:  "request",
+				Repository: "http://" + host + "/owner/repo",
+				PrURL:      "http://" + host + "/owner/repo/pull/1",
+				CI:         &ci,
+			}
+			report := &ciReport{}
+			if err := c.check(context.Background(), record, report); err != nil {
+				t.Fatalf("check failed: %v", err)
+			}
+
+			if len(tracker.updated) != 1 {
+				t.Fatalf("CI status updated %d times, want once", len(tracker.updated))
+			}
+			got := tracker.updated[0]
+			if got.State != tt.wantState {
+				t.Errorf("state = %q, want %q", got.State, tt.wantState)
+			}
+			if len(got.Checks) != tt.wantChecks {
+				t.Errorf("checks = %+v, want %d", got.Checks, tt.wantChecks)
+			}
+			if got.HeadSHA != "head" {
+				t.Errorf("head = %q, want the pull request's head", got.HeadSHA)
+			}
+			if tt.ci.HeadSHA != "head" && got.Since < now {
+				t.Errorf("since = %d, want it reset to now for a new head", got.Since)
+			}
+			if got.CheckedAt < now {
+				t.Errorf("checkedAt = %d, want now", got.CheckedAt)
+			}
+			if fake.checksListed != tt.wantListed {
+				t.Errorf("checks listed = %v, want %v", fake.checksListed, tt.wantListed)
+			}
+
+			if tt.wantFailed != "" {
+				if len(tracker.failed) != 1 || tracker.failed[0] != tt.wantFailed {
+					t.Errorf("failure messages = %q, want %q", tracker.failed, tt.wantFailed)
+				}
+			} else if len(tracker.failed) > 0 {
+				t.Errorf("failure messages = %q, want none", tracker.failed)
+			}
+
+			if tt.wantFix {
+				if len(queued) != 1 {
+					t.Fatalf("queued %d fixes, want one", len(queued))
+				}
+				if got.FixRequestID != "fix-1" || got.FixedSHA != "head" {
+					t.Errorf("fix = %q on %q, want fix-1 on head", got.FixRequestID, got.FixedSHA)
+				}
+				if queued[0].PullRequestURL != record.PrURL || queued[0].RepositoryURL != record.Repository {
+					t.Errorf("fix request = %+v, want it on the pull request", queued[0])
+				}
+				prompt := queued[0].ModificationPrompt
+				for _, want := range []string{"--- test ---\n", "main_test.go:12: failure: want 2, got 3", "--- ci/jenkins ---\n", "https://jenkins.example.com/1"} {
+					if !strings.Contains(prompt, want) {
+						t.Errorf("fix prompt = %q, want it to contain %q", prompt, want)
+					}
+				}
+				if report.FixesStarted != 1 {
+					t.Errorf("fixes started = %d, want 1", report.FixesStarted)
+				}
+			} else if len(queued) > 0 {
+				t.Errorf("queued fixes %+v, want none", queued)
+			}
+
+			if report.Passed != tt.wantPassed || report.Failed != tt.wantFailures {
+				t.Errorf("report = %+v, want %d passed and %d failed", report, tt.wantPassed, tt.wantFailures)
+			}
+		})
+	}
+}
+
+func TestCIHandlerRun(t *testing.T) {
+	fake := &fakeCIGitHub{state: "open", head: "head", checkRuns: []map[string]interface{}{checkRun(1, "build", "completed", "success")}}
+	credentials, host := newTestCredentials(t, fake)
+
+	tracker := &fakeCITracker{records: []status.StatusRecord{
+		{RequestID: "invalid", PrURL: "not a pull request", CI: &status.CIStatus{State: status.CIPending}},
+		{RequestID: "missing", PrURL: "http://" + host + "/owner/repo/pull/2", CI: &status.CIStatus{State: status.CIPending}},
+		{RequestID: "passing", PrURL: "http://" + host + "/owner/repo/pull/1", CI: &status.CIStatus{State: status.CIPending, HeadSHA: "head"}},
+	}}
+	c := &CIHandler{tracker: tracker, credentials: credentials}
+
+	report := c.run(context.Background())
+	if report.RequestsChecked != 3 || report.Passed != 1 || report.Incomplete {
+		t.Errorf("report = %+v, want 3 checked and 1 passed", report)
+	}
+	// One failing record does not stop the others
+	if len(report.Errors) != 2 || !strings.HasPrefix(report.Errors[0], "not a pull request: invalid pull request URL") {
+		t.Errorf("errors = %q, want the invalid URL and the missing pull request", report.Errors)
+	}
+	if len(tracker.updated) != 1 || tracker.updated[0].State != status.CISuccess {
+		t.Errorf("updates = %+v, want the passing request's", tracker.updated)
+	}
+}
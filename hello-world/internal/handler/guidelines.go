@@ -0,0 +1,135 @@
+package handler
+
+import (
+	"context"
+	"log"
+	"path"
+	"sort"
+	"strings"
+
+	"hello-world/internal/git"
+)
+
+const (
+	// Keeps long contributing guides from crowding out the source files
+	maxGuidelineChars = 8000
+)
+
+// GitHub looks for community health files in these directories
+var guidelineDirs = []string{"", ".github", "docs"}
+
+// Contribution rules and the pull request template a repository publishes.
+// Empty fields were not found
+type contributionGuidelines struct {
+	pullRequestTemplate string
+	contributing        string
+	codeOfConduct       string
+}
+
+// Reads the repository's pull request template, CONTRIBUTING and
+// CODE_OF_CONDUCT. Missing or unreadable files are skipped
+func loadGuidelines(ctx context.Context, ws workspace, fileTree *git.FileTree) *contributionGuidelines {
+	templatePath := findPullRequestTemplate(fileTree)
+	contributingPath := findGuideline(fileTree, "contributing")
+	conductPath := findGuideline(fileTree, "code_of_conduct")
+
+	var paths []string
+	for _, relPath := range []string{templatePath, contributingPath, conductPath} {
+		if relPath != "" {
+			paths = append(paths, relPath)
+		}
+	}
+	if len(paths) == 0 {
+		return &contributionGuidelines{}
+	}
+	log.Printf("Found contribution guidelines: %v", paths)
+	if err := ws.Materialize(ctx, paths); err != nil {
+		log.Printf("Warning: failed to materialize files: %v", err)
+	}
+
+	read := func(relPath string) string {
+		if relPath == "" {
+			return ""
+		}
+		content, err := ws.ReadFile(ctx, relPath)
+		if err != nil {
+			log.Printf("Warning: failed to read %s: %v", relPath, err)
+			return ""
+		}
+		return truncate(strings.TrimSpace(content), maxGuidelineChars)
+	}
+
+	return &contributionGuidelines{
+		pullRequestTemplate: read(templatePath),
+		contributing:        read(contributingPath),
+		codeOfConduct:       read(conductPath),
+	}
+}
+
+// The rules to follow while writing code, for the LLM
+func (g *contributionGuidelines) rules() string {
+	var builder strings.Builder
+	if g.contributing != "" {
+		builder.WriteString("=== CONTRIBUTING ===\n" + g.contributing + "\n\n")
+	}
+	if g.codeOfConduct != "" {
+		builder.WriteString("=== CODE OF CONDUCT ===\n" + g.codeOfConduct + "\n\n")
+	}
+	return builder.String()
+}
+
+// Looks for name.md, name.rst, name.txt or plain name in the places GitHub
+// does, ignoring case
+func findGuideline(fileTree *git.FileTree, name string) string {
+	for _, dir := range guidelineDirs {
+		for _, child := range children(fileTree, dir) {
+			base := strings.ToLower(child.Name)
+			if child.Dir || strings.TrimSuffix(base, path.Ext(base)) != name {
+				continue
+			}
+			switch path.Ext(base) {
+			case "", ".md", ".rst", ".txt":
+				return child.Path
+			}
+		}
+	}
+	return ""
+}
+
+// Returns the single pull request template, or the first of several in a
+// PULL_REQUEST_TEMPLATE directory since a request cannot pick one
+func findPullRequestTemplate(fileTree *git.FileTree) string {
+	if relPath := findGuideline(fileTree, "pull_request_template"); relPath != "" {
+		return relPath
+	}
+
+	for _, dir := range guidelineDirs {
+		for _, child := range children(fileTree, dir) {
+			if !child.Dir || !strings.EqualFold(child.Name, "pull_request_template") {
+				continue
+			}
+			var templates []string
+			for _, template := range child.Children {
+				if !template.Dir && strings.EqualFold(path.Ext(template.Name), ".md") {
+					templates = append(templates, template.Path)
+				}
+			}
+			if len(templates) > 0 {
+				sort.Strings(templates)
+				return templates[0]
+			}
+		}
+	}
+	return ""
+}
+
+func children(fileTree *git.FileTree, dir string) []*git.FileNode {
+	node := fileTree.Root
+	if dir != "" {
+		node = fileTree.Find(dir)
+	}
+	if node == nil || !node.Dir {
+		return nil
+	}
+	return node.Children
+}
@@ -3,18 +3,26 @@ package handler
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"net/url"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
 	"hello-world/internal/git"
 	"hello-world/internal/github"
 	"hello-world/internal/models"
 	"hello-world/internal/openai"
 	"hello-world/internal/ratelimit"
+	"hello-world/internal/redact"
 	"hello-world/internal/status"
+	"hello-world/internal/validate"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -24,18 +32,60 @@ import (
 	"github.com/google/uuid"
 )
 
+const (
+	// Attempts the model gets to fix a file that fails validation
+	maxSyntaxFixAttempts = 2
+	// Repositories at least this large are cloned without blobs
+	defaultPartialCloneThresholdMB = 200
+	// Lambda's default ephemeral storage is 512 MB
+	defaultCloneSizeLimitMB = 400
+	// Well past the function timeout, so only abandoned workspaces match
+	staleWorkspaceAge = time.Hour
+	// Keeps long issue discussions from crowding out the repository's files
+	maxIssuePromptChars = 24000
+	// Branches the bot creates, and the only ones it pushes follow-ups to
+	branchPrefix = "auto-pr-bot/"
+)
+
 type Handler struct {
-	githubClient  *github.Client
+	credentials   *github.Credentials
 	openaiClient  *openai.Client
-	githubToken   string
 	statusTracker *status.Tracker
 	rateLimiter   *ratelimit.Limiter
+	commitConfig  *git.CommitConfig
+}
+
+// Credentials are loaded once per container, so the app's installation
+// tokens are reused across warm invocations instead of created for each
+var (
+	credentialsMu     sync.Mutex
+	sharedCredentials *github.Credentials
+)
+
+func loadCredentials() (*github.Credentials, error) {
+	credentialsMu.Lock()
+	defer credentialsMu.Unlock()
+
+	if sharedCredentials == nil {
+		credentials, err := github.LoadCredentials()
+		if err != nil {
+			return nil, err
+		}
+		sharedCredentials = credentials
+	}
+	return sharedCredentials, nil
 }
 
 func New() (*Handler, error) {
-	githubToken := os.Getenv("GITHUB_TOKEN")
-	if githubToken == "" {
-		return nil, fmt.Errorf("GITHUB_TOKEN environment variable is required")
+	credentials, err := loadCredentials()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load GitHub credentials: %w", err)
+	}
+	redact.Register(os.Getenv("COMMIT_SIGNING_KEY_PASSPHRASE"))
+
+	commitConfig, err := git.LoadCommitConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load commit config: %w", err)
 	}
 
 	openaiClient, err := openai.NewClient()
@@ -54,11 +104,11 @@ func New() (*Handler, error) {
 	}
 
 	return &Handler{
-		githubClient:  github.NewClient(githubToken),
+		credentials:   credentials,
 		openaiClient:  openaiClient,
-		githubToken:   githubToken,
 		statusTracker: statusTracker,
 		rateLimiter:   rateLimiter,
+		commitConfig:  commitConfig,
 	}, nil
 }
 
@@ -75,6 +125,10 @@ func (h *Handler) Handle(ctx context.Context, request events.APIGatewayProxyRequ
 		return h.errorResponse(400, err.Error())
 	}
 
+	if err := h.resolveRepository(&req); err != nil {
+		return h.errorResponse(400, err.Error())
+	}
+
 	log.Printf("Processing request for repository: %s, user: %s", req.RepositoryURL, req.GitHubUsername)
 
 	// Check if this is a synchronous call from API Gateway
@@ -90,60 +144,24 @@ func (h *Handler) Handle(ctx context.Context, request events.APIGatewayProxyRequ
 		}
 		log.Printf("Request from IP: %s", ipAddress)
 
-		// Check rate limit
-		rateLimitResult, err := h.rateLimiter.CheckRateLimit(ctx, ipAddress)
-		if err != nil {
-			log.Printf("Warning: Failed to check rate limit: %v", err)
-			// Continue processing even if rate limit check fails
-		} else if !rateLimitResult.Allowed {
-			log.Printf("Rate limit exceeded for IP %s: %d/%d requests used", ipAddress, rateLimitResult.RequestsUsed, rateLimitResult.RequestsLimit)
-			return h.rateLimitErrorResponse(rateLimitResult)
-		}
-
-		// Generate unique request ID
-		requestID := uuid.New().String()
-		log.Printf("Generated request ID: %s", requestID)
-
-		// Record this request for rate limiting
-		if err := h.rateLimiter.RecordRequest(ctx, ipAddress, requestID); err != nil {
-			log.Printf("Warning: Failed to record rate limit: %v", err)
+		requestID, err := h.enqueue(ctx, req, ipAddress)
+		var rateLimited *rateLimitedError
+		if errors.As(err, &rateLimited) {
+			return h.rateLimitErrorResponse(rateLimited.result)
 		}
-
-		// Create initial status record
-		if err = h.statusTracker.Update(ctx, requestID, status.StatusPending, "Request received, starting processing...", 0, req.RepositoryURL); err != nil {
-			log.Printf("Warning: Failed to create initial status: %v", err)
+		if errors.Is(err, errAtCapacity) {
+			return h.errorResponse(503, "Bot is currently at capacity processing other requests. Please try again in a few minutes.")
 		}
-
-		// Add requestID to the request for async processing
-		reqWithID := models.RequestWithID{
-			Request:   req,
-			RequestID: requestID,
+		var exhausted *github.QuotaExhaustedError
+		if errors.As(err, &exhausted) {
+			return h.errorResponse(503, exhausted.Error())
 		}
-
-		requestBodyWithID, err := json.Marshal(reqWithID)
 		if err != nil {
-			log.Printf("Failed to marshal request with ID: %v", err)
-			return h.errorResponse(500, "Failed to start processing")
-		}
-
-		// Invoke this Lambda function asynchronously
-		if err := h.invokeAsync(ctx, string(requestBodyWithID)); err != nil {
-			log.Printf("Failed to invoke async: %v", err)
-
-			// Check if it's a concurrency limit error
-			if strings.Contains(err.Error(), "ReservedConcurrentExecutions") ||
-				strings.Contains(err.Error(), "TooManyRequestsException") ||
-				strings.Contains(err.Error(), "Rate exceeded") {
-				log.Printf("Concurrency limit reached")
-				return h.errorResponse(503, "Bot is currently at capacity processing other requests. Please try again in a few minutes.")
-			}
-
-			h.statusTracker.Error(ctx, requestID, fmt.Sprintf("Failed to start async processing: %v", err), req.RepositoryURL)
 			return h.errorResponse(500, fmt.Sprintf("Failed to start processing: %v", err))
 		}
 
 		// Return 202 Accepted immediately with requestId
-		responseBody := fmt.Sprintf(`{"status":"processing","message":"Your request is being processed.","repository":"%s","requestId":"%s"}`, req.RepositoryURL, requestID)
+		responseBody := fmt.Sprintf(`{"status":"processing","message":"Your request is being processed.","repository":"%s","requestId":"%s"}`, redact.String(req.RepositoryURL), requestID)
 		return events.APIGatewayProxyResponse{
 			StatusCode: 202,
 			Headers: map[string]string{
@@ -172,21 +190,197 @@ func (h *Handler) Handle(ctx context.Context, request events.APIGatewayProxyRequ
 		requestID = uuid.New().String()
 	}
 
-	result, err := h.processRepository(ctx, &reqWithID.Request, requestID)
+	process := h.processRepository
+	if reqWithID.PullRequestURL != "" {
+		process = h.processReview
+	}
+	result, err := process(ctx, &reqWithID.Request, requestID)
 	if err != nil {
 		log.Printf("ERROR: Failed to process repository: %v", err)
 		// Don't overwrite rejected status - it's already set with helpful feedback
 		// Only update to error status if it's not a validation rejection
-		if !strings.Contains(err.Error(), "prompt validation failed") {
+		if reset, ok := github.QuotaReset(err); ok {
+			h.statusTracker.QuotaExhausted(ctx, requestID, reset, err.Error(), reqWithID.RepositoryURL)
+		} else if !strings.Contains(err.Error(), "prompt validation failed") {
 			h.statusTracker.Error(ctx, requestID, err.Error(), reqWithID.RepositoryURL)
 		}
-		return events.APIGatewayProxyResponse{}, fmt.Errorf("failed to process repository: %w", err)
+		return events.APIGatewayProxyResponse{}, redact.Error(fmt.Errorf("failed to process repository: %w", err))
 	}
 
 	log.Printf("SUCCESS: %s", result)
 	return events.APIGatewayProxyResponse{}, nil
 }
 
+// Fills in RepositoryURL from an issue or pull request URL and rewrites it
+// as a full web URL on an allowed host, keeping any /tree/ path. A
+// repositoryUrl sent along with the issue or pull request must name the same
+// repository; its /tree/ path still picks the base branch and directory
+func (h *Handler) resolveRepository(req *models.Request) error {
+	treePath := github.TreePath(req.RepositoryURL)
+	given := req.RepositoryURL
+
+	// An issue or pull request URL names the repository as well
+	if req.IssueURL != "" {
+		_, _, _, number, err := github.ParseIssueURL(req.IssueURL)
+		if err != nil {
+			return fmt.Errorf("invalid issueUrl: %w", err)
+		}
+		req.RepositoryURL = req.IssueURL
+		req.IssueNumber = number
+	}
+	if req.PullRequestURL != "" {
+		if _, _, _, _, err := github.ParsePullRequestURL(req.PullRequestURL); err != nil {
+			return fmt.Errorf("invalid pullRequestUrl: %w", err)
+		}
+		req.RepositoryURL = req.PullRequestURL
+	}
+	if given != "" && given != req.RepositoryURL {
+		if err := sameRepository(given, req.RepositoryURL); err != nil {
+			return err
+		}
+	}
+
+	hostName, owner, repo, err := github.ParseRepoURL(req.RepositoryURL)
+	if err != nil {
+		return fmt.Errorf("invalid repository URL: %w", err)
+	}
+	if hostName == "" {
+		hostName = req.Host
+	} else if req.Host != "" && !strings.EqualFold(req.Host, hostName) {
+		return fmt.Errorf("host %s does not match the repository URL", req.Host)
+	}
+	host, err := h.credentials.Host(hostName)
+	if err != nil {
+		return err
+	}
+
+	// A branch and directory from a /tree/ URL are resolved while processing
+	req.RepositoryURL = host.RepoURL(owner, repo)
+	if treePath != "" {
+		segments := strings.Split(treePath, "/")
+		for i, segment := range segments {
+			segments[i] = url.PathEscape(segment)
+		}
+		req.RepositoryURL += "/tree/" + strings.Join(segments, "/")
+	}
+	return nil
+}
+
+// Checks that repositoryURL names the repository of an issue or pull request
+// URL. The shorthand owner/repo matches on any host
+func sameRepository(repositoryURL, otherURL string) error {
+	host, owner, repo, err := github.ParseRepoURL(repositoryURL)
+	if err != nil {
+		return fmt.Errorf("invalid repository URL: %w", err)
+	}
+	otherHost, otherOwner, otherRepo, err := github.ParseRepoURL(otherURL)
+	if err != nil {
+		return fmt.Errorf("invalid repository URL: %w", err)
+	}
+	if (host != "" && host != otherHost) || !strings.EqualFold(owner, otherOwner) || !strings.EqualFold(repo, otherRepo) {
+		return fmt.Errorf("repositoryUrl names %s/%s, but the issue or pull request is in %s/%s", owner, repo, otherOwner, otherRepo)
+	}
+	return nil
+}
+
+// Returns a *github.QuotaExhaustedError if the token used for repositoryURL
+// has no API quota left. Failures to check are logged and let through
+func (h *Handler) checkGitHubQuota(ctx context.Context, repositoryURL string) error {
+	host, owner, repo, err := github.ParseRepoURL(repositoryURL)
+	if err != nil {
+		return nil
+	}
+	githubClient, err := h.credentials.ClientFor(ctx, host, owner, repo)
+	if err == nil {
+		err = githubClient.CheckQuota(ctx)
+	}
+
+	var exhausted *github.QuotaExhaustedError
+	if errors.As(err, &exhausted) {
+		log.Printf("Refusing request: %v", err)
+		return exhausted
+	}
+	if err != nil {
+		log.Printf("Warning: failed to check GitHub quota: %v", err)
+	}
+	return nil
+}
+
+var errAtCapacity = errors.New("bot is at capacity")
+
+// Returned by enqueue when the client has used up its requests
+type rateLimitedError struct {
+	result *ratelimit.RateLimitResult
+}
+
+func (e *rateLimitedError) Error() string {
+	return fmt.Sprintf("rate limit exceeded: %d/%d requests used", e.result.RequestsUsed, e.result.RequestsLimit)
+}
+
+// enqueue starts asynchronous processing of req and returns its request ID.
+// clientKey identifies the caller for rate limiting, an IP address for API
+// requests
+func (h *Handler) enqueue(ctx context.Context, req models.Request, clientKey string) (string, error) {
+	// Requests started while the bot's GitHub quota is used up could only fail
+	if err := h.checkGitHubQuota(ctx, req.RepositoryURL); err != nil {
+		return "", err
+	}
+
+	// Check rate limit
+	rateLimitResult, err := h.rateLimiter.CheckRateLimit(ctx, clientKey)
+	if err != nil {
+		log.Printf("Warning: Failed to check rate limit: %v", err)
+		// Continue processing even if rate limit check fails
+	} else if !rateLimitResult.Allowed {
+		log.Printf("Rate limit exceeded for %s: %d/%d requests used", clientKey, rateLimitResult.RequestsUsed, rateLimitResult.RequestsLimit)
+		return "", &rateLimitedError{result: rateLimitResult}
+	}
+
+	// Generate unique request ID
+	requestID := uuid.New().String()
+	log.Printf("Generated request ID: %s", requestID)
+
+	// Record this request for rate limiting
+	if err := h.rateLimiter.RecordRequest(ctx, clientKey, requestID); err != nil {
+		log.Printf("Warning: Failed to record rate limit: %v", err)
+	}
+
+	// Create initial status record
+	if err = h.statusTracker.Update(ctx, requestID, status.StatusPending, "Request received, starting processing...", 0, req.RepositoryURL); err != nil {
+		log.Printf("Warning: Failed to create initial status: %v", err)
+	}
+
+	// Add requestID to the request for async processing
+	reqWithID := models.RequestWithID{
+		Request:   req,
+		RequestID: requestID,
+	}
+
+	requestBodyWithID, err := json.Marshal(reqWithID)
+	if err != nil {
+		log.Printf("Failed to marshal request with ID: %v", err)
+		return "", fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	// Invoke this Lambda function asynchronously
+	if err := h.invokeAsync(ctx, string(requestBodyWithID)); err != nil {
+		log.Printf("Failed to invoke async: %v", err)
+
+		// Check if it's a concurrency limit error
+		if strings.Contains(err.Error(), "ReservedConcurrentExecutions") ||
+			strings.Contains(err.Error(), "TooManyRequestsException") ||
+			strings.Contains(err.Error(), "Rate exceeded") {
+			log.Printf("Concurrency limit reached")
+			return "", errAtCapacity
+		}
+
+		h.statusTracker.Error(ctx, requestID, fmt.Sprintf("Failed to start async processing: %v", err), req.RepositoryURL)
+		return "", err
+	}
+
+	return requestID, nil
+}
+
 func (h *Handler) invokeAsync(ctx context.Context, payload string) error {
 	functionName := os.Getenv("AWS_LAMBDA_FUNCTION_NAME")
 	if functionName == "" {
@@ -231,12 +425,32 @@ func (h *Handler) invokeAsync(ctx context.Context, payload string) error {
 
 func (h *Handler) processRepository(ctx context.Context, req *models.Request, requestID string) (string, error) {
 	// Parse repository URL
-	owner, repo, err := github.ParseRepoURL(req.RepositoryURL)
+	host, owner, repo, err := github.ParseRepoURL(req.RepositoryURL)
 	if err != nil {
 		return "", fmt.Errorf("invalid repository URL: %w", err)
 	}
 
-	log.Printf("Parsed repository: owner=%s, repo=%s", owner, repo)
+	log.Printf("Parsed repository: host=%s, owner=%s, repo=%s", host, owner, repo)
+
+	// Authenticate as the GitHub App installation on the owner if there is
+	// one, otherwise with the host's personal access token
+	githubClient, err := h.credentials.ClientFor(ctx, host, owner, repo)
+	if err != nil {
+		return "", fmt.Errorf("failed to authenticate with GitHub: %w", err)
+	}
+
+	// Work from the issue if one was given, discussion included. Its title
+	// stands in for the prompt in commit messages and the PR title
+	summary := req.ModificationPrompt
+	if req.IssueNumber > 0 {
+		log.Printf("Fetching issue #%d...", req.IssueNumber)
+		issue, err := githubClient.GetIssue(ctx, owner, repo, req.IssueNumber)
+		if err != nil {
+			return "", fmt.Errorf("failed to fetch issue: %w", err)
+		}
+		req.ModificationPrompt = formatIssuePrompt(issue, req.ModificationPrompt)
+		summary = issue.Title
+	}
 
 	// Step 0: Validate the modification prompt
 	h.statusTracker.Update(ctx, requestID, status.StatusValidating, "Validating modification request...", 0, req.RepositoryURL)
@@ -253,95 +467,180 @@ func (h *Handler) processRepository(ctx context.Context, req *models.Request, re
 		log.Printf("Prompt validation passed: %s", reason)
 	}
 
-	// Step 1: Fork the repository
-	h.statusTracker.Update(ctx, requestID, status.StatusForking, "Forking repository...", 1, req.RepositoryURL)
-	log.Printf("Forking repository %s/%s...", owner, repo)
-	fork, err := h.githubClient.ForkRepository(ctx, owner, repo)
-	if err != nil {
-		return "", fmt.Errorf("fork failed: %w", err)
-	}
-
-	log.Printf("Fork created: %s", fork.GetHTMLURL())
-
-	// Get authenticated user info
-	user, err := h.githubClient.GetAuthenticatedUser(ctx)
-	if err != nil {
-		return "", fmt.Errorf("failed to get user info: %w", err)
-	}
-
-	log.Printf("Authenticated as: %s", user.GetLogin())
-
-	// Step 2: Clone the forked repository
-	h.statusTracker.Update(ctx, requestID, status.StatusCloning, "Cloning forked repository...", 2, req.RepositoryURL)
-	cloneOpts := git.CloneOptions{
-		URL:       fork.GetCloneURL(),
-		Directory: fmt.Sprintf("%s-%s", user.GetLogin(), repo),
-		Token:     h.githubToken,
-	}
-
-	log.Printf("Cloning repository to /tmp...")
-	clonePath, err := git.CloneRepository(cloneOpts)
-	if err != nil {
-		return "", fmt.Errorf("clone failed: %w", err)
+	// Step 1: Fork the repository, unless the bot can push to it directly.
+	// Branches pushed to upstream get a same-repo PR, so CI secrets and
+	// required checks work as they do for maintainers
+	direct := false
+	if directBranchModeEnabled() {
+		canPush, err := githubClient.CanPush(ctx, owner, repo)
+		if err != nil {
+			log.Printf("Warning: failed to check push access to %s/%s: %v", owner, repo, err)
+		}
+		direct = canPush
 	}
 
-	// Ensure cleanup happens
-	defer func() {
-		log.Printf("Cleaning up repository at %s", clonePath)
-		if cleanupErr := git.Cleanup(clonePath); cleanupErr != nil {
-			log.Printf("Warning: cleanup failed: %v", cleanupErr)
+	// headOwner and headURL identify the repository the branch is pushed to,
+	// and headClient is authenticated for it
+	headClient := githubClient
+	headOwner, headRepo := owner, repo
+	headURL := githubClient.Host().RepoURL(owner, repo)
+	cloneURL := headURL + ".git"
+	if direct {
+		log.Printf("Bot has push access to %s/%s, pushing the branch upstream instead of forking", owner, repo)
+	} else {
+		h.statusTracker.Update(ctx, requestID, status.StatusForking, "Forking repository...", 1, req.RepositoryURL)
+		log.Printf("Forking repository %s/%s...", owner, repo)
+		headClient, err = h.credentials.ForkClient(ctx, host, forkOrganization())
+		if err != nil {
+			return "", fmt.Errorf("fork failed: %w", err)
+		}
+		fork, err := headClient.ForkRepository(ctx, owner, repo, forkOrganization())
+		if err != nil {
+			return "", fmt.Errorf("fork failed: %w", err)
 		}
-	}()
 
-	log.Printf("Repository cloned to: %s", clonePath)
+		log.Printf("Fork created: %s", fork.GetHTMLURL())
+		headOwner = fork.GetOwner().GetLogin()
+		headRepo = fork.GetName()
+		headURL = fork.GetHTMLURL()
+		cloneURL = fork.GetCloneURL()
+	}
 
 	// Get the default branch before making changes
 	log.Printf("Getting default branch of upstream repository...")
-	defaultBranch, err := h.githubClient.GetDefaultBranch(ctx, owner, repo)
+	defaultBranch, err := githubClient.GetDefaultBranch(ctx, owner, repo)
 	if err != nil {
 		return "", fmt.Errorf("failed to get default branch: %w", err)
 	}
 	log.Printf("Default branch: %s", defaultBranch)
 
-	// Reset fork's main branch to match upstream
-	log.Printf("Resetting fork to match upstream...")
-	if err := git.ResetToUpstream(clonePath, owner, repo, defaultBranch); err != nil {
-		return "", fmt.Errorf("failed to reset to upstream: %w", err)
+	// A /tree/<branch>/<dir> URL targets another branch, and limits the
+	// changes to a directory of it
+	baseBranch, subdir := defaultBranch, ""
+	if treePath := github.TreePath(req.RepositoryURL); treePath != "" {
+		baseBranch, subdir, err = githubClient.ResolveTreePath(ctx, owner, repo, treePath)
+		if err != nil {
+			return "", err
+		}
+		if subdir != "" {
+			if subdir, err = git.CleanPath(subdir); err != nil {
+				return "", fmt.Errorf("invalid directory in repository URL: %w", err)
+			}
+		}
+		log.Printf("Targeting branch %s, directory %q", baseBranch, subdir)
+	}
+
+	repoSizeKB, err := githubClient.GetRepositorySize(ctx, owner, repo)
+	if err != nil {
+		log.Printf("Warning: failed to get repository size: %v", err)
 	}
-	log.Printf("Fork reset to upstream successfully")
 
 	// Create a new branch with timestamp
-	branchName := fmt.Sprintf("auto-pr-bot/%d", time.Now().Unix())
-	log.Printf("Creating new branch: %s", branchName)
-	if err := git.CreateAndCheckoutBranch(clonePath, branchName); err != nil {
-		return "", fmt.Errorf("failed to create branch: %w", err)
+	branchName := fmt.Sprintf("%s%d", branchPrefix, time.Now().Unix())
+	target := cloneTarget{
+		url:         cloneURL,
+		upstreamURL: githubClient.Host().RepoURL(owner, repo) + ".git",
+		baseBranch:  baseBranch,
+		branchName:  branchName,
+		repoSizeKB:  repoSizeKB,
+	}
+	if !direct {
+		target.forkOwner, target.forkRepo = headOwner, headRepo
+	}
+
+	// Step 2: Read the repository through the GitHub API when possible, so
+	// small changes need neither git nor /tmp. Otherwise clone the fork, or
+	// upstream in direct-branch mode
+	backend := commitBackend()
+	var ws workspace
+	usingAPI := false
+	if backend != "clone" {
+		h.statusTracker.Update(ctx, requestID, status.StatusCloning, "Reading repository through the GitHub API...", 2, req.RepositoryURL)
+		remote, err := githubClient.OpenRemoteWorkspace(ctx, owner, repo, baseBranch, headClient, headOwner, headRepo)
+		if err != nil {
+			log.Printf("Warning: cannot edit through the GitHub API, cloning instead: %v", err)
+		} else {
+			log.Printf("Editing %s/%s through the GitHub API on branch %s", headOwner, headRepo, branchName)
+			ws = &remoteWorkspace{remote}
+			usingAPI = true
+		}
+	}
+	if ws == nil {
+		h.statusTracker.Update(ctx, requestID, status.StatusCloning, "Cloning repository...", 2, req.RepositoryURL)
+		local, err := h.cloneWorkspace(ctx, githubClient, headClient, requestID, target)
+		if err != nil {
+			return "", err
+		}
+		ws = local
 	}
 
+	// Ensure cleanup happens, for whichever workspace is in use by then
+	defer func() {
+		ws.Cleanup()
+	}()
+
 	// List all files in the repository
 	log.Printf("Listing files in repository...")
-	fileTree, err := git.ListFiles(clonePath)
+	fileTree, err := ws.ListFiles(ctx)
 	if err != nil {
 		return "", fmt.Errorf("failed to list files: %w", err)
 	}
 
-	log.Printf("Repository file structure:\n%s", fileTree)
+	// Upstream's contribution rules guide generation, and its template
+	// shapes the PR description
+	guidelines := loadGuidelines(ctx, ws, fileTree)
+
+	// Only the requested directory is shown to the model and may be edited
+	if subdir != "" {
+		fileTree = fileTree.Subtree(subdir)
+		if fileTree == nil {
+			return "", fmt.Errorf("directory %s does not exist on branch %s", subdir, baseBranch)
+		}
+		ws = scopeWorkspace(ws, subdir)
+	}
+
+	// The compact rendering drops ignored paths and collapses vendored and
+	// generated directories to keep the prompt small
+	compactTree := fileTree.Compact()
+	log.Printf("Repository file structure:\n%s", compactTree)
 
 	// Step 3: Call OpenAI to analyze which files to read
 	h.statusTracker.Update(ctx, requestID, status.StatusAnalyzing, "Analyzing repository with AI...", 3, req.RepositoryURL)
 	log.Printf("Step 1: Calling OpenAI to determine which files to read...")
-	history, filesToRead, err := h.openaiClient.AnalyzeRepositoryForFiles(ctx, fileTree, req.ModificationPrompt)
+	history, filesToRead, err := h.openaiClient.AnalyzeRepositoryForFiles(ctx, compactTree, req.ModificationPrompt)
 	if err != nil {
 		return "", fmt.Errorf("failed to analyze repository with OpenAI: %w", err)
 	}
 
 	log.Printf("Files to read: %v", filesToRead)
+	if rules := guidelines.rules(); rules != "" {
+		openai.AddContributionGuidelines(history, rules)
+	}
+
+	// Reading many files of a larger repository is cheaper from a clone
+	if usingAPI && backend == "auto" && preferClone(repoSizeKB, len(filesToRead)) {
+		log.Printf("Model selected %d files, cloning instead of reading them through the API", len(filesToRead))
+		h.statusTracker.Update(ctx, requestID, status.StatusCloning, "Cloning repository...", 2, req.RepositoryURL)
+		local, err := h.cloneWorkspace(ctx, githubClient, headClient, requestID, target)
+		if err != nil {
+			return "", err
+		}
+		ws = scopeWorkspace(local, subdir)
+	}
 
 	// Step 2: Read the identified files
 	log.Printf("Step 2: Reading file contents...")
+	if err := ws.Materialize(ctx, filesToRead); err != nil {
+		log.Printf("Warning: failed to materialize files: %v", err)
+	}
+	filesToRead = h.safePaths(ctx, requestID, ws, filesToRead)
 	fileContents := make(map[string]string)
 	for _, relPath := range filesToRead {
-		fullPath := fmt.Sprintf("%s/%s", clonePath, relPath)
-		content, err := git.ReadFileContent(fullPath)
+		if node := fileTree.Find(relPath); node != nil && node.Binary {
+			log.Printf("Skipping binary file: %s", relPath)
+			continue
+		}
+		content, err := ws.ReadFile(ctx, relPath)
 		if err != nil {
 			log.Printf("Warning: failed to read file %s: %v", relPath, err)
 			continue
@@ -362,6 +661,10 @@ func (h *Handler) processRepository(ctx context.Context, req *models.Request, re
 	}
 
 	log.Printf("Files to modify: %v", filesToModify)
+	if err := ws.Materialize(ctx, filesToModify); err != nil {
+		log.Printf("Warning: failed to materialize files: %v", err)
+	}
+	filesToModify = h.safePaths(ctx, requestID, ws, filesToModify)
 	log.Printf("Explanation: %s", explanation)
 
 	// Step 4: Generate modified content for each file
@@ -369,11 +672,15 @@ func (h *Handler) processRepository(ctx context.Context, req *models.Request, re
 	log.Printf("Step 4: Generating modified file contents...")
 	modifiedFiles := make(map[string]string)
 	for _, filePath := range filesToModify {
+		if !fileTree.Editable(filePath) {
+			log.Printf("Warning: refusing to modify %s - it is binary, generated, vendored or ignored", filePath)
+			continue
+		}
+
 		originalContent, exists := fileContents[filePath]
 		if !exists {
 			log.Printf("Warning: file %s was not in the read list, attempting to read it now", filePath)
-			fullPath := fmt.Sprintf("%s/%s", clonePath, filePath)
-			content, err := git.ReadFileContent(fullPath)
+			content, err := ws.ReadFile(ctx, filePath)
 			if err != nil {
 				log.Printf("Warning: failed to read file %s: %v", filePath, err)
 				continue
@@ -396,13 +703,16 @@ func (h *Handler) processRepository(ctx context.Context, req *models.Request, re
 		return "", fmt.Errorf("no files could be modified")
 	}
 
-	// Step 5: Write modified files to disk
-	log.Printf("Step 5: Writing modified files to disk...")
+	// Step 5: Write modified files to the workspace
+	log.Printf("Step 5: Writing modified files...")
 	for filePath, content := range modifiedFiles {
-		fullPath := fmt.Sprintf("%s/%s", clonePath, filePath)
-		// Ensure content ends with newline (POSIX standard)
-		content = ensureTrailingNewline(content)
-		if err := git.WriteFile(fullPath, content); err != nil {
+		// Encoding, line endings and mode of existing files are preserved
+		if err := ws.WriteFile(ctx, filePath, content); err != nil {
+			if unwritable(err) {
+				log.Printf("Warning: leaving %s unchanged: %v", filePath, err)
+				delete(modifiedFiles, filePath)
+				continue
+			}
 			return "", fmt.Errorf("failed to write file %s: %w", filePath, err)
 		}
 		log.Printf("Wrote file: %s", filePath)
@@ -411,13 +721,38 @@ func (h *Handler) processRepository(ctx context.Context, req *models.Request, re
 	// Step 6: Commit and push changes to the new branch
 	h.statusTracker.Update(ctx, requestID, status.StatusCommitting, "Committing and pushing changes...", 5, req.RepositoryURL)
 	log.Printf("Step 6: Committing and pushing changes to branch %s...", branchName)
-	commitMessage := fmt.Sprintf("Auto PR: %s\n\n%s", req.ModificationPrompt, explanation)
-	err = git.CommitAndPush(clonePath, branchName, commitMessage, h.githubToken)
+
+	// Generation can take minutes, so make sure the branch is still based on
+	// the latest upstream before committing
+	if err := h.rebaseOntoUpstream(ctx, history, ws, baseBranch, modifiedFiles, req.ModificationPrompt); err != nil {
+		return "", fmt.Errorf("failed to rebase onto upstream: %w", err)
+	}
+
+	// Parse every modified file, gofmt Go files, and send broken files back
+	// to the model. Files that stay broken are reverted
+	if err := h.validateFiles(ctx, history, ws, fileTree, fileContents, modifiedFiles, req.ModificationPrompt); err != nil {
+		return "", fmt.Errorf("failed to validate modified files: %w", err)
+	}
+	if len(modifiedFiles) == 0 {
+		return "", fmt.Errorf("no files passed validation")
+	}
+	commitMessage := fmt.Sprintf("Auto PR: %s\n\n%s", summary, explanation)
+	commits := []git.Commit{{Message: commitMessage}}
+	squash := h.commitConfig.Squash
+	if req.SquashCommits != nil {
+		squash = *req.SquashCommits
+	}
+	if !squash {
+		commits = h.planCommits(ctx, history, modifiedFiles, explanation, req.ModificationPrompt, commitMessage)
+	}
+	log.Printf("Creating %d commit(s)", len(commits))
+	commitOptions := h.commitConfig.CommitOptions(h.coAuthor(ctx, githubClient, req.GitHubUsername), requestID)
+	err = ws.Commit(ctx, branchName, commits, commitOptions)
 
 	// Check if there are no changes to commit
 	hasChanges := true
 	if err != nil {
-		if strings.Contains(err.Error(), "no changes to commit") {
+		if errors.Is(err, git.ErrNoChanges) {
 			log.Printf("No changes detected - files are already up to date")
 			hasChanges = false
 		} else {
@@ -431,96 +766,117 @@ func (h *Handler) processRepository(ctx context.Context, req *models.Request, re
 	// Note: We ONLY close PRs from the default branch. PRs from feature branches
 	// (auto-pr-bot/<timestamp>) are left open, allowing multiple concurrent PRs per repo.
 	// This gives users flexibility to work on multiple independent changes.
-	log.Printf("Step 7: Checking for existing PRs from bot (default branch: %s)...", defaultBranch)
-	existingPRs, err := h.githubClient.ListOpenPullRequests(ctx, owner, repo, user.GetLogin(), defaultBranch)
-	if err != nil {
-		log.Printf("Warning: failed to list existing PRs: %v", err)
-	} else if len(existingPRs) > 0 {
-		// If there are no new changes and PRs already exist, just return success
+	// Only the fork's default branch is the bot's. In direct-branch mode it is
+	// upstream's, and PRs from it belong to the maintainers
+	if direct {
+		log.Printf("Step 7: Branch was pushed upstream - skipping the check for existing PRs")
 		if !hasChanges {
-			log.Printf("Found existing PR(s) and no new changes - nothing to do")
-			existingPR := existingPRs[0]
-			response := fmt.Sprintf(
-				"No changes needed - PR already exists!\n\n"+
-					"Original: %s/%s\n"+
-					"Fork: %s\n"+
-					"Existing Pull Request: %s\n\n"+
-					"The requested changes are already in the open PR.",
-				owner, repo,
-				fork.GetHTMLURL(),
-				existingPR.GetHTMLURL(),
-			)
-			return response, nil
-		}
-
-		// Close existing default-branch PRs and delete their branches
-		log.Printf("Found %d existing default-branch PR(s), closing them and deleting branches...", len(existingPRs))
-		for _, existingPR := range existingPRs {
-			oldBranch := existingPR.Head.GetRef()
-			closeComment := fmt.Sprintf("Closing this PR to create a new one with updated changes.\n\nNew modification request: %s", req.ModificationPrompt)
-			if err := h.githubClient.ClosePullRequest(ctx, owner, repo, existingPR.GetNumber(), closeComment); err != nil {
-				log.Printf("Warning: failed to close PR #%d: %v", existingPR.GetNumber(), err)
-			} else {
-				log.Printf("Closed PR #%d", existingPR.GetNumber())
+			return "", fmt.Errorf("no changes to commit")
+		}
+	} else {
+		log.Printf("Step 7: Checking for existing PRs from bot (default branch: %s)...", defaultBranch)
+		existingPRs, err := githubClient.ListOpenPullRequests(ctx, owner, repo, headOwner, headRepo, defaultBranch)
+		if err != nil {
+			log.Printf("Warning: failed to list existing PRs: %v", err)
+		} else if len(existingPRs) > 0 {
+			// If there are no new changes and PRs already exist, just return success
+			if !hasChanges {
+				log.Printf("Found existing PR(s) and no new changes - nothing to do")
+				existingPR := existingPRs[0]
+				response := fmt.Sprintf(
+					"No changes needed - PR already exists!\n\n"+
+						"Original: %s/%s\n"+
+						"Fork: %s\n"+
+						"Existing Pull Request: %s\n\n"+
+						"The requested changes are already in the open PR.",
+					owner, repo,
+					headURL,
+					existingPR.GetHTMLURL(),
+				)
+				return response, nil
 			}
 
-			// Delete the old branch from fork (skip if it's the default branch)
-			if oldBranch != defaultBranch {
-				if err := h.githubClient.DeleteBranch(ctx, user.GetLogin(), repo, oldBranch); err != nil {
-					log.Printf("Warning: failed to delete branch %s: %v", oldBranch, err)
+			// Close existing default-branch PRs and delete their branches
+			log.Printf("Found %d existing default-branch PR(s), closing them and deleting branches...", len(existingPRs))
+			for _, existingPR := range existingPRs {
+				oldBranch := existingPR.Head.GetRef()
+				closeComment := fmt.Sprintf("Closing this PR to create a new one with updated changes.\n\nNew modification request: %s", summary)
+				if err := githubClient.ClosePullRequest(ctx, owner, repo, existingPR.GetNumber(), closeComment); err != nil {
+					log.Printf("Warning: failed to close PR #%d: %v", existingPR.GetNumber(), err)
 				} else {
-					log.Printf("Deleted branch %s", oldBranch)
+					log.Printf("Closed PR #%d", existingPR.GetNumber())
+				}
+
+				// Delete the old branch from fork (skip if it's the default branch)
+				if oldBranch != defaultBranch {
+					if err := headClient.DeleteBranch(ctx, headOwner, headRepo, oldBranch); err != nil {
+						log.Printf("Warning: failed to delete branch %s: %v", oldBranch, err)
+					} else {
+						log.Printf("Deleted branch %s", oldBranch)
+					}
+				} else {
+					log.Printf("Skipping deletion of default branch %s", oldBranch)
 				}
-			} else {
-				log.Printf("Skipping deletion of default branch %s", oldBranch)
 			}
+		} else if !hasChanges {
+			// No existing PRs and no changes - this shouldn't happen but handle it gracefully
+			return "", fmt.Errorf("no changes to commit and no existing PR found")
 		}
-	} else if !hasChanges {
-		// No existing PRs and no changes - this shouldn't happen but handle it gracefully
-		return "", fmt.Errorf("no changes to commit and no existing PR found")
 	}
 
 	// Step 8: Create Pull Request from the new branch
 	h.statusTracker.Update(ctx, requestID, status.StatusCreatingPR, "Creating pull request...", 6, req.RepositoryURL)
 	log.Printf("Step 8: Creating pull request from branch %s...", branchName)
-	prTitle := fmt.Sprintf("Auto PR: %s", req.ModificationPrompt)
-	prBody := fmt.Sprintf(`This is an automated pull request.
-
-**Modification Request:**
-%s
-
-**Changes Made:**
-%s
-
-**Modified Files:**
-%s
-
----
-*Generated by [Auto PR Bot](https://www.auto-pr.com)*`, req.ModificationPrompt, explanation, formatModifiedFilesList(modifiedFiles))
+	prTitle := fmt.Sprintf("Auto PR: %s", summary)
+	prBody := h.pullRequestBody(ctx, history, guidelines.pullRequestTemplate, prTitle, summary, explanation, modifiedFiles, formatLinkedIssues(req.IssueNumber, req.LinkedIssues))
 
-	pr, err := h.githubClient.CreatePullRequest(
+	pr, err := githubClient.CreatePullRequest(
 		ctx,
-		owner,           // upstream owner
-		repo,            // upstream repo
-		user.GetLogin(), // fork owner
+		owner,     // upstream owner
+		repo,      // upstream repo
+		headOwner, // fork owner, or upstream owner for a same-repo PR
 		prTitle,
 		prBody,
-		branchName,    // head branch (the new timestamp branch)
-		defaultBranch, // base branch (upstream's default branch)
+		branchName, // head branch (the new timestamp branch)
+		baseBranch, // base branch (upstream's default branch, or the one in the URL)
+		req.Draft,
 	)
+	if errors.Is(err, github.ErrDraftUnsupported) {
+		// Draft PRs are not available on every plan; open a regular one
+		log.Printf("Warning: failed to create draft pull request, retrying as ready for review: %v", err)
+		h.statusTracker.MetadataFailed(ctx, requestID, "draft", err.Error())
+		pr, err = githubClient.CreatePullRequest(ctx, owner, repo, headOwner, prTitle, prBody, branchName, baseBranch, false)
+	}
 	if err != nil {
 		return "", fmt.Errorf("failed to create pull request: %w", err)
 	}
 
 	log.Printf("Pull request created: %s", pr.GetHTMLURL())
 
+	metadata := github.PullRequestMetadata{
+		Labels:        req.Labels,
+		Reviewers:     req.Reviewers,
+		TeamReviewers: req.TeamReviewers,
+		Assignees:     req.Assignees,
+		Milestone:     req.Milestone,
+	}
+	for _, failed := range githubClient.ApplyPullRequestMetadata(ctx, owner, repo, pr.GetNumber(), metadata) {
+		log.Printf("Warning: %v", failed)
+		h.statusTracker.MetadataFailed(ctx, requestID, failed.Field, failed.Err.Error())
+	}
+
 	// Mark as completed in status tracker
 	h.statusTracker.Complete(ctx, requestID, pr.GetHTMLURL(), req.RepositoryURL)
-
-	// Step 9: Add GitHub user as collaborator to the fork if provided
-	if req.GitHubUsername != "" {
-		log.Printf("Step 9: Adding %s as collaborator to fork %s/%s...", req.GitHubUsername, user.GetLogin(), repo)
-		if err := h.githubClient.AddCollaborator(ctx, user.GetLogin(), repo, req.GitHubUsername); err != nil {
+	// The CI poller records the pull request's checks from here on
+	h.statusTracker.WatchCI(ctx, requestID, pr.GetHead().GetSHA())
+
+	// Step 9: Add GitHub user as collaborator to the fork if provided. Never
+	// grant access to the upstream repository itself
+	if direct {
+		log.Printf("Branch was pushed upstream - skipping collaborator assignment")
+	} else if req.GitHubUsername != "" {
+		log.Printf("Step 9: Adding %s as collaborator to fork %s/%s...", req.GitHubUsername, headOwner, headRepo)
+		if err := headClient.AddCollaborator(ctx, headOwner, headRepo, req.GitHubUsername); err != nil {
 			log.Printf("Warning: failed to add collaborator %s: %v", req.GitHubUsername, err)
 			log.Printf("The PR was created successfully, but the user may need to be added manually")
 		} else {
@@ -533,7 +889,7 @@ func (h *Handler) processRepository(ctx context.Context, req *models.Request, re
 	// Print summary to CloudWatch
 	log.Printf("\n=== MODIFICATION SUMMARY ===")
 	log.Printf("Repository: %s/%s", owner, repo)
-	log.Printf("Fork: %s", fork.GetHTMLURL())
+	log.Printf("Fork: %s", headURL)
 	log.Printf("Modification prompt: %s", req.ModificationPrompt)
 	log.Printf("\nFiles analyzed: %d", len(filesToRead))
 	for _, file := range filesToRead {
@@ -558,7 +914,7 @@ func (h *Handler) processRepository(ctx context.Context, req *models.Request, re
 			"Explanation: %s\n\n"+
 			"Modified Files:\n%s",
 		owner, repo,
-		fork.GetHTMLURL(),
+		headURL,
 		pr.GetHTMLURL(),
 		len(filesToRead),
 		len(modifiedFiles),
@@ -569,15 +925,252 @@ func (h *Handler) processRepository(ctx context.Context, req *models.Request, re
 	return response, nil
 }
 
-// POSIX standard requires text files to end with a newline
-func ensureTrailingNewline(content string) string {
-	if content == "" {
-		return content
+// Repositories at or above the threshold are cloned partially. Setting
+// PARTIAL_CLONE_THRESHOLD_MB to 0 forces partial clones for every repository
+func usePartialClone(repoSizeKB int) bool {
+	thresholdMB := defaultPartialCloneThresholdMB
+	if value := os.Getenv("PARTIAL_CLONE_THRESHOLD_MB"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			log.Printf("Warning: invalid PARTIAL_CLONE_THRESHOLD_MB %q, using %d", value, thresholdMB)
+		} else {
+			thresholdMB = parsed
+		}
+	}
+	return repoSizeKB >= thresholdMB*1024
+}
+
+// Direct-branch mode is on unless DIRECT_BRANCH_MODE is "off"
+func directBranchModeEnabled() bool {
+	switch value := os.Getenv("DIRECT_BRANCH_MODE"); value {
+	case "", "auto":
+		return true
+	case "off":
+		return false
+	default:
+		log.Printf("Warning: invalid DIRECT_BRANCH_MODE %q, using auto", value)
+		return true
+	}
+}
+
+// Forks go to the FORK_ORGANIZATION organization when it is set, otherwise
+// to the bot's own account
+func forkOrganization() string {
+	return os.Getenv("FORK_ORGANIZATION")
+}
+
+// Canonicalizes paths returned by the LLM, dropping and recording any that
+// escape the repository, point into .git or traverse a symlink
+func (h *Handler) safePaths(ctx context.Context, requestID string, ws workspace, paths []string) []string {
+	safe := make([]string, 0, len(paths))
+	seen := make(map[string]bool)
+	for _, relPath := range paths {
+		cleaned, err := ws.ResolvePath(relPath)
+		if err != nil {
+			var pathErr *git.PathError
+			if !errors.As(err, &pathErr) {
+				log.Printf("Warning: failed to resolve path %s: %v", relPath, err)
+				continue
+			}
+			log.Printf("Warning: rejected path from model: %v", err)
+			h.statusTracker.RejectPath(ctx, requestID, pathErr.Path, pathErr.Reason)
+			continue
+		}
+		if !seen[cleaned] {
+			seen[cleaned] = true
+			safe = append(safe, cleaned)
+		}
+	}
+	return safe
+}
+
+// Moves the branch onto the current upstream tip if it moved since the clone.
+// Files upstream changed in the meantime are regenerated against the new
+// content; any that cannot be are dropped from modifiedFiles
+func (h *Handler) rebaseOntoUpstream(ctx context.Context, history *openai.ConversationHistory, ws workspace, baseBranch string, modifiedFiles map[string]string, modificationPrompt string) error {
+	paths := make([]string, 0, len(modifiedFiles))
+	for filePath := range modifiedFiles {
+		paths = append(paths, filePath)
+	}
+
+	rebase, err := ws.Rebase(ctx, paths)
+	if err != nil {
+		return err
+	}
+	if !rebase.Moved() {
+		log.Printf("Upstream %s has not moved", baseBranch)
+		return nil
+	}
+	log.Printf("Upstream %s moved from %s to %s, rebased with %d conflicting file(s)", baseBranch, rebase.OldBase, rebase.NewBase, len(rebase.Conflicts))
+
+	for _, filePath := range rebase.Conflicts {
+		upstreamContent, err := ws.ReadFile(ctx, filePath)
+		if errors.Is(err, os.ErrNotExist) {
+			upstreamContent = ""
+		} else if err != nil {
+			log.Printf("Warning: failed to read upstream version of %s, dropping it: %v", filePath, err)
+			delete(modifiedFiles, filePath)
+			continue
+		}
+
+		log.Printf("Regenerating %s against the new upstream content", filePath)
+		content, err := h.openaiClient.RegenerateConflictingFile(ctx, history, filePath, upstreamContent, modifiedFiles[filePath], modificationPrompt)
+		if err != nil {
+			log.Printf("Warning: failed to regenerate %s, dropping it: %v", filePath, err)
+			delete(modifiedFiles, filePath)
+			continue
+		}
+
+		if err := ws.WriteFile(ctx, filePath, content); err != nil {
+			if !unwritable(err) {
+				return fmt.Errorf("failed to write file %s: %w", filePath, err)
+			}
+			log.Printf("Warning: dropping %s, its regenerated content cannot be written: %v", filePath, err)
+			if err := ws.RestoreFile(filePath); err != nil {
+				return fmt.Errorf("failed to revert %s: %w", filePath, err)
+			}
+			delete(modifiedFiles, filePath)
+			continue
+		}
+		modifiedFiles[filePath] = content
+	}
+
+	return nil
+}
+
+// Whether err from writing a file means the content cannot be stored the
+// way the file is, such as a character outside a Latin-1 file's range, or
+// that the file is binary. Such files are left out of the change
+func unwritable(err error) bool {
+	return errors.Is(err, git.ErrBinaryFile) || errors.Is(err, git.ErrUnencodable)
+}
+
+func (h *Handler) validateFiles(ctx context.Context, history *openai.ConversationHistory, ws workspace, fileTree *git.FileTree, originals, modifiedFiles map[string]string, modificationPrompt string) error {
+	exists := func(relPath string) bool {
+		_, modified := modifiedFiles[relPath]
+		return modified || fileTree.Find(relPath) != nil
+	}
+
+	for filePath, content := range modifiedFiles {
+		opts := validate.Options{Original: originals[filePath], Exists: exists}
+		validated, err := validate.File(filePath, content, opts)
+		for attempt := 1; err != nil && attempt <= maxSyntaxFixAttempts; attempt++ {
+			log.Printf("Warning: %v", err)
+			log.Printf("Asking the model to fix %s (attempt %d/%d)", filePath, attempt, maxSyntaxFixAttempts)
+			fixed, fixErr := h.openaiClient.FixFileSyntax(ctx, history, filePath, content, err.Error(), modificationPrompt)
+			if fixErr != nil {
+				log.Printf("Warning: failed to fix %s: %v", filePath, fixErr)
+				break
+			}
+			content = fixed
+			validated, err = validate.File(filePath, content, opts)
+		}
+
+		if err != nil {
+			log.Printf("Warning: reverting %s, it still fails validation: %v", filePath, err)
+			if err := ws.RestoreFile(filePath); err != nil {
+				return fmt.Errorf("failed to revert %s: %w", filePath, err)
+			}
+			delete(modifiedFiles, filePath)
+			continue
+		}
+
+		if validated != modifiedFiles[filePath] {
+			if err := ws.WriteFile(ctx, filePath, validated); err != nil {
+				if !unwritable(err) {
+					return fmt.Errorf("failed to write file %s: %w", filePath, err)
+				}
+				log.Printf("Warning: reverting %s, its fixed content cannot be written: %v", filePath, err)
+				if err := ws.RestoreFile(filePath); err != nil {
+					return fmt.Errorf("failed to revert %s: %w", filePath, err)
+				}
+				delete(modifiedFiles, filePath)
+				continue
+			}
+			modifiedFiles[filePath] = validated
+		}
+	}
+
+	return nil
+}
+
+// Asks the model to split the modified files into logical commits. Files the
+// plan leaves out go into a final commit with fallbackMessage, and any
+// failure to plan falls back to a single commit
+func (h *Handler) planCommits(ctx context.Context, history *openai.ConversationHistory, modifiedFiles map[string]string, explanation, modificationPrompt, fallbackMessage string) []git.Commit {
+	files := make([]string, 0, len(modifiedFiles))
+	for filePath := range modifiedFiles {
+		files = append(files, filePath)
+	}
+	sort.Strings(files)
+
+	plan, err := h.openaiClient.PlanCommits(ctx, history, files, explanation, modificationPrompt)
+	if err != nil {
+		log.Printf("Warning: failed to plan commits, using a single commit: %v", err)
+		return []git.Commit{{Message: fallbackMessage}}
+	}
+
+	var commits []git.Commit
+	assigned := make(map[string]bool)
+	for _, group := range plan {
+		var paths []string
+		for _, filePath := range group.Files {
+			if _, ok := modifiedFiles[filePath]; !ok || assigned[filePath] {
+				continue
+			}
+			assigned[filePath] = true
+			paths = append(paths, filePath)
+		}
+		subject := strings.TrimSpace(group.Subject)
+		if len(paths) == 0 || subject == "" {
+			continue
+		}
+
+		message := subject
+		if body := strings.TrimSpace(group.Body); body != "" {
+			message += "\n\n" + body
+		}
+		commits = append(commits, git.Commit{Message: message, Paths: paths})
+	}
+
+	if len(assigned) < len(files) {
+		commits = append(commits, git.Commit{Message: fallbackMessage})
+	}
+	return commits
+}
+
+// Reads CLONE_SIZE_LIMIT_MB; 0 disables the limit
+func cloneSizeLimit() int64 {
+	limitMB := defaultCloneSizeLimitMB
+	if value := os.Getenv("CLONE_SIZE_LIMIT_MB"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			log.Printf("Warning: invalid CLONE_SIZE_LIMIT_MB %q, using %d", value, limitMB)
+		} else {
+			limitMB = parsed
+		}
+	}
+	return int64(limitMB) << 20
+}
+
+// Returns the requesting user's GitHub noreply identity for the
+// Co-authored-by trailer, which GitHub attributes by user ID
+func (h *Handler) coAuthor(ctx context.Context, githubClient *github.Client, username string) string {
+	if username == "" || !h.commitConfig.CoAuthor {
+		return ""
 	}
-	if !strings.HasSuffix(content, "\n") {
-		return content + "\n"
+
+	user, err := githubClient.GetUser(ctx, username)
+	if err != nil {
+		log.Printf("Warning: failed to look up co-author %s: %v", username, err)
+		return ""
 	}
-	return content
+
+	name := user.GetName()
+	if name == "" {
+		name = user.GetLogin()
+	}
+	return fmt.Sprintf("%s <%d+%s@users.noreply.%s>", name, user.GetID(), user.GetLogin(), githubClient.Host().Name)
 }
 
 func formatFileList(analyzed []string, modified map[string]string) string {
@@ -593,6 +1186,108 @@ func formatFileList(analyzed []string, modified map[string]string) string {
 	return builder.String()
 }
 
+// Fills in upstream's pull request template when it has one, falling back
+// to the bot's own layout. Closing keywords and the footer are added either
+// way so they cannot be lost in the template
+func (h *Handler) pullRequestBody(ctx context.Context, history *openai.ConversationHistory, template, title, summary, explanation string, modifiedFiles map[string]string, linkedIssues string) string {
+	footer := "\n---\n*Generated by [Auto PR Bot](https://www.auto-pr.com)*"
+
+	if template != "" {
+		files := make([]string, 0, len(modifiedFiles))
+		for filePath := range modifiedFiles {
+			files = append(files, filePath)
+		}
+		sort.Strings(files)
+
+		body, err := h.openaiClient.FillPullRequestTemplate(ctx, history, template, title, explanation, files)
+		if err == nil && body != "" {
+			return body + "\n" + linkedIssues + footer
+		}
+		log.Printf("Warning: failed to fill in the pull request template, using the default description: %v", err)
+	}
+
+	return fmt.Sprintf(`This is an automated pull request.
+
+**Modification Request:**
+%s
+
+**Changes Made:**
+%s
+
+**Modified Files:**
+%s
+%s`, summary, explanation, formatModifiedFilesList(modifiedFiles), linkedIssues) + footer
+}
+
+// Closing keywords make GitHub close the issues when the PR is merged. fixes
+// is the issue the request was built from, zero if none
+func formatLinkedIssues(fixes int, closes []int) string {
+	if fixes == 0 && len(closes) == 0 {
+		return ""
+	}
+
+	var builder strings.Builder
+	builder.WriteString("\n")
+	if fixes > 0 {
+		builder.WriteString(fmt.Sprintf("Fixes #%d\n", fixes))
+	}
+	for _, issue := range closes {
+		if issue != fixes {
+			builder.WriteString(fmt.Sprintf("Closes #%d\n", issue))
+		}
+	}
+	return builder.String()
+}
+
+// Turns an issue into the task description for the LLM. When the discussion
+// is too long, the oldest comments are dropped first since later ones tend to
+// refine what is wanted
+func formatIssuePrompt(issue *github.Issue, extraInstructions string) string {
+	var header strings.Builder
+	header.WriteString(fmt.Sprintf("Resolve GitHub issue #%d: %s\n", issue.Number, issue.Title))
+	if len(issue.Labels) > 0 {
+		header.WriteString(fmt.Sprintf("Labels: %s\n", strings.Join(issue.Labels, ", ")))
+	}
+	if issue.Body != "" {
+		header.WriteString(fmt.Sprintf("\n%s\n", truncate(issue.Body, maxIssuePromptChars/2)))
+	}
+	if extraInstructions != "" {
+		header.WriteString(fmt.Sprintf("\nAdditional instructions from the requester:\n%s\n", extraInstructions))
+	}
+
+	var comments []string
+	remaining := maxIssuePromptChars - header.Len()
+	for i := len(issue.Comments) - 1; i >= 0; i-- {
+		comment := fmt.Sprintf("@%s wrote:\n%s\n", issue.Comments[i].Author, issue.Comments[i].Body)
+		if len(comment) > remaining {
+			break
+		}
+		remaining -= len(comment)
+		comments = append([]string{comment}, comments...)
+	}
+
+	if len(comments) == 0 {
+		return header.String()
+	}
+	discussion := "\nDiscussion:\n"
+	if omitted := len(issue.Comments) - len(comments); omitted > 0 {
+		discussion += fmt.Sprintf("(%d earlier comments omitted)\n", omitted)
+	}
+	return header.String() + discussion + strings.Join(comments, "\n")
+}
+
+// Cuts s to at most limit bytes, backing up to a rune boundary so the
+// result stays valid UTF-8
+func truncate(s string, limit int) string {
+	if len(s) <= limit {
+		return s
+	}
+	for limit > 0 && !utf8.RuneStart(s[limit]) {
+		limit--
+	}
+	return s[:limit] + "\n[truncated]"
+}
+
 func formatModifiedFilesList(modified map[string]string) string {
 	var builder strings.Builder
 	for file := range modified {
@@ -620,7 +1315,7 @@ func (h *Handler) errorResponse(statusCode int, message string) (events.APIGatew
 			"Access-Control-Allow-Methods": "POST, OPTIONS",
 			"Access-Control-Allow-Headers": "Content-Type",
 		},
-		Body: fmt.Sprintf(`{"error": "%s"}`, message),
+		Body: fmt.Sprintf(`{"error": "%s"}`, redact.String(message)),
 	}, nil
 }
 
@@ -0,0 +1,188 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"hello-world/internal/git"
+	"hello-world/internal/github"
+	"hello-world/internal/models"
+)
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		name  string
+		s     string
+		limit int
+		want  string
+	}{
+		{name: "short", s: "hello", limit: 10, want: "hello"},
+		{name: "exact", s: "hello", limit: 5, want: "hello"},
+		{name: "ascii", s: "hello world", limit: 5, want: "hello\n[truncated]"},
+		// "é" is two bytes and "日" three; the cut backs up to the rune start
+		{name: "inside two-byte rune", s: "caféine", limit: 4, want: "caf\n[truncated]"},
+		{name: "after two-byte rune", s: "caféine", limit: 5, want: "café\n[truncated]"},
+		{name: "inside three-byte rune", s: "日本語", limit: 4, want: "日\n[truncated]"},
+		{name: "inside first rune", s: "日本語", limit: 2, want: "\n[truncated]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := truncate(tt.s, tt.limit)
+			if got != tt.want {
+				t.Errorf("truncate(%q, %d) = %q, want %q", tt.s, tt.limit, got, tt.want)
+			}
+			if !utf8.ValidString(got) {
+				t.Errorf("truncate(%q, %d) = %q is not valid UTF-8", tt.s, tt.limit, got)
+			}
+			if body := strings.TrimSuffix(got, "\n[truncated]"); len(body) > tt.limit {
+				t.Errorf("truncate(%q, %d) kept %d bytes", tt.s, tt.limit, len(body))
+			}
+		})
+	}
+}
+
+func TestResolveRepository(t *testing.T) {
+	t.Setenv("GITHUB_TOKEN", "token")
+	t.Setenv("GITHUB_APP_ID", "")
+	t.Setenv("GITHUB_APP_PRIVATE_KEY", "")
+	t.Setenv("GITHUB_ENTERPRISE_URL", "")
+	t.Setenv("GITHUB_ALLOWED_HOSTS", "")
+	credentials, err := github.LoadCredentials()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &Handler{credentials: credentials}
+
+	tests := []struct {
+		name          string
+		req           models.Request
+		repositoryURL string
+		issueNumber   int
+		invalid       bool
+	}{
+		{
+			name:          "repository",
+			req:           models.Request{RepositoryURL: "owner/repo"},
+			repositoryURL: "https://github.com/owner/repo",
+		},
+		{
+			name:          "tree URL",
+			req:           models.Request{RepositoryURL: "https://github.com/owner/repo/tree/release/2.x/my%20docs"},
+			repositoryURL: "https://github.com/owner/repo/tree/release/2.x/my%20docs",
+		},
+		{
+			name:          "issue",
+			req:           models.Request{IssueURL: "https://github.com/owner/repo/issues/7"},
+			repositoryURL: "https://github.com/owner/repo",
+			issueNumber:   7,
+		},
+		{
+			name: "issue with tree URL",
+			req: models.Request{
+				RepositoryURL: "https://github.com/owner/repo/tree/develop/docs",
+				IssueURL:      "https://github.com/owner/repo/issues/7",
+			},
+			repositoryURL: "https://github.com/owner/repo/tree/develop/docs",
+			issueNumber:   7,
+		},
+		{
+			name: "issue with shorthand",
+			req: models.Request{
+				RepositoryURL: "Owner/Repo",
+				IssueURL:      "https://github.com/owner/repo/issues/7",
+			},
+			repositoryURL: "https://github.com/owner/repo",
+			issueNumber:   7,
+		},
+		{
+			name: "pull request with tree URL",
+			req: models.Request{
+				RepositoryURL:  "https://github.com/owner/repo/tree/develop",
+				PullRequestURL: "https://github.com/owner/repo/pull/3",
+			},
+			repositoryURL: "https://github.com/owner/repo/tree/develop",
+		},
+		{
+			name: "issue in another repository",
+			req: models.Request{
+				RepositoryURL: "https://github.com/owner/other/tree/develop",
+				IssueURL:      "https://github.com/owner/repo/issues/7",
+			},
+			invalid: true,
+		},
+		{
+			name: "pull request in another repository",
+			req: models.Request{
+				RepositoryURL:  "https://github.com/owner/other",
+				PullRequestURL: "https://github.com/owner/repo/pull/3",
+			},
+			invalid: true,
+		},
+		{
+			name:    "host not allowed",
+			req:     models.Request{RepositoryURL: "https://gitlab.com/owner/repo"},
+			invalid: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := tt.req
+			err := h.resolveRepository(&req)
+			if tt.invalid {
+				if err == nil {
+					t.Fatalf("resolveRepository accepted %+v as %s", tt.req, req.RepositoryURL)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolveRepository failed: %v", err)
+			}
+			if req.RepositoryURL != tt.repositoryURL {
+				t.Errorf("RepositoryURL = %q, want %q", req.RepositoryURL, tt.repositoryURL)
+			}
+			if req.IssueNumber != tt.issueNumber {
+				t.Errorf("IssueNumber = %d, want %d", req.IssueNumber, tt.issueNumber)
+			}
+		})
+	}
+}
+
+func TestCoAuthor(t *testing.T) {
+	users := map[string]string{
+		"/users/octocat": `{"login": "octocat", "id": 583231, "name": "The Octocat"}`,
+		"/users/noname":  `{"login": "noname", "id": 7}`,
+	}
+	client := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := users[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(user))
+	}))
+	noreply := "users.noreply." + client.Host().Name
+	h := &Handler{commitConfig: &git.CommitConfig{CoAuthor: true}}
+
+	tests := []struct {
+		username string
+		want     string
+	}{
+		{username: "octocat", want: "The Octocat <583231+octocat@" + noreply + ">"},
+		{username: "noname", want: "noname <7+noname@" + noreply + ">"},
+		{username: "missing", want: ""},
+		{username: "", want: ""},
+	}
+	for _, tt := range tests {
+		if got := h.coAuthor(context.Background(), client, tt.username); got != tt.want {
+			t.Errorf("coAuthor(%q) = %q, want %q", tt.username, got, tt.want)
+		}
+	}
+
+	h.commitConfig.CoAuthor = false
+	if got := h.coAuthor(context.Background(), client, "octocat"); got != "" {
+		t.Errorf("coAuthor without the co-author trailer = %q, want none", got)
+	}
+}
@@ -0,0 +1,358 @@
+package handler
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"hello-world/internal/github"
+	"hello-world/internal/redact"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const (
+	// Forks without open bot PRs and no activity for this long are retired
+	defaultForkIdleDays = 30
+	// Stops starting new forks this close to the function timeout; the next
+	// run picks up where this one stopped
+	maintenanceMargin = 30 * time.Second
+)
+
+// MaintenanceHandler keeps the bot's forks tidy: it syncs them with upstream,
+// deletes bot branches whose pull requests are merged or closed, and archives
+// or deletes forks that have been idle. In direct-branch mode it also deletes
+// such branches from the repositories they were pushed to. It runs on a
+// schedule, or on demand through the admin endpoint
+type MaintenanceHandler struct {
+	credentials *github.Credentials
+	adminToken  string
+	idle        time.Duration
+	deleteIdle  bool
+	direct      bool
+	// Owner of the forks when they go to an organization
+	organization string
+}
+
+// What a maintenance run did
+type maintenanceReport struct {
+	ForksChecked    int      `json:"forksChecked"`
+	ForksSkipped    int      `json:"forksSkipped"`
+	ReposChecked    int      `json:"reposChecked"`
+	ForksSynced     int      `json:"forksSynced"`
+	BranchesDeleted int      `json:"branchesDeleted"`
+	ForksArchived   int      `json:"forksArchived"`
+	ForksDeleted    int      `json:"forksDeleted"`
+	Incomplete      bool     `json:"incomplete,omitempty"`
+	Errors          []string `json:"errors,omitempty"`
+}
+
+func NewMaintenanceHandler() (*MaintenanceHandler, error) {
+	credentials, err := loadCredentials()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load GitHub credentials: %w", err)
+	}
+
+	adminToken := os.Getenv("ADMIN_API_TOKEN")
+	redact.Register(adminToken)
+
+	idleDays := defaultForkIdleDays
+	if value := os.Getenv("FORK_IDLE_DAYS"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			log.Printf("Warning: invalid FORK_IDLE_DAYS %q, using %d", value, idleDays)
+		} else {
+			idleDays = parsed
+		}
+	}
+
+	deleteIdle := false
+	switch value := os.Getenv("FORK_IDLE_ACTION"); value {
+	case "", "archive":
+	case "delete":
+		deleteIdle = true
+	default:
+		log.Printf("Warning: invalid FORK_IDLE_ACTION %q, using archive", value)
+	}
+
+	return &MaintenanceHandler{
+		credentials:  credentials,
+		adminToken:   adminToken,
+		idle:         time.Duration(idleDays) * 24 * time.Hour,
+		deleteIdle:   deleteIdle,
+		direct:       directBranchModeEnabled(),
+		organization: forkOrganization(),
+	}, nil
+}
+
+func (m *MaintenanceHandler) Handle(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	// Scheduled runs invoke the function directly, without API Gateway's
+	// request context. Calls through the API need the admin token
+	if request.RequestContext.RequestID != "" && !adminAuthorized(m.adminToken, header(request, "Authorization")) {
+		return m.response(403, map[string]string{"error": "Forbidden"})
+	}
+
+	report := m.run(ctx)
+	log.Printf("Maintenance finished: %d forks checked, %d skipped, %d synced, %d repositories checked, %d branches deleted, %d forks archived, %d forks deleted, %d errors",
+		report.ForksChecked, report.ForksSkipped, report.ForksSynced, report.ReposChecked, report.BranchesDeleted, report.ForksArchived, report.ForksDeleted, len(report.Errors))
+	return m.response(200, report)
+}
+
+// Admin endpoints are disabled while ADMIN_API_TOKEN is empty
+func adminAuthorized(adminToken, authorization string) bool {
+	token, ok := strings.CutPrefix(authorization, "Bearer ")
+	return ok && adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1
+}
+
+func (m *MaintenanceHandler) run(ctx context.Context) *maintenanceReport {
+	report := &maintenanceReport{}
+	clients, err := m.credentials.AccountClients()
+	if err != nil {
+		report.Errors = append(report.Errors, err.Error())
+		return report
+	}
+
+	for _, githubClient := range clients {
+		forks, err := githubClient.ListForks(ctx, m.organization)
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: %v", githubClient.Host().Name, err))
+			continue
+		}
+
+		// Least recently pushed first, so idle forks are retired even when a
+		// run cannot get through every fork
+		sort.Slice(forks, func(i, j int) bool {
+			return forks[i].GetPushedAt().Before(forks[j].GetPushedAt().Time)
+		})
+
+		for _, fork := range forks {
+			if m.outOfTime(ctx, report) {
+				return report
+			}
+			report.ForksChecked++
+			if err := m.maintainFork(ctx, githubClient, fork.GetOwner().GetLogin(), fork.GetName(), report); err != nil {
+				log.Printf("Warning: maintenance of %s failed: %v", fork.GetFullName(), err)
+				report.Errors = append(report.Errors, fmt.Sprintf("%s: %v", fork.GetFullName(), err))
+			}
+		}
+	}
+
+	if m.direct {
+		m.pruneUpstreamBranches(ctx, clients, report)
+	}
+	return report
+}
+
+// Whether the run should stop before the function times out; the next run
+// picks up where this one stopped
+func (m *MaintenanceHandler) outOfTime(ctx context.Context, report *maintenanceReport) bool {
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < maintenanceMargin {
+		log.Printf("Stopping maintenance before the function times out")
+		report.Incomplete = true
+		return true
+	}
+	return false
+}
+
+// Only touches forks that show they are the bot's: tagged with
+// github.ForkTopic when the bot created them, or holding bot branches. Other
+// forks of the same account are left alone
+func (m *MaintenanceHandler) maintainFork(ctx context.Context, githubClient *github.Client, owner, name string, report *maintenanceReport) error {
+	fork, err := githubClient.GetRepository(ctx, owner, name)
+	if err != nil {
+		return err
+	}
+	parent := fork.GetParent()
+	if parent == nil {
+		return fmt.Errorf("fork has no parent")
+	}
+	upstreamOwner, upstreamRepo := parent.GetOwner().GetLogin(), parent.GetName()
+
+	branches, err := githubClient.ListBranches(ctx, owner, name, branchPrefix)
+	if err != nil {
+		return err
+	}
+	if !github.IsMarkedFork(fork) {
+		if len(branches) == 0 {
+			log.Printf("Skipping %s/%s, nothing shows it is the bot's fork", owner, name)
+			report.ForksSkipped++
+			return nil
+		}
+		// Tagged before its branches are pruned, which would leave no
+		// evidence that the fork is the bot's
+		if err := githubClient.MarkFork(ctx, fork); err != nil {
+			return err
+		}
+	}
+
+	// Anyone's pushes count as activity, so a fork someone still works on is
+	// kept. Created branches and updated pull requests cover what pushes miss
+	lastActivity := fork.GetCreatedAt().Time
+	if pushed := fork.GetPushedAt().Time; pushed.After(lastActivity) {
+		lastActivity = pushed
+	}
+	openPRs, err := m.pruneBranches(ctx, githubClient, owner, name, upstreamOwner, upstreamRepo, branches, &lastActivity, report)
+	if err != nil {
+		return err
+	}
+
+	if openPRs == 0 && m.idle > 0 && time.Since(lastActivity) > m.idle {
+		if m.deleteIdle {
+			if err := githubClient.DeleteRepository(ctx, owner, name); err != nil {
+				return err
+			}
+			log.Printf("Deleted idle fork %s/%s", owner, name)
+			report.ForksDeleted++
+		} else {
+			if err := githubClient.ArchiveRepository(ctx, owner, name); err != nil {
+				return err
+			}
+			log.Printf("Archived idle fork %s/%s", owner, name)
+			report.ForksArchived++
+		}
+		return nil
+	}
+
+	// Syncing pushes to the fork, which would keep idle forks from ever
+	// looking idle. Forks without open pull requests are reset to upstream
+	// by the next request anyway
+	if openPRs == 0 {
+		return nil
+	}
+	if err := githubClient.SyncFork(ctx, owner, name, fork.GetDefaultBranch()); err != nil {
+		return err
+	}
+	report.ForksSynced++
+	return nil
+}
+
+// Deletes the bot branches of owner/name whose pull requests against
+// upstreamOwner/upstreamRepo are all merged or closed, moving lastActivity up
+// to the latest branch or pull request. Returns how many branches have an
+// open pull request
+func (m *MaintenanceHandler) pruneBranches(ctx context.Context, githubClient *github.Client, owner, name, upstreamOwner, upstreamRepo string, branches []string, lastActivity *time.Time, report *maintenanceReport) (int, error) {
+	openPRs := 0
+	for _, branch := range branches {
+		if created := branchTime(branch); created.After(*lastActivity) {
+			*lastActivity = created
+		}
+
+		prs, err := githubClient.ListBranchPullRequests(ctx, upstreamOwner, upstreamRepo, owner, branch)
+		if err != nil {
+			return 0, err
+		}
+		open := false
+		for _, pr := range prs {
+			if updated := pr.GetUpdatedAt().Time; updated.After(*lastActivity) {
+				*lastActivity = updated
+			}
+			open = open || pr.GetState() == "open"
+		}
+
+		// Branches without a pull request may belong to a request still in
+		// progress
+		if open {
+			openPRs++
+		} else if len(prs) > 0 {
+			if err := githubClient.DeleteBranch(ctx, owner, name, branch); err != nil {
+				return 0, err
+			}
+			log.Printf("Deleted branch %s of %s/%s, its pull request is closed", branch, owner, name)
+			report.BranchesDeleted++
+		}
+	}
+	return openPRs, nil
+}
+
+// In direct-branch mode the bot pushes its branches to the repositories
+// themselves, with the personal access token or the app's installation on
+// the owner. Goes through every repository either can push to and deletes
+// the bot branches whose pull requests are merged or closed
+func (m *MaintenanceHandler) pruneUpstreamBranches(ctx context.Context, accountClients []*github.Client, report *maintenanceReport) {
+	type pushTarget struct {
+		client *github.Client
+		owner  string
+		name   string
+	}
+	var targets []pushTarget
+	seen := make(map[string]bool)
+	// The same repository may be reachable with both credentials
+	add := func(githubClient *github.Client, owner, name string) {
+		key := strings.ToLower(githubClient.Host().Name + "/" + owner + "/" + name)
+		if !seen[key] {
+			seen[key] = true
+			targets = append(targets, pushTarget{githubClient, owner, name})
+		}
+	}
+
+	for _, githubClient := range accountClients {
+		repos, err := githubClient.ListPushableRepositories(ctx)
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: %v", githubClient.Host().Name, err))
+			continue
+		}
+		for _, repo := range repos {
+			add(githubClient, repo.GetOwner().GetLogin(), repo.GetName())
+		}
+	}
+	installationClients, err := m.credentials.InstallationClients(ctx)
+	if err != nil {
+		report.Errors = append(report.Errors, err.Error())
+	}
+	for _, githubClient := range installationClients {
+		repos, err := githubClient.ListInstallationRepositories(ctx)
+		if err != nil {
+			report.Errors = append(report.Errors, err.Error())
+			continue
+		}
+		for _, repo := range repos {
+			add(githubClient, repo.GetOwner().GetLogin(), repo.GetName())
+		}
+	}
+
+	for _, target := range targets {
+		if m.outOfTime(ctx, report) {
+			return
+		}
+		report.ReposChecked++
+		branches, err := target.client.ListBranches(ctx, target.owner, target.name, branchPrefix)
+		if err == nil {
+			var lastActivity time.Time
+			_, err = m.pruneBranches(ctx, target.client, target.owner, target.name, target.owner, target.name, branches, &lastActivity, report)
+		}
+		if err != nil {
+			log.Printf("Warning: maintenance of %s/%s failed: %v", target.owner, target.name, err)
+			report.Errors = append(report.Errors, fmt.Sprintf("%s/%s: %v", target.owner, target.name, err))
+		}
+	}
+}
+
+// Bot branches are named after the Unix time they were created at
+func branchTime(branch string) time.Time {
+	seconds, err := strconv.ParseInt(strings.TrimPrefix(branch, branchPrefix), 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(seconds, 0)
+}
+
+func (m *MaintenanceHandler) response(statusCode int, body interface{}) (events.APIGatewayProxyResponse, error) {
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, fmt.Errorf("failed to marshal response: %w", err)
+	}
+	return events.APIGatewayProxyResponse{
+		StatusCode: statusCode,
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+		Body: redact.String(string(encoded)),
+	}, nil
+}
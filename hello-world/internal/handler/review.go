@@ -0,0 +1,289 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"hello-world/internal/git"
+	"hello-world/internal/github"
+	"hello-world/internal/models"
+	"hello-world/internal/status"
+)
+
+// errNotBotPullRequest is returned for pull requests the bot did not open,
+// including ones from branches named like the bot's
+var errNotBotPullRequest = errors.New("pull request was not opened by the bot")
+
+// Checks that a pull request is the bot's: from one of its branches, authored
+// by the identity githubClient acts as on owner/repo, and with its head in
+// owner/repo itself or in the bot's fork. Anyone can name a branch like the
+// bot's, so the prefix alone proves nothing. Returns the bot's login and a
+// client for the head repository; branches in the fork need the credentials
+// it was forked with
+func (h *Handler) botPullRequest(ctx context.Context, githubClient *github.Client, host, owner, repo, author, headRef, headOwner, headRepo string) (string, *github.Client, error) {
+	if !strings.HasPrefix(headRef, branchPrefix) {
+		return "", nil, errNotBotPullRequest
+	}
+	botLogin, err := githubClient.Login(ctx)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to identify the bot: %w", err)
+	}
+	if !strings.EqualFold(author, botLogin) {
+		return "", nil, fmt.Errorf("%w: it is by %s, not %s", errNotBotPullRequest, author, botLogin)
+	}
+
+	if strings.EqualFold(headOwner, owner) {
+		if !strings.EqualFold(headRepo, repo) {
+			return "", nil, fmt.Errorf("%w: its head is in %s/%s", errNotBotPullRequest, headOwner, headRepo)
+		}
+		return botLogin, githubClient, nil
+	}
+
+	headClient, err := h.credentials.ForkClient(ctx, host, forkOrganization())
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to authenticate with GitHub: %w", err)
+	}
+	forkOwner := forkOrganization()
+	if forkOwner == "" {
+		if forkOwner, err = headClient.Login(ctx); err != nil {
+			return "", nil, fmt.Errorf("failed to identify the bot: %w", err)
+		}
+	}
+	if !strings.EqualFold(headOwner, forkOwner) {
+		return "", nil, fmt.Errorf("%w: its head is in %s/%s, not the bot's fork", errNotBotPullRequest, headOwner, headRepo)
+	}
+	return botLogin, headClient, nil
+}
+
+// processReview addresses the open review threads on a pull request the bot
+// opened: it pushes a follow-up commit to the PR branch and replies to each
+// thread with what changed
+func (h *Handler) processReview(ctx context.Context, req *models.Request, requestID string) (string, error) {
+	host, owner, repo, number, err := github.ParsePullRequestURL(req.PullRequestURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid pull request URL: %w", err)
+	}
+
+	githubClient, err := h.credentials.ClientFor(ctx, host, owner, repo)
+	if err != nil {
+		return "", fmt.Errorf("failed to authenticate with GitHub: %w", err)
+	}
+
+	pr, err := githubClient.GetPullRequest(ctx, owner, repo, number)
+	if err != nil {
+		return "", err
+	}
+	if pr.GetState() != "open" {
+		return "", fmt.Errorf("pull request #%d is %s", number, pr.GetState())
+	}
+	branchName := pr.GetHead().GetRef()
+	headRepo := pr.GetHead().GetRepo()
+	botLogin, headClient, err := h.botPullRequest(ctx, githubClient, host, owner, repo,
+		pr.GetUser().GetLogin(), branchName, headRepo.GetOwner().GetLogin(), headRepo.GetName())
+	if err != nil {
+		return "", fmt.Errorf("pull request #%d: %w", number, err)
+	}
+
+	// Replies in the threads are the bot's when they are by its own identity
+	threads, err := githubClient.PendingReviewThreads(ctx, owner, repo, number, botLogin, trustedAssociations)
+	if err != nil {
+		return "", err
+	}
+	log.Printf("Found %d unanswered review thread(s) on %s/%s#%d", len(threads), owner, repo, number)
+	if len(threads) == 0 && req.ModificationPrompt == "" {
+		h.statusTracker.Complete(ctx, requestID, pr.GetHTMLURL(), req.RepositoryURL)
+		return "No review comments to address", nil
+	}
+
+	// The review body or CI logs are instructions like any request's prompt
+	if req.ModificationPrompt != "" {
+		h.statusTracker.Update(ctx, requestID, status.StatusValidating, "Validating modification request...", 0, req.RepositoryURL)
+		isValid, reason, err := h.openaiClient.ValidatePrompt(ctx, req.ModificationPrompt)
+		if err != nil {
+			log.Printf("Warning: Failed to validate prompt: %v. Continuing anyway.", err)
+		} else if !isValid {
+			log.Printf("Prompt validation failed: %s", reason)
+			h.statusTracker.Reject(ctx, requestID, reason, req.RepositoryURL)
+			return "", fmt.Errorf("prompt validation failed: %s", reason)
+		}
+	}
+
+	// Step 1: Clone the PR branch from wherever it lives, fork or upstream
+	h.statusTracker.Update(ctx, requestID, status.StatusCloning, "Cloning pull request branch...", 2, req.RepositoryURL)
+	token, err := headClient.Token(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to get GitHub token: %w", err)
+	}
+
+	cloneOpts := git.CloneOptions{
+		URL:       headRepo.GetCloneURL(),
+		Directory: requestID,
+		Token:     token,
+		Partial:   usePartialClone(headRepo.GetSize()),
+		SizeLimit: cloneSizeLimit(),
+		Branch:    branchName,
+	}
+	if err := git.SweepWorkspaces(staleWorkspaceAge); err != nil {
+		log.Printf("Warning: failed to sweep stale workspaces: %v", err)
+	}
+
+	clonePath, err := git.CloneRepository(cloneOpts)
+	if errors.Is(err, git.ErrPartialCloneUnsupported) {
+		log.Printf("Remote does not support partial clone, falling back to a full clone")
+		cloneOpts.Partial = false
+		clonePath, err = git.CloneRepository(cloneOpts)
+	}
+	if err != nil {
+		return "", fmt.Errorf("clone failed: %w", err)
+	}
+	ws := &localWorkspace{path: clonePath, client: headClient, upstream: githubClient, sizeLimit: cloneOpts.SizeLimit}
+	defer ws.Cleanup()
+
+	fileTree, err := ws.ListFiles(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to list files: %w", err)
+	}
+
+	// Step 2: Read the files the PR changes and the files commented on
+	h.statusTracker.Update(ctx, requestID, status.StatusAnalyzing, "Reading review comments...", 3, req.RepositoryURL)
+	filesToRead, err := githubClient.ListPullRequestFiles(ctx, owner, repo, number)
+	if err != nil {
+		return "", err
+	}
+	for _, thread := range threads {
+		filesToRead = append(filesToRead, thread.Path)
+	}
+	if err := ws.Materialize(ctx, filesToRead); err != nil {
+		log.Printf("Warning: failed to materialize files: %v", err)
+	}
+	filesToRead = h.safePaths(ctx, requestID, ws, filesToRead)
+	fileContents := make(map[string]string)
+	for _, relPath := range filesToRead {
+		if node := fileTree.Find(relPath); node == nil || node.Binary {
+			continue
+		}
+		content, err := ws.ReadFile(ctx, relPath)
+		if err != nil {
+			log.Printf("Warning: failed to read file %s: %v", relPath, err)
+			continue
+		}
+		fileContents[relPath] = content
+	}
+
+	history, plan, err := h.openaiClient.PlanReviewChanges(ctx, fileContents, formatReviewThreads(threads), req.ModificationPrompt)
+	if err != nil {
+		return "", fmt.Errorf("failed to plan review changes: %w", err)
+	}
+	log.Printf("Files to modify: %v", plan.FilesToModify)
+
+	// Step 3: Generate and write the changes
+	h.statusTracker.Update(ctx, requestID, status.StatusModifying, "Addressing review comments with AI...", 4, req.RepositoryURL)
+	reviewPrompt := "Address the review comments above."
+	if req.ModificationPrompt != "" {
+		reviewPrompt += "\n\n" + req.ModificationPrompt
+	}
+	if err := ws.Materialize(ctx, plan.FilesToModify); err != nil {
+		log.Printf("Warning: failed to materialize files: %v", err)
+	}
+	modifiedFiles := make(map[string]string)
+	for _, filePath := range h.safePaths(ctx, requestID, ws, plan.FilesToModify) {
+		if !fileTree.Editable(filePath) {
+			log.Printf("Warning: refusing to modify %s - it is binary, generated, vendored or ignored", filePath)
+			continue
+		}
+
+		originalContent, exists := fileContents[filePath]
+		if !exists {
+			if content, err := ws.ReadFile(ctx, filePath); err == nil {
+				originalContent = content
+			}
+		}
+
+		modifiedContent, err := h.openaiClient.GenerateModifiedFile(ctx, history, filePath, originalContent, reviewPrompt)
+		if err != nil {
+			log.Printf("Warning: failed to generate modifications for %s: %v", filePath, err)
+			continue
+		}
+		if err := ws.WriteFile(ctx, filePath, modifiedContent); err != nil {
+			if unwritable(err) {
+				log.Printf("Warning: leaving %s unchanged: %v", filePath, err)
+				continue
+			}
+			return "", fmt.Errorf("failed to write file %s: %w", filePath, err)
+		}
+		modifiedFiles[filePath] = modifiedContent
+	}
+
+	if err := h.validateFiles(ctx, history, ws, fileTree, fileContents, modifiedFiles, reviewPrompt); err != nil {
+		return "", fmt.Errorf("failed to validate modified files: %w", err)
+	}
+
+	// Step 4: Push a follow-up commit. The clone is at the branch tip, so
+	// the push is a fast-forward
+	h.statusTracker.Update(ctx, requestID, status.StatusCommitting, "Pushing follow-up commit...", 5, req.RepositoryURL)
+	pushed := false
+	if len(modifiedFiles) > 0 {
+		commitMessage := fmt.Sprintf("Address review comments\n\n%s", plan.Explanation)
+		commits := []git.Commit{{Message: commitMessage}}
+		squash := h.commitConfig.Squash
+		if req.SquashCommits != nil {
+			squash = *req.SquashCommits
+		}
+		if !squash {
+			commits = h.planCommits(ctx, history, modifiedFiles, plan.Explanation, reviewPrompt, commitMessage)
+		}
+		commitOptions := h.commitConfig.CommitOptions(h.coAuthor(ctx, githubClient, req.GitHubUsername), requestID)
+		err = ws.Commit(ctx, branchName, commits, commitOptions)
+		if err != nil && !errors.Is(err, git.ErrNoChanges) {
+			return "", fmt.Errorf("failed to commit and push: %w", err)
+		}
+		pushed = err == nil
+	}
+
+	// Step 5: Reply to every thread the model answered, then summarize
+	pending := make(map[int64]bool, len(threads))
+	for _, thread := range threads {
+		pending[thread.ID] = true
+	}
+	for _, reply := range plan.Replies {
+		if !pending[reply.CommentID] || reply.Reply == "" {
+			continue
+		}
+		if err := githubClient.ReplyToReviewComment(ctx, owner, repo, number, reply.CommentID, reply.Reply); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	}
+
+	summary := "Reviewed the feedback; no code changes were needed."
+	if pushed {
+		summary = fmt.Sprintf("Pushed a follow-up commit addressing the review:\n\n%s", plan.Explanation)
+	}
+	if err := githubClient.CommentOnIssue(ctx, owner, repo, number, summary); err != nil {
+		log.Printf("Warning: failed to comment on pull request: %v", err)
+	}
+
+	h.statusTracker.Complete(ctx, requestID, pr.GetHTMLURL(), req.RepositoryURL)
+
+	return fmt.Sprintf("Addressed %d review thread(s) on %s (files modified: %d)", len(threads), pr.GetHTMLURL(), len(modifiedFiles)), nil
+}
+
+// Renders the threads for the model, keyed by the ID replies must use
+func formatReviewThreads(threads []*github.ReviewThread) string {
+	if len(threads) == 0 {
+		return "(none)\n"
+	}
+
+	var builder strings.Builder
+	for _, thread := range threads {
+		builder.WriteString(fmt.Sprintf("--- commentId %d on %s line %d ---\n", thread.ID, thread.Path, thread.Line))
+		builder.WriteString(fmt.Sprintf("%s\n", thread.DiffHunk))
+		for _, comment := range thread.Comments {
+			builder.WriteString(fmt.Sprintf("@%s: %s\n", comment.Author, comment.Body))
+		}
+		builder.WriteString("\n")
+	}
+	return builder.String()
+}
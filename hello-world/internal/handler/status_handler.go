@@ -5,7 +5,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"time"
 
+	"hello-world/internal/redact"
 	"hello-world/internal/status"
 
 	"github.com/aws/aws-lambda-go/events"
@@ -46,7 +48,7 @@ func (h *StatusHandler) Handle(ctx context.Context, request events.APIGatewayPro
 	response := map[string]interface{}{
 		"requestId":  statusRecord.RequestID,
 		"status":     statusRecord.Status,
-		"message":    statusRecord.Message,
+		"message":    redact.String(statusRecord.Message),
 		"step":       statusRecord.Step,
 		"timestamp":  statusRecord.Timestamp,
 		"repository": statusRecord.Repository,
@@ -57,7 +59,20 @@ func (h *StatusHandler) Handle(ctx context.Context, request events.APIGatewayPro
 		response["prUrl"] = statusRecord.PrURL
 	}
 	if statusRecord.ErrorDetails != "" {
-		response["errorDetails"] = statusRecord.ErrorDetails
+		// Records written before redaction existed may still carry secrets
+		response["errorDetails"] = redact.String(statusRecord.ErrorDetails)
+	}
+	if statusRecord.QuotaResetAt != 0 {
+		response["quotaResetAt"] = time.Unix(statusRecord.QuotaResetAt, 0).UTC().Format(time.RFC3339)
+	}
+	if len(statusRecord.RejectedPaths) > 0 {
+		response["rejectedPaths"] = statusRecord.RejectedPaths
+	}
+	if len(statusRecord.MetadataErrors) > 0 {
+		response["metadataErrors"] = statusRecord.MetadataErrors
+	}
+	if statusRecord.CI != nil {
+		response["ci"] = statusRecord.CI
 	}
 
 	responseBody, err := json.Marshal(response)
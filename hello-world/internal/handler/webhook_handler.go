@@ -0,0 +1,366 @@
+package handler
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"hello-world/internal/github"
+	"hello-world/internal/models"
+	"hello-world/internal/redact"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// Comments starting a line with this trigger the bot, e.g. "/autopr add tests"
+const slashCommand = "/autopr"
+
+// Only people with a role on the repository may spend the bot's budget
+var trustedAssociations = map[string]bool{
+	"OWNER":        true,
+	"MEMBER":       true,
+	"COLLABORATOR": true,
+}
+
+// WebhookHandler receives GitHub webhooks. Slash commands in issue comments
+// become requests, and reviews on the bot's pull requests get addressed
+type WebhookHandler struct {
+	handler *Handler
+	secret  []byte
+}
+
+func NewWebhookHandler() (*WebhookHandler, error) {
+	secret := os.Getenv("GITHUB_WEBHOOK_SECRET")
+	if secret == "" {
+		return nil, fmt.Errorf("GITHUB_WEBHOOK_SECRET environment variable is required")
+	}
+	redact.Register(secret)
+
+	h, err := New()
+	if err != nil {
+		return nil, err
+	}
+
+	return &WebhookHandler{
+		handler: h,
+		secret:  []byte(secret),
+	}, nil
+}
+
+// The parts of an issue_comment payload the bot uses
+type issueCommentEvent struct {
+	Action string `json:"action"`
+	Issue  struct {
+		Number      int `json:"number"`
+		PullRequest *struct {
+			HTMLURL string `json:"html_url"`
+		} `json:"pull_request"`
+	} `json:"issue"`
+	Comment struct {
+		Body              string `json:"body"`
+		AuthorAssociation string `json:"author_association"`
+		User              struct {
+			Login string `json:"login"`
+			Type  string `json:"type"`
+		} `json:"user"`
+	} `json:"comment"`
+	Repository struct {
+		Name    string `json:"name"`
+		HTMLURL string `json:"html_url"`
+		Owner   struct {
+			Login string `json:"login"`
+		} `json:"owner"`
+	} `json:"repository"`
+}
+
+// The parts of a pull_request_review payload the bot uses
+type pullRequestReviewEvent struct {
+	Action string `json:"action"`
+	Review struct {
+		Body              string `json:"body"`
+		State             string `json:"state"`
+		AuthorAssociation string `json:"author_association"`
+		User              struct {
+			Login string `json:"login"`
+			Type  string `json:"type"`
+		} `json:"user"`
+	} `json:"review"`
+	PullRequest struct {
+		Number  int    `json:"number"`
+		HTMLURL string `json:"html_url"`
+		Head    struct {
+			Ref  string `json:"ref"`
+			Repo struct {
+				Name  string `json:"name"`
+				Owner struct {
+					Login string `json:"login"`
+				} `json:"owner"`
+			} `json:"repo"`
+		} `json:"head"`
+		User struct {
+			Login string `json:"login"`
+		} `json:"user"`
+	} `json:"pull_request"`
+	Repository struct {
+		Name    string `json:"name"`
+		HTMLURL string `json:"html_url"`
+		Owner   struct {
+			Login string `json:"login"`
+		} `json:"owner"`
+	} `json:"repository"`
+}
+
+func (w *WebhookHandler) Handle(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	body := []byte(request.Body)
+	if request.IsBase64Encoded {
+		decoded, err := base64.StdEncoding.DecodeString(request.Body)
+		if err != nil {
+			return w.response(400, "Invalid body encoding")
+		}
+		body = decoded
+	}
+
+	if !w.validSignature(header(request, "X-Hub-Signature-256"), body) {
+		log.Printf("Rejected webhook with invalid signature")
+		return w.response(401, "Invalid signature")
+	}
+
+	event := header(request, "X-GitHub-Event")
+	log.Printf("Received %s webhook (delivery %s)", event, header(request, "X-GitHub-Delivery"))
+
+	switch event {
+	case "ping":
+		return w.response(200, "pong")
+	case "issue_comment":
+		var payload issueCommentEvent
+		if err := json.Unmarshal(body, &payload); err != nil {
+			return w.response(400, fmt.Sprintf("Invalid JSON: %v", err))
+		}
+		return w.handleIssueComment(ctx, request, &payload)
+	case "pull_request_review":
+		var payload pullRequestReviewEvent
+		if err := json.Unmarshal(body, &payload); err != nil {
+			return w.response(400, fmt.Sprintf("Invalid JSON: %v", err))
+		}
+		return w.handlePullRequestReview(ctx, request, &payload)
+	default:
+		return w.response(202, fmt.Sprintf("Ignoring %s event", event))
+	}
+}
+
+func (w *WebhookHandler) handleIssueComment(ctx context.Context, request events.APIGatewayProxyRequest, event *issueCommentEvent) (events.APIGatewayProxyResponse, error) {
+	if event.Action != "created" {
+		return w.response(202, "Ignoring comment that was not newly created")
+	}
+
+	prompt, ok := parseSlashCommand(event.Comment.Body)
+	if !ok {
+		return w.response(202, "No command found")
+	}
+	if event.Comment.User.Type == "Bot" {
+		return w.response(202, "Ignoring command from a bot")
+	}
+	if !trustedAssociations[event.Comment.AuthorAssociation] {
+		log.Printf("Ignoring command from %s (%s)", event.Comment.User.Login, event.Comment.AuthorAssociation)
+		return w.response(202, "Commands are only accepted from owners, members and collaborators")
+	}
+
+	owner, repo, number := event.Repository.Owner.Login, event.Repository.Name, event.Issue.Number
+	req := models.Request{
+		RepositoryURL:      event.Repository.HTMLURL,
+		GitHubUsername:     event.Comment.User.Login,
+		ModificationPrompt: prompt,
+	}
+	if event.Issue.PullRequest != nil {
+		// On a pull request the command addresses its review comments
+		req.PullRequestURL = event.Issue.PullRequest.HTMLURL
+	} else {
+		// The issue itself describes the work; the command may add to it
+		req.IssueNumber = number
+	}
+	if err := req.Validate(); err != nil {
+		w.reply(ctx, req.RepositoryURL, number, fmt.Sprintf("@%s please describe the change after `%s`.", event.Comment.User.Login, slashCommand))
+		return w.response(400, err.Error())
+	}
+
+	log.Printf("Command from %s on %s/%s#%d", event.Comment.User.Login, owner, repo, number)
+	return w.enqueue(ctx, request, req, number)
+}
+
+// Bot-authored pull requests get their review addressed as soon as a review
+// with feedback is submitted
+func (w *WebhookHandler) handlePullRequestReview(ctx context.Context, request events.APIGatewayProxyRequest, event *pullRequestReviewEvent) (events.APIGatewayProxyResponse, error) {
+	if event.Action != "submitted" || event.Review.State == "approved" {
+		return w.response(202, "Ignoring review without feedback")
+	}
+	if !strings.HasPrefix(event.PullRequest.Head.Ref, branchPrefix) {
+		return w.response(202, "Ignoring review on a pull request the bot did not open")
+	}
+	// The bot's own replies to review comments arrive as reviews too
+	if event.Review.User.Type == "Bot" || strings.EqualFold(event.Review.User.Login, event.PullRequest.User.Login) {
+		return w.response(202, "Ignoring review from a bot")
+	}
+	if !trustedAssociations[event.Review.AuthorAssociation] {
+		log.Printf("Ignoring review from %s (%s)", event.Review.User.Login, event.Review.AuthorAssociation)
+		return w.response(202, "Reviews are only acted on from owners, members and collaborators")
+	}
+
+	owner, repo, number := event.Repository.Owner.Login, event.Repository.Name, event.PullRequest.Number
+	host, _, _, err := github.ParseRepoURL(event.Repository.HTMLURL)
+	if err != nil {
+		return w.response(400, fmt.Sprintf("Invalid repository URL: %v", err))
+	}
+	githubClient, err := w.handler.credentials.ClientFor(ctx, host, owner, repo)
+	if errors.Is(err, github.ErrHostNotAllowed) {
+		log.Printf("Ignoring webhook for %s: %v", event.Repository.HTMLURL, err)
+		return w.response(403, "Repository host is not allowed")
+	}
+	if err == nil {
+		head := event.PullRequest.Head
+		_, _, err = w.handler.botPullRequest(ctx, githubClient, host, owner, repo,
+			event.PullRequest.User.Login, head.Ref, head.Repo.Owner.Login, head.Repo.Name)
+	}
+	if errors.Is(err, errNotBotPullRequest) {
+		log.Printf("Ignoring review on %s/%s#%d: %v", owner, repo, number, err)
+		return w.response(202, "Ignoring review on a pull request the bot did not open")
+	}
+	if err != nil {
+		log.Printf("Failed to check %s/%s#%d: %v", owner, repo, number, err)
+		return w.response(500, "Failed to check the pull request")
+	}
+
+	req := models.Request{
+		RepositoryURL:      event.Repository.HTMLURL,
+		GitHubUsername:     event.Review.User.Login,
+		ModificationPrompt: event.Review.Body,
+		PullRequestURL:     event.PullRequest.HTMLURL,
+	}
+
+	log.Printf("Review from %s on %s/%s#%d", event.Review.User.Login, owner, repo, number)
+	return w.enqueue(ctx, request, req, number)
+}
+
+// Queues req on behalf of the GitHub user who asked for it and replies on the
+// issue or pull request with the outcome
+func (w *WebhookHandler) enqueue(ctx context.Context, request events.APIGatewayProxyRequest, req models.Request, number int) (events.APIGatewayProxyResponse, error) {
+	// Deliveries from hosts outside the allowlist are dropped without a reply
+	if err := w.handler.resolveRepository(&req); err != nil {
+		log.Printf("Ignoring webhook for %s: %v", req.RepositoryURL, err)
+		return w.response(403, "Repository host is not allowed")
+	}
+
+	requestID, err := w.handler.enqueue(ctx, req, "github:"+req.GitHubUsername)
+	var rateLimited *rateLimitedError
+	var exhausted *github.QuotaExhaustedError
+	switch {
+	case errors.As(err, &rateLimited):
+		w.reply(ctx, req.RepositoryURL, number, fmt.Sprintf("@%s you have reached the request limit. Try again after %s.",
+			req.GitHubUsername, rateLimited.result.NextAvailable.UTC().Format(time.RFC1123)))
+		return w.response(429, "Rate limit exceeded")
+	case errors.Is(err, errAtCapacity):
+		w.reply(ctx, req.RepositoryURL, number, "The bot is at capacity right now. Please try again in a few minutes.")
+		return w.response(503, "Bot is at capacity")
+	case errors.As(err, &exhausted):
+		w.reply(ctx, req.RepositoryURL, number, fmt.Sprintf("The bot's GitHub API quota is used up until %s. Please try again then.",
+			exhausted.Reset.UTC().Format(time.RFC1123)))
+		return w.response(503, exhausted.Error())
+	case err != nil:
+		w.reply(ctx, req.RepositoryURL, number, "Failed to start processing this request.")
+		return w.response(500, "Failed to start processing")
+	}
+
+	w.reply(ctx, req.RepositoryURL, number, fmt.Sprintf("On it! Request `%s` is queued; follow its progress at %s", requestID, statusURL(request, requestID)))
+	return w.response(202, fmt.Sprintf("Request %s queued", requestID))
+}
+
+// Comments are best effort; the request is already queued or refused
+func (w *WebhookHandler) reply(ctx context.Context, repositoryURL string, number int, body string) {
+	host, owner, repo, err := github.ParseRepoURL(repositoryURL)
+	if err != nil {
+		log.Printf("Warning: failed to reply on %s#%d: %v", repositoryURL, number, err)
+		return
+	}
+
+	githubClient, err := w.handler.credentials.ClientFor(ctx, host, owner, repo)
+	if err == nil {
+		err = githubClient.CommentOnIssue(ctx, owner, repo, number, body)
+	}
+	if err != nil {
+		log.Printf("Warning: failed to reply on %s/%s#%d: %v", owner, repo, number, err)
+	}
+}
+
+// Compares the HMAC-SHA256 of the raw body with the "sha256=<hex>" header
+func (w *WebhookHandler) validSignature(signature string, body []byte) bool {
+	digest, ok := strings.CutPrefix(signature, "sha256=")
+	if !ok {
+		return false
+	}
+	expected, err := hex.DecodeString(digest)
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, w.secret)
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+// Returns the text after the first line starting with the command, including
+// the lines that follow it
+func parseSlashCommand(body string) (string, bool) {
+	lines := strings.Split(strings.ReplaceAll(body, "\r\n", "\n"), "\n")
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		rest, ok := strings.CutPrefix(line, slashCommand)
+		if !ok || (rest != "" && rest[0] != ' ' && rest[0] != '\t') {
+			continue
+		}
+		prompt := strings.TrimSpace(rest + "\n" + strings.Join(lines[i+1:], "\n"))
+		return prompt, true
+	}
+	return "", false
+}
+
+// Header names are not case-normalized by API Gateway
+func header(request events.APIGatewayProxyRequest, name string) string {
+	for key, value := range request.Headers {
+		if strings.EqualFold(key, name) {
+			return value
+		}
+	}
+	return ""
+}
+
+// The status endpoint lives on the same API as the webhook. PUBLIC_API_URL
+// overrides it for custom domains, where the stage is not part of the path
+func statusURL(request events.APIGatewayProxyRequest, requestID string) string {
+	if base := os.Getenv("PUBLIC_API_URL"); base != "" {
+		return fmt.Sprintf("%s/status/%s", strings.TrimSuffix(base, "/"), requestID)
+	}
+	return fmt.Sprintf("https://%s/%s/status/%s", request.RequestContext.DomainName, request.RequestContext.Stage, requestID)
+}
+
+func (w *WebhookHandler) response(statusCode int, message string) (events.APIGatewayProxyResponse, error) {
+	body, err := json.Marshal(map[string]string{"message": message})
+	if err != nil {
+		return events.APIGatewayProxyResponse{StatusCode: 500}, nil
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: statusCode,
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+		Body: string(body),
+	}, nil
+}
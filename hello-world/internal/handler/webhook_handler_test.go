@@ -0,0 +1,75 @@
+package handler
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+func sign(secret, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestValidSignature(t *testing.T) {
+	w := &WebhookHandler{secret: []byte("secret")}
+	body := `{"action":"created"}`
+
+	tests := []struct {
+		name      string
+		signature string
+		body      string
+		want      bool
+	}{
+		{name: "valid", signature: sign("secret", body), body: body, want: true},
+		{name: "other secret", signature: sign("other", body), body: body},
+		{name: "modified body", signature: sign("secret", body), body: body + " "},
+		{name: "missing", signature: "", body: body},
+		{name: "sha1 prefix", signature: "sha1=" + sign("secret", body)[len("sha256="):], body: body},
+		{name: "no prefix", signature: sign("secret", body)[len("sha256="):], body: body},
+		{name: "not hex", signature: "sha256=zz", body: body},
+		{name: "truncated", signature: sign("secret", body)[:20], body: body},
+		{name: "empty digest", signature: "sha256=", body: body},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := w.validSignature(tt.signature, []byte(tt.body)); got != tt.want {
+				t.Errorf("validSignature(%q) = %t, want %t", tt.signature, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSlashCommand(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		prompt string
+		ok     bool
+	}{
+		{name: "command only", body: "/autopr", prompt: "", ok: true},
+		{name: "inline prompt", body: "/autopr fix the typo", prompt: "fix the typo", ok: true},
+		{name: "tab separated", body: "/autopr\tfix the typo", prompt: "fix the typo", ok: true},
+		{name: "multi-line prompt", body: "/autopr fix the typo\nin the README", prompt: "fix the typo\nin the README", ok: true},
+		{name: "prompt on next lines", body: "/autopr\nfix the typo\n", prompt: "fix the typo", ok: true},
+		{name: "CRLF", body: "/autopr fix the typo\r\nin the README\r\n", prompt: "fix the typo\nin the README", ok: true},
+		{name: "mid-comment", body: "Thanks for the report!\n\n/autopr fix the typo\nplease", prompt: "fix the typo\nplease", ok: true},
+		{name: "mid-comment CRLF", body: "Thanks!\r\n  /autopr fix the typo\r\n", prompt: "fix the typo", ok: true},
+		{name: "first command wins", body: "/autopr one\n/autopr two", prompt: "one\n/autopr two", ok: true},
+		{name: "longer command", body: "/autoprx fix the typo"},
+		{name: "longer command then command", body: "/autoprx ignored\n/autopr fix it", prompt: "fix it", ok: true},
+		{name: "inside a sentence", body: "please run /autopr fix the typo"},
+		{name: "other command", body: "/approve"},
+		{name: "empty", body: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prompt, ok := parseSlashCommand(tt.body)
+			if prompt != tt.prompt || ok != tt.ok {
+				t.Errorf("parseSlashCommand(%q) = %q, %t; want %q, %t", tt.body, prompt, ok, tt.prompt, tt.ok)
+			}
+		})
+	}
+}
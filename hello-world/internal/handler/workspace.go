@@ -0,0 +1,288 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"hello-world/internal/git"
+	"hello-world/internal/github"
+)
+
+const (
+	// Repositories smaller than this are always edited through the API
+	defaultAPIBackendMaxRepoMB = 10
+	// Larger repositories are edited through the API only when the model
+	// selects at most this many files, since every file is its own request
+	defaultAPIBackendMaxFiles = 10
+)
+
+// workspace is where a request's changes are made: a clone under /tmp, or
+// the GitHub API. Paths are relative to the repository root
+type workspace interface {
+	ListFiles(ctx context.Context) (*git.FileTree, error)
+	Materialize(ctx context.Context, paths []string) error
+	ResolvePath(relPath string) (string, error)
+	ReadFile(ctx context.Context, relPath string) (string, error)
+	WriteFile(ctx context.Context, relPath, content string) error
+	RestoreFile(relPath string) error
+	Rebase(ctx context.Context, paths []string) (*git.RebaseResult, error)
+	Commit(ctx context.Context, branchName string, commits []git.Commit, opts git.CommitOptions) error
+	Cleanup()
+}
+
+// A clone checked out on the branch the changes are pushed to. client is
+// authenticated for the cloned repository, upstream for the repository its
+// base branch is fetched from; they differ for forks. Fetches keep the
+// workspace within sizeLimit bytes, like the clone.
+//
+// forkOwner and forkRepo are set for partial clones of a fork. Their pushes
+// leave out upstream's base commit, which the clone has no blobs to send, so
+// the fork's base branch is synced first to hold it
+type localWorkspace struct {
+	path       string
+	baseBranch string
+	client     *github.Client
+	upstream   *github.Client
+	sizeLimit  int64
+	forkOwner  string
+	forkRepo   string
+}
+
+func (w *localWorkspace) ListFiles(ctx context.Context) (*git.FileTree, error) {
+	token, err := w.client.Token(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get GitHub token: %w", err)
+	}
+	return git.ListFiles(w.path, token)
+}
+
+// Partial clones fetch the blobs with the current token, since generation
+// may have outlived the clone's
+func (w *localWorkspace) Materialize(ctx context.Context, paths []string) error {
+	token, err := w.client.Token(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get GitHub token: %w", err)
+	}
+	return git.Materialize(w.path, paths, token)
+}
+
+func (w *localWorkspace) ResolvePath(relPath string) (string, error) {
+	_, cleaned, err := git.ResolvePath(w.path, relPath)
+	return cleaned, err
+}
+
+func (w *localWorkspace) ReadFile(ctx context.Context, relPath string) (string, error) {
+	return git.ReadFileContent(w.path, relPath)
+}
+
+func (w *localWorkspace) WriteFile(ctx context.Context, relPath, content string) error {
+	return git.WriteFile(w.path, relPath, content)
+}
+
+func (w *localWorkspace) RestoreFile(relPath string) error {
+	return git.RestoreFile(w.path, relPath)
+}
+
+func (w *localWorkspace) Rebase(ctx context.Context, paths []string) (*git.RebaseResult, error) {
+	token, err := w.upstream.Token(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get GitHub token: %w", err)
+	}
+	return git.RebaseOntoUpstream(w.path, w.baseBranch, token, w.sizeLimit, paths)
+}
+
+func (w *localWorkspace) Commit(ctx context.Context, branchName string, commits []git.Commit, opts git.CommitOptions) error {
+	// Fetched again since generation may have outlived the clone's token
+	token, err := w.client.Token(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get GitHub token: %w", err)
+	}
+
+	// Synced right before the push rather than at clone time, so a rebase
+	// onto a newer upstream tip is covered too
+	if w.forkOwner != "" {
+		log.Printf("Syncing %s of %s/%s with upstream before pushing from a partial clone...", w.baseBranch, w.forkOwner, w.forkRepo)
+		if err := w.client.SyncFork(ctx, w.forkOwner, w.forkRepo, w.baseBranch); err != nil {
+			return err
+		}
+	}
+	return git.CommitAndPush(w.path, branchName, commits, token, opts)
+}
+
+func (w *localWorkspace) Cleanup() {
+	log.Printf("Cleaning up repository at %s", w.path)
+	if err := git.Cleanup(w.path); err != nil {
+		log.Printf("Warning: cleanup failed: %v", err)
+	}
+}
+
+// Edits through the Git Data API. Nothing touches the disk, and blobs are
+// only fetched when read
+type remoteWorkspace struct {
+	*github.RemoteWorkspace
+}
+
+func (w *remoteWorkspace) Materialize(ctx context.Context, paths []string) error {
+	return nil
+}
+
+func (w *remoteWorkspace) Cleanup() {}
+
+// Confines edits to a subdirectory of the repository. Paths outside it are
+// refused like unsafe ones; reads are not limited, so repository-wide files
+// such as the contribution guidelines stay readable
+type scopedWorkspace struct {
+	workspace
+	dir string
+}
+
+// Returns ws limited to dir, or ws itself when dir is empty
+func scopeWorkspace(ws workspace, dir string) workspace {
+	if dir == "" {
+		return ws
+	}
+	return &scopedWorkspace{workspace: ws, dir: dir}
+}
+
+func (w *scopedWorkspace) ResolvePath(relPath string) (string, error) {
+	cleaned, err := w.workspace.ResolvePath(relPath)
+	if err != nil {
+		return "", err
+	}
+	if cleaned != w.dir && !strings.HasPrefix(cleaned, w.dir+"/") {
+		return "", &git.PathError{Path: relPath, Reason: fmt.Sprintf("outside the requested directory %s", w.dir)}
+	}
+	return cleaned, nil
+}
+
+func (w *scopedWorkspace) WriteFile(ctx context.Context, relPath, content string) error {
+	if _, err := w.ResolvePath(relPath); err != nil {
+		return err
+	}
+	return w.workspace.WriteFile(ctx, relPath, content)
+}
+
+// Where a clone comes from and the branch it is set up for
+type cloneTarget struct {
+	url         string
+	upstreamURL string
+	baseBranch  string
+	branchName  string
+	repoSizeKB  int
+	// The fork url belongs to, or empty when the branch is pushed upstream
+	forkOwner string
+	forkRepo  string
+}
+
+// Clones target.url with headClient, resets its default branch to upstream's
+// base branch, fetched with upstreamClient, and checks out a new branch for
+// the changes
+func (h *Handler) cloneWorkspace(ctx context.Context, upstreamClient, headClient *github.Client, requestID string, target cloneTarget) (*localWorkspace, error) {
+	token, err := headClient.Token(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get GitHub token: %w", err)
+	}
+	upstreamToken, err := upstreamClient.Token(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get GitHub token: %w", err)
+	}
+
+	cloneOpts := git.CloneOptions{
+		URL:       target.url,
+		Directory: requestID,
+		Token:     token,
+		Partial:   usePartialClone(target.repoSizeKB),
+		SizeLimit: cloneSizeLimit(),
+	}
+
+	if err := git.SweepWorkspaces(staleWorkspaceAge); err != nil {
+		log.Printf("Warning: failed to sweep stale workspaces: %v", err)
+	}
+
+	// GitHub reports roughly the packed size; a checkout needs about as much again
+	estimatedBytes := int64(target.repoSizeKB) * 1024
+	if !cloneOpts.Partial {
+		estimatedBytes *= 2
+		if cloneOpts.SizeLimit > 0 && estimatedBytes > cloneOpts.SizeLimit {
+			log.Printf("Full clone would exceed the size limit, cloning partially")
+			cloneOpts.Partial = true
+			estimatedBytes /= 2
+		}
+	}
+	if err := git.CheckFreeSpace(estimatedBytes); err != nil {
+		return nil, fmt.Errorf("clone failed: %w", err)
+	}
+
+	log.Printf("Cloning repository to /tmp (partial: %t, size: %d KB)...", cloneOpts.Partial, target.repoSizeKB)
+	clonePath, err := git.CloneRepository(cloneOpts)
+	if errors.Is(err, git.ErrPartialCloneUnsupported) {
+		log.Printf("Remote does not support partial clone, falling back to a full clone")
+		cloneOpts.Partial = false
+		clonePath, err = git.CloneRepository(cloneOpts)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("clone failed: %w", err)
+	}
+	ws := &localWorkspace{path: clonePath, baseBranch: target.baseBranch, client: headClient, upstream: upstreamClient, sizeLimit: cloneOpts.SizeLimit}
+	if cloneOpts.Partial {
+		ws.forkOwner, ws.forkRepo = target.forkOwner, target.forkRepo
+	}
+	log.Printf("Repository cloned to: %s", clonePath)
+
+	// Reset fork's main branch to match upstream
+	log.Printf("Resetting fork to match upstream...")
+	if err := git.ResetToUpstream(clonePath, target.upstreamURL, target.baseBranch, upstreamToken, cloneOpts.SizeLimit); err != nil {
+		ws.Cleanup()
+		return nil, fmt.Errorf("failed to reset to upstream: %w", err)
+	}
+	log.Printf("Fork reset to upstream successfully")
+
+	log.Printf("Creating new branch: %s", target.branchName)
+	if err := git.CreateAndCheckoutBranch(clonePath, target.branchName); err != nil {
+		ws.Cleanup()
+		return nil, fmt.Errorf("failed to create branch: %w", err)
+	}
+
+	return ws, nil
+}
+
+// Reads COMMIT_BACKEND: "clone" always clones, "api" uses the Git Data API
+// whenever the repository's tree can be listed through it, and "auto" (the
+// default) uses the API for small repositories or small changes
+func commitBackend() string {
+	switch value := os.Getenv("COMMIT_BACKEND"); value {
+	case "", "auto":
+		return "auto"
+	case "clone", "api":
+		return value
+	default:
+		log.Printf("Warning: invalid COMMIT_BACKEND %q, using auto", value)
+		return "auto"
+	}
+}
+
+// In auto mode, whether a change reading fileCount files is better made with
+// a clone than through the API
+func preferClone(repoSizeKB, fileCount int) bool {
+	maxRepoMB := envInt("API_BACKEND_MAX_REPO_MB", defaultAPIBackendMaxRepoMB)
+	maxFiles := envInt("API_BACKEND_MAX_FILES", defaultAPIBackendMaxFiles)
+	return repoSizeKB >= maxRepoMB*1024 && fileCount > maxFiles
+}
+
+func envInt(name string, fallback int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Warning: invalid %s %q, using %d", name, value, fallback)
+		return fallback
+	}
+	return parsed
+}
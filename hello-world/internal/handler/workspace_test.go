@@ -0,0 +1,94 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"hello-world/internal/git"
+	"hello-world/internal/github"
+)
+
+// Returns credentials for a GitHub Enterprise Server whose API calls go to
+// handler, with the /api/v3 prefix stripped from the request paths, and the
+// server's host
+func newTestCredentials(t *testing.T, handler http.Handler) (*github.Credentials, string) {
+	t.Helper()
+
+	server := httptest.NewServer(http.StripPrefix("/api/v3", handler))
+	t.Cleanup(server.Close)
+
+	t.Setenv("GITHUB_TOKEN", "")
+	t.Setenv("GITHUB_APP_ID", "")
+	t.Setenv("GITHUB_APP_PRIVATE_KEY", "")
+	t.Setenv("GITHUB_ENTERPRISE_URL", server.URL)
+	t.Setenv("GITHUB_ENTERPRISE_TOKEN", "token")
+	t.Setenv("GITHUB_ALLOWED_HOSTS", "")
+	credentials, err := github.LoadCredentials()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return credentials, strings.TrimPrefix(server.URL, "http://")
+}
+
+// Returns a client whose API calls go to handler, see newTestCredentials
+func newTestClient(t *testing.T, handler http.Handler) *github.Client {
+	t.Helper()
+
+	credentials, host := newTestCredentials(t, handler)
+	client, err := credentials.ClientFor(context.Background(), host, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestLocalWorkspaceCommitSyncsFork(t *testing.T) {
+	var synced []string
+	client := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/repos/bot/repo/merge-upstream" {
+			http.NotFound(w, r)
+			return
+		}
+		var body struct {
+			Branch string `json:"branch"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		synced = append(synced, body.Branch)
+		w.Write([]byte(`{"merge_type": "fast-forward"}`))
+	}))
+
+	// The workspace is not a clone, so committing fails after the sync
+	commits := []git.Commit{{Message: "change"}}
+	ws := &localWorkspace{path: t.TempDir(), baseBranch: "release", client: client, forkOwner: "bot", forkRepo: "repo"}
+	if err := ws.Commit(context.Background(), "auto-pr-bot/1", commits, git.CommitOptions{}); err == nil {
+		t.Fatal("Commit outside a clone succeeded")
+	}
+	if len(synced) != 1 || synced[0] != "release" {
+		t.Errorf("synced branches = %v, want the base branch release", synced)
+	}
+
+	// Full clones and upstream branches push everything the remote needs
+	synced = nil
+	ws.forkOwner, ws.forkRepo = "", ""
+	ws.Commit(context.Background(), "auto-pr-bot/1", commits, git.CommitOptions{})
+	if len(synced) > 0 {
+		t.Errorf("synced branches = %v without a partial clone of a fork, want none", synced)
+	}
+}
+
+func TestLocalWorkspaceCommitSyncFailure(t *testing.T) {
+	client := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(`{"message": "There are merge conflicts"}`))
+	}))
+
+	ws := &localWorkspace{path: t.TempDir(), baseBranch: "main", client: client, forkOwner: "bot", forkRepo: "repo"}
+	err := ws.Commit(context.Background(), "auto-pr-bot/1", []git.Commit{{Message: "change"}}, git.CommitOptions{})
+	if err == nil || !strings.Contains(err.Error(), "failed to sync fork") {
+		t.Errorf("err = %v, want the sync failure", err)
+	}
+}
@@ -3,9 +3,11 @@ package models
 import "errors"
 
 var (
-	ErrMissingRepositoryURL      = errors.New("repositoryUrl is required")
-	ErrMissingModificationPrompt = errors.New("modificationPrompt is required")
+	ErrMissingRepositoryURL      = errors.New("repositoryUrl, issueUrl or pullRequestUrl is required")
+	ErrMissingModificationPrompt = errors.New("modificationPrompt, an issue or a pull request is required")
 	ErrInvalidRepositoryURL      = errors.New("invalid repository URL format")
+	ErrInvalidMilestone          = errors.New("milestone must be a milestone number")
+	ErrInvalidIssueNumber        = errors.New("issue numbers must be positive")
 	ErrForkFailed                = errors.New("failed to fork repository")
 	ErrCloneFailed               = errors.New("failed to clone repository")
 	ErrMaxRetriesExceeded        = errors.New("maximum retries exceeded")
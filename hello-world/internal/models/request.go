@@ -1,9 +1,34 @@
 package models
 
 type Request struct {
+	// Web or SSH URL of the repository. A /tree/<branch>/<dir> URL opens the
+	// pull request against that branch and limits changes to the directory
 	RepositoryURL      string `json:"repositoryUrl"`
 	GitHubUsername     string `json:"githubUsername"`
 	ModificationPrompt string `json:"modificationPrompt"`
+	// GitHub host for an owner/repo RepositoryURL, e.g. a GitHub Enterprise
+	// Server. Must be in GITHUB_ALLOWED_HOSTS; defaults to github.com
+	Host string `json:"host,omitempty"`
+	// An issue to work from instead of, or in addition to, the prompt. Either
+	// a full issue URL, or a number in the repository at RepositoryURL
+	IssueURL    string `json:"issueUrl,omitempty"`
+	IssueNumber int    `json:"issueNumber,omitempty"`
+	// A pull request opened by the bot whose review comments should be
+	// addressed. ModificationPrompt is then optional extra instructions
+	PullRequestURL string `json:"pullRequestUrl,omitempty"`
+	// SquashCommits overrides COMMIT_STRATEGY for this request
+	SquashCommits *bool `json:"squashCommits,omitempty"`
+
+	// Pull request metadata. Failures to apply any of it are reported in the
+	// status record rather than failing the request
+	Draft         bool     `json:"draft,omitempty"`
+	Labels        []string `json:"labels,omitempty"`
+	Reviewers     []string `json:"reviewers,omitempty"`
+	TeamReviewers []string `json:"teamReviewers,omitempty"`
+	Assignees     []string `json:"assignees,omitempty"`
+	Milestone     int      `json:"milestone,omitempty"`
+	// Issue numbers in the upstream repository, closed when the PR merges
+	LinkedIssues []int `json:"linkedIssues,omitempty"`
 }
 
 type RequestWithID struct {
@@ -12,11 +37,22 @@ type RequestWithID struct {
 }
 
 func (r *Request) Validate() error {
-	if r.RepositoryURL == "" {
+	if r.RepositoryURL == "" && r.IssueURL == "" && r.PullRequestURL == "" {
 		return ErrMissingRepositoryURL
 	}
-	if r.ModificationPrompt == "" {
+	if r.ModificationPrompt == "" && r.IssueURL == "" && r.IssueNumber == 0 && r.PullRequestURL == "" {
 		return ErrMissingModificationPrompt
 	}
+	if r.IssueNumber < 0 {
+		return ErrInvalidIssueNumber
+	}
+	if r.Milestone < 0 {
+		return ErrInvalidMilestone
+	}
+	for _, issue := range r.LinkedIssues {
+		if issue <= 0 {
+			return ErrInvalidIssueNumber
+		}
+	}
 	return nil
 }
@@ -11,6 +11,8 @@ import (
 	"os"
 	"strings"
 	"time"
+
+	"hello-world/internal/redact"
 )
 
 const (
@@ -28,6 +30,7 @@ func NewClient() (*Client, error) {
 	if apiKey == "" {
 		return nil, fmt.Errorf("OPENAI_API_KEY environment variable is required")
 	}
+	redact.Register(apiKey)
 
 	return &Client{
 		apiKey: apiKey,
@@ -46,6 +49,29 @@ type FilesToModifyResponse struct {
 	Explanation   string   `json:"explanation"`
 }
 
+type CommitPlanResponse struct {
+	Commits []CommitPlan `json:"commits"`
+}
+
+// CommitPlan is one logical change set proposed by the model
+type CommitPlan struct {
+	Files   []string `json:"files"`
+	Subject string   `json:"subject"`
+	Body    string   `json:"body"`
+}
+
+type ReviewChangesResponse struct {
+	FilesToModify []string      `json:"filesToModify"`
+	Explanation   string        `json:"explanation"`
+	Replies       []ReviewReply `json:"replies"`
+}
+
+// ReviewReply answers one review thread
+type ReviewReply struct {
+	CommentID int64  `json:"commentId"`
+	Reply     string `json:"reply"`
+}
+
 type PromptValidationResponse struct {
 	IsValid bool   `json:"isValid"`
 	Reason  string `json:"reason"`
@@ -276,6 +302,183 @@ IMPORTANT for the "explanation" field:
 	return modifyResponse.FilesToModify, modifyResponse.Explanation, nil
 }
 
+// PlanReviewChanges starts a conversation about review feedback on a pull
+// request. reviewThreads describes each open thread with its comment ID, and
+// fileContents holds the current branch contents of the files involved
+func (c *Client) PlanReviewChanges(ctx context.Context, fileContents map[string]string, reviewThreads, instructions string) (*ConversationHistory, *ReviewChangesResponse, error) {
+	history := &ConversationHistory{}
+
+	systemPrompt := `You are an expert software engineer addressing code review feedback on a pull request you opened.
+
+Your task:
+1. Read the review comments and the current contents of the files on the pull request branch
+2. Decide which files need to change to address the feedback
+3. Write a short reply to every review thread
+
+Address every comment you agree with. When you disagree or a comment needs no change, say why in the reply instead of changing code. Do not make changes nobody asked for.
+
+Return ONLY a JSON object with this structure:
+{
+  "filesToModify": ["path/to/file1.ext"],
+  "explanation": "Brief summary of the changes made in response to the review",
+  "replies": [
+    {"commentId": 123, "reply": "What was changed in response, or why nothing was"}
+  ]
+}
+
+Write the explanation and replies in PAST TENSE, addressed to the reviewer.`
+
+	var contentBuilder strings.Builder
+	for filePath, content := range fileContents {
+		contentBuilder.WriteString(fmt.Sprintf("=== %s ===\n%s\n\n", filePath, content))
+	}
+
+	userPrompt := fmt.Sprintf(`Current contents of the files on the branch:
+
+%s
+Review threads:
+%s`, contentBuilder.String(), reviewThreads)
+	if instructions != "" {
+		userPrompt += fmt.Sprintf("\nAdditional instructions from the reviewer:\n%s\n", instructions)
+	}
+
+	history.AddMessage("system", systemPrompt)
+	history.AddMessage("user", userPrompt)
+
+	reqBody := ChatCompletionRequest{
+		Model:               gpt5Mini,
+		Messages:            history.Messages,
+		MaxCompletionTokens: 2000,
+		ResponseFormat: &struct {
+			Type       string                 `json:"type"`
+			JSONSchema map[string]interface{} `json:"json_schema,omitempty"`
+		}{
+			Type: "json_object",
+		},
+	}
+
+	response, err := c.makeAPICall(ctx, reqBody)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	history.AddMessage("assistant", response)
+
+	var plan ReviewChangesResponse
+	if err := json.Unmarshal([]byte(response), &plan); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse review changes: %w", err)
+	}
+
+	return history, &plan, nil
+}
+
+// AddContributionGuidelines puts the repository's contribution rules into the
+// conversation, so the code generated from it follows them
+func AddContributionGuidelines(history *ConversationHistory, rules string) {
+	history.AddMessage("user", fmt.Sprintf(`The repository publishes the following contribution guidelines. Follow them in every change you make: coding style, tests, documentation and any other conventions they describe.
+
+%s`, rules))
+}
+
+// FillPullRequestTemplate writes a pull request description by filling in
+// the repository's pull request template
+func (c *Client) FillPullRequestTemplate(ctx context.Context, history *ConversationHistory, template, title, explanation string, modifiedFiles []string) (string, error) {
+	userPrompt := fmt.Sprintf(`Write the description of the pull request "%s" by filling in the repository's pull request template.
+
+Summary of the changes: %s
+
+Modified files:
+%s
+
+Pull request template:
+%s
+
+Rules:
+- Keep the template's headings and structure, and answer each section from what was actually changed
+- Tick a checklist item ("- [x]") only if it is true of this change; leave the others unticked
+- Write "N/A" for sections that do not apply instead of deleting them
+- Drop the template's HTML comments and placeholder instructions
+- Do not claim tests were run or anything else that was not done
+
+Return only the Markdown description, not JSON.`, title, explanation, "- "+strings.Join(modifiedFiles, "\n- "), template)
+
+	tempHistory := &ConversationHistory{
+		Messages: make([]Message, len(history.Messages)),
+	}
+	copy(tempHistory.Messages, history.Messages)
+	tempHistory.AddMessage("user", userPrompt)
+
+	reqBody := ChatCompletionRequest{
+		Model:               gpt5Mini,
+		Messages:            tempHistory.Messages,
+		MaxCompletionTokens: 2000,
+	}
+
+	response, err := c.makeAPICall(ctx, reqBody)
+	if err != nil {
+		return "", fmt.Errorf("failed to fill pull request template: %w", err)
+	}
+	return strings.TrimSpace(response), nil
+}
+
+// PlanCommits groups the modified files into logical commits with
+// Conventional Commits messages
+func (c *Client) PlanCommits(ctx context.Context, history *ConversationHistory, modifiedFiles []string, explanation, modificationPrompt string) ([]CommitPlan, error) {
+	userPrompt := fmt.Sprintf(`The following files were modified to complete the request "%s":
+%s
+
+Summary of the changes: %s
+
+Group these files into logical commits so reviewers can follow the history. Use a single commit when the change is small or cannot be meaningfully split. Every file must appear in exactly one commit. Order commits so that each one builds on the previous ones.
+
+Return ONLY a JSON object with this structure:
+{
+  "commits": [
+    {
+      "files": ["path/to/file1.ext"],
+      "subject": "feat(scope): short imperative summary",
+      "body": "Why the change was made and anything reviewers should know"
+    }
+  ]
+}
+
+IMPORTANT for the "subject" field:
+- Follow Conventional Commits: type(optional scope): description
+- Use one of: feat, fix, docs, style, refactor, perf, test, build, ci, chore
+- Use the imperative mood, lowercase description, no trailing period
+- Keep it under 72 characters`, modificationPrompt, "- "+strings.Join(modifiedFiles, "\n- "), explanation)
+
+	tempHistory := &ConversationHistory{
+		Messages: make([]Message, len(history.Messages)),
+	}
+	copy(tempHistory.Messages, history.Messages)
+	tempHistory.AddMessage("user", userPrompt)
+
+	reqBody := ChatCompletionRequest{
+		Model:               gpt5Mini,
+		Messages:            tempHistory.Messages,
+		MaxCompletionTokens: 1500,
+		ResponseFormat: &struct {
+			Type       string                 `json:"type"`
+			JSONSchema map[string]interface{} `json:"json_schema,omitempty"`
+		}{
+			Type: "json_object",
+		},
+	}
+
+	response, err := c.makeAPICall(ctx, reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("failed to plan commits: %w", err)
+	}
+
+	var plan CommitPlanResponse
+	if err := json.Unmarshal([]byte(response), &plan); err != nil {
+		return nil, fmt.Errorf("failed to parse commit plan: %w", err)
+	}
+
+	return plan.Commits, nil
+}
+
 func (c *Client) GenerateModifiedFile(ctx context.Context, history *ConversationHistory, filePath, originalContent, modificationPrompt string) (string, error) {
 	userPrompt := fmt.Sprintf(`Please provide the complete modified content for the file: %s
 
@@ -311,6 +514,84 @@ Return it as plain text, not JSON. Just the file content exactly as it should be
 	return response, nil
 }
 
+// FixFileSyntax asks for a corrected version of a generated file that failed
+// syntax validation
+func (c *Client) FixFileSyntax(ctx context.Context, history *ConversationHistory, filePath, content, problems, modificationPrompt string) (string, error) {
+	userPrompt := fmt.Sprintf(`The content you generated for %s failed validation:
+%s
+
+Generated content:
+%s
+
+Modification request:
+%s
+
+Fix these problems while keeping the requested modification.
+Return the COMPLETE file content with all the necessary changes applied. Include ALL lines of the file, not just the changed parts.
+Do not use placeholders like "... rest of the file ..." - provide the full file.
+
+Return it as plain text, not JSON. Just the file content exactly as it should be written to disk.`, filePath, problems, content, modificationPrompt)
+
+	tempHistory := &ConversationHistory{
+		Messages: make([]Message, len(history.Messages)),
+	}
+	copy(tempHistory.Messages, history.Messages)
+	tempHistory.AddMessage("user", userPrompt)
+
+	reqBody := ChatCompletionRequest{
+		Model:               gpt5Mini,
+		Messages:            tempHistory.Messages,
+		MaxCompletionTokens: 4000,
+	}
+
+	response, err := c.makeAPICall(ctx, reqBody)
+	if err != nil {
+		return "", err
+	}
+
+	return response, nil
+}
+
+// RegenerateConflictingFile reapplies the requested change to a file that
+// changed upstream while the original modification was being generated
+func (c *Client) RegenerateConflictingFile(ctx context.Context, history *ConversationHistory, filePath, upstreamContent, previousContent, modificationPrompt string) (string, error) {
+	userPrompt := fmt.Sprintf(`The file %s was changed upstream after you generated your modification, so your version no longer applies cleanly.
+
+Current upstream content:
+%s
+
+Your previous modified version:
+%s
+
+Modification request:
+%s
+
+Apply the same modification to the current upstream content, keeping every upstream change that is unrelated to the request.
+Return the COMPLETE file content with all the necessary changes applied. Include ALL lines of the file, not just the changed parts.
+Do not use placeholders like "... rest of the file ..." - provide the full file.
+
+Return it as plain text, not JSON. Just the file content exactly as it should be written to disk.`, filePath, upstreamContent, previousContent, modificationPrompt)
+
+	tempHistory := &ConversationHistory{
+		Messages: make([]Message, len(history.Messages)),
+	}
+	copy(tempHistory.Messages, history.Messages)
+	tempHistory.AddMessage("user", userPrompt)
+
+	reqBody := ChatCompletionRequest{
+		Model:               gpt5Mini,
+		Messages:            tempHistory.Messages,
+		MaxCompletionTokens: 4000,
+	}
+
+	response, err := c.makeAPICall(ctx, reqBody)
+	if err != nil {
+		return "", err
+	}
+
+	return response, nil
+}
+
 func (c *Client) makeAPICall(ctx context.Context, reqBody ChatCompletionRequest) (string, error) {
 	const maxRetries = 3
 	var lastErr error
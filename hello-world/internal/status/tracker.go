@@ -6,8 +6,12 @@ import (
 	"log"
 	"os"
 	"strconv"
+	"sync"
 	"time"
 
+	"hello-world/internal/github"
+	"hello-world/internal/redact"
+
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
@@ -29,6 +33,26 @@ const (
 	StatusCompleted  Status = "completed"
 	StatusRejected   Status = "rejected"
 	StatusError      Status = "error"
+	// The pull request was opened but its CI checks failed
+	StatusCIFailed Status = "ci_failed"
+)
+
+// States of the ci section
+const (
+	CIPending = "pending"
+	CISuccess = "success"
+	CIFailure = "failure"
+	// No checks were reported on the pull request
+	CINone = "none"
+	// The pull request was closed before its checks finished
+	CIClosed = "closed"
+)
+
+// Records whose checks are pending carry ciWatch, which is the key of a sparse
+// index, so the poller does not scan the whole table
+const (
+	ciWatchAttribute = "ciWatch"
+	ciWatchIndex     = "CIWatchIndex"
 )
 
 type StatusRecord struct {
@@ -41,11 +65,64 @@ type StatusRecord struct {
 	ErrorDetails string `dynamodbav:"errorDetails,omitempty"`
 	Repository   string `dynamodbav:"repository"`
 	ExpiresAt    int64  `dynamodbav:"expiresAt"`
+
+	// Unix time the GitHub quota that stopped the request resets at
+	QuotaResetAt int64 `dynamodbav:"quotaResetAt,omitempty"`
+
+	RejectedPaths  []RejectedPath  `dynamodbav:"rejectedPaths,omitempty"`
+	MetadataErrors []MetadataError `dynamodbav:"metadataErrors,omitempty"`
+
+	// Checks on the opened pull request, watched until they finish
+	CI *CIStatus `dynamodbav:"ci,omitempty"`
+}
+
+// A file path proposed by the LLM that was refused before any read or write
+type RejectedPath struct {
+	Path   string `dynamodbav:"path" json:"path"`
+	Reason string `dynamodbav:"reason" json:"reason"`
+}
+
+// A pull request field that could not be set, usually for lack of permission
+type MetadataError struct {
+	Field string `dynamodbav:"field" json:"field"`
+	Error string `dynamodbav:"error" json:"error"`
+}
+
+// CI results on the head commit of a request's pull request
+type CIStatus struct {
+	State   string        `dynamodbav:"state" json:"state"`
+	HeadSHA string        `dynamodbav:"headSha" json:"headSha"`
+	Checks  []CheckResult `dynamodbav:"checks,omitempty" json:"checks,omitempty"`
+	// Unix times the head commit was first seen and last checked at
+	Since     int64 `dynamodbav:"since" json:"-"`
+	CheckedAt int64 `dynamodbav:"checkedAt" json:"checkedAt"`
+
+	// The request that pushed the automatic fix, and the commit it fixed
+	FixRequestID string `dynamodbav:"fixRequestId,omitempty" json:"fixRequestId,omitempty"`
+	FixedSHA     string `dynamodbav:"fixedSha,omitempty" json:"-"`
+}
+
+// The outcome of one check run or commit status
+type CheckResult struct {
+	Name  string `dynamodbav:"name" json:"name"`
+	State string `dynamodbav:"state" json:"state"`
+	URL   string `dynamodbav:"url,omitempty" json:"url,omitempty"`
+}
+
+// Annotations collected while a request is processed
+type annotations struct {
+	rejectedPaths  []RejectedPath
+	metadataErrors []MetadataError
 }
 
 type Tracker struct {
 	client    *dynamodb.Client
 	tableName string
+
+	// Every write replaces the whole record, so annotations collected during
+	// processing are kept here and included in each write
+	mu          sync.Mutex
+	annotations map[string]*annotations
 }
 
 func NewTracker(ctx context.Context) (*Tracker, error) {
@@ -60,8 +137,9 @@ func NewTracker(ctx context.Context) (*Tracker, error) {
 	}
 
 	return &Tracker{
-		client:    dynamodb.NewFromConfig(cfg),
-		tableName: tableName,
+		client:      dynamodb.NewFromConfig(cfg),
+		tableName:   tableName,
+		annotations: make(map[string]*annotations),
 	}, nil
 }
 
@@ -69,12 +147,13 @@ func (t *Tracker) Update(ctx context.Context, requestID string, status Status, m
 	record := StatusRecord{
 		RequestID:  requestID,
 		Status:     string(status),
-		Message:    message,
+		Message:    redact.String(message),
 		Step:       step,
 		Timestamp:  time.Now().Unix(),
 		Repository: repository,
 		ExpiresAt:  time.Now().Add(48 * time.Hour).Unix(), // Auto-delete after 48 hours
 	}
+	t.annotate(&record)
 
 	item, err := attributevalue.MarshalMap(record)
 	if err != nil {
@@ -108,6 +187,9 @@ func (t *Tracker) Complete(ctx context.Context, requestID string, prURL string,
 		Repository: repository,
 		ExpiresAt:  time.Now().Add(48 * time.Hour).Unix(),
 	}
+	t.annotate(&record)
+
+	t.forget(requestID)
 
 	item, err := attributevalue.MarshalMap(record)
 	if err != nil {
@@ -134,11 +216,14 @@ func (t *Tracker) Reject(ctx context.Context, requestID string, reason string, r
 		RequestID:    requestID,
 		Status:       string(StatusRejected),
 		Message:      "Request rejected: prompt needs improvement",
-		ErrorDetails: reason,
+		ErrorDetails: redact.String(reason),
 		Timestamp:    time.Now().Unix(),
 		Repository:   repository,
 		ExpiresAt:    time.Now().Add(48 * time.Hour).Unix(),
 	}
+	t.annotate(&record)
+
+	t.forget(requestID)
 
 	item, err := attributevalue.MarshalMap(record)
 	if err != nil {
@@ -165,11 +250,14 @@ func (t *Tracker) Error(ctx context.Context, requestID string, errorMsg string,
 		RequestID:    requestID,
 		Status:       string(StatusError),
 		Message:      "An error occurred during processing",
-		ErrorDetails: errorMsg,
+		ErrorDetails: redact.String(errorMsg),
 		Timestamp:    time.Now().Unix(),
 		Repository:   repository,
 		ExpiresAt:    time.Now().Add(48 * time.Hour).Unix(),
 	}
+	t.annotate(&record)
+
+	t.forget(requestID)
 
 	item, err := attributevalue.MarshalMap(record)
 	if err != nil {
@@ -191,6 +279,242 @@ func (t *Tracker) Error(ctx context.Context, requestID string, errorMsg string,
 	return nil
 }
 
+// QuotaExhausted marks the request failed because the bot ran out of GitHub
+// API quota, recording when it resets
+func (t *Tracker) QuotaExhausted(ctx context.Context, requestID string, reset time.Time, errorMsg string, repository string) error {
+	record := StatusRecord{
+		RequestID:    requestID,
+		Status:       string(StatusError),
+		Message:      github.QuotaMessage(reset),
+		ErrorDetails: redact.String(errorMsg),
+		Timestamp:    time.Now().Unix(),
+		Repository:   repository,
+		ExpiresAt:    time.Now().Add(48 * time.Hour).Unix(),
+		QuotaResetAt: reset.Unix(),
+	}
+	t.annotate(&record)
+
+	t.forget(requestID)
+
+	item, err := attributevalue.MarshalMap(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal record: %w", err)
+	}
+
+	input := &dynamodb.PutItemInput{
+		TableName: aws.String(t.tableName),
+		Item:      item,
+	}
+
+	_, err = t.client.PutItem(ctx, input)
+	if err != nil {
+		log.Printf("Warning: Failed to update error status in DynamoDB: %v", err)
+		return nil
+	}
+
+	log.Printf("Status error: %s - %s", requestID, record.Message)
+	return nil
+}
+
+// RejectPath records a path that was refused for the request and writes it to
+// the stored record immediately
+func (t *Tracker) RejectPath(ctx context.Context, requestID string, path string, reason string) error {
+	rejected := RejectedPath{Path: redact.String(path), Reason: reason}
+
+	t.mu.Lock()
+	t.get(requestID).rejectedPaths = append(t.get(requestID).rejectedPaths, rejected)
+	t.mu.Unlock()
+
+	if err := t.appendToList(ctx, requestID, "rejectedPaths", []RejectedPath{rejected}); err != nil {
+		log.Printf("Warning: Failed to record rejected path in DynamoDB: %v", err)
+		return nil
+	}
+
+	log.Printf("Rejected path for %s: %s (%s)", requestID, path, reason)
+	return nil
+}
+
+// MetadataFailed records a pull request field that could not be set and
+// writes it to the stored record immediately
+func (t *Tracker) MetadataFailed(ctx context.Context, requestID string, field string, errorMsg string) error {
+	failed := MetadataError{Field: field, Error: redact.String(errorMsg)}
+
+	t.mu.Lock()
+	t.get(requestID).metadataErrors = append(t.get(requestID).metadataErrors, failed)
+	t.mu.Unlock()
+
+	if err := t.appendToList(ctx, requestID, "metadataErrors", []MetadataError{failed}); err != nil {
+		log.Printf("Warning: Failed to record metadata error in DynamoDB: %v", err)
+		return nil
+	}
+
+	log.Printf("Failed to set %s for %s: %s", field, requestID, errorMsg)
+	return nil
+}
+
+// WatchCI starts following the checks on the request's pull request, whose
+// head is at headSHA
+func (t *Tracker) WatchCI(ctx context.Context, requestID string, headSHA string) error {
+	now := time.Now().Unix()
+	ci := CIStatus{State: CIPending, HeadSHA: headSHA, Since: now, CheckedAt: now}
+	if err := t.setCI(ctx, requestID, &ci, nil); err != nil {
+		log.Printf("Warning: Failed to start watching CI in DynamoDB: %v", err)
+		return nil
+	}
+
+	log.Printf("Watching CI for %s at %s", requestID, headSHA)
+	return nil
+}
+
+// UpdateCI stores the latest check results of the request's pull request
+func (t *Tracker) UpdateCI(ctx context.Context, requestID string, ci *CIStatus) error {
+	if err := t.setCI(ctx, requestID, ci, nil); err != nil {
+		log.Printf("Warning: Failed to update CI status in DynamoDB: %v", err)
+		return nil
+	}
+
+	log.Printf("CI status updated: %s - %s", requestID, ci.State)
+	return nil
+}
+
+// CIFailed stores failed check results and marks the request ci_failed
+func (t *Tracker) CIFailed(ctx context.Context, requestID string, ci *CIStatus, message string) error {
+	fields := map[string]types.AttributeValue{
+		"status":  &types.AttributeValueMemberS{Value: string(StatusCIFailed)},
+		"message": &types.AttributeValueMemberS{Value: redact.String(message)},
+	}
+	if err := t.setCI(ctx, requestID, ci, fields); err != nil {
+		log.Printf("Warning: Failed to update CI status in DynamoDB: %v", err)
+		return nil
+	}
+
+	log.Printf("Status ci_failed: %s - %s", requestID, message)
+	return nil
+}
+
+// Sets the ci section of a stored record, and fields next to it. Records that
+// have expired are not recreated. ciWatch is only kept while the checks are
+// pending, so the index on it holds just the records the poller follows
+func (t *Tracker) setCI(ctx context.Context, requestID string, ci *CIStatus, fields map[string]types.AttributeValue) error {
+	value, err := attributevalue.Marshal(ci)
+	if err != nil {
+		return fmt.Errorf("failed to marshal ci: %w", err)
+	}
+
+	expression := "SET #ci = :ci"
+	names := map[string]string{"#ci": "ci", "#ciWatch": ciWatchAttribute}
+	values := map[string]types.AttributeValue{":ci": value}
+	for name, fieldValue := range fields {
+		expression += fmt.Sprintf(", #%s = :%s", name, name)
+		names["#"+name] = name
+		values[":"+name] = fieldValue
+	}
+	if ci.State == CIPending {
+		expression += ", #ciWatch = :ciWatch"
+		values[":ciWatch"] = &types.AttributeValueMemberS{Value: CIPending}
+	} else {
+		expression += " REMOVE #ciWatch"
+	}
+
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String(t.tableName),
+		Key: map[string]types.AttributeValue{
+			"requestId": &types.AttributeValueMemberS{Value: requestID},
+		},
+		UpdateExpression:          aws.String(expression),
+		ConditionExpression:       aws.String("attribute_exists(requestId)"),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+	}
+
+	_, err = t.client.UpdateItem(ctx, input)
+	return err
+}
+
+// WatchedCI returns the records whose pull request checks are still pending
+func (t *Tracker) WatchedCI(ctx context.Context) ([]StatusRecord, error) {
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(t.tableName),
+		IndexName:              aws.String(ciWatchIndex),
+		KeyConditionExpression: aws.String("#ciWatch = :pending"),
+		ExpressionAttributeNames: map[string]string{
+			"#ciWatch": ciWatchAttribute,
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":pending": &types.AttributeValueMemberS{Value: CIPending},
+		},
+	}
+
+	var records []StatusRecord
+	paginator := dynamodb.NewQueryPaginator(t.client, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query watched CI: %w", err)
+		}
+		var pageRecords []StatusRecord
+		if err := attributevalue.UnmarshalListOfMaps(page.Items, &pageRecords); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal records: %w", err)
+		}
+		records = append(records, pageRecords...)
+	}
+
+	return records, nil
+}
+
+// Appends values, a slice, to a list attribute of the stored record
+func (t *Tracker) appendToList(ctx context.Context, requestID string, attribute string, values interface{}) error {
+	value, err := attributevalue.Marshal(values)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s: %w", attribute, err)
+	}
+
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String(t.tableName),
+		Key: map[string]types.AttributeValue{
+			"requestId": &types.AttributeValueMemberS{Value: requestID},
+		},
+		UpdateExpression: aws.String("SET #list = list_append(if_not_exists(#list, :empty), :values)"),
+		ExpressionAttributeNames: map[string]string{
+			"#list": attribute,
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":values": value,
+			":empty":  &types.AttributeValueMemberL{Value: []types.AttributeValue{}},
+		},
+	}
+
+	_, err = t.client.UpdateItem(ctx, input)
+	return err
+}
+
+// Returns the request's annotations, creating them if needed. Callers hold mu
+func (t *Tracker) get(requestID string) *annotations {
+	a, ok := t.annotations[requestID]
+	if !ok {
+		a = &annotations{}
+		t.annotations[requestID] = a
+	}
+	return a
+}
+
+// Copies the request's annotations into a record about to be written
+func (t *Tracker) annotate(record *StatusRecord) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if a, ok := t.annotations[record.RequestID]; ok {
+		record.RejectedPaths = append([]RejectedPath(nil), a.rejectedPaths...)
+		record.MetadataErrors = append([]MetadataError(nil), a.metadataErrors...)
+	}
+}
+
+// Terminal records carry the final annotations, so they can be dropped
+func (t *Tracker) forget(requestID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.annotations, requestID)
+}
+
 func (t *Tracker) Get(ctx context.Context, requestID string) (*StatusRecord, error) {
 	input := &dynamodb.GetItemInput{
 		TableName: aws.String(t.tableName),
@@ -229,6 +553,7 @@ func ParseStepFromStatus(status Status) int {
 		StatusCommitting: 5,
 		StatusCreatingPR: 6,
 		StatusCompleted:  9,
+		StatusCIFailed:   9,
 		StatusRejected:   -1,
 		StatusError:      -1,
 	}
@@ -0,0 +1,144 @@
+package validate
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+var (
+	fencePattern   = regexp.MustCompile("^\\s{0,3}(```+|~~~+)(.*)$")
+	headingPattern = regexp.MustCompile(`^\s{0,3}(#{1,6})(\s+|$)(.*)$`)
+	// "#Title" renders as a paragraph on GitHub
+	headingNoSpacePattern = regexp.MustCompile(`^\s{0,3}#{1,6}[^#\s]`)
+	linkPattern           = regexp.MustCompile(`!?\[[^\]]*\]\(([^)\s]*)(?:\s+"[^"]*")?\)`)
+	inlineCodePattern     = regexp.MustCompile("`[^`]*`")
+	htmlAnchorPattern     = regexp.MustCompile(`<a\s+(?:name|id)="([^"]+)"`)
+)
+
+// Checks heading syntax, unclosed code fences, relative links to files that
+// do not exist and in-page links to headings that do not exist
+func checkMarkdown(relPath, content string, opts Options) ([]string, string) {
+	var problems []string
+	type link struct {
+		target string
+		line   int
+	}
+	var links []link
+	anchors := make(map[string]bool)
+	slugCounts := make(map[string]int)
+
+	fence := ""
+	fenceLine := 0
+	for i, line := range strings.Split(content, "\n") {
+		lineNumber := i + 1
+
+		if match := fencePattern.FindStringSubmatch(line); match != nil {
+			marker := match[1]
+			switch {
+			case fence == "":
+				fence, fenceLine = marker, lineNumber
+			// A closing fence has no info string; "```go" inside a
+			// block is content
+			case marker[0] == fence[0] && len(marker) >= len(fence) && strings.TrimSpace(match[2]) == "":
+				fence = ""
+			}
+			continue
+		}
+		if fence != "" {
+			continue
+		}
+
+		if headingNoSpacePattern.MatchString(line) && !strings.HasPrefix(strings.TrimSpace(line), "#!") {
+			problems = append(problems, fmt.Sprintf("heading %q is missing a space after # (line %d)", strings.TrimSpace(line), lineNumber))
+		}
+		if match := headingPattern.FindStringSubmatch(line); match != nil {
+			slug := headingSlug(match[3])
+			if count := slugCounts[slug]; count > 0 {
+				anchors[fmt.Sprintf("%s-%d", slug, count)] = true
+			} else {
+				anchors[slug] = true
+			}
+			slugCounts[slug]++
+		}
+		for _, match := range htmlAnchorPattern.FindAllStringSubmatch(line, -1) {
+			anchors[strings.ToLower(match[1])] = true
+		}
+
+		text := inlineCodePattern.ReplaceAllString(line, "")
+		for _, match := range linkPattern.FindAllStringSubmatch(text, -1) {
+			links = append(links, link{target: match[1], line: lineNumber})
+		}
+	}
+
+	if fence != "" {
+		problems = append(problems, fmt.Sprintf("code fence opened with %s is never closed (line %d)", fence, fenceLine))
+	}
+
+	for _, l := range links {
+		if problem := checkLink(relPath, l.target, anchors, opts); problem != "" {
+			problems = append(problems, fmt.Sprintf("%s (line %d)", problem, l.line))
+		}
+	}
+
+	return problems, ""
+}
+
+func checkLink(relPath, target string, anchors map[string]bool, opts Options) string {
+	if target == "" {
+		return "link has an empty target"
+	}
+
+	parsed, err := url.Parse(target)
+	if err != nil {
+		return fmt.Sprintf("link target %q is not a valid URL", target)
+	}
+	if parsed.Scheme != "" || parsed.Host != "" {
+		return ""
+	}
+
+	if parsed.Path == "" {
+		if parsed.Fragment != "" && !anchors[strings.ToLower(parsed.Fragment)] {
+			return fmt.Sprintf("link to #%s matches no heading in this file", parsed.Fragment)
+		}
+		return ""
+	}
+
+	if opts.Exists == nil {
+		return ""
+	}
+
+	linked := parsed.Path
+	if strings.HasPrefix(linked, "/") {
+		linked = strings.TrimPrefix(linked, "/")
+	} else {
+		linked = path.Join(path.Dir(relPath), linked)
+	}
+	linked = strings.TrimSuffix(path.Clean(linked), "/")
+	if linked == "." || strings.HasPrefix(linked, "../") {
+		return ""
+	}
+	if !opts.Exists(linked) {
+		return fmt.Sprintf("link to %s points to a file that does not exist", parsed.Path)
+	}
+	return ""
+}
+
+// GitHub's anchor for a heading: lowercased, punctuation removed and spaces
+// replaced with hyphens
+func headingSlug(heading string) string {
+	heading = strings.TrimSpace(strings.TrimRight(strings.TrimSpace(heading), "#"))
+	var slug strings.Builder
+	for _, r := range strings.ToLower(heading) {
+		switch {
+		case unicode.IsLetter(r), unicode.IsDigit(r), r == '-', r == '_':
+			slug.WriteRune(r)
+		case r == ' ':
+			slug.WriteRune('-')
+		}
+	}
+	return slug.String()
+}
@@ -0,0 +1,131 @@
+package validate
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckMarkdown(t *testing.T) {
+	files := map[string]bool{
+		"README.md":         true,
+		"docs/guide.md":     true,
+		"docs/images/a.png": true,
+		"LICENSE":           true,
+	}
+	exists := func(relPath string) bool { return files[relPath] }
+
+	tests := []struct {
+		name     string
+		path     string
+		content  string
+		problems []string
+	}{
+		{name: "valid", path: "README.md", content: "# Title\n\nText with [a link](https://example.com).\n"},
+		{name: "heading without space", path: "README.md", content: "#Title\n", problems: []string{`heading "#Title" is missing a space after # (line 1)`}},
+		{name: "level six heading without space", path: "README.md", content: "text\n######Title\n", problems: []string{`heading "######Title" is missing a space after # (line 2)`}},
+		{name: "shebang", path: "README.md", content: "#!/bin/sh\n"},
+		{name: "indented heading without space", path: "README.md", content: "   #Title\n", problems: []string{`heading "#Title" is missing a space after # (line 1)`}},
+		{name: "indented code", path: "README.md", content: "    #include <stdio.h>\n"},
+		{name: "empty heading", path: "README.md", content: "#\n"},
+
+		{name: "relative link", path: "README.md", content: "[guide](docs/guide.md)\n"},
+		{name: "link from subdirectory", path: "docs/guide.md", content: "[readme](../README.md) and ![image](images/a.png)\n"},
+		{name: "root-relative link", path: "docs/guide.md", content: "[license](/LICENSE)\n"},
+		{name: "link with fragment and title", path: "README.md", content: "[guide](docs/guide.md#setup \"Setup\")\n"},
+		{name: "link to directory", path: "README.md", content: "[docs](docs/)\n", problems: []string{"link to docs/ points to a file that does not exist (line 1)"}},
+		{name: "missing file", path: "README.md", content: "text\n[guide](docs/missing.md)\n", problems: []string{"link to docs/missing.md points to a file that does not exist (line 2)"}},
+		{name: "missing image", path: "docs/guide.md", content: "![image](images/b.png)\n", problems: []string{"link to images/b.png points to a file that does not exist (line 1)"}},
+		{name: "outside the repository", path: "README.md", content: "[parent](../other/README.md)\n"},
+		{name: "external links", path: "README.md", content: "[a](https://example.com/x) [b](mailto:a@example.com) [c](//example.com)\n"},
+		{name: "empty target", path: "README.md", content: "[todo]()\n", problems: []string{"link has an empty target (line 1)"}},
+		{name: "invalid URL", path: "README.md", content: "[bad](%zz)\n", problems: []string{`link target "%zz" is not a valid URL (line 1)`}},
+		{name: "link in inline code", path: "README.md", content: "Use `[text](missing.md)` syntax.\n"},
+
+		{name: "anchor", path: "README.md", content: "# Getting Started\n\n[start](#getting-started)\n"},
+		{name: "anchor is case insensitive", path: "README.md", content: "## Usage\n\n[usage](#Usage)\n"},
+		{name: "anchor punctuation", path: "README.md", content: "## What's new? (v2.0)\n\n[new](#whats-new-v20)\n"},
+		{name: "anchor with closing hashes", path: "README.md", content: "## Install ##\n\n[install](#install)\n"},
+		{name: "anchor with unicode", path: "README.md", content: "## Café au lait\n\n[café](#café-au-lait)\n"},
+		{name: "html anchor", path: "README.md", content: "<a name=\"Custom\"></a>\n\n[custom](#custom)\n"},
+		{name: "html id", path: "README.md", content: "<a id=\"other\"></a>\n\n[other](#other)\n"},
+		{name: "missing anchor", path: "README.md", content: "# Title\n\n[usage](#usage)\n", problems: []string{"link to #usage matches no heading in this file (line 3)"}},
+		{name: "anchor of heading in a fence", path: "README.md", content: "```\n# Usage\n```\n[usage](#usage)\n", problems: []string{"link to #usage matches no heading in this file (line 4)"}},
+		{name: "anchor in another file", path: "README.md", content: "[setup](docs/guide.md#anything)\n"},
+
+		{name: "duplicate headings", path: "README.md", content: "## Example\n## Example\n## Example\n\n[a](#example) [b](#example-1) [c](#example-2)\n"},
+		{name: "duplicate heading beyond count", path: "README.md", content: "## Example\n## Example\n\n[c](#example-2)\n", problems: []string{"link to #example-2 matches no heading in this file (line 4)"}},
+		{name: "duplicates differ in punctuation", path: "README.md", content: "## Notes\n## Notes!\n\n[b](#notes-1)\n"},
+
+		{name: "fence", path: "README.md", content: "```go\n#not a heading\n[x](missing.md)\n```\n"},
+		{name: "tilde fence", path: "README.md", content: "~~~\n#not a heading\n~~~\n"},
+		{name: "unclosed fence", path: "README.md", content: "text\n```\ncode\n", problems: []string{"code fence opened with ``` is never closed (line 2)"}},
+		{name: "backticks do not close tildes", path: "README.md", content: "~~~\n```\n", problems: []string{"code fence opened with ~~~ is never closed (line 1)"}},
+		{name: "shorter fence does not close", path: "README.md", content: "````\n```\n", problems: []string{"code fence opened with ```` is never closed (line 1)"}},
+		{name: "longer fence closes", path: "README.md", content: "```\ncode\n`````\n#Title\n", problems: []string{`heading "#Title" is missing a space after # (line 4)`}},
+		{name: "info string does not close", path: "README.md", content: "```\n```go\n", problems: []string{"code fence opened with ``` is never closed (line 1)"}},
+		{name: "closing fence with trailing spaces", path: "README.md", content: "```\ncode\n```  \n"},
+		{name: "nested fence example", path: "README.md", content: "````md\n```go\ncode\n```\n````\n"},
+		{name: "indented fence", path: "README.md", content: "   ```\n   code\n   ```\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			problems, formatted := checkMarkdown(tt.path, tt.content, Options{Exists: exists})
+			if formatted != "" {
+				t.Errorf("checkMarkdown formatted the content to %q", formatted)
+			}
+			if strings.Join(problems, "\n") != strings.Join(tt.problems, "\n") {
+				t.Errorf("checkMarkdown(%q) = %q, want %q", tt.content, problems, tt.problems)
+			}
+		})
+	}
+}
+
+func TestCheckMarkdownWithoutExists(t *testing.T) {
+	problems, _ := checkMarkdown("README.md", "[guide](missing.md) [usage](#usage)\n", Options{})
+	want := []string{"link to #usage matches no heading in this file (line 1)"}
+	if strings.Join(problems, "\n") != strings.Join(want, "\n") {
+		t.Errorf("problems = %q, want only the anchor checked: %q", problems, want)
+	}
+}
+
+func TestHeadingSlug(t *testing.T) {
+	tests := []struct {
+		heading string
+		want    string
+	}{
+		{heading: "Getting Started", want: "getting-started"},
+		{heading: "  Padded  ", want: "padded"},
+		{heading: "API_v2 - Overview", want: "api_v2---overview"},
+		{heading: "What's new?", want: "whats-new"},
+		{heading: "Install ##", want: "install"},
+		{heading: "C++ & Go", want: "c--go"},
+		{heading: "Über Straße", want: "über-straße"},
+		{heading: "1. Intro", want: "1-intro"},
+		{heading: "`code` heading", want: "code-heading"},
+	}
+	for _, tt := range tests {
+		if got := headingSlug(tt.heading); got != tt.want {
+			t.Errorf("headingSlug(%q) = %q, want %q", tt.heading, got, tt.want)
+		}
+	}
+}
+
+// Moving a broken link down does not report it again once the original is
+// known to have it, while a new broken link is still reported
+func TestFileMarkdownKnownProblems(t *testing.T) {
+	exists := func(string) bool { return false }
+	original := "# Title\n\n[old](missing.md)\n"
+	content := "# Title\n\nNew intro.\n\n[old](missing.md)\n[new](gone.md)\n"
+
+	_, err := File("README.md", content, Options{Original: original, Exists: exists})
+	if err == nil {
+		t.Fatal("File accepted a new broken link")
+	}
+	if msg := err.Error(); strings.Contains(msg, "missing.md") || !strings.Contains(msg, "link to gone.md points to a file that does not exist (line 6)") {
+		t.Errorf("error = %q, want only the new link", msg)
+	}
+
+	if _, err := File("README.md", "# Title\n\nNew intro.\n\n[old](missing.md)\n", Options{Original: original, Exists: exists}); err != nil {
+		t.Errorf("File reported a link the original already had: %v", err)
+	}
+}
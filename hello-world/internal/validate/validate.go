@@ -0,0 +1,169 @@
+package validate
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"io"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// SyntaxError describes why generated content for a file is invalid. The
+// message is meant to be handed back to the LLM as is
+type SyntaxError struct {
+	Path     string
+	Language string
+	Problems []string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("%s is not valid %s:\n- %s", e.Path, e.Language, strings.Join(e.Problems, "\n- "))
+}
+
+// Options carries what a checker may need beyond the file itself
+type Options struct {
+	// Original is the content before modification, empty for new files.
+	// Problems it already had are not reported, so templated YAML or JSON
+	// with comments that never parsed strictly is left alone
+	Original string
+	// Exists reports whether a repository-relative path exists, used to
+	// check relative Markdown links. Nil skips that check
+	Exists func(relPath string) bool
+}
+
+type checker struct {
+	language string
+	// check returns the problems found and, for languages with a canonical
+	// formatter, the formatted content
+	check func(relPath, content string, opts Options) ([]string, string)
+}
+
+var checkers = map[string]checker{
+	".go":       {"Go", checkGo},
+	".json":     {"JSON", checkJSON},
+	".yaml":     {"YAML", checkYAML},
+	".yml":      {"YAML", checkYAML},
+	".toml":     {"TOML", checkTOML},
+	".md":       {"Markdown", checkMarkdown},
+	".markdown": {"Markdown", checkMarkdown},
+}
+
+// File validates content generated for relPath. It returns the content to
+// write, which for Go is gofmt'd, or a *SyntaxError. Files without a
+// checker are returned unchanged
+func File(relPath, content string, opts Options) (string, error) {
+	c, ok := checkers[strings.ToLower(path.Ext(relPath))]
+	if !ok {
+		return content, nil
+	}
+
+	problems, formatted := c.check(relPath, content, opts)
+	if len(problems) > 0 && opts.Original != "" {
+		known, _ := c.check(relPath, opts.Original, Options{Exists: opts.Exists})
+		problems = withoutKnown(problems, known)
+	}
+	if len(problems) > 0 {
+		return content, &SyntaxError{Path: relPath, Language: c.language, Problems: problems}
+	}
+
+	if formatted != "" {
+		return formatted, nil
+	}
+	return content, nil
+}
+
+// Drops problems the original already had. Parser errors carry positions
+// that shift with any edit, so for single-error parsers a broken original
+// suppresses the check entirely
+func withoutKnown(problems, known []string) []string {
+	if len(known) == 0 {
+		return problems
+	}
+
+	seen := make(map[string]bool, len(known))
+	for _, problem := range known {
+		seen[lineSuffix.ReplaceAllString(problem, "")] = true
+	}
+
+	var remaining []string
+	for _, problem := range problems {
+		if !seen[lineSuffix.ReplaceAllString(problem, "")] && !strings.HasPrefix(problem, parseErrorPrefix) {
+			remaining = append(remaining, problem)
+		}
+	}
+	return remaining
+}
+
+const parseErrorPrefix = "parse error: "
+
+// Problems end in " (line N)" so the same problem matches across versions
+var lineSuffix = regexp.MustCompile(` \(line \d+\)$`)
+
+func parseError(err error) []string {
+	return []string{parseErrorPrefix + err.Error()}
+}
+
+func checkGo(relPath, content string, _ Options) ([]string, string) {
+	fset := token.NewFileSet()
+	if _, err := parser.ParseFile(fset, relPath, content, parser.ParseComments); err != nil {
+		return parseError(err), ""
+	}
+
+	formatted, err := format.Source([]byte(content))
+	if err != nil {
+		return parseError(err), ""
+	}
+	return nil, string(formatted)
+}
+
+func checkJSON(_, content string, _ Options) ([]string, string) {
+	decoder := json.NewDecoder(strings.NewReader(content))
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			line := 1 + strings.Count(content[:syntaxErr.Offset], "\n")
+			return parseError(fmt.Errorf("line %d: %w", line, err)), ""
+		}
+		return parseError(err), ""
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return parseError(fmt.Errorf("unexpected content after the top-level value")), ""
+	}
+	return nil, ""
+}
+
+func checkYAML(_, content string, _ Options) ([]string, string) {
+	// Files may hold several documents separated by ---
+	decoder := yaml.NewDecoder(strings.NewReader(content))
+	for {
+		var value yaml.Node
+		err := decoder.Decode(&value)
+		if err == io.EOF {
+			return nil, ""
+		}
+		if err != nil {
+			return parseError(err), ""
+		}
+	}
+}
+
+func checkTOML(_, content string, _ Options) ([]string, string) {
+	var value map[string]interface{}
+	if _, err := toml.Decode(content, &value); err != nil {
+		var parseErr toml.ParseError
+		if errors.As(err, &parseErr) {
+			return parseError(fmt.Errorf("line %d: %s", parseErr.Position.Line, parseErr.Message)), ""
+		}
+		return parseError(err), ""
+	}
+	return nil, ""
+}
@@ -0,0 +1,143 @@
+package validate
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		path     string
+		content  string
+		original string
+		want     string
+		// A substring of the reported problem, empty for valid content
+		problem string
+	}{
+		{name: "Go", path: "main.go", content: "package main\n"},
+		{name: "Go formatted", path: "main.go", content: "package main\nfunc main(){\nx:=1\n_=x}\n", want: "package main\n\nfunc main() {\n\tx := 1\n\t_ = x\n}\n"},
+		{name: "Go syntax error", path: "main.go", content: "package main\nfunc main() {\n", problem: "parse error: main.go:2"},
+		{name: "Go missing package", path: "main.go", content: "func main() {}\n", problem: "expected 'package'"},
+
+		{name: "JSON", path: "package.json", content: `{"name": "app", "version": 1}`},
+		{name: "JSON array", path: "data.json", content: "[1, 2, 3]\n"},
+		{name: "JSON trailing comma", path: "package.json", content: "{\n  \"name\": \"app\",\n}\n", problem: "line 3"},
+		{name: "JSON two values", path: "package.json", content: "{}\n{}\n", problem: "unexpected content after the top-level value"},
+		{name: "JSON truncated", path: "package.json", content: `{"name": `, problem: "parse error: unexpected EOF"},
+
+		{name: "YAML", path: "config.yaml", content: "name: app\nitems:\n  - a\n  - b\n"},
+		{name: "YAML documents", path: "k8s.yml", content: "kind: A\n---\nkind: B\n"},
+		{name: "YAML bad indentation", path: "config.yml", content: "name: app\n  version: 1\n", problem: "line 2"},
+		{name: "YAML bad second document", path: "k8s.yml", content: "kind: A\n---\nkind: [B\n", problem: "parse error"},
+
+		{name: "TOML", path: "Cargo.toml", content: "[package]\nname = \"app\"\n"},
+		{name: "TOML missing value", path: "Cargo.toml", content: "[package]\nname =\n", problem: "line 2"},
+		{name: "TOML duplicate table", path: "Cargo.toml", content: "[a]\nx = 1\n[a]\ny = 2\n", problem: "parse error"},
+
+		{name: "upper case extension", path: "CONFIG.JSON", content: "{", problem: "parse error"},
+		{name: "no checker", path: "main.py", content: "def broken(:\n"},
+
+		// Problems the original already had are not the change's fault
+		{name: "original JSON with comments", path: "tsconfig.json", original: "{\n  // comment\n}\n", content: "{\n  // comment\n  \"strict\": true\n}\n"},
+		{name: "original YAML template", path: "chart.yaml", original: "name: {{ .Name }}\n", content: "name: {{ .Name }}\nversion: {{ .Version }}\n"},
+		{name: "original Go broken", path: "gen.go", original: "package gen\nfunc {\n", content: "package gen\nfunc {\n\nvar x = 1\n"},
+		{name: "original valid", path: "package.json", original: "{}\n", content: "{", problem: "parse error"},
+
+		{name: "Markdown", path: "README.md", content: "# Title\n\nSee [usage](#title).\n"},
+		{name: "Markdown broken anchor", path: "docs/guide.markdown", content: "# Title\n\nSee [usage](#usage).\n", problem: "link to #usage matches no heading in this file (line 3)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := File(tt.path, tt.content, Options{Original: tt.original})
+			if tt.problem != "" {
+				var syntaxErr *SyntaxError
+				if !errors.As(err, &syntaxErr) {
+					t.Fatalf("File(%q) error = %v, want a *SyntaxError", tt.path, err)
+				}
+				if syntaxErr.Path != tt.path || !strings.Contains(err.Error(), tt.problem) {
+					t.Errorf("File(%q) error = %v, want a problem with %q", tt.path, err, tt.problem)
+				}
+				if got != tt.content {
+					t.Errorf("File(%q) = %q with an error, want the content unchanged", tt.path, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("File(%q) failed: %v", tt.path, err)
+			}
+			want := tt.want
+			if want == "" {
+				want = tt.content
+			}
+			if got != want {
+				t.Errorf("File(%q) = %q, want %q", tt.path, got, want)
+			}
+		})
+	}
+}
+
+func TestSyntaxErrorLanguage(t *testing.T) {
+	for path, language := range map[string]string{"a.go": "Go", "a.json": "JSON", "a.yml": "YAML", "a.toml": "TOML"} {
+		_, err := File(path, "{[", Options{})
+		var syntaxErr *SyntaxError
+		if !errors.As(err, &syntaxErr) || syntaxErr.Language != language {
+			t.Errorf("File(%q) error = %v, want a %s syntax error", path, err, language)
+			continue
+		}
+		if want := path + " is not valid " + language + ":\n- parse error: "; !strings.HasPrefix(err.Error(), want) {
+			t.Errorf("File(%q) error = %q, want it to start with %q", path, err, want)
+		}
+	}
+}
+
+func TestWithoutKnown(t *testing.T) {
+	tests := []struct {
+		name     string
+		problems []string
+		known    []string
+		want     []string
+	}{
+		{
+			name:     "nothing known",
+			problems: []string{"link to a.md points to a file that does not exist (line 3)"},
+			want:     []string{"link to a.md points to a file that does not exist (line 3)"},
+		},
+		{
+			name:     "known on another line",
+			problems: []string{"link to a.md points to a file that does not exist (line 7)", "link to b.md points to a file that does not exist (line 9)"},
+			known:    []string{"link to a.md points to a file that does not exist (line 3)"},
+			want:     []string{"link to b.md points to a file that does not exist (line 9)"},
+		},
+		{
+			name:     "line number only stripped at the end",
+			problems: []string{`heading "#(line 1)" is missing a space after # (line 4)`},
+			known:    []string{`heading "#" is missing a space after # (line 4)`},
+			want:     []string{`heading "#(line 1)" is missing a space after # (line 4)`},
+		},
+		{
+			name:     "parse error hidden when the original failed",
+			problems: []string{"parse error: line 12: unexpected character"},
+			known:    []string{"parse error: line 2: invalid character"},
+		},
+		{
+			name:     "parse error hidden when the original had any problem",
+			problems: []string{"parse error: line 12: unexpected character"},
+			known:    []string{"link to #usage matches no heading in this file (line 1)"},
+		},
+		{
+			name:     "parse error kept when the original was valid",
+			problems: []string{"parse error: line 12: unexpected character"},
+			want:     []string{"parse error: line 12: unexpected character"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := withoutKnown(tt.problems, tt.known)
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("withoutKnown = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}